@@ -0,0 +1,161 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// Sides of an AccessRecord.
+const (
+	AccessClient = "client"
+	AccessServer = "server"
+)
+
+// Outcomes of a request, see AccessRecord.Outcome.
+const (
+	// AccessSucceeded means that a successful response was sent or received.
+	AccessSucceeded = "succeeded"
+
+	// AccessFailed means that an error response was sent or received, see AccessRecord.ErrorCode,
+	// or that the request failed without one, see AccessRecord.Error.
+	AccessFailed = "failed"
+
+	// AccessCancelled means that the server dropped the request without a response,
+	// e.g. it was cancelled with ControlCancel.
+	AccessCancelled = "cancelled"
+)
+
+// AccessRecord describes a completed request, see ClientOptions.AccessLog and ServerOptions.AccessLog.
+// Unlike the debug logging with Infof, the records have a fixed structure,
+// e.g. to feed a SIEM system.
+type AccessRecord struct {
+	// Side is AccessClient or AccessServer.
+	Side string `json:"side"`
+
+	Op          string `json:"op"`
+	RequestID   string `json:"request_id,omitempty"`
+	Key         string `json:"key,omitempty"`
+	ResponseKey string `json:"response_key,omitempty"`
+
+	// Identity is the caller's Identity.
+	Identity Identity `json:"identity"`
+
+	// InputSize and OutputSize are the sizes of the input and the response body.
+	InputSize  int64 `json:"input_size"`
+	OutputSize int64 `json:"output_size"`
+
+	// Duration is the time from the request was taken off the queue by the server,
+	// or passed to Execute on the client, until it completed.
+	Duration time.Duration `json:"duration"`
+
+	// Outcome is AccessSucceeded, AccessFailed or AccessCancelled.
+	Outcome   string `json:"outcome"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	// InstanceID is the ServerOptions.InstanceID of the server.
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// Time is when the request completed.
+	Time time.Time `json:"time"`
+}
+
+type accessEntryKey struct{}
+
+// accessEntry collects the parts of the AccessRecord of a request that are not known
+// where the request starts.
+type accessEntry struct {
+	requestID   string
+	key         string
+	responseKey string
+	inputSize   int64
+	outputSize  int64
+	errorCode   string
+	errorMsg    string
+	responded   bool
+}
+
+// withAccessEntry returns a context that collects the AccessRecord of a request.
+func withAccessEntry(ctx context.Context) (context.Context, *accessEntry) {
+	e := &accessEntry{}
+	return context.WithValue(ctx, accessEntryKey{}, e), e
+}
+
+// accessEntryFrom returns the entry of the request handled with ctx, nil if there is no AccessLog.
+func accessEntryFrom(ctx context.Context) *accessEntry {
+	e, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return e
+}
+
+func (e *accessEntry) setRequest(id, key string, inputSize int64) {
+	if e == nil {
+		return
+	}
+	e.requestID, e.key, e.inputSize = id, key, inputSize
+}
+
+// setResponse records the response sent or received, with the error code and message of error responses.
+func (e *accessEntry) setResponse(key string, size int64, errorCode, errorMsg string) {
+	if e == nil {
+		return
+	}
+	e.responseKey, e.outputSize, e.errorCode, e.errorMsg, e.responded = key, size, errorCode, errorMsg, true
+}
+
+// record returns the AccessRecord of the request for op that started at started and ended with err.
+func (e *accessEntry) record(side, op string, identity Identity, started time.Time, err error) AccessRecord {
+	r := AccessRecord{
+		Side:        side,
+		Op:          op,
+		RequestID:   e.requestID,
+		Key:         e.key,
+		ResponseKey: e.responseKey,
+		Identity:    identity,
+		InputSize:   e.inputSize,
+		OutputSize:  e.outputSize,
+		Duration:    time.Since(started),
+		ErrorCode:   e.errorCode,
+		Error:       e.errorMsg,
+		Time:        time.Now().UTC(),
+	}
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		r.ErrorCode = respErr.Code
+	}
+	switch {
+	case err != nil:
+		r.Outcome, r.Error = AccessFailed, err.Error()
+	case r.ErrorCode != "":
+		r.Outcome = AccessFailed
+	case e.responded:
+		r.Outcome = AccessSucceeded
+	default:
+		r.Outcome = AccessCancelled
+	}
+	return r
+}
+
+// mergeIdentity returns id with the fields not set filled in from defaults.
+func mergeIdentity(id, defaults Identity) Identity {
+	if id.Service == "" {
+		id.Service = defaults.Service
+	}
+	if id.User == "" {
+		id.User = defaults.User
+	}
+	if id.Tenant == "" {
+		id.Tenant = defaults.Tenant
+	}
+	return id
+}
+
+// fileSize returns the size of the file, 0 if it can not be determined.
+func fileSize(filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
@@ -0,0 +1,63 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAccessRecord(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(accessEntryFrom(context.Background()), qt.IsNil)
+	var nilEntry *accessEntry
+	nilEntry.setRequest("01gcabc", "to_server/ocr/01gcabc_input.csv", 42)
+	nilEntry.setResponse("from_server/ocr/01gcabc_input.csv", 32, "", "")
+
+	identity := Identity{Service: "billing", Tenant: "acme"}
+	started := time.Now().Add(-time.Second)
+	newEntry := func() *accessEntry {
+		ctx, e := withAccessEntry(context.Background())
+		c.Assert(accessEntryFrom(ctx), qt.Equals, e)
+		e.setRequest("01gcabc", "to_server/ocr/01gcabc_input.csv", 42)
+		return e
+	}
+
+	e := newEntry()
+	e.setResponse("from_server/ocr/01gcabc_input.csv", 32, "", "")
+	r := e.record(AccessServer, "ocr", identity, started, nil)
+	c.Assert(r.Duration >= time.Second, qt.IsTrue)
+	r.Duration, r.Time = 0, time.Time{}
+	c.Assert(r, qt.DeepEquals, AccessRecord{
+		Side:        AccessServer,
+		Op:          "ocr",
+		RequestID:   "01gcabc",
+		Key:         "to_server/ocr/01gcabc_input.csv",
+		ResponseKey: "from_server/ocr/01gcabc_input.csv",
+		Identity:    identity,
+		InputSize:   42,
+		OutputSize:  32,
+		Outcome:     AccessSucceeded,
+	})
+
+	e = newEntry()
+	e.setResponse("from_server/ocr/01gcabc_input.csv", 0, ErrorCodeInvalidInput, "bad input")
+	r = e.record(AccessServer, "ocr", identity, started, nil)
+	c.Assert([]string{r.Outcome, r.ErrorCode, r.Error}, qt.DeepEquals, []string{AccessFailed, ErrorCodeInvalidInput, "bad input"})
+
+	r = newEntry().record(AccessServer, "ocr", identity, started, nil)
+	c.Assert(r.Outcome, qt.Equals, AccessCancelled)
+
+	r = newEntry().record(AccessServer, "ocr", identity, started, errors.New("upload failed"))
+	c.Assert([]string{r.Outcome, r.ErrorCode, r.Error}, qt.DeepEquals, []string{AccessFailed, "", "upload failed"})
+
+	// The client gets the error responses as errors.
+	r = newEntry().record(AccessClient, "ocr", identity, started, fmt.Errorf("apply: %w", &ResponseError{Code: ErrorCodeQuotaExceeded, Message: "slow down"}))
+	c.Assert([]string{r.Outcome, r.ErrorCode}, qt.DeepEquals, []string{AccessFailed, ErrorCodeQuotaExceeded})
+
+	c.Assert(mergeIdentity(Identity{User: "bob", Tenant: "other"}, identity), qt.Equals, Identity{Service: "billing", User: "bob", Tenant: "other"})
+}
@@ -0,0 +1,335 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// AdminOptions are options for the Admin.
+type AdminOptions struct {
+	// The AWS config.
+	// The user needs s3:ListBucket on the bucket and access to the queues,
+	// e.g. the admin user used by the Provisioner.
+	AWSConfig
+}
+
+func (opts *AdminOptions) init() error {
+	if opts.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+
+	if opts.AccessKeyID == "" {
+		return errors.New("access key id is required")
+	}
+
+	if opts.SecretAccessKey == "" {
+		return errors.New("secret access key is required")
+	}
+
+	// Resolve the region last, as it may need a network call.
+	return opts.resolveRegion("")
+}
+
+// Admin inspects and manages the requests and responses in a bucket and the queues.
+type Admin struct {
+	bucket    string
+	s3Client  *s3.Client
+	sqsClient *sqs.Client
+}
+
+// NewAdmin creates a new Admin.
+// If AWSConfig.ExpectedBucketOwner is set, it checks that the bucket is owned by that account.
+func NewAdmin(opts AdminOptions) (*Admin, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+
+	awsCfg := aws.Config{
+		Region:      opts.Region,
+		Credentials: credentials.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, ""),
+		APIOptions:  opts.apiOptions(),
+	}
+
+	a := &Admin{
+		bucket:    opts.Bucket,
+		s3Client:  s3.NewFromConfig(awsCfg),
+		sqsClient: sqs.NewFromConfig(awsCfg),
+	}
+
+	if opts.ExpectedBucketOwner != "" {
+		if err := checkBucketOwner(context.Background(), a.s3Client, a.bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// RequestInfo describes a request or response object in the bucket.
+type RequestInfo struct {
+	Key       string
+	Op        string
+	RequestID string
+
+	// Filename is the base name of the client's input file.
+	Filename string
+
+	// Date is the day of the key's date partition, zero if it has none.
+	// See ClientOptions.DatePartitions.
+	Date time.Time
+
+	Size         int64
+	LastModified time.Time
+
+	// Age is the time since LastModified when listed.
+	Age time.Duration
+}
+
+// ListPending lists the requests not yet picked up by a server, oldest first.
+func (a *Admin) ListPending(ctx context.Context) ([]RequestInfo, error) {
+	return a.list(ctx, toServer+"/")
+}
+
+// ListResponses lists the responses not yet picked up by a client, oldest first.
+func (a *Admin) ListResponses(ctx context.Context) ([]RequestInfo, error) {
+	return a.list(ctx, toClient+"/")
+}
+
+// ListPendingOn lists the pending requests in the date partition of the given day, oldest first.
+// It only lists requests sent with ClientOptions.DatePartitions,
+// but avoids listing all of to_server/ in busy buckets.
+func (a *Admin) ListPendingOn(ctx context.Context, day time.Time) ([]RequestInfo, error) {
+	return a.listOn(ctx, toServer+"/", day)
+}
+
+// ListResponsesOn lists the responses in the date partition of the given day, oldest first.
+// See ListPendingOn.
+func (a *Admin) ListResponsesOn(ctx context.Context, day time.Time) ([]RequestInfo, error) {
+	return a.listOn(ctx, toClient+"/", day)
+}
+
+// listOn lists the keys in the date partition of day under each op under prefix.
+func (a *Admin) listOn(ctx context.Context, prefix string, day time.Time) ([]RequestInfo, error) {
+	var ops []string
+	p := s3.NewListObjectsV2Paginator(a.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(a.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ops: %w", err)
+		}
+		for _, cp := range page.CommonPrefixes {
+			ops = append(ops, aws.ToString(cp.Prefix))
+		}
+	}
+
+	var infos []RequestInfo
+	for _, op := range ops {
+		opInfos, err := a.list(ctx, op+day.UTC().Format(datePartitionLayout)+"/")
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, opInfos...)
+	}
+	sortRequestInfos(infos)
+	return infos, nil
+}
+
+func (a *Admin) list(ctx context.Context, prefix string) ([]RequestInfo, error) {
+	var infos []RequestInfo
+	now := time.Now()
+	p := s3.NewListObjectsV2Paginator(a.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, o := range page.Contents {
+			info, ok := parseRequestKey(aws.ToString(o.Key))
+			if !ok {
+				continue
+			}
+			info.Size = o.Size
+			info.LastModified = aws.ToTime(o.LastModified)
+			info.Age = now.Sub(info.LastModified)
+			infos = append(infos, info)
+		}
+	}
+	sortRequestInfos(infos)
+	return infos, nil
+}
+
+// ListArchived lists the archived request inputs, oldest first.
+// See ServerOptions.Archive.
+func (a *Admin) ListArchived(ctx context.Context) ([]RequestInfo, error) {
+	return a.list(ctx, archive+"/")
+}
+
+// Replay re-enqueues the archived request input with the given key (see ListArchived)
+// as a new request for the same op with a fresh request ID, e.g. after fixing a handler bug.
+// It returns the key of the new request.
+// The response is written to to_client/ as usual, where it expires if no client picks it up.
+func (a *Admin) Replay(ctx context.Context, archivedKey string) (string, error) {
+	info, ok := parseRequestKey(archivedKey)
+	if !ok || !strings.HasPrefix(archivedKey, archive+"/") {
+		return "", fmt.Errorf("invalid archive key %q", archivedKey)
+	}
+	var date time.Time
+	if !info.Date.IsZero() {
+		date = time.Now()
+	}
+	key := requestKey(info.Op, newRequestID(), info.Filename, date)
+	c := &common{bucket: a.bucket, s3Client: a.s3Client}
+	if err := c.copyObject(ctx, archivedKey, key); err != nil {
+		return "", fmt.Errorf("failed to replay %q: %w", archivedKey, err)
+	}
+	return key, nil
+}
+
+// sortRequestInfos sorts infos oldest first.
+func sortRequestInfos(infos []RequestInfo) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].LastModified.Before(infos[j].LastModified)
+	})
+}
+
+// archiveKey returns the archive key for the request key to_server/<op>/<id>_<filename>.
+func archiveKey(key string) string {
+	return archive + strings.TrimPrefix(key, toServer)
+}
+
+// PurgeQueue deletes all messages in the queue with the given URL.
+// SQS allows one purge per queue every 60 seconds.
+func (a *Admin) PurgeQueue(ctx context.Context, queue string) error {
+	if _, err := a.sqsClient.PurgeQueue(ctx, &sqs.PurgeQueueInput{QueueUrl: aws.String(queue)}); err != nil {
+		return fmt.Errorf("failed to purge queue: %w", err)
+	}
+	return nil
+}
+
+// RedriveOptions are options for Admin.Redrive.
+type RedriveOptions struct {
+	// From is the URL of the dead-letter queue to move messages from.
+	From string
+
+	// To is the URL of the queue to move messages to.
+	To string
+
+	// Op, if set, only moves requests for this op.
+	Op string
+
+	// MinAge and MaxAge, if set, only move requests created
+	// at least MinAge and at most MaxAge ago.
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+// RedriveResult is the result of Admin.Redrive.
+type RedriveResult struct {
+	// Moved is the number of messages moved.
+	Moved int
+
+	// Skipped is the number of messages not matching the filters.
+	// They become visible in the dead-letter queue again after a minute.
+	Skipped int
+}
+
+// redriveVisibilityTimeout hides the skipped messages while scanning the dead-letter queue.
+const redriveVisibilityTimeout = 60
+
+// Redrive moves the request messages matching opts from a dead-letter queue back to a queue,
+// e.g. after fixing the handler bug that made them fail.
+func (a *Admin) Redrive(ctx context.Context, opts RedriveOptions) (RedriveResult, error) {
+	var res RedriveResult
+	if opts.From == "" || opts.To == "" {
+		return res, errors.New("from and to queues are required")
+	}
+
+	for {
+		result, err := a.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(opts.From),
+			MaxNumberOfMessages: 10,
+			VisibilityTimeout:   redriveVisibilityTimeout,
+			WaitTimeSeconds:     1,
+			// Keep the attributes of messages sent with ClientOptions.SubmitQueue.
+			MessageAttributeNames: []string{"All"},
+			AttributeNames:        []sqstypes.QueueAttributeName{sqstypes.QueueAttributeName(sqstypes.MessageSystemAttributeNameSentTimestamp)},
+		})
+		if err != nil {
+			return res, fmt.Errorf("failed to receive messages: %w", err)
+		}
+		if len(result.Messages) == 0 {
+			return res, nil
+		}
+
+		for _, m := range result.Messages {
+			if !opts.matches(m, time.Now()) {
+				res.Skipped++
+				continue
+			}
+			if _, err := a.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+				QueueUrl:          aws.String(opts.To),
+				MessageBody:       m.Body,
+				MessageAttributes: m.MessageAttributes,
+			}); err != nil {
+				return res, fmt.Errorf("failed to send message: %w", err)
+			}
+			if _, err := a.sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(opts.From),
+				ReceiptHandle: m.ReceiptHandle,
+			}); err != nil {
+				return res, fmt.Errorf("failed to delete message: %w", err)
+			}
+			res.Moved++
+		}
+	}
+}
+
+func (opts RedriveOptions) matches(m sqstypes.Message, now time.Time) bool {
+	if opts.Op == "" && opts.MinAge == 0 && opts.MaxAge == 0 {
+		return true
+	}
+	msg, ok, err := parseSQSMessage(m)
+	if err != nil || !ok {
+		return false
+	}
+	if opts.Op != "" && msg.Op != opts.Op {
+		return false
+	}
+	age := now.Sub(msg.EventTime)
+	if opts.MinAge != 0 && age < opts.MinAge {
+		return false
+	}
+	if opts.MaxAge != 0 && age > opts.MaxAge {
+		return false
+	}
+	return true
+}
+
+// InFlightRequest is a request being handled by a server.
+type InFlightRequest struct {
+	Op        string
+	RequestID string
+	Started   time.Time
+}
+
+// InFlight returns the requests currently being handled by this server, oldest first.
+func (s *Server) InFlight() []InFlightRequest {
+	return s.control.list()
+}
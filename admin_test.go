@@ -0,0 +1,96 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func TestParseRequestKey(t *testing.T) {
+	c := qt.New(t)
+
+	info, ok := parseRequestKey("to_server/resize/01gcabc_my_image.jpg")
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(info, qt.DeepEquals, RequestInfo{
+		Key:       "to_server/resize/01gcabc_my_image.jpg",
+		Op:        "resize",
+		RequestID: "01gcabc",
+		Filename:  "my_image.jpg",
+	})
+
+	// The request ID must match exactly, not as a substring of the key.
+	info, ok = parseRequestKey("to_client/resize/01gcabd_01gcabc.jpg")
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(info.RequestID, qt.Equals, "01gcabd")
+
+	info, ok = parseRequestKey("to_server/resize/2026/10/15/01gcabc_image.jpg")
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(info.RequestID, qt.Equals, "01gcabc")
+	c.Assert(info.Filename, qt.Equals, "image.jpg")
+	c.Assert(info.Date, qt.Equals, time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC))
+
+	for _, key := range []string{"to_server/", "to_server/resize/", "to_server/resize/noid", "foo", "to_server/resize/a/01gcabc_image.jpg", "to_server/resize/2026/1/15/01gcabc_image.jpg"} {
+		_, ok := parseRequestKey(key)
+		c.Assert(ok, qt.IsFalse, qt.Commentf(key))
+	}
+
+	day := time.Date(2026, 10, 15, 23, 0, 0, 0, time.FixedZone("CET", -3600))
+	c.Assert(requestKey("resize", "01gcabc", "image.jpg", time.Time{}), qt.Equals, "to_server/resize/01gcabc_image.jpg")
+	c.Assert(requestKey("resize", "01gcabc", "image.jpg", day), qt.Equals, "to_server/resize/2026/10/16/01gcabc_image.jpg")
+	c.Assert(responseKey("resize", "to_server/resize/01gcabc_image.jpg"), qt.Equals, "to_client/resize/01gcabc_image.jpg")
+	c.Assert(responseKey("resize", "to_server/resize/2026/10/16/01gcabc_image.jpg"), qt.Equals, "to_client/resize/2026/10/16/01gcabc_image.jpg")
+
+	_, err := NewAdmin(AdminOptions{})
+	c.Assert(err, qt.ErrorMatches, "bucket is required")
+}
+
+func TestServerInFlight(t *testing.T) {
+	c := qt.New(t)
+
+	s := &Server{control: newControl()}
+	_, done1, _ := s.control.start(context.Background(), "resize", "id1")
+	_, done2, _ := s.control.start(context.Background(), "compact", "id2")
+
+	inFlight := s.InFlight()
+	c.Assert(inFlight, qt.HasLen, 2)
+	c.Assert(inFlight[0].RequestID, qt.Equals, "id1")
+	c.Assert(inFlight[1].Op, qt.Equals, "compact")
+
+	done1()
+	done2()
+	c.Assert(s.InFlight(), qt.HasLen, 0)
+}
+
+func TestRedriveMatches(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Date(2022, 9, 12, 10, 0, 0, 0, time.UTC)
+	body := `{"Records":[{"eventTime":"2022-09-12T09:00:00Z","s3":{"bucket":{"name":"mybucket"},"object":{"key":"to_server/resize/01gcabc_image.jpg"}}}]}`
+	m := sqstypes.Message{Body: aws.String(body)}
+
+	c.Assert(RedriveOptions{}.matches(sqstypes.Message{Body: aws.String("invalid")}, now), qt.IsTrue)
+	c.Assert(RedriveOptions{Op: "resize"}.matches(m, now), qt.IsTrue)
+	c.Assert(RedriveOptions{Op: "compact"}.matches(m, now), qt.IsFalse)
+	c.Assert(RedriveOptions{MinAge: 30 * time.Minute}.matches(m, now), qt.IsTrue)
+	c.Assert(RedriveOptions{MinAge: 2 * time.Hour}.matches(m, now), qt.IsFalse)
+	c.Assert(RedriveOptions{MaxAge: 30 * time.Minute}.matches(m, now), qt.IsFalse)
+	c.Assert(RedriveOptions{Op: "resize", MaxAge: 2 * time.Hour}.matches(m, now), qt.IsTrue)
+	c.Assert(RedriveOptions{Op: "resize"}.matches(sqstypes.Message{Body: aws.String("invalid")}, now), qt.IsFalse)
+}
+
+func TestArchive(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(archiveKey("to_server/resize/01gcabc_image.jpg"), qt.Equals, "archive/resize/01gcabc_image.jpg")
+	c.Assert(archiveKey("to_server/resize/2026/10/15/01gcabc_image.jpg"), qt.Equals, "archive/resize/2026/10/15/01gcabc_image.jpg")
+	c.Assert(copySource("mybucket", "archive/resize/01gcabc_my image.jpg"), qt.Equals, "mybucket/archive/resize/01gcabc_my%20image.jpg")
+
+	a := &Admin{bucket: "mybucket"}
+	_, err := a.Replay(context.Background(), "to_server/resize/01gcabc_image.jpg")
+	c.Assert(err, qt.ErrorMatches, `invalid archive key.*`)
+}
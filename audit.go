@@ -0,0 +1,218 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// Audit events, see AuditRecord.Event.
+const (
+	// AuditReceived is recorded when the server takes a request off the queue.
+	AuditReceived = "received"
+
+	// AuditHandled is recorded when the handler returns.
+	AuditHandled = "handled"
+
+	// AuditResponded is recorded when the response, or an error response, is uploaded.
+	AuditResponded = "responded"
+
+	// AuditFailed is recorded when handling the request fails without a response.
+	AuditFailed = "failed"
+
+	// AuditCleaned is recorded when the server has removed its local files for the request.
+	AuditCleaned = "cleaned"
+)
+
+// AuditRecord is a request lifecycle event.
+type AuditRecord struct {
+	Event     string `json:"event"`
+	Op        string `json:"op"`
+	RequestID string `json:"request_id"`
+	Key       string `json:"key"`
+
+	// Size is the input size for AuditHandled and the response size for AuditResponded.
+	Size int64 `json:"size,omitempty"`
+
+	// Duration is the handler duration for AuditHandled.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Principal and SourceIP identify the AWS principal that uploaded the request
+	// and where from, for AuditReceived.
+	Principal string `json:"principal,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+
+	// Identity is the caller's Identity, once the request metadata is downloaded.
+	Identity *Identity `json:"identity,omitempty"`
+
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	InstanceID string    `json:"instance_id"`
+	Time       time.Time `json:"time"`
+}
+
+// AuditOptions configures writing an AuditRecord per request lifecycle event
+// as JSON lines to a durable audit trail.
+type AuditOptions struct {
+	// FirehoseStream is the Firehose delivery stream to write to.
+	// The server user needs firehose:PutRecordBatch on it.
+	FirehoseStream string
+
+	// S3, if set, writes the records as JSONL objects below audit/<date>/ in the bucket,
+	// one object per Interval, instead of to FirehoseStream.
+	// See ProvisionerOptions.AuditExpirationDays.
+	S3 bool
+
+	// Write, if set, is used instead of FirehoseStream to write a batch of records,
+	// e.g. to a Kinesis data stream.
+	Write func(ctx context.Context, records [][]byte) error
+
+	// Interval is the interval between writes of the buffered records.
+	// Defaults to 1 second, or 1 minute with S3.
+	Interval time.Duration
+}
+
+func (opts *AuditOptions) init() error {
+	if opts.FirehoseStream == "" && opts.Write == nil && !opts.S3 {
+		return errors.New("audit: FirehoseStream, S3 or Write is required")
+	}
+	if opts.Interval == 0 {
+		opts.Interval = time.Second
+		if opts.S3 {
+			opts.Interval = time.Minute
+		}
+	}
+	return nil
+}
+
+// maxFirehoseRecordsPerRequest is the number of records allowed in one PutRecordBatch call.
+const maxFirehoseRecordsPerRequest = 500
+
+type auditLog struct {
+	opts  AuditOptions
+	write func(ctx context.Context, records [][]byte) error
+	infof func(format string, args ...interface{})
+
+	mu      sync.Mutex
+	records [][]byte
+}
+
+func newAuditLog(opts *AuditOptions, awsCfg aws.Config, infof func(format string, args ...interface{})) *auditLog {
+	if opts == nil {
+		return nil
+	}
+	a := &auditLog{opts: *opts, write: opts.Write, infof: infof}
+	if a.write == nil && !opts.S3 {
+		a.write = firehoseWriter(firehose.NewFromConfig(awsCfg), opts.FirehoseStream)
+	}
+	return a
+}
+
+func firehoseWriter(client *firehose.Client, stream string) func(ctx context.Context, records [][]byte) error {
+	return func(ctx context.Context, records [][]byte) error {
+		for len(records) > 0 {
+			n := len(records)
+			if n > maxFirehoseRecordsPerRequest {
+				n = maxFirehoseRecordsPerRequest
+			}
+			batch := make([]types.Record, n)
+			for i, r := range records[:n] {
+				batch[i] = types.Record{Data: r}
+			}
+			out, err := client.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+				DeliveryStreamName: aws.String(stream),
+				Records:            batch,
+			})
+			if err != nil {
+				return err
+			}
+			if failed := aws.ToInt32(out.FailedPutCount); failed > 0 {
+				return fmt.Errorf("%d of %d records failed", failed, n)
+			}
+			records = records[n:]
+		}
+		return nil
+	}
+}
+
+// add buffers r as a JSON line.
+func (a *auditLog) add(r AuditRecord) {
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	a.records = append(a.records, append(b, '\n'))
+	a.mu.Unlock()
+}
+
+// run writes the buffered records every interval until ctx is done or quit is closed.
+func (a *auditLog) run(ctx context.Context, quit <-chan struct{}) {
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush(ctx)
+			continue
+		case <-ctx.Done():
+		case <-quit:
+		}
+		// Use a fresh context, to write the last records on shutdown.
+		a.flush(context.Background())
+		return
+	}
+}
+
+func (a *auditLog) flush(ctx context.Context) {
+	a.mu.Lock()
+	records := a.records
+	a.records = nil
+	a.mu.Unlock()
+	if len(records) == 0 {
+		return
+	}
+	if err := a.write(ctx, records); err != nil {
+		a.infof("Failed to write %d audit records: %s", len(records), err)
+	}
+}
+
+// s3AuditWriter writes records as one JSONL object below audit/<date>/.
+func (s *Server) s3AuditWriter() func(ctx context.Context, records [][]byte) error {
+	return func(ctx context.Context, records [][]byte) error {
+		key := auditKey(time.Now().UTC(), s.stats.instanceID, newRequestID())
+		return s.uploadBytes(ctx, key, bytes.Join(records, nil), nil)
+	}
+}
+
+func auditKey(t time.Time, instanceID, id string) string {
+	return fmt.Sprintf("%s/%s/%s_%s.jsonl", audit, t.Format("2006-01-02"), safeFilename(instanceID), id)
+}
+
+// auditEvent records a lifecycle event for the request with the given key.
+func (s *Server) auditEvent(ctx context.Context, op, key string, r AuditRecord) {
+	if s.audit == nil {
+		return
+	}
+	if id := RequestIdentity(ctx); !id.IsZero() {
+		r.Identity = &id
+	}
+	r.Op = op
+	r.Key = key
+	r.RequestID = requestID(key)
+	r.InstanceID = s.stats.instanceID
+	r.Time = time.Now().UTC()
+	s.audit.add(r)
+}
@@ -0,0 +1,54 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestAuditLog(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&AuditOptions{}).init(), qt.ErrorMatches, "audit: FirehoseStream, S3 or Write is required")
+
+	var written [][]byte
+	opts := &AuditOptions{Write: func(ctx context.Context, records [][]byte) error {
+		written = append(written, records...)
+		return nil
+	}}
+	c.Assert(opts.init(), qt.IsNil)
+
+	s := &Server{
+		stats: newServerStats("server1"),
+		audit: newAuditLog(opts, aws.Config{}, func(format string, args ...interface{}) {}),
+	}
+	ctx := WithIdentity(context.Background(), Identity{Service: "billing", Tenant: "acme"})
+	s.auditEvent(context.Background(), "resize", "to_server/resize/01gcabc_image.jpg", AuditRecord{Event: AuditReceived})
+	s.auditEvent(ctx, "resize", "to_server/resize/01gcabc_image.jpg", AuditRecord{Event: AuditResponded, Size: 42})
+	s.audit.flush(context.Background())
+	s.audit.flush(context.Background())
+
+	c.Assert(written, qt.HasLen, 2)
+	var r AuditRecord
+	c.Assert(json.Unmarshal(written[1], &r), qt.IsNil)
+	c.Assert(r.Event, qt.Equals, AuditResponded)
+	c.Assert(r.RequestID, qt.Equals, "01gcabc")
+	c.Assert(r.InstanceID, qt.Equals, "server1")
+	c.Assert(r.Size, qt.Equals, int64(42))
+	c.Assert(r.Identity, qt.DeepEquals, &Identity{Service: "billing", Tenant: "acme"})
+	c.Assert(string(written[0]), qt.Not(qt.Contains), "identity")
+	c.Assert(written[1][len(written[1])-1], qt.Equals, byte('\n'))
+
+	s3Opts := &AuditOptions{S3: true}
+	c.Assert(s3Opts.init(), qt.IsNil)
+	c.Assert(s3Opts.Interval, qt.Equals, time.Minute)
+	c.Assert(auditKey(time.Date(2022, 9, 12, 10, 0, 0, 0, time.UTC), "host:1", "01gcabc"), qt.Equals, "audit/2022-09-12/host_1_01gcabc.jsonl")
+
+	// No audit configured.
+	(&Server{}).auditEvent(context.Background(), "resize", "to_server/resize/01gcabc_image.jpg", AuditRecord{Event: AuditReceived})
+}
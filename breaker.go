@@ -0,0 +1,94 @@
+package s3rpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned from Client.Execute when the circuit breaker of every endpoint is open,
+// see ClientOptions.CircuitBreaker.
+var ErrUnavailable = errors.New("circuit breaker is open")
+
+// CircuitBreakerOptions configures failing fast when an endpoint's AWS calls keep failing.
+//
+// After Failures consecutive failed executions against an endpoint its circuit opens,
+// and requests skip it, failing over to the next endpoint or returning ErrUnavailable.
+// After OpenFor one probe request is let through; if it succeeds the circuit closes,
+// else it stays open for another OpenFor.
+type CircuitBreakerOptions struct {
+	// Failures is the number of consecutive failures that opens the circuit.
+	// Defaults to 5.
+	Failures int
+
+	// OpenFor is how long the circuit stays open before a probe request is let through.
+	// Defaults to 30 seconds.
+	OpenFor time.Duration
+}
+
+func (o *CircuitBreakerOptions) init() error {
+	if o.Failures < 0 || o.OpenFor < 0 {
+		return errors.New("circuit breaker: Failures and OpenFor can not be negative")
+	}
+	if o.Failures == 0 {
+		o.Failures = 5
+	}
+	if o.OpenFor == 0 {
+		o.OpenFor = 30 * time.Second
+	}
+	return nil
+}
+
+type breaker struct {
+	opts CircuitBreakerOptions
+	now  func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+func newBreaker(opts *CircuitBreakerOptions) *breaker {
+	if opts == nil {
+		return nil
+	}
+	return &breaker{opts: *opts, now: time.Now}
+}
+
+// allow returns ErrUnavailable if the circuit is open.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.opts.OpenFor {
+		return ErrUnavailable
+	}
+	b.probing = true
+	return nil
+}
+
+// record records the result of an execution let through by allow.
+// Only endpoint errors count as failures.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var epErr *endpointError
+	if !errors.As(err, &epErr) {
+		b.failures, b.open, b.probing = 0, false, false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.opts.Failures {
+		b.open, b.probing, b.openedAt = true, false, b.now()
+	}
+}
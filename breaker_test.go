@@ -0,0 +1,50 @@
+package s3rpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBreaker(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &CircuitBreakerOptions{Failures: 2}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.OpenFor, qt.Equals, 30*time.Second)
+	c.Assert((&CircuitBreakerOptions{Failures: -1}).init(), qt.Not(qt.IsNil))
+
+	now := time.Now()
+	b := newBreaker(opts)
+	b.now = func() time.Time { return now }
+	awsErr := &endpointError{err: errors.New("connection refused")}
+
+	// Errors from the server don't count.
+	b.record(&ResponseError{Code: ErrorCodeInvalidInput})
+	b.record(awsErr)
+	c.Assert(b.allow(), qt.IsNil)
+	b.record(awsErr)
+	c.Assert(b.allow(), qt.Equals, ErrUnavailable)
+
+	// Half-open: one probe is let through.
+	now = now.Add(31 * time.Second)
+	c.Assert(b.allow(), qt.IsNil)
+	c.Assert(b.allow(), qt.Equals, ErrUnavailable)
+
+	// A failed probe opens the circuit again.
+	b.record(awsErr)
+	c.Assert(b.allow(), qt.Equals, ErrUnavailable)
+	now = now.Add(31 * time.Second)
+	c.Assert(b.allow(), qt.IsNil)
+
+	// A successful probe closes it.
+	b.record(nil)
+	c.Assert(b.allow(), qt.IsNil)
+	c.Assert(b.allow(), qt.IsNil)
+
+	var nilBreaker *breaker
+	c.Assert(nilBreaker.allow(), qt.IsNil)
+	nilBreaker.record(awsErr)
+}
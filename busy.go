@@ -0,0 +1,124 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrorCodeBusy means that the server was saturated and did not handle the request,
+// see ServerOptions.Backpressure. ResponseError.RetryAfter holds the server's hint.
+const ErrorCodeBusy = "busy"
+
+// MetaRetryAfter holds the seconds to wait before retrying a request rejected with ErrorCodeBusy.
+const MetaRetryAfter = "s3rpc-retry-after"
+
+// ErrBusy is returned from Client.Execute when the server was too busy to handle the request,
+// and the retries in RetryOptions.BusyAttempts are used up. Check for it with errors.Is.
+var ErrBusy = errors.New("server busy")
+
+// BackpressureOptions configures the server to reject requests with ErrorCodeBusy when it is saturated,
+// instead of leaving them to wait until the client times out.
+// Clients with ClientOptions.Retry retry them after ResponseError.RetryAfter.
+type BackpressureOptions struct {
+	// RetryAfter is how long clients are asked to wait before retrying.
+	// Defaults to 30 seconds.
+	RetryAfter time.Duration
+
+	// OpConcurrency, if set, rejects the requests for an op at its OpOptions.MaxConcurrency,
+	// instead of retrying them on this or another server.
+	OpConcurrency bool
+
+	// Busy, if set, is called before each request is downloaded. A non-nil error rejects it,
+	// e.g. when the free disk space in TempDir is low.
+	Busy func(ctx context.Context, op string) error
+}
+
+func (o *BackpressureOptions) init() error {
+	if o.RetryAfter < 0 {
+		return errors.New("backpressure: retry after can not be negative")
+	}
+	if o.RetryAfter == 0 {
+		o.RetryAfter = 30 * time.Second
+	}
+	return nil
+}
+
+// rejectsOpConcurrency reports whether requests for an op at its max concurrency are rejected.
+func (o *BackpressureOptions) rejectsOpConcurrency() bool {
+	return o != nil && o.OpConcurrency
+}
+
+// check returns a *busyError if the request for op should be rejected.
+// opFull is set if op is at its max concurrency.
+// A nil BackpressureOptions accepts all requests.
+func (o *BackpressureOptions) check(ctx context.Context, op string, opFull bool) error {
+	if o == nil {
+		return nil
+	}
+	if opFull {
+		return &busyError{err: fmt.Errorf("op %q is at its max concurrency", op), retryAfter: o.RetryAfter}
+	}
+	if o.Busy != nil {
+		if err := o.Busy(ctx, op); err != nil {
+			return &busyError{err: err, retryAfter: o.RetryAfter}
+		}
+	}
+	return nil
+}
+
+// busyError is sent to the client as a ResponseError with code ErrorCodeBusy.
+type busyError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *busyError) Unwrap() error {
+	return e.err
+}
+
+// formatRetryAfter formats d as whole seconds for MetaRetryAfter, rounded up.
+func formatRetryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// parseRetryAfter parses the MetaRetryAfter value s, 0 if it is missing or invalid.
+func parseRetryAfter(s string) time.Duration {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// executeBusy executes the op against ep, retrying after the server's hint
+// while it rejects the request with ErrorCodeBusy, see RetryOptions.BusyAttempts.
+func (c *Client) executeBusy(ctx context.Context, ep *common, op string, input Input) (Output, error) {
+	for attempt := 1; ; attempt++ {
+		output, err := c.execute(ctx, ep, op, input)
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) || respErr.Code != ErrorCodeBusy || c.retrier == nil || attempt >= c.retrier.opts.BusyAttempts {
+			return output, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < respErr.RetryAfter {
+			// Fail now rather than wait for the timeout.
+			return output, err
+		}
+		if !c.retrier.take() {
+			return output, err
+		}
+		ep.logf(ctx, "Server is busy (attempt %d), retrying %q in %s: %s", attempt, op, respErr.RetryAfter, respErr.Message)
+		select {
+		case <-ctx.Done():
+			return output, err
+		case <-time.After(respErr.RetryAfter):
+		}
+	}
+}
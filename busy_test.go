@@ -0,0 +1,55 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBackpressure(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	c.Assert((&BackpressureOptions{RetryAfter: -1}).init(), qt.ErrorMatches, "backpressure: retry after can not be negative")
+
+	var nilOpts *BackpressureOptions
+	c.Assert(nilOpts.rejectsOpConcurrency(), qt.IsFalse)
+	c.Assert(nilOpts.check(ctx, "ocr", true), qt.IsNil)
+
+	diskFull := errors.New("disk is almost full")
+	var busy bool
+	opts := &BackpressureOptions{OpConcurrency: true, Busy: func(ctx context.Context, op string) error {
+		if busy {
+			return diskFull
+		}
+		return nil
+	}}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.RetryAfter, qt.Equals, 30*time.Second)
+	c.Assert(opts.rejectsOpConcurrency(), qt.IsTrue)
+
+	c.Assert(opts.check(ctx, "ocr", false), qt.IsNil)
+	c.Assert(opts.check(ctx, "ocr", true), qt.ErrorMatches, `op "ocr" is at its max concurrency`)
+	busy = true
+	err := opts.check(ctx, "ocr", false)
+	c.Assert(errors.Is(err, diskFull), qt.IsTrue)
+	var busyErr *busyError
+	c.Assert(errors.As(err, &busyErr), qt.IsTrue)
+	c.Assert(busyErr.retryAfter, qt.Equals, 30*time.Second)
+
+	// The hint is sent in whole seconds.
+	c.Assert(formatRetryAfter(1500*time.Millisecond), qt.Equals, "2")
+	c.Assert(parseRetryAfter("2"), qt.Equals, 2*time.Second)
+	c.Assert(parseRetryAfter("-1"), qt.Equals, time.Duration(0))
+	c.Assert(parseRetryAfter(""), qt.Equals, time.Duration(0))
+
+	err = fmt.Errorf("apply: %w", responseErrorFrom(map[string]string{MetaErrorCode: ErrorCodeBusy, MetaError: "disk is almost full", MetaRetryAfter: "30"}))
+	c.Assert(errors.Is(err, ErrBusy), qt.IsTrue)
+	var respErr *ResponseError
+	c.Assert(errors.As(err, &respErr), qt.IsTrue)
+	c.Assert(respErr.RetryAfter, qt.Equals, 30*time.Second)
+}
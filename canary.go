@@ -0,0 +1,113 @@
+package s3rpc
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MetaVariant is set in the response metadata by a CanaryHandler to the variant
+// that handled the request, VariantStable or VariantCanary.
+const MetaVariant = "s3rpc-variant"
+
+// Variants, see MetaVariant.
+const (
+	VariantStable = "stable"
+	VariantCanary = "canary"
+)
+
+// CanaryHandler passes a percentage of the requests to a canary handler and the rest to the stable one,
+// to de-risk handler upgrades. Use its Handle method in Handlers.
+type CanaryHandler struct {
+	stable, canary func(ctx context.Context, input Input) (Output, error)
+
+	mu      sync.Mutex
+	percent float64
+	rand    *rand.Rand
+	stats   map[string]VariantStats
+}
+
+// VariantStats holds statistics for a CanaryHandler variant.
+type VariantStats struct {
+	// Requests is the number of requests handled.
+	Requests uint64
+
+	// Failed is the number of requests where the handler returned an error.
+	Failed uint64
+
+	// Duration is the total duration of the handler calls.
+	Duration time.Duration
+}
+
+// NewCanaryHandler creates a CanaryHandler passing percent (0-100) of the requests to canary.
+func NewCanaryHandler(stable, canary func(ctx context.Context, input Input) (Output, error), percent float64) *CanaryHandler {
+	h := &CanaryHandler{
+		stable: stable,
+		canary: canary,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		stats:  make(map[string]VariantStats),
+	}
+	h.SetPercent(percent)
+	return h
+}
+
+// SetPercent sets the percentage of requests passed to the canary,
+// e.g. to ramp it up or roll it back without a restart.
+func (h *CanaryHandler) SetPercent(percent float64) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	h.mu.Lock()
+	h.percent = percent
+	h.mu.Unlock()
+}
+
+// Handle handles input with the stable or the canary handler.
+func (h *CanaryHandler) Handle(ctx context.Context, input Input) (Output, error) {
+	h.mu.Lock()
+	variant, handler := VariantStable, h.stable
+	if h.rand.Float64()*100 < h.percent {
+		variant, handler = VariantCanary, h.canary
+	}
+	h.mu.Unlock()
+
+	start := time.Now()
+	output, err := handler(ctx, input)
+	duration := time.Since(start)
+
+	h.mu.Lock()
+	stats := h.stats[variant]
+	stats.Requests++
+	stats.Duration += duration
+	if err != nil {
+		stats.Failed++
+	}
+	h.stats[variant] = stats
+	h.mu.Unlock()
+
+	if err != nil {
+		return output, err
+	}
+	metadata := make(map[string]string, len(output.Metadata)+1)
+	for k, v := range output.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaVariant] = variant
+	output.Metadata = metadata
+	return output, nil
+}
+
+// Stats returns the statistics per variant.
+func (h *CanaryHandler) Stats() map[string]VariantStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make(map[string]VariantStats, len(h.stats))
+	for variant, s := range h.stats {
+		stats[variant] = s
+	}
+	return stats
+}
@@ -0,0 +1,43 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCanaryHandler(t *testing.T) {
+	c := qt.New(t)
+
+	stable := func(ctx context.Context, input Input) (Output, error) {
+		return Output{Filename: "stable", Metadata: map[string]string{"k": "v"}}, nil
+	}
+	canary := func(ctx context.Context, input Input) (Output, error) {
+		return Output{}, errors.New("canary failed")
+	}
+
+	h := NewCanaryHandler(stable, canary, 20)
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		output, err := h.Handle(ctx, Input{})
+		if err == nil {
+			c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"k": "v", MetaVariant: VariantStable})
+		}
+	}
+	stats := h.Stats()
+	c.Assert(stats[VariantStable].Requests+stats[VariantCanary].Requests, qt.Equals, uint64(1000))
+	c.Assert(stats[VariantCanary].Failed, qt.Equals, stats[VariantCanary].Requests)
+	c.Assert(stats[VariantStable].Failed, qt.Equals, uint64(0))
+	c.Assert(stats[VariantCanary].Requests > 100 && stats[VariantCanary].Requests < 300, qt.IsTrue)
+
+	h.SetPercent(0)
+	for i := 0; i < 100; i++ {
+		_, err := h.Handle(ctx, Input{})
+		c.Assert(err, qt.IsNil)
+	}
+	h.SetPercent(1000)
+	_, err := h.Handle(ctx, Input{})
+	c.Assert(err, qt.ErrorMatches, "canary failed")
+}
@@ -0,0 +1,110 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+const checkpoints = "checkpoints"
+
+// checkpointKey returns the key of the checkpoint of a request.
+func checkpointKey(op, id string) string {
+	return checkpoints + "/" + op + "/" + id
+}
+
+// Checkpoint stores data as the progress of the request handled with ctx, replacing any
+// previous checkpoint, so a retry of the request with the same request ID, see WithRequestID,
+// can resume where it left off with LoadCheckpoint, e.g. after returning ErrPartial.
+// The checkpoint is removed when the request succeeds.
+// It requires ProvisionerOptions.Checkpoints.
+func Checkpoint(ctx context.Context, data []byte) error {
+	cp, ok := ctx.Value(checkpointerKey{}).(*checkpointer)
+	if !ok {
+		return errors.New("Checkpoint must be called with the context passed to the handler")
+	}
+	return cp.store(ctx, data)
+}
+
+// LoadCheckpoint returns the data last stored with Checkpoint for the request handled with ctx,
+// nil if there is none.
+func LoadCheckpoint(ctx context.Context) ([]byte, error) {
+	cp, ok := ctx.Value(checkpointerKey{}).(*checkpointer)
+	if !ok {
+		return nil, errors.New("LoadCheckpoint must be called with the context passed to the handler")
+	}
+	return cp.load(ctx)
+}
+
+type checkpointerKey struct{}
+
+// checkpointer stores the checkpoints of a request.
+type checkpointer struct {
+	s      *Server
+	op, id string
+
+	mu   sync.Mutex
+	used bool
+}
+
+func withCheckpointer(ctx context.Context, cp *checkpointer) context.Context {
+	return context.WithValue(ctx, checkpointerKey{}, cp)
+}
+
+func (cp *checkpointer) store(ctx context.Context, data []byte) error {
+	cp.mu.Lock()
+	cp.used = true
+	cp.mu.Unlock()
+	if _, err := cp.s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(cp.s.bucket),
+		Key:    aws.String(checkpointKey(cp.op, cp.id)),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (cp *checkpointer) load(ctx context.Context) ([]byte, error) {
+	o, err := cp.s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cp.s.bucket),
+		Key:    aws.String(checkpointKey(cp.op, cp.id)),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("load checkpoint: %w", err)
+	}
+	defer o.Body.Close()
+	cp.mu.Lock()
+	cp.used = true
+	cp.mu.Unlock()
+	b, err := io.ReadAll(o.Body)
+	if err != nil {
+		return nil, fmt.Errorf("load checkpoint: %w", err)
+	}
+	return b, nil
+}
+
+// remove removes the checkpoint of a succeeded request, if the handler used one.
+func (cp *checkpointer) remove(ctx context.Context) {
+	cp.mu.Lock()
+	used := cp.used
+	cp.mu.Unlock()
+	if !used {
+		return
+	}
+	if err := cp.s.deleteObject(ctx, checkpointKey(cp.op, cp.id)); err != nil {
+		// It expires with the bucket's lifecycle rules.
+		cp.s.logf(ctx, "Failed to remove checkpoint of %q: %s", cp.id, err)
+	}
+}
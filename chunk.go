@@ -0,0 +1,217 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const chunks = "chunks"
+
+// MetaChunkCount holds the number of chunks the handler emitted with EmitChunk.
+// It is set on the final response, if any chunks were emitted.
+const MetaChunkCount = "s3rpc-chunk-count"
+
+// chunkPollInterval is the interval between checks for the next chunk.
+const chunkPollInterval = time.Second
+
+// chunkKey returns the key of the chunk with the given index for a request.
+// The chunks are stored outside of to_client/, so they do not trigger response notifications.
+func chunkKey(op, id string, index int) string {
+	return fmt.Sprintf("%s/%s/%s_%06d", chunks, op, id, index)
+}
+
+// Chunk is a partial result emitted by a handler with EmitChunk.
+type Chunk struct {
+	// Index is the position of the chunk, starting at 0.
+	Index int
+
+	Output
+}
+
+// EmitChunk uploads chunk as the next partial result of the request handled in ctx,
+// so clients using Client.ExecuteChunks can start on it before the handler returns.
+// Chunks are delivered in the order they are emitted.
+// The Filename can be removed when EmitChunk returns.
+// It requires ProvisionerOptions.Chunks.
+func EmitChunk(ctx context.Context, chunk Output) error {
+	e, ok := ctx.Value(chunkEmitterKey{}).(*chunkEmitter)
+	if !ok {
+		return errors.New("EmitChunk must be called with the context passed to the handler")
+	}
+	return e.emit(ctx, chunk)
+}
+
+type chunkEmitterKey struct{}
+
+// chunkEmitter uploads the chunks of a request.
+type chunkEmitter struct {
+	s      *Server
+	op, id string
+
+	mu sync.Mutex
+	n  int
+}
+
+func withChunkEmitter(ctx context.Context, e *chunkEmitter) context.Context {
+	return context.WithValue(ctx, chunkEmitterKey{}, e)
+}
+
+func (e *chunkEmitter) emit(ctx context.Context, chunk Output) error {
+	// Upload one chunk at a time, so the indexes have no gaps.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := chunkKey(e.op, e.id, e.n)
+	if err := e.s.upload(ctx, chunk.Filename, key, chunk.ContentType, e.s.ops[e.op].StorageClass, chunk.Metadata); err != nil {
+		return fmt.Errorf("emit chunk: %w", err)
+	}
+	e.n++
+	return nil
+}
+
+func (e *chunkEmitter) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.n
+}
+
+// ChunkStream is the result of Client.ExecuteChunks.
+type ChunkStream struct {
+	// C receives the chunks in order and is closed when the request is done.
+	// It must be drained, or the request does not finish.
+	// The chunk files are temporary, as with Execute.
+	C <-chan Chunk
+
+	done   chan struct{}
+	output Output
+	err    error
+}
+
+// Wait waits for the request to finish and returns its final output, as Execute.
+func (s *ChunkStream) Wait() (Output, error) {
+	<-s.done
+	return s.output, s.err
+}
+
+// ExecuteChunks executes the op as Execute, but also delivers the partial results
+// the handler emits with EmitChunk on the returned stream's channel as they are ready,
+// so the caller can start on them before the whole job finishes.
+// The chunks are fetched by polling the bucket every second while waiting for the response.
+// Requests are not coalesced with ClientOptions.Deduplicate.
+// With failover, each chunk index is delivered once, so the chunks already received
+// from an endpoint that failed are not delivered again.
+func (c *Client) ExecuteChunks(ctx context.Context, op string, input Input) *ChunkStream {
+	ch := make(chan Chunk)
+	s := &ChunkStream{C: ch, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer close(ch)
+		if schema := c.schemas[op]; schema != nil {
+			if s.err = schema.Validate(input.Metadata); s.err != nil {
+				return
+			}
+		}
+		s.output, s.err = c.executeFailover(withChunkReceiver(ctx, &chunkReceiver{ch: ch}), op, input)
+	}()
+	return s
+}
+
+type chunkReceiverKey struct{}
+
+// chunkReceiver downloads the chunks of a request for ExecuteChunks.
+type chunkReceiver struct {
+	ch   chan<- Chunk
+	next int
+}
+
+func withChunkReceiver(ctx context.Context, r *chunkReceiver) context.Context {
+	return context.WithValue(ctx, chunkReceiverKey{}, r)
+}
+
+func chunkReceiverFrom(ctx context.Context) *chunkReceiver {
+	r, _ := ctx.Value(chunkReceiverKey{}).(*chunkReceiver)
+	return r
+}
+
+// start polls for the chunks of the request with the given id until the returned func is called.
+func (r *chunkReceiver) start(ctx context.Context, c *Client, ep *common, op, id string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			ok, err := r.fetchNext(ctx, c, ep, op, id)
+			if err != nil && ctx.Err() == nil {
+				ep.logf(ctx, "Failed to fetch chunk %d: %s", r.next, err)
+			}
+			if ok {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(chunkPollInterval):
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
+// finish fetches the remaining chunks after the response with count chunks has arrived.
+// start must be stopped.
+func (r *chunkReceiver) finish(ctx context.Context, c *Client, ep *common, op, id string, count int) error {
+	for r.next < count {
+		ok, err := r.fetchNext(ctx, c, ep, op, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("chunk %d of %d is missing", r.next, count)
+		}
+	}
+	return nil
+}
+
+// fetchNext downloads and delivers the next chunk, returning false if it does not exist yet.
+func (r *chunkReceiver) fetchNext(ctx context.Context, c *Client, ep *common, op, id string) (bool, error) {
+	key := chunkKey(op, id, r.next)
+	if _, err := ep.headObject(ctx, key); err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	filename, metadata, contentType, err := c.download(ctx, ep, key)
+	if err != nil {
+		return false, err
+	}
+	select {
+	case r.ch <- Chunk{Index: r.next, Output: Output{Filename: filename, Metadata: metadata, ContentType: contentType}}:
+	case <-ctx.Done():
+		// Leave the chunk in the bucket to be fetched again.
+		os.Remove(filename)
+		return false, ctx.Err()
+	}
+	r.next++
+	_ = ep.deleteObject(ctx, key)
+	return true, nil
+}
+
+// chunkCount returns the MetaChunkCount in the response metadata.
+func chunkCount(metadata map[string]string) int {
+	n, _ := strconv.Atoi(metadata[MetaChunkCount])
+	return n
+}
@@ -0,0 +1,40 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestChunks(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(chunkKey("ocr", "01h", 12), qt.Equals, "chunks/ocr/01h_000012")
+	c.Assert(chunkCount(map[string]string{MetaChunkCount: "3"}), qt.Equals, 3)
+	c.Assert(chunkCount(nil), qt.Equals, 0)
+
+	ctx := context.Background()
+	c.Assert(EmitChunk(ctx, Output{Filename: "a.txt"}), qt.ErrorMatches, "EmitChunk must be called with the context passed to the handler")
+	c.Assert(chunkReceiverFrom(ctx), qt.IsNil)
+	r := &chunkReceiver{}
+	c.Assert(chunkReceiverFrom(withChunkReceiver(ctx, r)), qt.Equals, r)
+
+	e := &chunkEmitter{n: 2}
+	c.Assert(e.count(), qt.Equals, 2)
+}
+
+func TestExecuteChunksInvalidMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	schemas := map[string]*MetadataSchema{"ocr": {Fields: map[string]MetadataField{"lang": {Required: true}}}}
+	c.Assert(initMetadataSchemas(schemas), qt.IsNil)
+	client := &Client{schemas: schemas}
+
+	stream := client.ExecuteChunks(context.Background(), "ocr", Input{Filename: "a.pdf"})
+	for range stream.C {
+		c.Fatal("unexpected chunk")
+	}
+	_, err := stream.Wait()
+	c.Assert(err, qt.ErrorMatches, "invalid metadata: lang: required")
+}
@@ -0,0 +1,214 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Retryable wraps an error returned from a handler to mark the failure as transient,
+// e.g. a dependency that timed out. The server retries the handler with backoff,
+// see HandlerRetryOptions, and sends the error to the client as a ResponseError
+// with code ErrorCodeHandler when the attempts are used up.
+// Retryable(nil) returns nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err}
+}
+
+// Permanent wraps an error returned from a handler to mark the failure as final,
+// e.g. an input the handler can not process. The server does not retry it,
+// and sends it to the client as a ResponseError with code ErrorCodeHandler.
+// Permanent(nil) returns nil.
+//
+// Other errors returned from a handler stop the server.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// classifiedHandlerError reports whether err was wrapped with Retryable or Permanent.
+// Permanent wins if it is both.
+func classifiedHandlerError(err error) (retryable, permanent bool) {
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return false, true
+	}
+	var retryErr *retryableError
+	return errors.As(err, &retryErr), false
+}
+
+// HandlerRetryOptions configures the retries of handlers that fail with a Retryable error,
+// see ServerOptions.HandlerRetry and OpOptions.HandlerRetry.
+type HandlerRetryOptions struct {
+	// MaxAttempts is the max number of attempts of the handler, including the first.
+	// Defaults to 3.
+	MaxAttempts int
+
+	// InitialBackoff is the backoff before the first retry, doubled for each retry.
+	// Defaults to 1 second.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the backoff.
+	// Defaults to 30 seconds.
+	MaxBackoff time.Duration
+
+	// Jitter, if set, waits a random duration up to the backoff,
+	// so requests that failed together are not retried together.
+	Jitter bool
+
+	// Requeue, if set, sends the request back to the server's queue with a delay of the backoff
+	// instead of retrying it in place, freeing the slot for other requests in the meantime.
+	// The retry may be handled by any server, and resumes from the last Checkpoint.
+	// Streamed inputs are only retried with Requeue.
+	// The backoff can be at most 15 minutes, the max delay of SQS,
+	// and the server needs ProvisionerOptions.HandlerRequeue.
+	// It is not supported with ServerOptions.ListPolling.
+	Requeue bool
+}
+
+func (o *HandlerRetryOptions) init() error {
+	if o.MaxAttempts < 0 || o.InitialBackoff < 0 || o.MaxBackoff < 0 {
+		return errors.New("handler retry: options can not be negative")
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 3
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.Requeue && o.MaxBackoff > maxRequeueDelay {
+		return errors.New("handler retry: max backoff can be at most 15 minutes with requeue")
+	}
+	return nil
+}
+
+// maxRequeueDelay is the max delay of an SQS message.
+const maxRequeueDelay = 15 * time.Minute
+
+// backoff returns InitialBackoff*2^(attempt-1), capped at MaxBackoff,
+// or with Jitter, a random duration up to that.
+func (o *HandlerRetryOptions) backoff(attempt int) time.Duration {
+	d := o.MaxBackoff
+	if attempt < 32 {
+		if exp := o.InitialBackoff << (attempt - 1); exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	if o.Jitter {
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
+
+// handlerRetry returns the retry options of op.
+func (s *Server) handlerRetry(opts OpOptions) *HandlerRetryOptions {
+	if opts.HandlerRetry != nil {
+		return opts.HandlerRetry
+	}
+	return s.handlerRetries
+}
+
+// requeueError is returned from runHandlerWithRetries when the request should be
+// sent back to the queue, see HandlerRetryOptions.Requeue.
+type requeueError struct {
+	err error
+
+	// attempt is the attempt of the retry.
+	attempt int
+	delay   time.Duration
+}
+
+func (e *requeueError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requeueError) Unwrap() error {
+	return e.err
+}
+
+// runHandlerWithRetries runs the handler with runHandler from the given attempt, retrying it
+// while it fails with a Retryable error, the attempts are not used up and the backoff fits in the
+// RemainingBudget of ctx. newCtx returns the context of each attempt.
+// A *requeueError is returned if the retry should be requeued.
+// Streamed inputs can only be read once, so they are only retried when requeued.
+func (s *Server) runHandlerWithRetries(ctx context.Context, newCtx func() (context.Context, context.CancelFunc), op, id string, opts OpOptions, first int, streamed bool, handle func(ctx context.Context, input Input) (Output, error), input Input) (Output, error) {
+	retry := s.handlerRetry(opts)
+	for attempt := first; ; attempt++ {
+		input.Attempt = attempt
+		handlerCtx, cancel := newCtx()
+		result, err := s.runHandler(handlerCtx, cancel, op, id, opts, handle, input)
+		cancel()
+		if retryable, _ := classifiedHandlerError(err); !retryable || streamed && !retry.Requeue || attempt >= retry.MaxAttempts || ctx.Err() != nil {
+			return result, err
+		}
+		backoff := retry.backoff(attempt)
+		if budget, ok := RemainingBudget(ctx); ok && budget < backoff {
+			// The client would not get the response.
+			return result, err
+		}
+		if retry.Requeue {
+			return result, &requeueError{err: err, attempt: attempt + 1, delay: backoff}
+		}
+		s.logf(ctx, "Request %q failed (attempt %d), retrying in %s: %s", id, attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// requeueMessage sends the request in m back to the server's queue
+// to be received again after delay, as the given attempt.
+func (s *Server) requeueMessage(ctx context.Context, m message, attempt int, delay time.Duration) error {
+	attributes := requestAttributes(s.bucket, m.Op, m.RequestID, m.Key, m.ReplyQueue)
+	attributes[AttrAttempt] = stringAttribute(strconv.Itoa(attempt))
+	if _, err := s.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(s.queue),
+		MessageBody:       aws.String(m.Key),
+		MessageAttributes: attributes,
+		DelaySeconds:      int32(math.Ceil(delay.Seconds())),
+	}); err != nil {
+		return fmt.Errorf("failed to requeue %q: %w", m.Key, err)
+	}
+	return nil
+}
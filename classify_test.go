@@ -0,0 +1,129 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClassifiedHandlerError(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(Retryable(nil), qt.IsNil)
+	c.Assert(Permanent(nil), qt.IsNil)
+
+	timeout := errors.New("dependency timed out")
+	for _, test := range []struct {
+		err                  error
+		retryable, permanent bool
+	}{
+		{nil, false, false},
+		{timeout, false, false},
+		{Retryable(timeout), true, false},
+		{fmt.Errorf("ocr: %w", Retryable(timeout)), true, false},
+		{Permanent(timeout), false, true},
+		{Permanent(Retryable(timeout)), false, true},
+	} {
+		retryable, permanent := classifiedHandlerError(test.err)
+		c.Assert(retryable, qt.Equals, test.retryable, qt.Commentf("%v", test.err))
+		c.Assert(permanent, qt.Equals, test.permanent, qt.Commentf("%v", test.err))
+	}
+	c.Assert(errors.Is(Retryable(timeout), timeout), qt.IsTrue)
+	c.Assert(Permanent(timeout), qt.ErrorMatches, "dependency timed out")
+}
+
+func TestHandlerRetryOptions(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&HandlerRetryOptions{MaxAttempts: -1}).init(), qt.ErrorMatches, "handler retry: options can not be negative")
+
+	opts := &HandlerRetryOptions{}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(*opts, qt.DeepEquals, HandlerRetryOptions{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second})
+	c.Assert(opts.backoff(1), qt.Equals, time.Second)
+	c.Assert(opts.backoff(3), qt.Equals, 4*time.Second)
+	c.Assert(opts.backoff(10), qt.Equals, 30*time.Second)
+	c.Assert(opts.backoff(100), qt.Equals, 30*time.Second)
+
+	opts.Jitter = true
+	for i := 0; i < 10; i++ {
+		d := opts.backoff(2)
+		c.Assert(d >= 0 && d <= 2*time.Second, qt.IsTrue, qt.Commentf("%s", d))
+	}
+
+	c.Assert((&HandlerRetryOptions{Requeue: true, MaxBackoff: time.Hour}).init(), qt.ErrorMatches, "handler retry: max backoff can be at most 15 minutes with requeue")
+	c.Assert((&HandlerRetryOptions{Requeue: true}).init(), qt.IsNil)
+}
+
+func TestRunHandlerWithRetries(t *testing.T) {
+	c := qt.New(t)
+
+	s := &Server{
+		common:         &common{infof: func(format string, args ...interface{}) {}},
+		handlerRetries: &HandlerRetryOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	}
+	newCtx := func() (context.Context, context.CancelFunc) {
+		return context.WithCancel(context.Background())
+	}
+	var attempts, lastAttempt int
+	failing := func(err error, succeedAt int) func(ctx context.Context, input Input) (Output, error) {
+		attempts = 0
+		return func(ctx context.Context, input Input) (Output, error) {
+			attempts++
+			lastAttempt = input.Attempt
+			if attempts == succeedAt {
+				return Output{Filename: input.Filename}, nil
+			}
+			return Output{}, err
+		}
+	}
+	run := func(opts OpOptions, streamed bool, handle func(ctx context.Context, input Input) (Output, error)) (Output, error) {
+		return s.runHandlerWithRetries(context.Background(), newCtx, "ocr", "01h", opts, 1, streamed, handle, Input{Filename: "a.png"})
+	}
+
+	timeout := Retryable(errors.New("dependency timed out"))
+	output, err := run(OpOptions{}, false, failing(timeout, 2))
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.Filename, qt.Equals, "a.png")
+	c.Assert(attempts, qt.Equals, 2)
+	c.Assert(lastAttempt, qt.Equals, 2)
+
+	_, err = run(OpOptions{}, false, failing(timeout, 0))
+	c.Assert(err, qt.Equals, timeout)
+	c.Assert(attempts, qt.Equals, 3)
+
+	opts := OpOptions{HandlerRetry: &HandlerRetryOptions{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+	_, err = run(opts, false, failing(timeout, 0))
+	c.Assert(err, qt.Equals, timeout)
+	c.Assert(attempts, qt.Equals, 5)
+
+	_, err = run(OpOptions{}, true, failing(timeout, 0))
+	c.Assert(err, qt.Equals, timeout)
+	c.Assert(attempts, qt.Equals, 1)
+
+	for _, err := range []error{errors.New("unclassified"), Permanent(errors.New("unreadable input"))} {
+		_, got := run(OpOptions{}, false, failing(err, 0))
+		c.Assert(got, qt.Equals, err)
+		c.Assert(attempts, qt.Equals, 1)
+	}
+
+	requeue := OpOptions{HandlerRetry: &HandlerRetryOptions{MaxAttempts: 3, InitialBackoff: time.Minute, MaxBackoff: time.Minute, Requeue: true}}
+	for _, streamed := range []bool{false, true} {
+		_, err = run(requeue, streamed, failing(timeout, 0))
+		var requeueErr *requeueError
+		c.Assert(errors.As(err, &requeueErr), qt.IsTrue)
+		c.Assert(requeueErr.attempt, qt.Equals, 2)
+		c.Assert(requeueErr.delay, qt.Equals, time.Minute)
+		c.Assert(errors.Is(err, timeout), qt.IsTrue)
+		c.Assert(attempts, qt.Equals, 1)
+	}
+
+	// The last attempt of a requeued request.
+	_, err = s.runHandlerWithRetries(context.Background(), newCtx, "ocr", "01h", requeue, 3, false, failing(timeout, 0), Input{})
+	c.Assert(err, qt.Equals, timeout)
+	c.Assert(lastAttempt, qt.Equals, 3)
+}
@@ -2,19 +2,21 @@ package s3rpc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
-	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	"github.com/oklog/ulid/v2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -28,10 +30,18 @@ func NewClient(opts ClientOptions) (*Client, error) {
 	awsCfg := aws.Config{
 		Region:      opts.Region,
 		Credentials: credentials.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, ""),
+		APIOptions:  opts.apiOptions(),
 	}
 
-	if opts.Timeout == 0 {
-		opts.Timeout = 5 * time.Minute
+	if opts.ResponseWaitTimeout == 0 {
+		opts.ResponseWaitTimeout = opts.Timeout
+	}
+	if opts.ResponseWaitTimeout == 0 {
+		opts.ResponseWaitTimeout = 5 * time.Minute
+	}
+
+	if opts.Logger != nil {
+		opts.Infof = opts.Logger.Infof
 	}
 
 	if opts.Infof == nil {
@@ -45,138 +55,812 @@ func NewClient(opts ClientOptions) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{
-		timeout: opts.Timeout,
-		common: &common{
-			bucket:    opts.Bucket,
-			queue:     opts.Queue,
-			s3Client:  s3.NewFromConfig(awsCfg),
-			sqsClient: sqs.NewFromConfig(awsCfg),
-			tempDir:   tempDir,
-			infof:     opts.Infof,
+	if opts.ResponseQueues != nil {
+		if opts.Queue, err = opts.ResponseQueues.CreateResponseQueue(context.Background(), newResponseQueueID()); err != nil {
+			os.RemoveAll(tempDir)
+			return nil, err
+		}
+	}
+
+	client := &Client{
+		timeouts: clientTimeouts{
+			upload:       opts.UploadTimeout,
+			responseWait: opts.ResponseWaitTimeout,
+			download:     opts.DownloadTimeout,
+			total:        opts.TotalTimeout,
 		},
-	}, nil
+		fsync:                opts.Fsync,
+		datePartitions:       opts.DatePartitions,
+		verifyResponses:      opts.VerifyResponses,
+		directSubmit:         opts.DirectSubmit,
+		events:               opts.Events,
+		responsePollInterval: opts.ResponsePollInterval,
+		schemas:              opts.MetadataSchemas,
+		newID:                opts.IDGenerator,
+		identity:             opts.Identity,
+		signing:              opts.Signing,
+		responseSignatures:   newSignatureVerifier(opts.ResponseSignatures, nil),
+		accessLog:            opts.AccessLog,
+		encrypter:            newMetadataEncrypter(opts.EncryptMetadata, kms.NewFromConfig(awsCfg)),
+		ops:                  opts.Ops,
+		retrier:              newRetrier(opts.Retry),
+		stats:                newClientStats(opts.MaxInFlight),
+		responseQueues:       opts.ResponseQueues,
+		completed:            newRecentResponses(recentResponsesSize),
+		common:               newCommon(awsCfg, opts.Bucket, opts.Queue, tempDir, opts.Infof, opts.Logger),
+	}
+
+	if opts.Deduplicate {
+		client.dedup = newDedup(tempDir)
+	}
+
+	client.submitQueue = opts.SubmitQueue
+
+	for _, ep := range opts.FailoverEndpoints {
+		epCfg := awsCfg.Copy()
+		epCfg.Region = ep.Region
+		failover := newCommon(epCfg, ep.Bucket, ep.Queue, tempDir, opts.Infof, opts.Logger)
+		failover.submitQueue = ep.SubmitQueue
+		client.failover = append(client.failover, failover)
+	}
+
+	transfers := newTransferMonitor(opts.SlowTransfer, nil)
+	for _, ep := range append([]*common{client.common}, client.failover...) {
+		ep.objectLock = opts.ObjectLock
+		ep.transfers = transfers
+		client.breakers = append(client.breakers, newBreaker(opts.CircuitBreaker))
+	}
+
+	if opts.Journal != nil {
+		client.journal, err = newJournal(*opts.Journal, opts.Fsync)
+		if err != nil {
+			client.deleteResponseQueue()
+			os.RemoveAll(tempDir)
+			return nil, err
+		}
+		client.journal.start(client)
+	}
+
+	return client, nil
 
 }
 
 // Client is a client for executing operations on a server.
 type Client struct {
-	timeout time.Duration
+	timeouts        clientTimeouts
+	fsync           bool
+	datePartitions  bool
+	verifyResponses bool
+	directSubmit    bool
+	events          *EventBus
+
+	// responsePollInterval is set if polling the bucket for responses.
+	responsePollInterval time.Duration
+	schemas              map[string]*MetadataSchema
+	ops                  map[string]ClientOpOptions
+	newID                IDGenerator
+	identity             Identity
+	signing              *SigningOptions
+	responseSignatures   *signatureVerifier
+	accessLog            func(r AccessRecord)
+	encrypter            *metadataEncrypter
+
+	// The primary endpoint.
 	*common
+
+	// Endpoints to try if the primary fails, in order.
+	failover []*common
+
+	retrier *retrier
+	stats   *clientStats
+	dedup   *dedup
+
+	// completed holds the response messages this client has deleted.
+	completed *recentResponses
+
+	// The circuit breakers of the primary and failover endpoints, in order.
+	// The breakers are nil if not enabled.
+	breakers []*breaker
+
+	// serverProtocol is the protocol version of the last response on the primary endpoint.
+	serverProtocol int32
+
+	// journal is set with ClientOptions.Journal.
+	journal *journal
+
+	// responseQueues is set with ClientOptions.ResponseQueues.
+	responseQueues ResponseQueues
 }
 
 // Execute executes the given op on a server with input.Filename as its main input.
-// This will block until the response is received or the timeout is reached.
+// This will block until the response is received or one of the timeouts in ClientOptions is reached,
+// in which case an error wrapping context.DeadlineExceeded is returned.
+// If the AWS calls against an endpoint fail, the request is retried against the next
+// endpoint in ClientOptions.FailoverEndpoints.
+// If ClientOptions.CircuitBreaker is set, endpoints with an open circuit are skipped,
+// and ErrUnavailable is returned if there are none left.
+// If ClientOptions.Deduplicate is set, concurrent calls with the same op, input content and metadata
+// share the result of one request.
+// If ClientOptions.MetadataSchemas has a schema for op, input.Metadata is validated before upload,
+// returning a *MetadataValidationError if invalid.
+// If the server responded with an error, e.g. the input was rejected by a Validator,
+// a *ResponseError is returned.
+// If the handler returned a partial result, see ErrPartial, it is returned along with the *ResponseError.
+// If the server was busy, see ServerOptions.Backpressure, and ClientOptions.Retry is set,
+// the request is retried after the server's hint, see RetryOptions.BusyAttempts.
+// The request ID is generated with ClientOptions.IDGenerator, unless set with WithRequestID.
 // Note that Output.Filename should be considered temporary and will be removed on Close.
 func (c *Client) Execute(ctx context.Context, op string, input Input) (Output, error) {
-	// ULID is case insensitive, and lower case works better for filenames.
-	id := strings.ToLower(ulid.Make().String())
-	key := fmt.Sprintf("%s/%s/%s_%s", toServer, op, id, filepath.Base(input.Filename))
+	if id := requestIDFrom(ctx); id != "" {
+		if err := validateRequestID(id); err != nil {
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+	}
+	if err := RequestIdentity(ctx).validate(); err != nil {
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+	if schema := c.schemas[op]; schema != nil {
+		if err := schema.Validate(input.Metadata); err != nil {
+			return Output{}, err
+		}
+	}
+	if c.dedup == nil {
+		return c.executeFailover(ctx, op, input)
+	}
+	key, err := dedupKey(op, input)
+	if err != nil {
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+	return c.dedup.do(ctx, key, func() (Output, error) {
+		return c.executeFailover(ctx, op, input)
+	})
+}
+
+// executeFailover executes the op against the endpoints in order until one does not fail.
+func (c *Client) executeFailover(ctx context.Context, op string, input Input) (output Output, err error) {
+	endpoints := append([]*common{c.common}, c.failover...)
+
+	if c.accessLog != nil {
+		var access *accessEntry
+		ctx, access = withAccessEntry(ctx)
+		defer func(started time.Time) {
+			c.accessLog(access.record(AccessClient, op, mergeIdentity(RequestIdentity(ctx), c.identity), started, err))
+		}(time.Now())
+	}
+
+	ctx, cancel := withOptionalTimeout(ctx, c.timeoutsFor(op).total)
+	defer cancel()
+
+	if err := c.stats.acquire(ctx); err != nil {
+		return Output{}, fmt.Errorf("apply: waiting for an in-flight slot: %w", err)
+	}
+	defer c.stats.release()
+
+	for i, ep := range endpoints {
+		if err = c.breakers[i].allow(); err == nil {
+			output, err = c.executeBusy(ctx, ep, op, input)
+			c.breakers[i].record(err)
+			if err != nil {
+				c.events.publish(Event{Type: EventError, Op: op, Err: err})
+			}
+		}
+
+		var epErr *endpointError
+		unavailable := errors.Is(err, ErrUnavailable)
+		if !(unavailable || errors.As(err, &epErr)) || i == len(endpoints)-1 || ctx.Err() != nil {
+			break
+		}
+		if unavailable {
+			c.infof("Endpoint %s/%s is unavailable, failing over to %s/%s", ep.bucket, ep.queue, endpoints[i+1].bucket, endpoints[i+1].queue)
+			continue
+		}
+		c.infof("Endpoint %s/%s failed, failing over to %s/%s: %s", ep.bucket, ep.queue, endpoints[i+1].bucket, endpoints[i+1].queue, epErr.err)
+	}
+
+	return output, err
+}
+
+// partialSuffix is the suffix of responses being downloaded.
+const partialSuffix = ".part"
+
+// download downloads the response with the given key to a temp file and returns its name.
+// The response is written to a .part file renamed into place when complete,
+// so a crash mid-download never leaves a partial file under the returned name.
+func (c *Client) download(ctx context.Context, ep *common, key string) (string, map[string]string, string, error) {
+	f, err := createTemp(c.tempDir, key+partialSuffix)
+	if err != nil {
+		return "", nil, "", err
+	}
+	partial := f.Name()
+	defer os.Remove(partial)
+
+	metaData, contentType, err := ep.getObject(ctx, f, key)
+	if err == nil && c.fsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	filename := strings.TrimSuffix(partial, partialSuffix)
+	if err := os.Rename(partial, filename); err != nil {
+		return "", nil, "", fmt.Errorf("failed to rename response: %w", err)
+	}
+	if c.fsync {
+		if err := syncDir(c.tempDir); err != nil {
+			return "", nil, "", err
+		}
+	}
+	return filename, metaData, contentType, nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories can not be synced on Windows.
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// maxReceiveErrors is the number of consecutive failed receives from the response queue
+// before the endpoint is considered unavailable.
+const maxReceiveErrors = 3
+
+// endpointError is an error from AWS that signals that the endpoint may be unavailable.
+type endpointError struct {
+	err error
+}
+
+func (e *endpointError) Error() string {
+	return e.err.Error()
+}
+
+func (e *endpointError) Unwrap() error {
+	return e.err
+}
+
+func (c *Client) execute(ctx context.Context, ep *common, op string, input Input) (Output, error) {
+	id := requestIDFrom(ctx)
+	if id == "" {
+		id = c.newID()
+		if err := validateRequestID(id); err != nil {
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+	}
+	var date time.Time
+	if c.datePartitions {
+		date = time.Now()
+	}
+	key := requestKey(op, id, filepath.Base(input.Filename), date)
+	ctx = withRequestLogFields(ctx, op, key)
+	access := accessEntryFrom(ctx)
+	if access != nil {
+		access.setRequest(id, key, fileSize(input.Filename))
+	}
+
+	opts := c.ops[op]
+	timeouts := c.timeoutsFor(op)
+
+	baseline := deltaBaselineFrom(ctx)
+	var inputChecksum string
+	metadata := make(map[string]string, len(input.Metadata)+3)
+	for k, v := range input.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaProtocolVersion] = strconv.Itoa(requestProtocolVersion)
+	if deadline, ok := requestDeadline(ctx, timeouts.responseWait); ok {
+		metadata[MetaDeadline] = deadline.UTC().Format(time.RFC3339Nano)
+	}
+	RequestIdentity(ctx).setMetadata(metadata)
+	c.identity.setMetadata(metadata)
+	if c.verifyResponses {
+		var err error
+		if inputChecksum, err = fileChecksum(input.Filename); err != nil {
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+		metadata[MetaInputChecksum] = inputChecksum
+	}
+
+	if err := c.encrypter.encrypt(ctx, op, metadata); err != nil {
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+
+	if c.signing != nil {
+		// Sign the input as the server sees it, before any delta encoding and compression.
+		checksum := inputChecksum
+		if checksum == "" {
+			var err error
+			if checksum, err = fileChecksum(input.Filename); err != nil {
+				return Output{}, fmt.Errorf("apply: %w", err)
+			}
+		}
+		c.signing.sign(key, checksum, metadata)
+	}
+
+	filename, contentType := input.Filename, input.ContentType
+	if baseline != "" {
+		var err error
+		if contentType == "" {
+			if contentType, err = detectContentType(filename); err != nil {
+				return Output{}, fmt.Errorf("apply: %w", err)
+			}
+		}
+		delta, etag, err := ep.encodeDelta(ctx, c.tempDir, baseline, filename)
+		if err != nil {
+			ep.logf(ctx, "Uploading the full input, no delta against baseline %q: %s", baseline, err)
+		} else {
+			defer os.Remove(delta)
+			filename = delta
+			metadata[MetaDeltaBaseline] = baseline
+			metadata[MetaDeltaETag] = etag
+		}
+	}
+	if opts.Compress || opts.Dictionary != "" {
+		var err error
+		if contentType == "" {
+			if contentType, err = detectContentType(filename); err != nil {
+				return Output{}, fmt.Errorf("apply: %w", err)
+			}
+		}
+		if filename, err = ep.compressFile(ctx, c.tempDir, filename, opts.Dictionary, metadata); err != nil {
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+		defer os.Remove(filename)
+	}
 
 	// First upload the file to the input folder.
-	if err := c.upload(input.Filename, key, input.Metadata); err != nil {
-		return Output{}, fmt.Errorf("apply: %v", err)
+	uploadStarted := time.Now()
+	uploadCtx, cancelUpload := withOptionalTimeout(withUploadOptions(ctx, opts.PartSize, opts.UploadConcurrency), timeouts.upload)
+	defer cancelUpload()
+	err := c.retrier.do(uploadCtx, func() error {
+		return ep.upload(uploadCtx, filename, key, contentType, opts.StorageClass, metadata)
+	}, func(attempt int, backoff time.Duration, err error) {
+		ep.logf(ctx, "Upload of %q failed (attempt %d), retrying in %s: %s", key, attempt, backoff.Round(time.Millisecond), err)
+	})
+	if err != nil {
+		if uploadCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return Output{}, fmt.Errorf("apply: upload timed out after %s: %w", timeouts.upload, context.DeadlineExceeded)
+		}
+		return Output{}, fmt.Errorf("apply: %w", &endpointError{err: err})
 	}
+	uploadFinished := time.Now()
 
-	var output Output
+	if ep.submitQueue != "" {
+		var replyQueue string
+		if c.directSubmit {
+			replyQueue = ep.queue
+		}
+		err := c.retrier.do(ctx, func() error {
+			return ep.submit(ctx, op, id, key, replyQueue)
+		}, func(attempt int, backoff time.Duration, err error) {
+			ep.logf(ctx, "Submit of %q failed (attempt %d), retrying in %s: %s", key, attempt, backoff.Round(time.Millisecond), err)
+		})
+		if err != nil {
+			return Output{}, fmt.Errorf("apply: %w", &endpointError{err: err})
+		}
+	}
+
+	receiver := chunkReceiverFrom(ctx)
+	stopChunks := func() {}
+	if receiver != nil {
+		stopChunks = receiver.start(ctx, c, ep, op, id)
+	}
+	defer stopChunks()
+
+	// The response is signed with the key it is expected at.
+	signedKey := responseKey(op, key)
 
 	// Now, wait for the response from server.
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	var responseKey string
+	if c.responsePollInterval > 0 {
+		responseKey, err = c.pollResponse(ctx, ep, op, key, inputChecksum)
+	} else {
+		responseKey, err = c.waitForResponse(ctx, ep, op, id, inputChecksum)
+	}
+	if err != nil {
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+	c.stats.responseLatency.observe(time.Since(uploadStarted))
+
+	downloadStarted := time.Now()
+	downloadCtx, cancelDownload := withOptionalTimeout(ctx, timeouts.download)
+	defer cancelDownload()
+	var output Output
+	err = c.retrier.do(downloadCtx, func() (err error) {
+		output.Filename, output.Metadata, output.ContentType, err = c.download(downloadCtx, ep, responseKey)
+		return err
+	}, func(attempt int, backoff time.Duration, err error) {
+		ep.logf(ctx, "Download of %q failed (attempt %d), retrying in %s: %s", responseKey, attempt, backoff.Round(time.Millisecond), err)
+	})
+	if err != nil {
+		if downloadCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return Output{}, fmt.Errorf("apply: download timed out after %s: %w", timeouts.download, context.DeadlineExceeded)
+		}
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+	output.Timeline = timelineFromMetadata(output.Metadata)
+	output.Timeline.UploadStarted, output.Timeline.UploadFinished = uploadStarted, uploadFinished
+	output.Timeline.DownloadStarted, output.Timeline.DownloadFinished = downloadStarted, time.Now()
+
+	if c.responseSignatures != nil {
+		if err := c.responseSignatures.verify(ctx, signedKey, Input{Filename: output.Filename, Metadata: output.Metadata}); err != nil {
+			os.Remove(output.Filename)
+			return Output{}, fmt.Errorf("apply: response %q: %w", responseKey, err)
+		}
+	}
+
+	// We don't need these anymore.
+	// They will eventually also expire,
+	// if the below should somehow fail,
+	// so ignore any error.
+	_ = ep.deleteObject(ctx, responseKey)
+	_ = ep.deleteObject(ctx, key)
+
+	if v, err := protocolVersion(output.Metadata); err == nil && ep == c.common {
+		atomic.StoreInt32(&c.serverProtocol, int32(v))
+	}
+
+	if respErr := responseErrorFrom(output.Metadata); respErr != nil {
+		if errors.Is(respErr, ErrPartial) {
+			// The output holds the partial result.
+			return output, respErr
+		}
+		os.Remove(output.Filename)
+		return Output{}, respErr
+	}
+
+	if err := checkResponseProtocol(output.Metadata, requestProtocolVersion); err != nil {
+		os.Remove(output.Filename)
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+
+	if receiver != nil {
+		stopChunks()
+		if err := receiver.finish(ctx, c, ep, op, id, chunkCount(output.Metadata)); err != nil {
+			os.Remove(output.Filename)
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+	}
+
+	size := fileSize(output.Filename)
+	access.setResponse(responseKey, size, "", "")
+	c.events.publish(Event{Type: EventResponseDownloaded, Op: op, RequestID: id, Key: responseKey, Size: size, Duration: time.Since(uploadStarted)})
+
+	return output, nil
+
+}
+
+// waitForResponse polls the endpoint's queue until the response to the request with the given id arrives,
+// deletes its message and returns its key.
+func (c *Client) waitForResponse(ctx context.Context, ep *common, op, id, inputChecksum string) (string, error) {
+	parent := ctx
+	responseWait := c.timeoutsFor(op).responseWait
+	ctx, cancel := context.WithTimeout(ctx, responseWait)
 	defer cancel()
 
+	var responseKey string
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
+		var receiveErrors int
 		for {
 			select {
 			case <-ctx.Done():
 				return nil
 			default:
 				//c.infof("Checking queue %q for new messages", c.queue)
-				ms, err := c.Receive(ctx)
+				ms, err := ep.Receive(ctx)
 				if err != nil {
-					return err
+					if ctx.Err() != nil {
+						return nil
+					}
+					receiveErrors++
+					if receiveErrors >= maxReceiveErrors {
+						return &endpointError{err: err}
+					}
+					ep.logf(ctx, "Receive from %q failed (%d/%d): %s", ep.queue, receiveErrors, maxReceiveErrors, err)
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(time.Duration(receiveErrors) * time.Second):
+					}
+					continue
 				}
+				receiveErrors = 0
 				for _, m := range ms {
-					if m.Bucket != c.bucket {
-						return fmt.Errorf("expected bucket %q, got %q", c.bucket, m.Bucket)
+					if m.Bucket != ep.bucket {
+						return fmt.Errorf("expected bucket %q, got %q", ep.bucket, m.Bucket)
 					}
 
-					if !strings.Contains(m.Key, id) {
-						if err := c.releaseMessage(ctx, m.ReceiptHandle); err != nil {
+					if c.completed.contains(m.MessageID) {
+						// A redelivery of a response we already have.
+						ep.logf(ctx, "Deleting duplicate response message for %q", m.Key)
+						if err := ep.deleteMessage(ctx, m.ReceiptHandle); err != nil {
 							return err
 						}
 						continue
 					}
 
-					// We found the message we are looking for.
-					// Delete the message from the queue and download the file from S3.
-					if err := c.deleteMessage(ctx, m.ReceiptHandle); err != nil {
-						return err
-					}
-
-					return func() error {
-						f, err := os.CreateTemp(c.tempDir, "*_"+path.Base(m.Key))
-						if err != nil {
-							return fmt.Errorf("tempfile: %w", err)
+					if m.RequestID != id || m.Op != op {
+						if err := ep.releaseMessage(ctx, m.ReceiptHandle); err != nil {
+							return err
 						}
-						output.Filename = f.Name()
-						defer f.Close()
+						continue
+					}
 
-						metaData, err := c.getObject(ctx, f, m.Key)
+					if c.verifyResponses {
+						responseMetadata, err := ep.headObject(ctx, m.Key)
 						if err != nil {
 							return err
 						}
-						output.Metadata = metaData
-
-						// We don't need these anymore.
-						// They will eventually also expire,
-						// if the below should somehow fail,
-						// so ignore any error.
-						_ = c.deleteObject(ctx, m.Key)
-						_ = c.deleteObject(ctx, key)
-						return nil
-					}()
+						if err := verifyResponse(responseMetadata, op, id, inputChecksum); err != nil {
+							ep.logf(ctx, "Ignoring response %q: %s", m.Key, err)
+							if err := ep.releaseMessage(ctx, m.ReceiptHandle); err != nil {
+								return err
+							}
+							continue
+						}
+					}
+
+					// We found the message we are looking for.
+					// Delete the message from the queue; the file is downloaded by the caller.
+					if err := ep.deleteMessage(ctx, m.ReceiptHandle); err != nil {
+						return err
+					}
+					c.completed.add(m.MessageID)
+					responseKey = m.Key
+					return nil
 				}
 			}
 		}
 	})
 
 	if err := g.Wait(); err != nil {
-		return Output{}, fmt.Errorf("apply: %v", err)
+		return "", err
 	}
+	if responseKey == "" {
+		if err := parent.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("timed out after %s waiting for the response: %w", responseWait, context.DeadlineExceeded)
+	}
+	return responseKey, nil
+}
 
-	return output, nil
-
+// Stats returns the current statistics for the client.
+func (c *Client) Stats() ClientStats {
+	stats := c.stats.snapshot()
+	stats.Uploads, stats.Downloads = c.transfers.snapshot()
+	return stats
 }
 
-// Close removes the temporary directory.
+// Close removes the temporary directory and,
+// with ClientOptions.ResponseQueues, the client's response queue.
 func (c *Client) Close() error {
 	var err error
 	c.closeOnce.Do(func() {
+		if c.journal != nil {
+			c.journal.close()
+		}
+		queueErr := c.deleteResponseQueue()
 		err = os.RemoveAll(c.tempDir)
+		if err == nil {
+			err = queueErr
+		}
 	})
 	return err
 }
 
+// deleteResponseQueue deletes the response queue created with ClientOptions.ResponseQueues, if any.
+func (c *Client) deleteResponseQueue() error {
+	if c.responseQueues == nil {
+		return nil
+	}
+	return c.responseQueues.DeleteResponseQueue(context.Background(), c.queue)
+}
+
+// newResponseQueueID returns an id for the response queue of a client instance, see ResponseQueues.
+func newResponseQueueID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%d-%s", os.Getpid(), hex.EncodeToString(b))
+}
+
 type ClientOptions struct {
 	// The out queue to listen for responses from server.
+	// Not used with ResponsePollInterval.
 	Queue string
 
+	// ResponsePollInterval, if set, waits for the response by checking for the response
+	// object in the bucket at this interval instead of receiving from Queue,
+	// e.g. with servers with ServerOptions.ListPolling.
+	ResponsePollInterval time.Duration
+
+	// SubmitQueue, if set, is the server's queue.
+	// After uploading the input, the client sends a message to it with the op, request ID,
+	// bucket and key as message attributes (see AttrOp), so the server does not depend on
+	// S3 event notifications for to_server/.
+	// Remove those notifications, or requests are handled twice.
+	SubmitQueue string
+
+	// DirectSubmit, if set, asks the server to send a message to Queue when the response
+	// is uploaded, so no S3 event notifications are needed at all.
+	// It requires SubmitQueue and a server with ServerOptions.DirectSubmit.
+	DirectSubmit bool
+
+	// ResponseQueues, if set, creates a response queue for this client instance in NewClient,
+	// used instead of Queue, and deletes it in Close, so many concurrent clients do not
+	// receive and release each other's responses from a shared queue.
+	// Pass a *Provisioner, or assign a queue created with Provisioner.CreateResponseQueue
+	// to Queue instead. Failover endpoints keep their own queues.
+	// It requires DirectSubmit.
+	ResponseQueues ResponseQueues
+
+	// Deduplicate, if set, coalesces concurrent Execute calls with the same op, input content,
+	// content type and metadata into one request, giving each caller a copy of the result.
+	// This reads the input file an extra time to calculate its checksum.
+	// A caller that joins a running request shares its outcome, including a timeout.
+	Deduplicate bool
+
+	// MaxInFlight, if set, limits the number of concurrent Execute calls.
+	// Calls beyond the limit wait for a slot, see ClientStats.Waiting.
+	MaxInFlight int
+
+	// UploadTimeout, if set, is the maximum time to upload the input, including retries.
+	UploadTimeout time.Duration
+
+	// ResponseWaitTimeout is the maximum time to wait for the server to respond after the upload.
+	// Defaults to Timeout, or 5 minutes.
+	ResponseWaitTimeout time.Duration
+
+	// DownloadTimeout, if set, is the maximum time to download the response, including retries.
+	DownloadTimeout time.Duration
+
+	// TotalTimeout, if set, is the maximum duration of an Execute call,
+	// including failover to other endpoints.
+	TotalTimeout time.Duration
+
 	// Timeout is the maximum time to wait for a response from the server.
+	//
+	// Deprecated: Use ResponseWaitTimeout.
 	Timeout time.Duration
 
 	// Infof logs info messages.
 	Infof func(format string, args ...interface{})
 
+	// Logger, if set, is used instead of Infof to log JSON lines,
+	// including the op and request ID for the request being executed.
+	Logger *JSONLogger
+
+	// Fsync, if set, syncs downloaded responses to disk before they are returned,
+	// so a result survives a crash of the host.
+	Fsync bool
+
+	// VerifyResponses, if set, checks that a response's request ID, op and input checksum
+	// match the request before accepting it, protecting against misdirected responses.
+	// This reads the input file an extra time to calculate its checksum.
+	VerifyResponses bool
+
+	// MetadataSchemas maps an operation to a MetadataSchema the request metadata
+	// is validated against before upload.
+	MetadataSchemas map[string]*MetadataSchema
+
+	// Ops maps an operation to ClientOpOptions overriding the defaults for it,
+	// e.g. its timeouts.
+	Ops map[string]ClientOpOptions
+
+	// ObjectLock, if set, configures writes and deletes for buckets with S3 Object Lock enabled.
+	ObjectLock *ObjectLockOptions
+
+	// FailoverEndpoints are tried in order if the AWS calls against
+	// the primary endpoint (Region, Bucket and Queue) fail, e.g. during a regional outage.
+	// The same credentials are used for all endpoints.
+	// See MultiRegionProvisioner.
+	FailoverEndpoints []Endpoint
+
+	// Retry, if set, retries failed uploads of the input and downloads of the response
+	// with exponential backoff.
+	Retry *RetryOptions
+
+	// Events, if set, receives an EventResponseDownloaded or EventError per request.
+	Events *EventBus
+
+	// SlowTransfer, if set, warns about slow request uploads and response downloads.
+	// The throughput of all transfers is available in ClientStats.
+	SlowTransfer *SlowTransferOptions
+
+	// CircuitBreaker, if set, fails requests fast with ErrUnavailable after repeated
+	// AWS failures against an endpoint, instead of waiting for ResponseWaitTimeout.
+	CircuitBreaker *CircuitBreakerOptions
+
+	// DatePartitions, if set, puts requests and their responses under a date prefix,
+	// e.g. to_server/<op>/<yyyy>/<mm>/<dd>/<id>_<filename>, so listings of the bucket
+	// can be limited to a day, see Admin.ListPendingOn.
+	// Servers handle keys with and without date partitions.
+	DatePartitions bool
+
+	// Identity identifies the caller in every request, see WithIdentity for per-request identities.
+	Identity Identity
+
+	// EncryptMetadata, if set, encrypts sensitive metadata values with KMS before upload.
+	EncryptMetadata *EncryptMetadataOptions
+
+	// Signing, if set, signs the requests, see ServerOptions.Signatures.
+	Signing *SigningOptions
+
+	// AccessLog, if set, is called with an AccessRecord once per completed Execute.
+	// It is called synchronously, so it should not block.
+	AccessLog func(r AccessRecord)
+
+	// ResponseSignatures, if set, verifies the signatures of responses from servers with
+	// ServerOptions.ResponseSigning, detecting responses written by anyone else with
+	// write access to the bucket. Execute returns an error wrapping ErrInvalidSignature
+	// for responses that do not verify.
+	ResponseSignatures *SignatureOptions
+
+	// IDGenerator generates the request IDs.
+	// Defaults to NewUUIDv7. See WithRequestID for caller-supplied IDs.
+	IDGenerator IDGenerator
+
+	// Journal, if set, enables Submit, which journals requests locally so they can be
+	// submitted while offline, and executes them in the background.
+	Journal *JournalOptions
+
 	// The AWS config.
 	AWSConfig
 }
 
-func (opts *ClientOptions) init() error {
-	if opts.Region == "" {
-		opts.Region = defaultRegion
+// clientTimeouts are the timeouts of the phases of Execute.
+// Zero means no timeout, except for responseWait which is always set.
+type clientTimeouts struct {
+	upload       time.Duration
+	responseWait time.Duration
+	download     time.Duration
+	total        time.Duration
+}
+
+// timeoutsFor returns the timeouts for op, with the overrides in ClientOptions.Ops applied.
+func (c *Client) timeoutsFor(op string) clientTimeouts {
+	t := c.timeouts
+	o := c.ops[op]
+	if o.ResponseWaitTimeout != 0 {
+		t.responseWait = o.ResponseWaitTimeout
+	}
+	if o.TotalTimeout != 0 {
+		t.total = o.TotalTimeout
+	}
+	return t
+}
+
+// withOptionalTimeout is context.WithTimeout, unless d is zero.
+func withOptionalTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d == 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Endpoint is a bucket and queue in a region.
+type Endpoint struct {
+	Region string
+	Bucket string
+
+	// The queue to listen for responses from server.
+	Queue string
 
+	// SubmitQueue is the server's queue, see ClientOptions.SubmitQueue.
+	SubmitQueue string
+}
+
+func (opts *ClientOptions) init() error {
 	if opts.AccessKeyID == "" {
 		return errors.New("access key id is required")
 	}
@@ -185,9 +869,111 @@ func (opts *ClientOptions) init() error {
 		return errors.New("secret access key is required")
 	}
 
-	if opts.Queue == "" {
+	if opts.ResponsePollInterval < 0 {
+		return errors.New("response poll interval can not be negative")
+	}
+
+	if opts.ResponseQueues != nil {
+		if !opts.DirectSubmit {
+			return errors.New("response queues require direct submit")
+		}
+		if opts.ResponsePollInterval != 0 {
+			return errors.New("response queues can not be used with response polling")
+		}
+	} else if opts.Queue == "" && opts.ResponsePollInterval == 0 {
 		return fmt.Errorf("queue is required")
 	}
 
-	return nil
+	for _, ep := range opts.FailoverEndpoints {
+		if ep.Region == "" || ep.Bucket == "" || (ep.Queue == "" && opts.ResponsePollInterval == 0) {
+			return fmt.Errorf("failover endpoint %v: region, bucket and queue are required", ep)
+		}
+		if opts.DirectSubmit && ep.SubmitQueue == "" {
+			return fmt.Errorf("failover endpoint %v: submit queue is required with direct submit", ep)
+		}
+	}
+
+	if opts.DirectSubmit && opts.SubmitQueue == "" {
+		return errors.New("submit queue is required with direct submit")
+	}
+
+	if opts.ObjectLock != nil {
+		if err := opts.ObjectLock.init(); err != nil {
+			return err
+		}
+	}
+
+	if err := initMetadataSchemas(opts.MetadataSchemas); err != nil {
+		return err
+	}
+
+	for op, o := range opts.Ops {
+		if err := o.validate(op); err != nil {
+			return err
+		}
+	}
+
+	if opts.MaxInFlight < 0 {
+		return errors.New("max in-flight can not be negative")
+	}
+
+	if opts.UploadTimeout < 0 || opts.ResponseWaitTimeout < 0 || opts.DownloadTimeout < 0 || opts.TotalTimeout < 0 || opts.Timeout < 0 {
+		return errors.New("timeouts can not be negative")
+	}
+
+	if opts.Retry != nil {
+		if err := opts.Retry.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.CircuitBreaker != nil {
+		if err := opts.CircuitBreaker.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.SlowTransfer != nil {
+		if err := opts.SlowTransfer.init(); err != nil {
+			return err
+		}
+	}
+
+	if err := opts.Identity.validate(); err != nil {
+		return err
+	}
+
+	if opts.EncryptMetadata != nil {
+		if err := opts.EncryptMetadata.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Signing != nil {
+		if err := opts.Signing.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.ResponseSignatures != nil {
+		if opts.ResponseSignatures.KeysInBucket {
+			return errors.New("response signatures: keys in bucket is not supported")
+		}
+		if err := opts.ResponseSignatures.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.IDGenerator == nil {
+		opts.IDGenerator = NewUUIDv7
+	}
+
+	if opts.Journal != nil {
+		if err := opts.Journal.init(); err != nil {
+			return err
+		}
+	}
+
+	// Resolve the region last, as it may need a network call.
+	return opts.resolveRegion(opts.Queue)
 }
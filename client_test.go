@@ -0,0 +1,128 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+func TestClientTimeouts(t *testing.T) {
+	c := qt.New(t)
+
+	newClient := func(opts ClientOptions) (*Client, error) {
+		opts.Queue = "https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue"
+		opts.AccessKeyID, opts.SecretAccessKey = "id", "secret"
+		client, err := NewClient(opts)
+		if err == nil {
+			c.Cleanup(func() { client.Close() })
+		}
+		return client, err
+	}
+
+	client, err := newClient(ClientOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.timeouts, qt.Equals, clientTimeouts{responseWait: 5 * time.Minute})
+
+	client, err = newClient(ClientOptions{Timeout: time.Minute, UploadTimeout: time.Hour, DownloadTimeout: 2 * time.Hour, TotalTimeout: 3 * time.Hour})
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.timeouts, qt.Equals, clientTimeouts{upload: time.Hour, responseWait: time.Minute, download: 2 * time.Hour, total: 3 * time.Hour})
+
+	_, err = newClient(ClientOptions{UploadTimeout: -1})
+	c.Assert(err, qt.ErrorMatches, "timeouts can not be negative")
+
+	ctx, cancel := withOptionalTimeout(context.Background(), 0)
+	_, hasDeadline := ctx.Deadline()
+	c.Assert(hasDeadline, qt.IsFalse)
+	cancel()
+	c.Assert(ctx.Err(), qt.Equals, context.Canceled)
+}
+
+func TestClientFailover(t *testing.T) {
+	c := qt.New(t)
+
+	primary, secondary := newFakeS3(), newFakeS3()
+	primary.fail, secondary.echo = true, true
+
+	var logged []string
+	opts := ClientOptions{
+		ResponsePollInterval: 10 * time.Millisecond,
+		FailoverEndpoints:    []Endpoint{{Region: "eu-west-1", Bucket: "secondary"}},
+		Infof: func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		},
+	}
+	opts.Region, opts.Bucket = "eu-north-1", "primary"
+	opts.AccessKeyID, opts.SecretAccessKey = "id", "secret"
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { client.Close() })
+	for i, ep := range append([]*common{client.common}, client.failover...) {
+		ep.s3Client = []*fakeS3{primary, secondary}[i].client(c)
+		ep.uploader = manager.NewUploader(ep.s3Client)
+	}
+
+	filename := filepath.Join(c.TempDir(), "input.txt")
+	c.Assert(os.WriteFile(filename, []byte("hello"), 0o644), qt.IsNil)
+
+	output, err := client.executeFailover(context.Background(), "echo", Input{Filename: filename})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "hello")
+	c.Assert(logged, qt.Any(qt.Matches), `Endpoint primary/ failed, failing over to secondary/: .*AccessDenied.*`)
+	// The request and response are removed.
+	c.Assert(secondary.objects, qt.HasLen, 0)
+
+	// The error from the last endpoint is returned.
+	secondary.fail = true
+	_, err = client.executeFailover(context.Background(), "echo", Input{Filename: filename})
+	var epErr *endpointError
+	c.Assert(errors.As(err, &epErr), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `apply: .*AccessDenied.*`)
+}
+
+type fakeResponseQueues struct {
+	created, deleted []string
+}
+
+func (q *fakeResponseQueues) CreateResponseQueue(ctx context.Context, id string) (string, error) {
+	url := "https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue_rq_" + id
+	q.created = append(q.created, url)
+	return url, nil
+}
+
+func (q *fakeResponseQueues) DeleteResponseQueue(ctx context.Context, queueURL string) error {
+	q.deleted = append(q.deleted, queueURL)
+	return nil
+}
+
+func TestClientResponseQueues(t *testing.T) {
+	c := qt.New(t)
+
+	queues := &fakeResponseQueues{}
+	opts := ClientOptions{ResponseQueues: queues, SubmitQueue: "https://sqs.eu-north-1.amazonaws.com/123456789012/squeue"}
+	opts.Region, opts.Bucket = "eu-north-1", "mybucket"
+	opts.AccessKeyID, opts.SecretAccessKey = "id", "secret"
+	_, err := NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, "response queues require direct submit")
+	c.Assert(queues.created, qt.HasLen, 0)
+
+	opts.DirectSubmit = true
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(queues.created, qt.HasLen, 1)
+	c.Assert(client.queue, qt.Equals, queues.created[0])
+	c.Assert(client.queue, qt.Matches, `.*/myqueue_rq_\d+-[0-9a-f]{8}`)
+
+	c.Assert(client.Close(), qt.IsNil)
+	c.Assert(client.Close(), qt.IsNil)
+	c.Assert(queues.deleted, qt.DeepEquals, queues.created)
+}
@@ -0,0 +1,247 @@
+// Command s3rpc-bench drives requests against an s3rpc deployment and reports
+// throughput, latency percentiles and the number of S3 and SQS calls made.
+//
+// The client (and, with -serve, the server) is configured with the environment
+// variables written by Provisioner.Create, see ProvisionResults.WriteDotenv.
+//
+//	s3rpc-bench -op echo -rate 5 -duration 1m -size 100000 -serve
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/bep/s3rpc"
+	"golang.org/x/sync/errgroup"
+)
+
+func main() {
+	var (
+		op          = flag.String("op", "echo", "the op to execute")
+		rate        = flag.Float64("rate", 1, "requests per second")
+		duration    = flag.Duration("duration", time.Minute, "how long to send requests")
+		size        = flag.Int("size", 1024, "payload size in bytes")
+		concurrency = flag.Int("concurrency", 10, "maximum number of outstanding requests")
+		timeout     = flag.Duration("timeout", 5*time.Minute, "client timeout per request")
+		serve       = flag.Bool("serve", false, "also run a server with an echo handler for -op")
+		verbose     = flag.Bool("v", false, "log client and server info messages")
+	)
+	flag.Parse()
+
+	if err := run(*op, *rate, *duration, *size, *concurrency, *timeout, *serve, *verbose); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(op string, rate float64, duration time.Duration, size, concurrency int, timeout time.Duration, serve, verbose bool) error {
+	if rate <= 0 || concurrency <= 0 {
+		return fmt.Errorf("rate and concurrency must be positive")
+	}
+
+	infof := func(format string, args ...interface{}) {}
+	if verbose {
+		infof = log.Printf
+	}
+
+	clientCalls, serverCalls := newCallCounter(), newCallCounter()
+
+	client, err := s3rpc.NewClient(s3rpc.ClientOptions{
+		Queue:               os.Getenv("S3RPC_CLIENT_QUEUE"),
+		ResponseWaitTimeout: timeout,
+		Infof:               infof,
+		AWSConfig: s3rpc.AWSConfig{
+			Region:          os.Getenv("S3RPC_REGION"),
+			Bucket:          os.Getenv("S3RPC_BUCKET"),
+			AccessKeyID:     os.Getenv("S3RPC_CLIENT_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3RPC_CLIENT_SECRET_ACCESS_KEY"),
+			APIOptions:      []func(*middleware.Stack) error{clientCalls.middleware},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var gServer errgroup.Group
+	if serve {
+		server, err := s3rpc.NewServer(s3rpc.ServerOptions{
+			Handlers: s3rpc.Handlers{
+				op: func(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+					return s3rpc.Output{Filename: input.Filename, Metadata: input.Metadata}, nil
+				},
+			},
+			Queue:          os.Getenv("S3RPC_SERVER_QUEUE"),
+			MaxConcurrency: concurrency,
+			Infof:          infof,
+			AWSConfig: s3rpc.AWSConfig{
+				Region:          os.Getenv("S3RPC_REGION"),
+				Bucket:          os.Getenv("S3RPC_BUCKET"),
+				AccessKeyID:     os.Getenv("S3RPC_SERVER_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("S3RPC_SERVER_SECRET_ACCESS_KEY"),
+				APIOptions:      []func(*middleware.Stack) error{serverCalls.middleware},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		gServer.Go(func() error {
+			return server.ListenAndServe(ctx)
+		})
+		defer func() {
+			server.Close()
+			gServer.Wait()
+		}()
+	}
+
+	tempDir, err := os.MkdirTemp("", "s3rpc-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := filepath.Join(tempDir, "payload.bin")
+	if err := writePayload(input, size); err != nil {
+		return err
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failed    int
+		sem       = make(chan struct{}, concurrency)
+		wg        sync.WaitGroup
+		ticker    = time.NewTicker(time.Duration(float64(time.Second) / rate))
+		deadline  = time.After(duration)
+		started   = time.Now()
+		skipped   int
+	)
+	defer ticker.Stop()
+
+	fmt.Printf("Sending %.1f req/s of %d bytes to %q for %s\n", rate, size, op, duration)
+
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			select {
+			case sem <- struct{}{}:
+			default:
+				// All requests still outstanding; the deployment is not keeping up.
+				skipped++
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				start := time.Now()
+				_, err := client.Execute(ctx, op, s3rpc.Input{Filename: input})
+				d := time.Since(start)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed++
+					infof("request failed: %s", err)
+					return
+				}
+				latencies = append(latencies, d)
+			}()
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	report(os.Stdout, elapsed, latencies, failed, skipped, size)
+	fmt.Println("\nClient calls:")
+	clientCalls.report(os.Stdout)
+	if serve {
+		fmt.Println("\nServer calls:")
+		serverCalls.report(os.Stdout)
+	}
+
+	return nil
+}
+
+func writePayload(filename string, size int) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(f, rand.Reader, int64(size))
+	return err
+}
+
+func report(w io.Writer, elapsed time.Duration, latencies []time.Duration, failed, skipped, size int) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	n := len(latencies)
+
+	fmt.Fprintf(w, "\nRequests:   %d ok, %d failed, %d skipped (concurrency limit reached)\n", n, failed, skipped)
+	fmt.Fprintf(w, "Throughput: %.2f req/s, %.2f KB/s\n", float64(n)/elapsed.Seconds(), float64(n*size)/1024/elapsed.Seconds())
+	if n == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Latency:    min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		latencies[0], percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[n-1])
+}
+
+// percentile returns the p'th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Millisecond)
+}
+
+// callCounter counts AWS API calls by service and operation.
+type callCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCallCounter() *callCounter {
+	return &callCounter{counts: make(map[string]int)}
+}
+
+func (c *callCounter) middleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("s3rpcBenchCallCounter",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			c.mu.Lock()
+			c.counts[awsmiddleware.GetServiceID(ctx)+" "+awsmiddleware.GetOperationName(ctx)]++
+			c.mu.Unlock()
+			return next.HandleInitialize(ctx, in)
+		},
+	), middleware.After)
+}
+
+func (c *callCounter) report(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %-30s %d\n", k, c.counts[k])
+	}
+}
@@ -0,0 +1,159 @@
+// Command s3rpc is an admin tool for s3rpc deployments.
+//
+// It uses the admin credentials in S3RPC_ADMIN_ACCESS_KEY_ID and S3RPC_ADMIN_ACCESS_KEY_SECRET
+// and the bucket and region in S3RPC_BUCKET and S3RPC_REGION.
+//
+// Usage:
+//
+//	s3rpc pending                   list the requests not yet picked up by a server
+//	s3rpc responses                 list the responses not yet picked up by a client
+//	s3rpc archived                  list the archived request inputs
+//	s3rpc replay <key>              re-enqueue an archived request input as a new request
+//	s3rpc purge <queue-url>         delete all messages in a queue
+//	s3rpc redrive [flags]           move messages from a dead-letter queue back to a queue
+//	s3rpc verify [flags] <name>     check the environment name against what the provisioner would create
+//
+// The verify command exits with a non-zero status if any problems are found.
+// Pass the options the environment was created with as a JSON encoded
+// s3rpc.ProvisionerOptions in the -options file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bep/s3rpc"
+)
+
+func main() {
+	log.SetFlags(0)
+	if err := run(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: s3rpc <pending|responses|archived|replay|purge|redrive|verify> [args]")
+	}
+
+	if args[0] == "verify" {
+		// This needs no bucket.
+		return verify(ctx, args[1:], w)
+	}
+
+	admin, err := s3rpc.NewAdmin(s3rpc.AdminOptions{
+		AWSConfig: s3rpc.AWSConfig{
+			Region:          os.Getenv("S3RPC_REGION"),
+			Bucket:          os.Getenv("S3RPC_BUCKET"),
+			AccessKeyID:     os.Getenv("S3RPC_ADMIN_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3RPC_ADMIN_ACCESS_KEY_SECRET"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "pending", "responses", "archived":
+		list := admin.ListPending
+		switch cmd {
+		case "responses":
+			list = admin.ListResponses
+		case "archived":
+			list = admin.ListArchived
+		}
+		infos, err := list(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tOP\tREQUEST ID\tFILENAME\tSIZE\tAGE")
+		for _, info := range infos {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", info.Key, info.Op, info.RequestID, info.Filename, info.Size, info.Age.Round(time.Second))
+		}
+		return tw.Flush()
+	case "replay":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: s3rpc replay <key>")
+		}
+		key, err := admin.Replay(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, key)
+		return nil
+	case "purge":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: s3rpc purge <queue-url>")
+		}
+		return admin.PurgeQueue(ctx, args[0])
+	case "redrive":
+		var opts s3rpc.RedriveOptions
+		fs := flag.NewFlagSet("redrive", flag.ContinueOnError)
+		fs.StringVar(&opts.From, "from", "", "the dead-letter queue URL")
+		fs.StringVar(&opts.To, "to", "", "the queue URL to move the messages to")
+		fs.StringVar(&opts.Op, "op", "", "only move requests for this op")
+		fs.DurationVar(&opts.MinAge, "min-age", 0, "only move requests at least this old")
+		fs.DurationVar(&opts.MaxAge, "max-age", 0, "only move requests at most this old")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		res, err := admin.Redrive(ctx, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Moved %d messages, skipped %d.\n", res.Moved, res.Skipped)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func verify(ctx context.Context, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	optionsFile := fs.String("options", "", "a JSON file with the provisioner options the environment was created with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: s3rpc verify [-options <file>] <name>")
+	}
+
+	var opts s3rpc.ProvisionerOptions
+	if *optionsFile != "" {
+		b, err := os.ReadFile(*optionsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &opts); err != nil {
+			return fmt.Errorf("failed to read options from %s: %w", *optionsFile, err)
+		}
+	}
+	opts.Name = fs.Arg(0)
+	if opts.Region == "" {
+		opts.Region = os.Getenv("S3RPC_REGION")
+	}
+
+	p, err := s3rpc.NewProvisionerWithOptions(opts)
+	if err != nil {
+		return err
+	}
+	res, err := p.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, res)
+	if !res.OK() {
+		return fmt.Errorf("found %d problems", len(res.Problems))
+	}
+	return nil
+}
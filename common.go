@@ -1,24 +1,38 @@
 package s3rpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go/middleware"
 )
 
 const (
-	toServer = "to_server"
-	toClient = "to_client"
+	toServer   = "to_server"
+	toClient   = "to_client"
+	archive    = "archive"
+	quarantine = "quarantine"
+	audit      = "audit"
 
 	defaultRegion = "eu-north-1"
 
@@ -27,11 +41,63 @@ const (
 	visibilitySeconds = 7
 )
 
+// Metadata keys set by s3rpc.
+// S3 lower cases all metadata keys, so these are all lower case.
+const (
+	// MetaInstanceID holds the ServerOptions.InstanceID of the server that handled the request.
+	MetaInstanceID = "s3rpc-instance-id"
+
+	// MetaCost holds the estimated AWS cost in USD of handling the request on the server.
+	// See ServerOptions.Pricing.
+	MetaCost = "s3rpc-cost"
+
+	// MetaErrorCode and MetaError hold the ResponseError code and message in an error response.
+	MetaErrorCode = "s3rpc-error-code"
+	MetaError     = "s3rpc-error"
+
+	// MetaRequestID and MetaOp hold the request ID and op a response answers.
+	MetaRequestID = "s3rpc-request-id"
+	MetaOp        = "s3rpc-op"
+
+	// MetaInputChecksum holds the hex encoded SHA-256 of the request input.
+	// It is set on requests with ClientOptions.VerifyResponses and echoed by the server
+	// with the checksum of the input it downloaded.
+	MetaInputChecksum = "s3rpc-input-sha256"
+
+	// MetaCallbackURL, if set on a request, is the URL the server POSTs a WebhookPayload to
+	// when the request finishes, see ServerOptions.Webhooks.
+	MetaCallbackURL = "s3rpc-callback-url"
+
+	// MetaTaskToken, if set on a request, is the Step Functions task token the server
+	// completes when the request finishes, see ServerOptions.StepFunctions.
+	MetaTaskToken = "s3rpc-task-token"
+
+	// MetaContentEncoding is set to "gzip" on compressed request inputs and responses,
+	// see ClientOpOptions.Compress and OpOptions.Compress.
+	MetaContentEncoding = "s3rpc-content-encoding"
+)
+
 type AWSConfig struct {
-	Region          string
+	// Region is the AWS region.
+	// If not set, it is detected from the queue URL or the bucket location.
+	Region string
+
+	// UseDefaultRegion, if set, falls back to eu-north-1 if Region is not set
+	// and could not be detected.
+	UseDefaultRegion bool
+
 	Bucket          string
 	AccessKeyID     string
 	SecretAccessKey string
+
+	// ExpectedBucketOwner, if set, is the ID of the AWS account expected to own Bucket.
+	// It is set on all S3 calls, which S3 rejects with 403 Access Denied if the bucket
+	// is owned by another account, e.g. a similarly named bucket.
+	// NewAdmin also checks the owner on startup.
+	ExpectedBucketOwner string
+
+	// APIOptions are added to the AWS SDK clients, e.g. middleware for metrics or tracing.
+	APIOptions []func(*middleware.Stack) error
 }
 
 type common struct {
@@ -40,22 +106,68 @@ type common struct {
 	bucket string
 	queue  string
 
+	// submitQueue is the server queue requests are sent to, if set, see ClientOptions.SubmitQueue.
+	submitQueue string
+
+	// directSubmit is set on servers that only accept messages sent by clients,
+	// see ServerOptions.DirectSubmit.
+	directSubmit bool
+
 	s3Client  *s3.Client
 	sqsClient *sqs.Client
+	uploader  *manager.Uploader
+
+	// dictionaries caches the compression dictionaries, see ClientOpOptions.Dictionary.
+	dictionaries *dictionaryCache
 
 	closeOnce sync.Once
 
 	infof func(format string, args ...interface{})
+
+	// logger is set if logging JSON.
+	logger *JSONLogger
+
+	objectLock *ObjectLockOptions
+
+	// transfers records the throughput of uploads and downloads, nil if not tracked.
+	transfers *transferMonitor
+}
+
+func newCommon(awsCfg aws.Config, bucket, queue, tempDir string, infof func(format string, args ...interface{}), logger *JSONLogger) *common {
+	awsCfg.APIOptions = append(append([]func(*middleware.Stack) error(nil), awsCfg.APIOptions...), addUsageMiddleware)
+	s3Client := s3.NewFromConfig(awsCfg)
+	c := &common{
+		bucket:    bucket,
+		queue:     queue,
+		s3Client:  s3Client,
+		sqsClient: sqs.NewFromConfig(awsCfg),
+		uploader:  manager.NewUploader(s3Client),
+		tempDir:   tempDir,
+		infof:     infof,
+		logger:    logger,
+	}
+	c.dictionaries = newDictionaryCache(c.fetchDictionary)
+	return c
 }
 
 func (c *common) Receive(ctx context.Context) ([]message, error) {
+	return c.receive(ctx, 5, maxPollWait)
+}
+
+// receive receives up to max messages (at most 10),
+// waiting up to wait (rounded to seconds) for a message to arrive.
+func (c *common) receive(ctx context.Context, max int, wait time.Duration) ([]message, error) {
+	if max > 10 {
+		max = 10
+	}
 	result, err := c.sqsClient.ReceiveMessage(ctx,
 		&sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(c.queue),
-			MaxNumberOfMessages: 5,
-			VisibilityTimeout:   visibilitySeconds,
-			// Wait for 20 seconds for a message to arrive.
-			WaitTimeSeconds: 20,
+			QueueUrl:              aws.String(c.queue),
+			MaxNumberOfMessages:   int32(max),
+			VisibilityTimeout:     visibilitySeconds,
+			WaitTimeSeconds:       int32(wait / time.Second),
+			MessageAttributeNames: []string{"s3rpc-.*"},
+			AttributeNames:        []sqstypes.QueueAttributeName{sqstypes.QueueAttributeName(sqstypes.MessageSystemAttributeNameSentTimestamp)},
 		},
 	)
 
@@ -65,25 +177,63 @@ func (c *common) Receive(ctx context.Context) ([]message, error) {
 
 	var messages []message
 	for _, m := range result.Messages {
-		var messageBody messageBody
-		err := json.Unmarshal([]byte(*m.Body), &messageBody)
+		if c.directSubmit {
+			msg, ok := parseSubmitMessage(m)
+			if !ok {
+				// Most likely an S3 event notification, which would otherwise be handled twice.
+				c.infof("Deleting message %s without request attributes from %q", aws.ToString(m.MessageId), c.queue)
+				if err := c.deleteMessage(ctx, aws.ToString(m.ReceiptHandle)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			msg.MessageID = aws.ToString(m.MessageId)
+			messages = append(messages, msg)
+			continue
+		}
+		msg, ok, err := parseSQSMessage(m)
 		if err != nil {
 			return nil, err
 		}
-		if len(messageBody.Records) == 0 {
+		if !ok {
 			continue
 		}
-		if len(messageBody.Records) > 1 {
-			return nil, fmt.Errorf("expected only one record, got %d", len(messageBody.Records))
-		}
-
-		s3 := messageBody.Records[0].S3
-		messages = append(messages, message{Bucket: s3.Bucket.Name, Key: s3.Object.Key, ReceiptHandle: *m.ReceiptHandle})
+		msg.MessageID = aws.ToString(m.MessageId)
+		messages = append(messages, msg)
 	}
 
 	return messages, nil
 }
 
+// parseMessage parses an S3 event notification.
+// It returns false if the body has no records, e.g. the s3:TestEvent.
+func parseMessage(body, receiptHandle string) (message, bool, error) {
+	var messageBody messageBody
+	err := json.Unmarshal([]byte(body), &messageBody)
+	if err != nil {
+		return message{}, false, err
+	}
+	if len(messageBody.Records) == 0 {
+		return message{}, false, nil
+	}
+	if len(messageBody.Records) > 1 {
+		return message{}, false, fmt.Errorf("expected only one record, got %d", len(messageBody.Records))
+	}
+
+	r := messageBody.Records[0]
+	info, _ := parseRequestKey(r.S3.Object.Key)
+	return message{
+		Bucket:        r.S3.Bucket.Name,
+		Key:           r.S3.Object.Key,
+		Op:            info.Op,
+		RequestID:     info.RequestID,
+		ReceiptHandle: receiptHandle,
+		EventTime:     r.EventTime,
+		Principal:     r.UserIdentity.PrincipalID,
+		SourceIP:      r.RequestParameters.SourceIPAddress,
+	}, true, nil
+}
+
 func (c *common) deleteMessage(ctx context.Context, receiptHandle string) error {
 	//c.infof("Delete message from %q", c.queue)
 	_, err := c.sqsClient.DeleteMessage(
@@ -98,6 +248,9 @@ func (c *common) deleteMessage(ctx context.Context, receiptHandle string) error
 }
 
 func (c *common) deleteObject(ctx context.Context, key string) error {
+	if c.objectLock.skipDeletes() {
+		return nil
+	}
 	//c.infof("Delete %s/%s", c.bucket, key)
 	_, err := c.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(c.bucket),
@@ -106,8 +259,10 @@ func (c *common) deleteObject(ctx context.Context, key string) error {
 	return err
 }
 
-func (c *common) getObject(ctx context.Context, f *os.File, key string) (map[string]string, error) {
-	c.infof("Downloading %s/%s", c.bucket, key)
+// getObject downloads the object with the given key to w and returns its metadata and content type.
+// Compressed objects are decompressed, see MetaContentEncoding.
+func (c *common) getObject(ctx context.Context, w io.Writer, key string) (map[string]string, string, error) {
+	c.logf(ctx, "Downloading %s/%s", c.bucket, key)
 	o, err := c.s3Client.GetObject(
 		ctx,
 		&s3.GetObjectInput{
@@ -116,61 +271,298 @@ func (c *common) getObject(ctx context.Context, f *os.File, key string) (map[str
 		},
 	)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer o.Body.Close()
-	_, err = io.Copy(f, o.Body)
+	metadata := decodeMetadata(o.Metadata)
+	body, err := decompressBody(ctx, o.Body, metadata, c.dictionaries)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	started := time.Now()
+	n, err := copyBuffered(w, body)
+	if err != nil {
+		return nil, "", err
+	}
+	if body != o.Body {
+		// Count the bytes transferred, not the decompressed bytes.
+		n = o.ContentLength
 	}
-	return o.Metadata, nil
+	c.transfers.observe(ctx, c, TransferDownload, key, n, time.Since(started))
+	return metadata, aws.ToString(o.ContentType), nil
 
 }
 
+// headObject returns the metadata of the object with the given key.
+func (c *common) headObject(ctx context.Context, key string) (map[string]string, error) {
+	o, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(o.Metadata), nil
+}
+
 func (c *common) releaseMessage(ctx context.Context, receiptHandle string) error {
 	//c.infof("Release message from %q", c.queue)
+	return c.changeMessageVisibility(ctx, receiptHandle, 0)
+}
+
+// changeMessageVisibility makes the message visible to other consumers after d.
+func (c *common) changeMessageVisibility(ctx context.Context, receiptHandle string, d time.Duration) error {
 	_, err := c.sqsClient.ChangeMessageVisibility(
 		ctx,
 		&sqs.ChangeMessageVisibilityInput{
 			QueueUrl:          aws.String(c.queue),
 			ReceiptHandle:     aws.String(receiptHandle),
-			VisibilityTimeout: 0,
+			VisibilityTimeout: int32(d.Seconds()),
 		},
 	)
 	return err
 }
 
-func (c *common) upload(filename, key string, metaData map[string]string) error {
+// upload uploads filename to key.
+// If contentType is empty, it is detected from the filename extension or content.
+// If storageClass is empty, the bucket's default storage class applies.
+func (c *common) upload(ctx context.Context, filename, key, contentType, storageClass string, metaData map[string]string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	c.infof("Uploading %s to %s/%s", filename, c.bucket, key)
+	if contentType == "" {
+		if contentType, err = detectContentType(filename); err != nil {
+			return err
+		}
+	}
+
+	c.logf(ctx, "Uploading %s to %s/%s", filename, c.bucket, key)
 
-	metaDatap := make(map[string]*string)
-	for k, v := range metaData {
-		metaDatap[k] = aws.String(v)
+	// The uploader reads the parts directly from the file, so there is no extra buffering.
+	in := &s3.PutObjectInput{
+		Bucket:      aws.String(c.bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String(contentType),
+		Metadata:    encodeMetadata(metaData),
 	}
+	if storageClass != "" {
+		in.StorageClass = types.StorageClass(storageClass)
+	}
+	c.objectLock.apply(in)
+	started := time.Now()
+	_, err = c.uploader.Upload(ctx, in, uploadOptions(ctx)...)
 
-	_, err = manager.NewUploader(c.s3Client).Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:   aws.String(c.bucket),
-		Key:      aws.String(key),
-		Body:     file,
-		Metadata: metaData,
+	if err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+	if fi, err := file.Stat(); err == nil {
+		c.transfers.observe(ctx, c, TransferUpload, key, fi.Size(), time.Since(started))
+	}
+	return nil
+}
+
+// detectContentType returns the MIME type for the filename extension, if known,
+// else the type sniffed from its first 512 bytes by http.DetectContentType.
+func detectContentType(filename string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+		return contentType, nil
+	}
+	return sniffContentType(filename)
+}
+
+func sniffContentType(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(b[:n]), nil
+}
+
+// maxTempNameLen is the max length in bytes of the key part of temp file names,
+// well within the 255 bytes most file systems allow, so long keys don't exceed path limits.
+const maxTempNameLen = 100
+
+// createTemp creates a temp file in dir named after the base name of key.
+func createTemp(dir, key string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, "*_"+safeFilename(path.Base(key)))
+	if err != nil {
+		return nil, fmt.Errorf("tempfile: %w", err)
+	}
+	return f, nil
+}
+
+// safeFilename replaces characters that are invalid in filenames on any common OS,
+// such as ':' on Windows, and shortens long names, keeping the extension.
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 32, r == utf8.RuneError, strings.ContainsRune(`<>:"/\|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows does not allow names ending in a dot or space.
+	name = strings.TrimRight(name, ". ")
+
+	if len(name) > maxTempNameLen {
+		ext := path.Ext(name)
+		if len(ext) > maxTempNameLen/2 {
+			ext = ""
+		}
+		base := name[:maxTempNameLen-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+	return name
+}
+
+// copyBufferSize is the size of the buffers used to stream object bodies to disk.
+const copyBufferSize = 64 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffered is io.Copy using a pooled buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(b)
+	// Hide any ReadFrom/WriteTo implementations (e.g. *os.File's),
+	// which would otherwise allocate their own buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *b)
+}
+
+// newRequestID returns a new unique request ID.
+func newRequestID() string {
+	return NewUUIDv7()
+}
+
+// copyObject copies the object at from to to within the bucket, including its metadata.
+func (c *common) copyObject(ctx context.Context, from, to string) error {
+	_, err := c.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(c.bucket),
+		CopySource: aws.String(copySource(c.bucket, from)),
+		Key:        aws.String(to),
 	})
+	return err
+}
+
+// copySource returns the URL-encoded bucket/key for CopyObject.
+func copySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
 
+// uploadBytes uploads b to key.
+func (c *common) uploadBytes(ctx context.Context, key string, b []byte, metaData map[string]string) error {
+	c.logf(ctx, "Uploading %d bytes to %s/%s", len(b), c.bucket, key)
+	in := &s3.PutObjectInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(b),
+		Metadata: encodeMetadata(metaData),
+	}
+	c.objectLock.apply(in)
+	_, err := c.s3Client.PutObject(ctx, in)
 	if err != nil {
 		return fmt.Errorf("upload: %v", err)
 	}
 	return nil
 }
 
+// responseKey returns the key of the response to the request with the given key.
+// The client uses the request ID in the base name to identify the response,
+// so we need to preserve that, and the date partition, if any.
+func responseKey(op, key string) string {
+	if info, ok := parseRequestKey(key); ok && !info.Date.IsZero() {
+		return requestKeyIn(toClient, op, info.RequestID, info.Filename, info.Date)
+	}
+	return toClient + "/" + op + "/" + path.Base(key)
+}
+
+// datePartitionLayout is the layout of the date partition of keys, see ClientOptions.DatePartitions.
+const datePartitionLayout = "2006/01/02"
+
+// requestKey returns the key of a new request, on the form to_server/<op>/<id>_<filename>,
+// or to_server/<op>/<yyyy>/<mm>/<dd>/<id>_<filename> if date is set.
+func requestKey(op, id, filename string, date time.Time) string {
+	return requestKeyIn(toServer, op, id, filename, date)
+}
+
+func requestKeyIn(prefix, op, id, filename string, date time.Time) string {
+	if date.IsZero() {
+		return fmt.Sprintf("%s/%s/%s_%s", prefix, op, id, filename)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s_%s", prefix, op, date.UTC().Format(datePartitionLayout), id, filename)
+}
+
+// parseRequestKey parses a key on the form <prefix>/<op>/<id>_<filename>
+// or <prefix>/<op>/<yyyy>/<mm>/<dd>/<id>_<filename>.
+func parseRequestKey(key string) (RequestInfo, bool) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return RequestInfo{}, false
+	}
+	name := parts[2]
+	var date time.Time
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		var err error
+		if date, err = time.Parse(datePartitionLayout, name[:i]); err != nil {
+			return RequestInfo{}, false
+		}
+		name = name[i+1:]
+	}
+	id, filename, ok := strings.Cut(name, "_")
+	if !ok || id == "" {
+		return RequestInfo{}, false
+	}
+	return RequestInfo{Key: key, Op: parts[1], RequestID: id, Filename: filename, Date: date}, true
+}
+
 type message struct {
 	Bucket        string
 	Key           string
 	ReceiptHandle string
+
+	// MessageID is the SQS message ID, which is the same for redeliveries of the message.
+	MessageID string
+
+	// Op and RequestID identify the request.
+	// They are empty if Key is not a request key.
+	Op        string
+	RequestID string
+
+	// ReplyQueue is the queue to send the response message to, see AttrReplyQueue.
+	ReplyQueue string
+
+	// Attempt is the attempt of a request the server sent back to its queue, see AttrAttempt.
+	// It is 0 for the first.
+	Attempt int
+
+	// EventTime is when the object was created.
+	EventTime time.Time
+
+	// Principal and SourceIP identify who uploaded the object.
+	Principal string
+	SourceIP  string
 }
 
 type messageBody struct {
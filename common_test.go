@@ -0,0 +1,106 @@
+package s3rpc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCopyBuffered(t *testing.T) {
+	c := qt.New(t)
+
+	content := strings.Repeat("abcdefgh", copyBufferSize/4)
+	f, err := os.Create(filepath.Join(c.TempDir(), "out.txt"))
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+
+	n, err := copyBuffered(f, strings.NewReader(content))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(len(content)))
+
+	b, err := os.ReadFile(f.Name())
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, content)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _ = f.Seek(0, 0)
+		_, _ = copyBuffered(f, strings.NewReader(content))
+	})
+	c.Assert(allocs < 10, qt.IsTrue, qt.Commentf("allocs: %v", allocs))
+}
+
+func BenchmarkCopyBuffered(b *testing.B) {
+	content := strings.Repeat("a", 100*1024)
+	f, err := os.Create(filepath.Join(b.TempDir(), "out.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, 0); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := copyBuffered(f, strings.NewReader(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	c := qt.New(t)
+
+	dir := c.TempDir()
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"doc.pdf", "not really a pdf", "application/pdf"},
+		{"image", "\x89PNG\x0D\x0A\x1A\x0A", "image/png"},
+		{"data", "hello", "text/plain; charset=utf-8"},
+	} {
+		filename := filepath.Join(dir, test.name)
+		c.Assert(os.WriteFile(filename, []byte(test.content), 0o644), qt.IsNil)
+		contentType, err := detectContentType(filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(contentType, qt.Equals, test.expected)
+	}
+}
+
+func TestSafeFilename(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(safeFilename("01gcabc_my image.jpg"), qt.Equals, "01gcabc_my image.jpg")
+	c.Assert(safeFilename(`a:b<c>d"e|f?g*h\i.txt`), qt.Equals, "a_b_c_d_e_f_g_h_i.txt")
+	c.Assert(safeFilename("tab\there.txt. "), qt.Equals, "tab_here.txt")
+	c.Assert(safeFilename("blåbær.txt"), qt.Equals, "blåbær.txt")
+
+	long := safeFilename(strings.Repeat("ø", 100) + ".jpeg")
+	c.Assert(len(long) <= maxTempNameLen, qt.IsTrue)
+	c.Assert(strings.HasSuffix(long, "ø.jpeg"), qt.IsTrue)
+
+	f, err := createTemp(c.TempDir(), "to_server/resize/01gcabc_"+strings.Repeat("a:", 200)+".png")
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	c.Assert(filepath.Ext(f.Name()), qt.Equals, ".png")
+}
+
+func TestParseMessage(t *testing.T) {
+	c := qt.New(t)
+
+	body := `{"Records":[{"eventTime":"2022-09-12T09:00:00Z","userIdentity":{"principalId":"AWS:AIDAEXAMPLE"},"requestParameters":{"sourceIPAddress":"192.0.2.1"},"s3":{"bucket":{"name":"mybucket"},"object":{"key":"to_server/resize/01gcabc_image.jpg"}}}]}`
+	m, ok, err := parseMessage(body, "rh")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(m.Key, qt.Equals, "to_server/resize/01gcabc_image.jpg")
+	c.Assert(m.Op, qt.Equals, "resize")
+	c.Assert(m.RequestID, qt.Equals, "01gcabc")
+	c.Assert(m.Principal, qt.Equals, "AWS:AIDAEXAMPLE")
+	c.Assert(m.SourceIP, qt.Equals, "192.0.2.1")
+}
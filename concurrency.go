@@ -0,0 +1,273 @@
+package s3rpc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdaptiveConcurrencyOptions configures the server to vary the number of requests
+// handled concurrently between 1 and ServerOptions.MaxConcurrency.
+//
+// The concurrency is increased by one while the server is saturated and the host is healthy,
+// and decreased by a quarter when handler latency grows or the host is under CPU or memory pressure.
+type AdaptiveConcurrencyOptions struct {
+	// MaxCPU is the host CPU usage (0-1) above which concurrency is decreased.
+	// Defaults to 0.9.
+	MaxCPU float64
+
+	// MaxMemory is the fraction of host memory in use (0-1) above which concurrency is decreased.
+	// Defaults to 0.85.
+	MaxMemory float64
+
+	// LatencyTolerance is how many times slower than the fastest observed
+	// handler invocation (per op) requests may get before concurrency is decreased.
+	// Defaults to 2.
+	LatencyTolerance float64
+
+	// Interval is the minimum interval between adjustments.
+	// Defaults to 1 second.
+	Interval time.Duration
+}
+
+func (opts *AdaptiveConcurrencyOptions) init() error {
+	if opts.MaxCPU == 0 {
+		opts.MaxCPU = 0.9
+	}
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = 0.85
+	}
+	if opts.LatencyTolerance == 0 {
+		opts.LatencyTolerance = 2
+	}
+	if opts.Interval == 0 {
+		opts.Interval = time.Second
+	}
+	if opts.MaxCPU > 1 || opts.MaxMemory > 1 || opts.LatencyTolerance < 1 {
+		return fmt.Errorf("adaptive concurrency: invalid options %+v", *opts)
+	}
+	return nil
+}
+
+// hostLoad is the CPU and memory usage of the host, both 0-1.
+// A negative value means unknown.
+type hostLoad struct {
+	cpu    float64
+	memory float64
+}
+
+// limiter limits the number of requests handled concurrently.
+type limiter struct {
+	maxLimit int
+	adaptive *AdaptiveConcurrencyOptions
+	freed    chan struct{}
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+
+	// Adaptive state.
+	minLatency   map[string]time.Duration
+	latencyRatio float64
+	lastAdjust   time.Time
+	cpu          cpuSampler
+}
+
+func newLimiter(maxLimit int, adaptive *AdaptiveConcurrencyOptions) *limiter {
+	l := &limiter{
+		maxLimit:   maxLimit,
+		adaptive:   adaptive,
+		freed:      make(chan struct{}, 1),
+		limit:      maxLimit,
+		minLatency: make(map[string]time.Duration),
+	}
+	if adaptive != nil {
+		l.limit = 1
+		l.lastAdjust = time.Now()
+	}
+	return l
+}
+
+// wait blocks until a slot is available or quit is closed.
+// It returns the number of available slots.
+func (l *limiter) wait(quit <-chan struct{}) int {
+	return l.waitFor(quit, 0)
+}
+
+// waitFor is wait that also gives up after d, if d > 0, returning 0.
+func (l *limiter) waitFor(quit <-chan struct{}, d time.Duration) int {
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		if n := l.available(); n > 0 {
+			return n
+		}
+		select {
+		case <-quit:
+			return 0
+		case <-timeout:
+			return 0
+		case <-l.freed:
+		}
+	}
+}
+
+func (l *limiter) available() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit - l.inFlight
+}
+
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	l.inFlight++
+	l.mu.Unlock()
+}
+
+// release frees a slot after handling a request for op that took latency.
+func (l *limiter) release(op string, latency time.Duration) {
+	l.mu.Lock()
+	l.inFlight--
+	if l.adaptive != nil {
+		l.observe(op, latency)
+		if time.Since(l.lastAdjust) >= l.adaptive.Interval {
+			l.adjust(hostLoad{cpu: l.cpu.sample(), memory: memoryUsage()})
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.freed <- struct{}{}:
+	default:
+	}
+}
+
+func (l *limiter) currentLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// observe records the latency of a request, relative to the fastest seen for op.
+// l.mu must be held.
+func (l *limiter) observe(op string, latency time.Duration) {
+	if latency <= 0 {
+		latency = 1
+	}
+	fastest, found := l.minLatency[op]
+	if !found || latency < fastest {
+		fastest = latency
+		l.minLatency[op] = fastest
+	}
+	ratio := float64(latency) / float64(fastest)
+	if l.latencyRatio == 0 {
+		l.latencyRatio = ratio
+	} else {
+		// Exponentially weighted moving average.
+		l.latencyRatio = 0.8*l.latencyRatio + 0.2*ratio
+	}
+}
+
+// adjust grows or shrinks the limit.
+// l.mu must be held.
+func (l *limiter) adjust(load hostLoad) {
+	l.lastAdjust = time.Now()
+	opts := l.adaptive
+
+	if load.cpu > opts.MaxCPU || load.memory > opts.MaxMemory || l.latencyRatio > opts.LatencyTolerance {
+		l.limit -= (l.limit + 3) / 4
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		return
+	}
+
+	// Only grow when all slots were in use before this release.
+	if l.inFlight+1 >= l.limit && l.limit < l.maxLimit {
+		l.limit++
+	}
+}
+
+// cpuSampler measures host CPU usage between calls to sample.
+type cpuSampler struct {
+	idle, total uint64
+}
+
+// sample returns the CPU usage since the previous call, or -1 if not known.
+func (s *cpuSampler) sample() float64 {
+	idle, total, err := readProcStat()
+	if err != nil {
+		return -1
+	}
+	prevIdle, prevTotal := s.idle, s.total
+	s.idle, s.total = idle, total
+	if prevTotal == 0 || total <= prevTotal {
+		return -1
+	}
+	return 1 - float64(idle-prevIdle)/float64(total-prevTotal)
+}
+
+// readProcStat reads the aggregated CPU times from /proc/stat (Linux only).
+func readProcStat() (idle, total uint64, err error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat format")
+	}
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += v
+		// idle and iowait.
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return idle, total, nil
+}
+
+// memoryUsage returns the fraction of host memory in use (Linux only), or -1 if not known.
+func memoryUsage() float64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	var total, available float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if total == 0 || available == 0 {
+		return -1
+	}
+	return 1 - available/total
+}
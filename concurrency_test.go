@@ -0,0 +1,85 @@
+package s3rpc
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestLimiter(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Fixed", func(c *qt.C) {
+		l := newLimiter(2, nil)
+		c.Assert(l.wait(nil), qt.Equals, 2)
+		l.acquire()
+		l.acquire()
+		c.Assert(l.available(), qt.Equals, 0)
+		l.release("op", time.Second)
+		c.Assert(l.wait(nil), qt.Equals, 1)
+		c.Assert(l.currentLimit(), qt.Equals, 2)
+	})
+
+	c.Run("Adaptive", func(c *qt.C) {
+		opts := &AdaptiveConcurrencyOptions{}
+		c.Assert(opts.init(), qt.IsNil)
+		l := newLimiter(4, opts)
+		c.Assert(l.currentLimit(), qt.Equals, 1)
+
+		healthy := hostLoad{cpu: 0.5, memory: 0.5}
+		saturate := func() {
+			for l.inFlight+1 < l.limit {
+				l.inFlight++
+			}
+		}
+
+		// Grows while saturated and healthy.
+		for i := 0; i < 10; i++ {
+			saturate()
+			l.observe("op", time.Second)
+			l.adjust(healthy)
+		}
+		c.Assert(l.limit, qt.Equals, 4)
+
+		// Does not grow when not saturated.
+		l.limit, l.inFlight = 3, 0
+		l.adjust(healthy)
+		c.Assert(l.limit, qt.Equals, 3)
+
+		// Shrinks under pressure.
+		l.limit = 4
+		l.adjust(hostLoad{cpu: 0.95, memory: 0.5})
+		c.Assert(l.limit, qt.Equals, 3)
+		l.adjust(hostLoad{cpu: 0.5, memory: 0.9})
+		c.Assert(l.limit, qt.Equals, 2)
+
+		// Shrinks when latency grows.
+		for i := 0; i < 10; i++ {
+			l.observe("op", 5*time.Second)
+		}
+		l.adjust(healthy)
+		l.adjust(healthy)
+		c.Assert(l.limit, qt.Equals, 1)
+
+		// Unknown load is ignored.
+		l.latencyRatio = 1
+		l.inFlight = 0
+		l.adjust(hostLoad{cpu: -1, memory: -1})
+		c.Assert(l.limit, qt.Equals, 2)
+	})
+
+	c.Assert((&AdaptiveConcurrencyOptions{MaxCPU: 2}).init(), qt.IsNotNil)
+}
+
+func BenchmarkLimiter(b *testing.B) {
+	l := newLimiter(4, &AdaptiveConcurrencyOptions{MaxCPU: 0.9, MaxMemory: 0.85, LatencyTolerance: 2, Interval: time.Hour})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.wait(nil)
+		l.acquire()
+		l.release("op", time.Millisecond)
+	}
+}
@@ -0,0 +1,293 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Control commands, see ControlMessage.
+const (
+	// ControlPause makes the server stop picking up new requests.
+	// Requests already being handled are completed.
+	ControlPause = "pause"
+
+	// ControlResume resumes a paused server.
+	ControlResume = "resume"
+
+	// ControlReloadHandlers replaces the handlers with the ones returned from ServerOptions.ReloadHandlers.
+	ControlReloadHandlers = "reload-handlers"
+
+	// ControlCancel cancels the request with ControlMessage.RequestID.
+	// A request being handled gets its context cancelled and no response is sent;
+	// a request not yet picked up is dropped.
+	ControlCancel = "cancel"
+)
+
+// ControlMessage is an admin command sent to servers on ServerOptions.ControlQueue.
+type ControlMessage struct {
+	// Command is one of the Control* constants.
+	Command string `json:"command"`
+
+	// RequestID is the request to cancel for ControlCancel.
+	RequestID string `json:"request_id,omitempty"`
+
+	// InstanceID, if set, targets a single server instance.
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+func (m ControlMessage) validate() error {
+	switch m.Command {
+	case ControlPause, ControlResume, ControlReloadHandlers:
+	case ControlCancel:
+		if m.RequestID == "" {
+			return errors.New("cancel: request ID is required")
+		}
+	default:
+		return fmt.Errorf("unknown control command %q", m.Command)
+	}
+	return nil
+}
+
+// SendControlMessage sends m to the given control queue.
+func SendControlMessage(ctx context.Context, cfg AWSConfig, queue string, m ControlMessage) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := cfg.resolveRegion(queue); err != nil {
+		return err
+	}
+	client := sqs.NewFromConfig(aws.Config{
+		Region:      cfg.Region,
+		Credentials: credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		APIOptions:  cfg.APIOptions,
+	})
+	_, err = client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queue),
+		MessageBody: aws.String(string(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send control message: %w", err)
+	}
+	return nil
+}
+
+// cancelledTTL is how long to remember cancelled requests not yet picked up.
+const cancelledTTL = time.Hour
+
+// control holds the state steered by control messages.
+type control struct {
+	mu        sync.Mutex
+	resumed   chan struct{} // nil when not paused.
+	inFlight  map[string]inFlightRequest
+	cancelled map[string]time.Time
+}
+
+type inFlightRequest struct {
+	InFlightRequest
+	cancel context.CancelFunc
+}
+
+func newControl() *control {
+	return &control{
+		inFlight:  make(map[string]inFlightRequest),
+		cancelled: make(map[string]time.Time),
+	}
+}
+
+func (c *control) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+func (c *control) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+func (c *control) paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed != nil
+}
+
+// waitIfPaused blocks while paused, or until ctx is done or quit is closed.
+func (c *control) waitIfPaused(ctx context.Context, quit <-chan struct{}) {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	case <-quit:
+	}
+}
+
+// start registers a request being handled and returns its context.
+// It returns false if the request is cancelled.
+func (c *control) start(ctx context.Context, op, requestID string) (context.Context, func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.cancelled[requestID]; found {
+		delete(c.cancelled, requestID)
+		return ctx, nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.inFlight[requestID] = inFlightRequest{
+		InFlightRequest: InFlightRequest{Op: op, RequestID: requestID, Started: time.Now()},
+		cancel:          cancel,
+	}
+	return ctx, func() {
+		c.mu.Lock()
+		delete(c.inFlight, requestID)
+		c.mu.Unlock()
+		cancel()
+	}, true
+}
+
+// cancel cancels the request with the given ID, or marks it as cancelled if not yet started.
+func (c *control) cancel(requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, found := c.inFlight[requestID]; found {
+		r.cancel()
+		c.cancelled[requestID] = time.Now()
+		return
+	}
+	now := time.Now()
+	for id, t := range c.cancelled {
+		if now.Sub(t) > cancelledTTL {
+			delete(c.cancelled, id)
+		}
+	}
+	c.cancelled[requestID] = now
+}
+
+func (c *control) list() []InFlightRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	requests := make([]InFlightRequest, 0, len(c.inFlight))
+	for _, r := range c.inFlight {
+		requests = append(requests, r.InFlightRequest)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Started.Before(requests[j].Started)
+	})
+	return requests
+}
+
+// isCancelled reports whether requestID was cancelled while in flight, and forgets it.
+func (c *control) isCancelled(requestID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found := c.cancelled[requestID]
+	delete(c.cancelled, requestID)
+	return found
+}
+
+// listenControl receives and applies control messages until ctx is done or the server is closed.
+func (s *Server) listenControl(ctx context.Context) error {
+	for {
+		select {
+		case <-s.quit:
+			return nil
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		result, err := s.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.controlQueue),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("control: %w", err)
+		}
+
+		for _, m := range result.Messages {
+			var cm ControlMessage
+			if err := json.Unmarshal([]byte(aws.ToString(m.Body)), &cm); err != nil {
+				s.infof("Invalid control message %q: %s", aws.ToString(m.Body), err)
+			} else if cm.InstanceID != "" && cm.InstanceID != s.stats.instanceID {
+				// Leave it to the targeted instance.
+				if err := s.releaseControlMessage(ctx, m.ReceiptHandle); err != nil {
+					return err
+				}
+				continue
+			} else if err := s.applyControl(cm); err != nil {
+				s.infof("Control message %q failed: %s", cm.Command, err)
+			}
+			if _, err := s.sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.controlQueue),
+				ReceiptHandle: m.ReceiptHandle,
+			}); err != nil {
+				return fmt.Errorf("control: %w", err)
+			}
+		}
+	}
+}
+
+func (s *Server) releaseControlMessage(ctx context.Context, receiptHandle *string) error {
+	_, err := s.sqsClient.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.controlQueue),
+		ReceiptHandle:     receiptHandle,
+		VisibilityTimeout: 0,
+	})
+	return err
+}
+
+func (s *Server) applyControl(m ControlMessage) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	s.infof("Control: %s %s", m.Command, m.RequestID)
+
+	switch m.Command {
+	case ControlPause:
+		s.control.pause()
+	case ControlResume:
+		s.control.resume()
+	case ControlCancel:
+		s.control.cancel(m.RequestID)
+	case ControlReloadHandlers:
+		if s.reloadHandlers == nil {
+			return errors.New("reload-handlers: ServerOptions.ReloadHandlers is not set")
+		}
+		handlers, err := s.reloadHandlers()
+		if err != nil {
+			return fmt.Errorf("reload-handlers: %w", err)
+		}
+		s.handlersMu.Lock()
+		s.handlers = handlers
+		s.handlersMu.Unlock()
+	}
+
+	return nil
+}
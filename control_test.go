@@ -0,0 +1,83 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestControl(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Pause", func(c *qt.C) {
+		ctrl := newControl()
+		c.Assert(ctrl.paused(), qt.IsFalse)
+		ctrl.waitIfPaused(context.Background(), nil)
+
+		ctrl.pause()
+		ctrl.pause()
+		c.Assert(ctrl.paused(), qt.IsTrue)
+
+		done := make(chan struct{})
+		go func() {
+			ctrl.waitIfPaused(context.Background(), nil)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			c.Fatal("expected to block while paused")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		ctrl.resume()
+		ctrl.resume()
+		<-done
+		c.Assert(ctrl.paused(), qt.IsFalse)
+	})
+
+	c.Run("Cancel in flight", func(c *qt.C) {
+		ctrl := newControl()
+		ctx, done, ok := ctrl.start(context.Background(), "op", "id1")
+		c.Assert(ok, qt.IsTrue)
+		ctrl.cancel("id1")
+		c.Assert(ctx.Err(), qt.Equals, context.Canceled)
+		done()
+		c.Assert(ctrl.isCancelled("id1"), qt.IsTrue)
+		c.Assert(ctrl.isCancelled("id1"), qt.IsFalse)
+	})
+
+	c.Run("Cancel pending", func(c *qt.C) {
+		ctrl := newControl()
+		ctrl.cancel("id2")
+		_, _, ok := ctrl.start(context.Background(), "op", "id2")
+		c.Assert(ok, qt.IsFalse)
+		_, done, ok := ctrl.start(context.Background(), "op", "id2")
+		c.Assert(ok, qt.IsTrue)
+		done()
+		c.Assert(ctrl.isCancelled("id2"), qt.IsFalse)
+	})
+
+	c.Run("Apply", func(c *qt.C) {
+		s := &Server{
+			control: newControl(),
+			common:  &common{infof: func(format string, args ...interface{}) {}},
+		}
+		c.Assert(s.applyControl(ControlMessage{Command: ControlPause}), qt.IsNil)
+		c.Assert(s.control.paused(), qt.IsTrue)
+		c.Assert(s.applyControl(ControlMessage{Command: ControlResume}), qt.IsNil)
+		c.Assert(s.control.paused(), qt.IsFalse)
+		c.Assert(s.applyControl(ControlMessage{Command: ControlCancel}), qt.ErrorMatches, ".*request ID is required")
+		c.Assert(s.applyControl(ControlMessage{Command: "foo"}), qt.ErrorMatches, `unknown control command "foo"`)
+		c.Assert(s.applyControl(ControlMessage{Command: ControlReloadHandlers}), qt.ErrorMatches, ".*ReloadHandlers is not set")
+
+		s.reloadHandlers = func() (Handlers, error) {
+			return Handlers{"new": nil}, nil
+		}
+		c.Assert(s.applyControl(ControlMessage{Command: ControlReloadHandlers}), qt.IsNil)
+		_, found := s.handlers["new"]
+		c.Assert(found, qt.IsTrue)
+	})
+}
@@ -0,0 +1,60 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MetaDeadline holds when the client stops waiting for the response, see RequestDeadline.
+// It is UTC in RFC 3339 format with nanoseconds.
+const MetaDeadline = "s3rpc-deadline"
+
+// ErrorCodePartial means that the handler returned a partial result with ErrPartial.
+const ErrorCodePartial = "partial"
+
+// ErrPartial is returned, possibly wrapped, by a handler together with an Output holding
+// a partial result, e.g. when its RemainingBudget ran out.
+// The partial result is sent to the client, where Execute returns it along with a *ResponseError
+// with code ErrorCodePartial, which matches ErrPartial. Retry the request with the same
+// request ID, see WithRequestID, to resume from the last Checkpoint.
+var ErrPartial = errors.New("partial result")
+
+// requestDeadline returns the deadline sent with a request executed with ctx:
+// the earlier of the deadline of ctx and when the client stops waiting for the response.
+func requestDeadline(ctx context.Context, responseWait time.Duration) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if responseWait > 0 {
+		if waitDeadline := time.Now().Add(responseWait); !ok || waitDeadline.Before(deadline) {
+			deadline, ok = waitDeadline, true
+		}
+	}
+	return deadline, ok
+}
+
+// RequestDeadline returns when the client stops waiting for the response to the request
+// handled with ctx, as sent by the client, false if it did not send one.
+// Note that the server's clock may be skewed against the client's.
+func RequestDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, err := time.Parse(time.RFC3339Nano, requestMetadataFromContext(ctx)[MetaDeadline])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// RemainingBudget returns the time left to handle the request handled with ctx,
+// until the earlier of RequestDeadline and the deadline of ctx, e.g. from OpOptions.Timeout,
+// or false if there is neither.
+// Handlers should leave time to upload the response, and may return a partial result
+// with ErrPartial when the budget runs out.
+func RemainingBudget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := RequestDeadline(ctx)
+	if d, found := ctx.Deadline(); found && (!ok || d.Before(deadline)) {
+		deadline, ok = d, true
+	}
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
@@ -0,0 +1,63 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeadline(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	_, ok := requestDeadline(ctx, 0)
+	c.Assert(ok, qt.IsFalse)
+	deadline, ok := requestDeadline(ctx, time.Minute)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(time.Until(deadline) > 59*time.Second, qt.IsTrue)
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	deadline, _ = requestDeadline(shortCtx, time.Minute)
+	c.Assert(time.Until(deadline) <= time.Second, qt.IsTrue)
+
+	_, ok = RequestDeadline(ctx)
+	c.Assert(ok, qt.IsFalse)
+	_, ok = RemainingBudget(ctx)
+	c.Assert(ok, qt.IsFalse)
+
+	sent := time.Now().Add(time.Minute)
+	handlerCtx := withRequestMetadata(ctx, map[string]string{MetaDeadline: sent.UTC().Format(time.RFC3339Nano)})
+	got, ok := RequestDeadline(handlerCtx)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(got.Equal(sent), qt.IsTrue)
+	budget, ok := RemainingBudget(handlerCtx)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(budget > 59*time.Second && budget <= time.Minute, qt.IsTrue)
+
+	// The op timeout is shorter.
+	handlerCtx, cancel = context.WithTimeout(handlerCtx, time.Second)
+	defer cancel()
+	budget, _ = RemainingBudget(handlerCtx)
+	c.Assert(budget <= time.Second, qt.IsTrue)
+
+	err := responseErrorFrom(map[string]string{MetaErrorCode: ErrorCodePartial, MetaError: fmt.Errorf("%w: 3 of 10 pages", ErrPartial).Error()})
+	c.Assert(errors.Is(err, ErrPartial), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "partial: partial result: 3 of 10 pages")
+}
+
+func TestCheckpoint(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	c.Assert(Checkpoint(ctx, []byte("page 3")), qt.ErrorMatches, "Checkpoint must be called with the context passed to the handler")
+	_, err := LoadCheckpoint(ctx)
+	c.Assert(err, qt.ErrorMatches, "LoadCheckpoint must be called with the context passed to the handler")
+	c.Assert(checkpointKey("ocr", "01gcabc"), qt.Equals, "checkpoints/ocr/01gcabc")
+
+	// Nothing to remove if the handler never used a checkpoint.
+	(&checkpointer{op: "ocr", id: "01gcabc"}).remove(ctx)
+}
@@ -0,0 +1,146 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// dedup coalesces concurrent identical requests, see ClientOptions.Deduplicate.
+type dedup struct {
+	tempDir string
+
+	mu    sync.Mutex
+	calls map[string]*dedupCall
+}
+
+type dedupCall struct {
+	done chan struct{}
+
+	// waiters are the callers sharing the result, in the order they joined.
+	// A waiter is set to nil if its caller gave up waiting.
+	waiters []*dedupWaiter
+
+	// sharing is set when the result is being copied to the waiters.
+	sharing bool
+}
+
+type dedupWaiter struct {
+	output Output
+	err    error
+}
+
+func newDedup(tempDir string) *dedup {
+	return &dedup{tempDir: tempDir, calls: make(map[string]*dedupCall)}
+}
+
+// dedupKey returns a key identifying requests with the same op, content and metadata.
+func dedupKey(op string, input Input) (string, error) {
+	checksum, err := fileChecksum(input.Filename)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(input.Metadata))
+	for k := range input.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %q", op, checksum, input.ContentType)
+	for _, k := range keys {
+		fmt.Fprintf(h, " %q=%q", k, input.Metadata[k])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// do runs execute for the first caller with a key and shares its result with the callers
+// that join while it runs. Each caller gets its own copy of the output file.
+func (d *dedup) do(ctx context.Context, key string, execute func() (Output, error)) (Output, error) {
+	d.mu.Lock()
+	if call, found := d.calls[key]; found {
+		w := &dedupWaiter{}
+		i := len(call.waiters)
+		call.waiters = append(call.waiters, w)
+		d.mu.Unlock()
+		select {
+		case <-call.done:
+			return w.output, w.err
+		case <-ctx.Done():
+			d.mu.Lock()
+			sharing := call.sharing
+			if !sharing {
+				call.waiters[i] = nil
+			}
+			d.mu.Unlock()
+			if sharing {
+				// Our copy is being made, wait for it and remove it.
+				<-call.done
+				if w.output.Filename != "" {
+					os.Remove(w.output.Filename)
+				}
+			}
+			return Output{}, ctx.Err()
+		}
+	}
+	call := &dedupCall{done: make(chan struct{})}
+	d.calls[key] = call
+	d.mu.Unlock()
+
+	output, err := execute()
+
+	d.mu.Lock()
+	delete(d.calls, key)
+	call.sharing = true
+	waiters := call.waiters
+	d.mu.Unlock()
+
+	for _, w := range waiters {
+		if w == nil {
+			continue
+		}
+		w.output, w.err = output, err
+		if err == nil {
+			w.output.Metadata = copyMetadata(output.Metadata)
+			w.output.Filename, w.err = d.copyFile(output.Filename)
+		}
+	}
+	close(call.done)
+
+	return output, err
+}
+
+func (d *dedup) copyFile(filename string) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := createTemp(d.tempDir, filename)
+	if err != nil {
+		return "", err
+	}
+	_, err = copyBuffered(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("failed to copy shared output: %w", err)
+	}
+	return dst.Name(), nil
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,107 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDedupKey(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	c.Assert(os.WriteFile(a, []byte("hello"), 0o644), qt.IsNil)
+	c.Assert(os.WriteFile(b, []byte("hello"), 0o644), qt.IsNil)
+
+	key := func(op string, input Input) string {
+		k, err := dedupKey(op, input)
+		c.Assert(err, qt.IsNil)
+		return k
+	}
+	meta := map[string]string{"width": "100", "height": "50"}
+	c.Assert(key("resize", Input{Filename: a, Metadata: meta}), qt.Equals, key("resize", Input{Filename: b, Metadata: map[string]string{"height": "50", "width": "100"}}))
+	c.Assert(key("resize", Input{Filename: a, Metadata: meta}), qt.Not(qt.Equals), key("convert", Input{Filename: a, Metadata: meta}))
+	c.Assert(key("resize", Input{Filename: a}), qt.Not(qt.Equals), key("resize", Input{Filename: a, Metadata: meta}))
+}
+
+func TestDedup(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	d := newDedup(dir)
+	result := filepath.Join(dir, "result.txt")
+	c.Assert(os.WriteFile(result, []byte("result"), 0o644), qt.IsNil)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int
+	execute := func() (Output, error) {
+		calls++
+		close(started)
+		<-release
+		return Output{Filename: result, Metadata: map[string]string{"k": "v"}}, nil
+	}
+
+	ctx := context.Background()
+	var (
+		wg      sync.WaitGroup
+		outputs = make([]Output, 3)
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outputs[0], _ = d.do(ctx, "key", execute)
+	}()
+	<-started
+	for i := 1; i < len(outputs); i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			outputs[i], err = d.do(ctx, "key", execute)
+			c.Check(err, qt.IsNil)
+		}()
+	}
+	// A caller that gives up gets its own error.
+	ctxCanceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	for {
+		d.mu.Lock()
+		n := len(d.calls["key"].waiters)
+		d.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err := d.do(ctxCanceled, "key", execute)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+
+	close(release)
+	wg.Wait()
+	c.Assert(calls, qt.Equals, 1)
+	c.Assert(outputs[0].Filename, qt.Equals, result)
+	seen := map[string]bool{}
+	for _, output := range outputs {
+		c.Assert(seen[output.Filename], qt.IsFalse)
+		seen[output.Filename] = true
+		b, err := os.ReadFile(output.Filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, "result")
+		c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"k": "v"})
+	}
+	entries, err := os.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 3)
+
+	// A new call after the first finished executes again.
+	_, err = d.do(ctx, "key", func() (Output, error) { return Output{}, errors.New("failed") })
+	c.Assert(err, qt.ErrorMatches, "failed")
+}
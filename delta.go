@@ -0,0 +1,476 @@
+package s3rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const baselines = "baselines"
+
+// Metadata keys set on delta requests, see Client.ExecuteDelta.
+const (
+	// MetaDeltaBaseline holds the name of the baseline the input is a delta against.
+	MetaDeltaBaseline = "s3rpc-delta-baseline"
+
+	// MetaDeltaETag holds the ETag of the baseline the delta was computed against,
+	// so a delta is never applied to a baseline that has since been replaced.
+	MetaDeltaETag = "s3rpc-delta-etag"
+)
+
+const (
+	// deltaBlockSize is the size of the baseline blocks a delta copies from.
+	deltaBlockSize = 64 << 10
+
+	// deltaMaxLiteral is the max size of the literal data buffered before it is written to a delta.
+	deltaMaxLiteral = 1 << 20
+
+	signatureMagic = "s3rs"
+	deltaMagic     = "s3rd"
+
+	deltaOpCopy    = 'C'
+	deltaOpLiteral = 'L'
+)
+
+// baselineKey and signatureKey return the keys of the baseline with the given name and its signature.
+func baselineKey(name string) string {
+	return baselines + "/data/" + name
+}
+
+func signatureKey(name string) string {
+	return baselines + "/signatures/" + name
+}
+
+// UploadBaseline uploads filename as the baseline with the given name, replacing any previous one,
+// so similar inputs can later be sent as deltas against it with ExecuteDelta.
+// The baseline is uploaded to the primary endpoint only.
+// It requires ProvisionerOptions.Baselines.
+func (c *Client) UploadBaseline(ctx context.Context, name, filename string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) {
+		return fmt.Errorf("baseline: invalid name %q", name)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+	defer f.Close()
+	sig, err := createTemp(c.tempDir, name)
+	if err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+	defer os.Remove(sig.Name())
+	if err := writeSignature(sig, f, deltaBlockSize); err != nil {
+		sig.Close()
+		return fmt.Errorf("baseline: %w", err)
+	}
+	if err := sig.Close(); err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+
+	if err := c.upload(ctx, filename, baselineKey(name), "", "", nil); err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+	head, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(baselineKey(name)),
+	})
+	if err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+	metadata := map[string]string{MetaDeltaETag: aws.ToString(head.ETag)}
+	if err := c.upload(ctx, sig.Name(), signatureKey(name), "application/octet-stream", "", metadata); err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+	return nil
+}
+
+// ExecuteDelta executes the op as Execute, but uploads only the blocks of input.Filename
+// that differ from the baseline with the given name, see UploadBaseline.
+// The server rebuilds the full input from the baseline before it is handled,
+// a big win for workflows resubmitting slightly modified large files.
+// If the baseline is missing, e.g. on a failover endpoint, or the delta is not smaller
+// than the input, the full input is uploaded.
+// If the baseline was replaced after the delta was computed, a *ResponseError
+// with code ErrorCodeInvalidInput is returned.
+func (c *Client) ExecuteDelta(ctx context.Context, op, baseline string, input Input) (Output, error) {
+	return c.Execute(withDeltaBaseline(ctx, baseline), op, input)
+}
+
+type deltaBaselineKey struct{}
+
+func withDeltaBaseline(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, deltaBaselineKey{}, name)
+}
+
+func deltaBaselineFrom(ctx context.Context) string {
+	name, _ := ctx.Value(deltaBaselineKey{}).(string)
+	return name
+}
+
+// encodeDelta writes the delta of filename against the baseline with the given name
+// to a temp file in dir and returns its filename and the baseline's ETag.
+func (c *common) encodeDelta(ctx context.Context, dir, name, filename string) (string, string, error) {
+	o, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(signatureKey(name)),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer o.Body.Close()
+	etag := decodeMetadata(o.Metadata)[MetaDeltaETag]
+	if etag == "" {
+		return "", "", errors.New("signature has no baseline ETag")
+	}
+	sig, err := readSignature(bufio.NewReader(o.Body))
+	if err != nil {
+		return "", "", err
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	out, err := createTemp(dir, filename)
+	if err != nil {
+		return "", "", err
+	}
+	err = writeDelta(out, sig, in, fi.Size())
+	if err == nil {
+		var ofi os.FileInfo
+		if ofi, err = out.Stat(); err == nil && ofi.Size() >= fi.Size() {
+			err = errors.New("delta is not smaller than the input")
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
+	}
+	return out.Name(), etag, nil
+}
+
+// reconstructDelta rebuilds the input from the delta in f and the baseline named in metadata
+// into a new file in dir. The delta keys are removed from metadata.
+func (s *Server) reconstructDelta(ctx context.Context, dir, key string, f *os.File, metadata map[string]string) (*os.File, error) {
+	name, etag := metadata[MetaDeltaBaseline], metadata[MetaDeltaETag]
+	delete(metadata, MetaDeltaBaseline)
+	delete(metadata, MetaDeltaETag)
+
+	base, err := createTemp(s.tempDir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Close()
+	defer os.Remove(base.Name())
+	started := time.Now()
+	o, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(s.bucket),
+		Key:     aws.String(baselineKey(name)),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("baseline %q: %w", name, err)
+	}
+	n, err := copyBuffered(base, o.Body)
+	o.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("baseline %q: %w", name, err)
+	}
+	s.transfers.observe(ctx, s.common, TransferDownload, baselineKey(name), n, time.Since(started))
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	out, err := createTemp(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(out, copyBufferSize)
+	if err = applyDelta(w, base, f); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return nil, fmt.Errorf("delta against baseline %q: %w", name, err)
+	}
+	return out, nil
+}
+
+// rollsum is the rolling checksum of rsync, which can be moved along the input one byte at a time.
+type rollsum struct {
+	a, b, n uint32
+}
+
+func (r *rollsum) init(p []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(p))
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll moves the window one byte, removing out and adding in.
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rollsum) digest() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// strongSum returns the truncated SHA-256 confirming a rollsum match.
+func strongSum(p []byte) [16]byte {
+	var s [16]byte
+	h := sha256.Sum256(p)
+	copy(s[:], h[:])
+	return s
+}
+
+// signature holds the checksums of the full blocks of a baseline.
+type signature struct {
+	blockSize int
+	strong    [][16]byte
+	weak      map[uint32][]int
+}
+
+// writeSignature writes the signature of the full blocks in r to w.
+// The signature is the magic, the block size and for each block its rollsum and strong sum.
+func writeSignature(w io.Writer, r io.Reader, blockSize int) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(signatureMagic)
+	binary.Write(bw, binary.BigEndian, uint32(blockSize))
+	block := make([]byte, blockSize)
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		var sum rollsum
+		sum.init(block)
+		binary.Write(bw, binary.BigEndian, sum.digest())
+		strong := strongSum(block)
+		bw.Write(strong[:])
+	}
+	return bw.Flush()
+}
+
+func readSignature(r io.Reader) (*signature, error) {
+	var header struct {
+		Magic     [4]byte
+		BlockSize uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil || string(header.Magic[:]) != signatureMagic || header.BlockSize == 0 {
+		return nil, errors.New("invalid signature")
+	}
+	sig := &signature{blockSize: int(header.BlockSize), weak: make(map[uint32][]int)}
+	var block struct {
+		Weak   uint32
+		Strong [16]byte
+	}
+	for {
+		if err := binary.Read(r, binary.BigEndian, &block); err != nil {
+			if err == io.EOF {
+				return sig, nil
+			}
+			return nil, fmt.Errorf("invalid signature: %w", err)
+		}
+		sig.weak[block.Weak] = append(sig.weak[block.Weak], len(sig.strong))
+		sig.strong = append(sig.strong, block.Strong)
+	}
+}
+
+// match returns the index of the baseline block equal to p with the rollsum weak, if any.
+func (s *signature) match(weak uint32, p []byte) (int, bool) {
+	candidates := s.weak[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongSum(p)
+	for _, i := range candidates {
+		if s.strong[i] == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// deltaWriter writes the operations of a delta, merging copies of consecutive blocks.
+type deltaWriter struct {
+	w                    *bufio.Writer
+	copyStart, copyCount uint64
+}
+
+func (d *deltaWriter) copy(block int) {
+	if d.copyCount > 0 && uint64(block) == d.copyStart+d.copyCount {
+		d.copyCount++
+		return
+	}
+	d.flushCopy()
+	d.copyStart, d.copyCount = uint64(block), 1
+}
+
+func (d *deltaWriter) flushCopy() {
+	if d.copyCount == 0 {
+		return
+	}
+	d.w.WriteByte(deltaOpCopy)
+	binary.Write(d.w, binary.BigEndian, [2]uint64{d.copyStart, d.copyCount})
+	d.copyCount = 0
+}
+
+func (d *deltaWriter) literal(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	d.flushCopy()
+	d.w.WriteByte(deltaOpLiteral)
+	binary.Write(d.w, binary.BigEndian, uint32(len(p)))
+	d.w.Write(p)
+}
+
+// writeDelta writes the delta of the size bytes in r against the baseline with signature sig to w.
+// The delta is the magic, the block size and the size, followed by operations copying
+// blocks from the baseline or adding literal data.
+func writeDelta(w io.Writer, sig *signature, r io.Reader, size int64) error {
+	d := &deltaWriter{w: bufio.NewWriter(w)}
+	d.w.WriteString(deltaMagic)
+	binary.Write(d.w, binary.BigEndian, uint32(sig.blockSize))
+	binary.Write(d.w, binary.BigEndian, uint64(size))
+
+	var (
+		bs = sig.blockSize
+		// buf[:pos] is literal data not yet written and buf[pos:pos+bs] is the window.
+		buf   []byte
+		pos   int
+		eof   bool
+		sum   rollsum
+		fresh = true
+		chunk = make([]byte, copyBufferSize)
+	)
+	fill := func(n int) error {
+		for !eof && len(buf) < n {
+			m, err := r.Read(chunk)
+			buf = append(buf, chunk[:m]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		if err := fill(pos + bs + 1); err != nil {
+			return err
+		}
+		if len(buf)-pos < bs {
+			break
+		}
+		window := buf[pos : pos+bs]
+		if fresh {
+			sum.init(window)
+			fresh = false
+		}
+		if block, ok := sig.match(sum.digest(), window); ok {
+			d.literal(buf[:pos])
+			d.copy(block)
+			buf = append(buf[:0], buf[pos+bs:]...)
+			pos = 0
+			fresh = true
+			continue
+		}
+		if len(buf)-pos == bs {
+			// No more input to roll in.
+			break
+		}
+		sum.roll(buf[pos], buf[pos+bs])
+		pos++
+		if pos >= deltaMaxLiteral {
+			d.literal(buf[:pos])
+			buf = append(buf[:0], buf[pos:]...)
+			pos = 0
+		}
+	}
+	d.literal(buf)
+	d.flushCopy()
+	return d.w.Flush()
+}
+
+// applyDelta writes the input rebuilt from delta and base to w.
+func applyDelta(w io.Writer, base io.ReaderAt, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	var header struct {
+		Magic     [4]byte
+		BlockSize uint32
+		Size      uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil || !bytes.Equal(header.Magic[:], []byte(deltaMagic)) || header.BlockSize == 0 {
+		return errors.New("invalid delta")
+	}
+	bs := int64(header.BlockSize)
+	var written int64
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case deltaOpCopy:
+			var blocks [2]uint64
+			if err := binary.Read(r, binary.BigEndian, &blocks); err != nil {
+				return fmt.Errorf("invalid delta: %w", err)
+			}
+			n := int64(blocks[1]) * bs
+			m, err := copyBuffered(w, io.NewSectionReader(base, int64(blocks[0])*bs, n))
+			if err != nil {
+				return err
+			}
+			if m != n {
+				return errors.New("baseline is too short")
+			}
+			written += n
+		case deltaOpLiteral:
+			var n uint32
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				return fmt.Errorf("invalid delta: %w", err)
+			}
+			if _, err := io.CopyN(w, r, int64(n)); err != nil {
+				return fmt.Errorf("invalid delta: %w", err)
+			}
+			written += int64(n)
+		default:
+			return fmt.Errorf("invalid delta: unknown operation %q", op)
+		}
+	}
+	if written != int64(header.Size) {
+		return fmt.Errorf("invalid delta: rebuilt %d bytes, expected %d", written, header.Size)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRollsum(t *testing.T) {
+	c := qt.New(t)
+
+	p := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(p)
+	var rolled rollsum
+	rolled.init(p[:16])
+	for i := 1; i+16 <= len(p); i++ {
+		rolled.roll(p[i-1], p[i+15])
+		var sum rollsum
+		sum.init(p[i : i+16])
+		c.Assert(rolled.digest(), qt.Equals, sum.digest(), qt.Commentf("offset %d", i))
+	}
+}
+
+func TestDelta(t *testing.T) {
+	c := qt.New(t)
+
+	const bs = 16
+	baseline := make([]byte, 50*bs+5)
+	rand.New(rand.NewSource(2)).Read(baseline)
+
+	var sigBuf bytes.Buffer
+	c.Assert(writeSignature(&sigBuf, bytes.NewReader(baseline), bs), qt.IsNil)
+	sig, err := readSignature(&sigBuf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sig.blockSize, qt.Equals, bs)
+	c.Assert(sig.strong, qt.HasLen, 50)
+
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	for _, test := range []struct {
+		name  string
+		input []byte
+	}{
+		{"unchanged", baseline},
+		{"empty", nil},
+		{"modified", concat(baseline[:100], []byte("changed"), baseline[107:])},
+		{"inserted", concat(baseline[:333], []byte("inserted bytes"), baseline[333:])},
+		{"removed", concat(baseline[:200], baseline[250:])},
+		{"appended", concat(baseline, []byte("more data at the end"))},
+		{"reordered", concat(baseline[400:], baseline[:400])},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			var delta bytes.Buffer
+			c.Assert(writeDelta(&delta, sig, bytes.NewReader(test.input), int64(len(test.input))), qt.IsNil)
+			if len(test.input) > 0 {
+				c.Assert(delta.Len() < len(test.input)/2, qt.IsTrue, qt.Commentf("delta is %d bytes", delta.Len()))
+			}
+			var rebuilt bytes.Buffer
+			c.Assert(applyDelta(&rebuilt, bytes.NewReader(baseline), &delta), qt.IsNil)
+			c.Assert(rebuilt.Bytes(), qt.DeepEquals, test.input)
+		})
+	}
+
+	// A delta applied to a shorter baseline.
+	var delta bytes.Buffer
+	c.Assert(writeDelta(&delta, sig, bytes.NewReader(baseline), int64(len(baseline))), qt.IsNil)
+	c.Assert(applyDelta(&bytes.Buffer{}, bytes.NewReader(baseline[:100]), &delta), qt.ErrorMatches, "baseline is too short")
+
+	c.Assert(applyDelta(&bytes.Buffer{}, bytes.NewReader(baseline), bytes.NewReader([]byte("garbage"))), qt.ErrorMatches, "invalid delta")
+	_, err = readSignature(bytes.NewReader([]byte("garbage")))
+	c.Assert(err, qt.ErrorMatches, "invalid signature")
+}
+
+func TestDeltaBaseline(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(baselineKey("reports/q3.csv"), qt.Equals, "baselines/data/reports/q3.csv")
+	c.Assert(signatureKey("reports/q3.csv"), qt.Equals, "baselines/signatures/reports/q3.csv")
+	c.Assert(deltaBaselineFrom(context.Background()), qt.Equals, "")
+	c.Assert(deltaBaselineFrom(withDeltaBaseline(context.Background(), "q3")), qt.Equals, "q3")
+
+	client := &Client{}
+	for _, name := range []string{"", "/abs", "a/../b", "a//b"} {
+		c.Assert(client.UploadBaseline(context.Background(), name, "input.csv"), qt.ErrorMatches, "baseline: invalid name .*")
+	}
+}
@@ -0,0 +1,284 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
+)
+
+const dictionaries = "dictionaries"
+
+// Metadata keys set on objects compressed with a dictionary, see ClientOpOptions.Dictionary.
+const (
+	// MetaDictionary holds the name of the dictionary.
+	MetaDictionary = "s3rpc-dictionary"
+
+	// MetaDictionaryID holds the ID of the dictionary, so a retrained dictionary
+	// is not used to decompress objects compressed with the previous one.
+	MetaDictionaryID = "s3rpc-dictionary-id"
+)
+
+const (
+	// contentEncodingZstd is the MetaContentEncoding of objects compressed with zstd and a dictionary.
+	contentEncodingZstd = "zstd"
+
+	// maxDictionarySize is the max size of a trained dictionary, as the zstd CLI's default.
+	maxDictionarySize = 110 << 10
+
+	// dictionaryRefreshInterval is how often the dictionary used for compression is reloaded,
+	// so a retrained dictionary is picked up.
+	dictionaryRefreshInterval = 5 * time.Minute
+)
+
+// dictionaryKey returns the well-known key of the dictionary with the given name.
+func dictionaryKey(name string) string {
+	return dictionaries + "/" + name
+}
+
+// TrainDictionary builds a zstd dictionary from samples of the payloads it is to compress,
+// e.g. a thousand typical JSON documents. With many small, similar payloads, compressing
+// each with a shared dictionary gives much better ratios than compressing them on their own.
+// See Client.UploadDictionary.
+func TrainDictionary(samples [][]byte) (dict []byte, err error) {
+	// zstd matches against the dictionary content, so use the most recent samples, skipping duplicates,
+	// with the most recent at the end where it is cheapest to reference.
+	// The entropy tables are tuned to the compression of the other samples,
+	// so at most half of the sample bytes go into the content.
+	total := 0
+	for _, sample := range samples {
+		total += len(sample)
+	}
+	size := total / 2
+	if size > maxDictionarySize {
+		size = maxDictionarySize
+	}
+	var (
+		history  []byte
+		contents [][]byte
+		seen     = make(map[uint32]bool)
+	)
+	for i := len(samples) - 1; i >= 0; i-- {
+		sample := samples[i]
+		sum := crc32.ChecksumIEEE(sample)
+		if len(history)+len(sample) > size || seen[sum] {
+			contents = append(contents, sample)
+			continue
+		}
+		seen[sum] = true
+		history = append(append([]byte(nil), sample...), history...)
+	}
+	if len(history) < 8 || len(contents) == 0 {
+		return nil, errors.New("train dictionary: too few samples")
+	}
+
+	defer func() {
+		// BuildDict divides by zero with too few samples to gather statistics from.
+		if r := recover(); r != nil {
+			dict, err = nil, fmt.Errorf("train dictionary: too few samples: %v", r)
+		}
+	}()
+	dict, err = zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       dictionaryID(history),
+		Contents: contents,
+		History:  history,
+		// The initial repeat offsets of zstd.
+		Offsets: [3]int{1, 4, 8},
+		// The level s3rpc compresses with.
+		Level: zstd.SpeedDefault,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("train dictionary: %w", err)
+	}
+	return dict, nil
+}
+
+// dictionaryID derives the ID of a dictionary from its content,
+// within the range zstd leaves for private use.
+func dictionaryID(content []byte) uint32 {
+	const min, max = 1 << 15, 1 << 31
+	return min + crc32.ChecksumIEEE(content)%(max-min)
+}
+
+// UploadDictionary uploads dict, as returned by TrainDictionary, as the dictionary with
+// the given name to the primary and failover endpoints, replacing any previous one.
+// Clients and servers pick up a replaced dictionary within five minutes.
+// It requires ProvisionerOptions.Dictionaries.
+func (c *Client) UploadDictionary(ctx context.Context, name string, dict []byte) error {
+	if _, err := zstd.InspectDictionary(dict); err != nil {
+		return fmt.Errorf("dictionary: %w", err)
+	}
+	for _, ep := range append([]*common{c.common}, c.failover...) {
+		if err := ep.uploadBytes(ctx, dictionaryKey(name), dict, nil); err != nil {
+			return fmt.Errorf("dictionary: %w", err)
+		}
+	}
+	return nil
+}
+
+// zstdDictionary is a loaded dictionary.
+type zstdDictionary struct {
+	id       uint32
+	b        []byte
+	loadedAt time.Time
+}
+
+// dictionaryCache caches the dictionaries of an endpoint.
+type dictionaryCache struct {
+	// fetch fetches the dictionary with the given name.
+	fetch func(ctx context.Context, name string) ([]byte, error)
+
+	mu      sync.Mutex
+	current map[string]*zstdDictionary
+	byID    map[uint32]*zstdDictionary
+}
+
+func newDictionaryCache(fetch func(ctx context.Context, name string) ([]byte, error)) *dictionaryCache {
+	return &dictionaryCache{
+		fetch:   fetch,
+		current: make(map[string]*zstdDictionary),
+		byID:    make(map[uint32]*zstdDictionary),
+	}
+}
+
+// get returns the dictionary with the given name and ID,
+// or the current dictionary with the given name if id is 0.
+func (d *dictionaryCache) get(ctx context.Context, name string, id uint32) (*zstdDictionary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id != 0 {
+		if dict, found := d.byID[id]; found {
+			return dict, nil
+		}
+	} else if dict, found := d.current[name]; found && time.Since(dict.loadedAt) < dictionaryRefreshInterval {
+		return dict, nil
+	}
+
+	b, err := d.fetch(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("dictionary %q: %w", name, err)
+	}
+	info, err := zstd.InspectDictionary(b)
+	if err != nil {
+		return nil, fmt.Errorf("dictionary %q: %w", name, err)
+	}
+	dict := &zstdDictionary{id: info.ID(), b: b, loadedAt: time.Now()}
+	d.current[name] = dict
+	d.byID[dict.id] = dict
+	if id != 0 && id != dict.id {
+		return nil, fmt.Errorf("dictionary %q: ID %d has been replaced by %d", name, id, dict.id)
+	}
+	return dict, nil
+}
+
+// fetchDictionary downloads the dictionary with the given name.
+func (c *common) fetchDictionary(ctx context.Context, name string) ([]byte, error) {
+	o, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(dictionaryKey(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	return io.ReadAll(o.Body)
+}
+
+// compressFile writes a compressed copy of filename to a temp file in dir and returns its name,
+// setting the metadata keys needed to decompress it.
+// It uses zstd with the dictionary with the given name, if set, else gzip.
+func (c *common) compressFile(ctx context.Context, dir, filename, dictionary string, metadata map[string]string) (string, error) {
+	if dictionary == "" {
+		compressed, err := gzipFile(dir, filename)
+		if err != nil {
+			return "", err
+		}
+		metadata[MetaContentEncoding] = contentEncodingGzip
+		return compressed, nil
+	}
+	dict, err := c.dictionaries.get(ctx, dictionary, 0)
+	if err != nil {
+		return "", fmt.Errorf("compress: %w", err)
+	}
+	compressed, err := zstdFile(dir, filename, dict)
+	if err != nil {
+		return "", err
+	}
+	metadata[MetaContentEncoding] = contentEncodingZstd
+	metadata[MetaDictionary] = dictionary
+	metadata[MetaDictionaryID] = strconv.FormatUint(uint64(dict.id), 10)
+	return compressed, nil
+}
+
+// zstdFile writes a copy of filename compressed with dict to a temp file in dir and returns its name.
+func zstdFile(dir, filename string, dict *zstdDictionary) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := createTemp(dir, filepath.Base(filename)+".zst")
+	if err != nil {
+		return "", err
+	}
+	zw, err := zstd.NewWriter(dst, zstd.WithEncoderDict(dict.b), zstd.WithEncoderConcurrency(1))
+	if err == nil {
+		_, err = copyBuffered(zw, src)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("compress: %w", err)
+	}
+	return dst.Name(), nil
+}
+
+// zstdReader closes the decoder at the end of the stream.
+type zstdReader struct {
+	d *zstd.Decoder
+}
+
+func (r zstdReader) Read(p []byte) (int, error) {
+	n, err := r.d.Read(p)
+	if err != nil {
+		r.d.Close()
+	}
+	return n, err
+}
+
+// decompressZstd returns body decompressed with the dictionary in metadata,
+// removing the dictionary keys from metadata.
+func (d *dictionaryCache) decompressZstd(ctx context.Context, body io.Reader, metadata map[string]string) (io.Reader, error) {
+	name := metadata[MetaDictionary]
+	id, err := strconv.ParseUint(metadata[MetaDictionaryID], 10, 32)
+	if name == "" || err != nil || id == 0 {
+		return nil, errors.New("decompress: missing dictionary")
+	}
+	dict, err := d.get(ctx, name, uint32(id))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	zr, err := zstd.NewReader(body, zstd.WithDecoderDicts(dict.b), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	delete(metadata, MetaDictionary)
+	delete(metadata, MetaDictionaryID)
+	return zstdReader{d: zr}, nil
+}
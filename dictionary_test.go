@@ -0,0 +1,100 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/klauspost/compress/zstd"
+)
+
+func testDictionarySamples(n int) [][]byte {
+	samples := make([][]byte, n)
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"id":%d,"type":"invoice","customer":{"name":"Customer %d","country":"NO"},"lines":[{"sku":"SKU-%d","quantity":%d,"currency":"NOK"}],"status":"paid"}`, i, i%17, i*7, i%5+1))
+	}
+	return samples
+}
+
+func TestTrainDictionary(t *testing.T) {
+	c := qt.New(t)
+
+	samples := testDictionarySamples(2000)
+	dict, err := TrainDictionary(samples)
+	c.Assert(err, qt.IsNil)
+	info, err := zstd.InspectDictionary(dict)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.ID() >= 1<<15, qt.IsTrue)
+
+	plain, err := zstd.NewWriter(nil)
+	c.Assert(err, qt.IsNil)
+	withDict, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict))
+	c.Assert(err, qt.IsNil)
+	payload := testDictionarySamples(3000)[2999]
+	c.Assert(len(withDict.EncodeAll(payload, nil))*2 < len(plain.EncodeAll(payload, nil)), qt.IsTrue)
+
+	_, err = TrainDictionary(nil)
+	c.Assert(err, qt.ErrorMatches, "train dictionary: too few samples")
+	_, err = TrainDictionary(testDictionarySamples(10))
+	c.Assert(err, qt.ErrorMatches, "train dictionary: too few samples.*")
+	c.Assert((&Client{}).UploadDictionary(context.Background(), "invoices", []byte("not a dictionary")), qt.ErrorMatches, "dictionary: .*")
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	c := qt.New(t)
+
+	dict, err := TrainDictionary(testDictionarySamples(2000))
+	c.Assert(err, qt.IsNil)
+	fetches := 0
+	current := dict
+	cache := newDictionaryCache(func(ctx context.Context, name string) ([]byte, error) {
+		c.Assert(name, qt.Equals, "invoices")
+		fetches++
+		return current, nil
+	})
+	ep := &common{dictionaries: cache}
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "invoice.json")
+	content := testDictionarySamples(2500)[2499]
+	c.Assert(os.WriteFile(filename, content, 0o644), qt.IsNil)
+
+	metadata := map[string]string{"foo": "bar"}
+	compressed, err := ep.compressFile(ctx, dir, filename, "invoices", metadata)
+	c.Assert(err, qt.IsNil)
+	c.Assert(metadata[MetaContentEncoding], qt.Equals, contentEncodingZstd)
+	c.Assert(metadata[MetaDictionary], qt.Equals, "invoices")
+	id, err := strconv.ParseUint(metadata[MetaDictionaryID], 10, 32)
+	c.Assert(err, qt.IsNil)
+
+	f, err := os.Open(compressed)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	body, err := decompressBody(ctx, f, metadata, cache)
+	c.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, string(content))
+	c.Assert(metadata, qt.DeepEquals, map[string]string{"foo": "bar"})
+	c.Assert(fetches, qt.Equals, 1)
+
+	// A retrained dictionary is not used for objects compressed with the previous one,
+	// which is still cached.
+	current, err = TrainDictionary(testDictionarySamples(1500))
+	c.Assert(err, qt.IsNil)
+	_, err = cache.get(ctx, "invoices", uint32(id)+1)
+	c.Assert(err, qt.ErrorMatches, `dictionary "invoices": ID \d+ has been replaced by \d+`)
+	old, err := cache.get(ctx, "invoices", uint32(id))
+	c.Assert(err, qt.IsNil)
+	c.Assert(old.id, qt.Equals, uint32(id))
+	c.Assert(fetches, qt.Equals, 2)
+
+	_, err = decompressBody(ctx, f, map[string]string{MetaContentEncoding: contentEncodingZstd}, cache)
+	c.Assert(err, qt.ErrorMatches, "decompress: missing dictionary")
+}
@@ -0,0 +1,268 @@
+package s3rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// maxDiffPaths is the max number of differing JSON paths reported in an OutputDiff.
+const maxDiffPaths = 100
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// IgnoreMetadata are metadata keys not compared.
+	// The s3rpc- keys set by the server, e.g. MetaInstanceID, are always ignored.
+	IgnoreMetadata []string
+
+	// JSON, if set, compares outputs that are valid JSON structurally,
+	// reporting the differing paths instead of a byte offset.
+	JSON bool
+}
+
+// OutputDiff describes the differences between two Outputs.
+type OutputDiff struct {
+	// Equal is whether the outputs are equal.
+	Equal bool
+
+	// ContentType holds the content types of a and b, if they differ.
+	ContentType [2]string `json:",omitempty"`
+
+	// Metadata holds the values in a and b of the differing metadata keys.
+	Metadata map[string][2]string `json:",omitempty"`
+
+	// Size holds the sizes of a and b.
+	Size [2]int64
+
+	// Offset is the first differing byte offset, or -1 if the content is equal
+	// or compared as JSON.
+	Offset int64
+
+	// Paths are the differing JSON paths, e.g. "$.items[2].name", with DiffOptions.JSON.
+	Paths []string `json:",omitempty"`
+}
+
+// String returns a short summary of the differences.
+func (d OutputDiff) String() string {
+	if d.Equal {
+		return "equal"
+	}
+	var parts []string
+	if d.ContentType != [2]string{} {
+		parts = append(parts, fmt.Sprintf("content type %q != %q", d.ContentType[0], d.ContentType[1]))
+	}
+	keys := make([]string, 0, len(d.Metadata))
+	for k := range d.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("metadata %s %q != %q", k, d.Metadata[k][0], d.Metadata[k][1]))
+	}
+	if d.Offset >= 0 {
+		parts = append(parts, fmt.Sprintf("content differs at byte %d (sizes %d and %d)", d.Offset, d.Size[0], d.Size[1]))
+	}
+	if len(d.Paths) > 0 {
+		parts = append(parts, "content differs at "+strings.Join(d.Paths, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Diff runs input through a and b concurrently and compares their outputs,
+// e.g. for regression testing an updated handler deployed as a new op or to a second server:
+//
+//	diff, err := s3rpc.Diff(ctx, input,
+//		func(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) { return client.Execute(ctx, "resize", input) },
+//		func(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) { return client.Execute(ctx, "resize-v2", input) },
+//		s3rpc.DiffOptions{},
+//	)
+func Diff(ctx context.Context, input Input, a, b func(ctx context.Context, input Input) (Output, error), opts DiffOptions) (OutputDiff, error) {
+	var outputs [2]Output
+	g, ctx := errgroup.WithContext(ctx)
+	for i, execute := range []func(ctx context.Context, input Input) (Output, error){a, b} {
+		i, execute := i, execute
+		g.Go(func() error {
+			output, err := execute(ctx, input)
+			if err != nil {
+				return fmt.Errorf("diff: output %d: %w", i+1, err)
+			}
+			outputs[i] = output
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return OutputDiff{}, err
+	}
+	return DiffOutputs(outputs[0], outputs[1], opts)
+}
+
+// DiffOutputs compares the content type, metadata and content of a and b.
+func DiffOutputs(a, b Output, opts DiffOptions) (OutputDiff, error) {
+	d := OutputDiff{Offset: -1}
+
+	if a.ContentType != b.ContentType {
+		d.ContentType = [2]string{a.ContentType, b.ContentType}
+	}
+
+	ignored := make(map[string]bool, len(opts.IgnoreMetadata))
+	for _, k := range opts.IgnoreMetadata {
+		ignored[strings.ToLower(k)] = true
+	}
+	for _, m := range []map[string]string{a.Metadata, b.Metadata} {
+		for k := range m {
+			if ignored[strings.ToLower(k)] || strings.HasPrefix(strings.ToLower(k), "s3rpc-") {
+				continue
+			}
+			if va, vb := a.Metadata[k], b.Metadata[k]; va != vb {
+				if d.Metadata == nil {
+					d.Metadata = make(map[string][2]string)
+				}
+				d.Metadata[k] = [2]string{va, vb}
+			}
+		}
+	}
+
+	for i, filename := range []string{a.Filename, b.Filename} {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return OutputDiff{}, err
+		}
+		d.Size[i] = fi.Size()
+	}
+
+	contentEqual := true
+	if opts.JSON {
+		paths, ok, err := diffJSONFiles(a.Filename, b.Filename)
+		if err != nil {
+			return OutputDiff{}, err
+		}
+		if ok {
+			d.Paths = paths
+			contentEqual = len(paths) == 0
+		} else {
+			opts.JSON = false
+		}
+	}
+	if !opts.JSON {
+		offset, err := diffFiles(a.Filename, b.Filename)
+		if err != nil {
+			return OutputDiff{}, err
+		}
+		d.Offset = offset
+		contentEqual = offset < 0
+	}
+
+	d.Equal = contentEqual && d.ContentType == [2]string{} && len(d.Metadata) == 0
+	return d, nil
+}
+
+// diffFiles returns the first differing byte offset of a and b, or -1 if they are equal.
+func diffFiles(a, b string) (int64, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return 0, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return 0, err
+	}
+	defer fb.Close()
+
+	ra, rb := bufio.NewReader(fa), bufio.NewReader(fb)
+	for offset := int64(0); ; offset++ {
+		ca, errA := ra.ReadByte()
+		cb, errB := rb.ReadByte()
+		if errA == io.EOF && errB == io.EOF {
+			return -1, nil
+		}
+		if errA != nil && errA != io.EOF {
+			return 0, errA
+		}
+		if errB != nil && errB != io.EOF {
+			return 0, errB
+		}
+		if errA != nil || errB != nil || ca != cb {
+			return offset, nil
+		}
+	}
+}
+
+// diffJSONFiles returns the differing paths of a and b,
+// and false if either is not valid JSON.
+func diffJSONFiles(a, b string) ([]string, bool, error) {
+	var values [2]interface{}
+	for i, filename := range []string{a, b} {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, false, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.UseNumber()
+		if err := dec.Decode(&values[i]); err != nil {
+			return nil, false, nil
+		}
+	}
+	var paths []string
+	diffJSON("$", values[0], values[1], &paths)
+	return paths, true, nil
+}
+
+func diffJSON(path string, a, b interface{}, paths *[]string) {
+	if len(*paths) >= maxDiffPaths {
+		return
+	}
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, found := va[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(path+"."+k, va[k], vb[k], paths)
+		}
+		return
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		n := len(va)
+		if len(vb) > n {
+			n = len(vb)
+		}
+		for i := 0; i < n; i++ {
+			var ea, eb interface{}
+			if i < len(va) {
+				ea = va[i]
+			}
+			if i < len(vb) {
+				eb = vb[i]
+			}
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), ea, eb, paths)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*paths = append(*paths, path)
+	}
+}
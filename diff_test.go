@@ -0,0 +1,86 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDiff(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+		return filename
+	}
+
+	handler := func(content string, metadata map[string]string) func(ctx context.Context, input Input) (Output, error) {
+		return func(ctx context.Context, input Input) (Output, error) {
+			return Output{Filename: write(content+".txt", content), Metadata: metadata, ContentType: "text/plain"}, nil
+		}
+	}
+
+	ctx := context.Background()
+	input := Input{Filename: write("input.txt", "input")}
+	d, err := Diff(ctx, input,
+		handler("abcdef", map[string]string{"k": "v", MetaInstanceID: "server1"}),
+		handler("abcxef", map[string]string{"k": "v", MetaInstanceID: "server2"}),
+		DiffOptions{},
+	)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Equal, qt.IsFalse)
+	c.Assert(d.Offset, qt.Equals, int64(3))
+	c.Assert(d.Metadata, qt.IsNil)
+	c.Assert(d.String(), qt.Equals, "content differs at byte 3 (sizes 6 and 6)")
+
+	d, err = DiffOutputs(
+		Output{Filename: write("a.txt", "same"), Metadata: map[string]string{"width": "100", "time": "1"}},
+		Output{Filename: write("b.txt", "same"), Metadata: map[string]string{"width": "101", "time": "2"}, ContentType: "text/plain"},
+		DiffOptions{IgnoreMetadata: []string{"Time"}},
+	)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Equal, qt.IsFalse)
+	c.Assert(d.Offset, qt.Equals, int64(-1))
+	c.Assert(d.String(), qt.Equals, `content type "" != "text/plain"; metadata width "100" != "101"`)
+
+	d, err = DiffOutputs(Output{Filename: write("a.txt", "same")}, Output{Filename: write("b.txt", "same!")}, DiffOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Offset, qt.Equals, int64(4))
+
+	d, err = DiffOutputs(Output{Filename: write("a.txt", "same")}, Output{Filename: write("b.txt", "same")}, DiffOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Equal, qt.IsTrue)
+	c.Assert(d.String(), qt.Equals, "equal")
+}
+
+func TestDiffJSON(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	write := func(name, content string) Output {
+		filename := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+		return Output{Filename: filename}
+	}
+
+	a := write("a.json", `{"name": "a", "items": [{"id": 1}, {"id": 2}], "same": true}`)
+	b := write("b.json", `{"same":true,"items":[{"id":1},{"id":3},{"id":4}],"name":"a","extra":1}`)
+	d, err := DiffOutputs(a, b, DiffOptions{JSON: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Equal, qt.IsFalse)
+	c.Assert(d.Paths, qt.DeepEquals, []string{"$.extra", "$.items[1].id", "$.items[2]"})
+
+	d, err = DiffOutputs(a, write("c.json", `{"name":"a","items":[{"id":1},{"id":2}],"same":true}`), DiffOptions{JSON: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Equal, qt.IsTrue)
+
+	// Not JSON, compared byte by byte.
+	d, err = DiffOutputs(a, write("d.txt", "not json"), DiffOptions{JSON: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Offset, qt.Equals, int64(0))
+}
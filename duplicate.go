@@ -0,0 +1,53 @@
+package s3rpc
+
+import (
+	"sync"
+)
+
+// recentResponsesSize is the number of response messages a client remembers,
+// enough to cover the redeliveries of the messages it deleted in the last minutes.
+const recentResponsesSize = 1000
+
+// recentResponses remembers the IDs of the response messages the client has completed,
+// so a copy delivered again, e.g. because the visibility timeout expired before the
+// client deleted the first, is recognized and deleted instead of being handled twice
+// or passed around between clients.
+type recentResponses struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+func newRecentResponses(size int) *recentResponses {
+	return &recentResponses{ids: make(map[string]struct{}, size), order: make([]string, size)}
+}
+
+// add remembers the message with the given ID, forgetting the oldest if full.
+func (r *recentResponses) add(id string) {
+	if r == nil || id == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.ids[id]; found {
+		return
+	}
+	if oldest := r.order[r.next]; oldest != "" {
+		delete(r.ids, oldest)
+	}
+	r.order[r.next] = id
+	r.next = (r.next + 1) % len(r.order)
+	r.ids[id] = struct{}{}
+}
+
+// contains reports whether the message with the given ID was completed.
+func (r *recentResponses) contains(id string) bool {
+	if r == nil || id == "" {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, found := r.ids[id]
+	return found
+}
@@ -0,0 +1,34 @@
+package s3rpc
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRecentResponses(t *testing.T) {
+	c := qt.New(t)
+
+	var nilResponses *recentResponses
+	nilResponses.add("m1")
+	c.Assert(nilResponses.contains("m1"), qt.IsFalse)
+
+	r := newRecentResponses(3)
+	r.add("")
+	c.Assert(r.contains(""), qt.IsFalse)
+
+	r.add("m1")
+	r.add("m2")
+	r.add("m1")
+	r.add("m3")
+	c.Assert(r.contains("m1"), qt.IsTrue)
+	c.Assert(r.contains("m2"), qt.IsTrue)
+	c.Assert(r.contains("m3"), qt.IsTrue)
+	c.Assert(r.contains("m4"), qt.IsFalse)
+
+	// The oldest is forgotten.
+	r.add("m4")
+	c.Assert(r.contains("m1"), qt.IsFalse)
+	c.Assert(r.contains("m4"), qt.IsTrue)
+	c.Assert(r.ids, qt.HasLen, 3)
+}
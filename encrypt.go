@@ -0,0 +1,135 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// MetaEncryptedKeys holds the comma separated metadata keys of a request
+// with values encrypted with KMS, see ClientOptions.EncryptMetadata.
+const MetaEncryptedKeys = "s3rpc-encrypted-keys"
+
+// EncryptMetadataOptions configures the client to encrypt sensitive metadata values with KMS
+// before upload, e.g. callback tokens or credentials for downstream systems,
+// so they never sit in plaintext in the object metadata.
+// Servers with ServerOptions.DecryptMetadata decrypt them before the request is handled.
+//
+// Each value is encrypted with the op and its metadata key as the KMS encryption context,
+// so it can not be moved to another key or op.
+// The client user needs kms:Encrypt and the server user kms:Decrypt on the key.
+// Use a multi-Region key with ClientOptions.FailoverEndpoints in other regions.
+type EncryptMetadataOptions struct {
+	// KMSKeyID is the ID, ARN or alias of the KMS key. Required.
+	KMSKeyID string
+
+	// Keys are the metadata keys with values to encrypt, e.g. MetaCallbackURL.
+	// Keys not set in a request are skipped.
+	Keys []string
+}
+
+func (o *EncryptMetadataOptions) init() error {
+	if o.KMSKeyID == "" {
+		return errors.New("encrypt metadata: KMS key ID is required")
+	}
+	if len(o.Keys) == 0 {
+		return errors.New("encrypt metadata: keys are required")
+	}
+	for i, k := range o.Keys {
+		// S3 lower cases the metadata keys.
+		k = strings.ToLower(k)
+		if k == "" || strings.Contains(k, ",") || strings.HasPrefix(k, "s3rpc-") && k != MetaCallbackURL && k != MetaTaskToken {
+			return fmt.Errorf("encrypt metadata: invalid key %q", o.Keys[i])
+		}
+		o.Keys[i] = k
+	}
+	return nil
+}
+
+// kmsClient is the subset of the KMS API used to encrypt and decrypt metadata.
+type kmsClient interface {
+	Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// metadataEncryptionContext returns the KMS encryption context of the metadata value with the given key.
+func metadataEncryptionContext(op, key string) map[string]string {
+	return map[string]string{"s3rpc-op": op, "s3rpc-metadata-key": key}
+}
+
+// metadataEncrypter encrypts metadata values, see EncryptMetadataOptions.
+type metadataEncrypter struct {
+	opts   EncryptMetadataOptions
+	client kmsClient
+}
+
+func newMetadataEncrypter(opts *EncryptMetadataOptions, client kmsClient) *metadataEncrypter {
+	if opts == nil {
+		return nil
+	}
+	return &metadataEncrypter{opts: *opts, client: client}
+}
+
+// encrypt encrypts the values of the configured keys in the metadata of a request for op, in place.
+func (e *metadataEncrypter) encrypt(ctx context.Context, op string, metadata map[string]string) error {
+	if e == nil {
+		return nil
+	}
+	var encrypted []string
+	for _, k := range e.opts.Keys {
+		v, found := metadata[k]
+		if !found {
+			continue
+		}
+		out, err := e.client.Encrypt(ctx, &kms.EncryptInput{
+			KeyId:             aws.String(e.opts.KMSKeyID),
+			Plaintext:         []byte(v),
+			EncryptionContext: metadataEncryptionContext(op, k),
+		})
+		if err != nil {
+			return fmt.Errorf("encrypt metadata %q: %w", k, err)
+		}
+		metadata[k] = base64.StdEncoding.EncodeToString(out.CiphertextBlob)
+		encrypted = append(encrypted, k)
+	}
+	if len(encrypted) > 0 {
+		sort.Strings(encrypted)
+		metadata[MetaEncryptedKeys] = strings.Join(encrypted, ",")
+	}
+	return nil
+}
+
+// decryptMetadata decrypts the values encrypted by a metadataEncrypter in the metadata
+// of a request for op, in place, removing MetaEncryptedKeys.
+// client is nil if the server does not decrypt metadata.
+func decryptMetadata(ctx context.Context, client kmsClient, op string, metadata map[string]string) error {
+	list, found := metadata[MetaEncryptedKeys]
+	if !found {
+		return nil
+	}
+	if client == nil {
+		return errors.New("request has encrypted metadata, but the server does not decrypt it")
+	}
+	for _, k := range strings.Split(list, ",") {
+		ciphertext, err := base64.StdEncoding.DecodeString(metadata[k])
+		if err != nil || len(ciphertext) == 0 {
+			return fmt.Errorf("decrypt metadata %q: invalid value", k)
+		}
+		out, err := client.Decrypt(ctx, &kms.DecryptInput{
+			CiphertextBlob:    ciphertext,
+			EncryptionContext: metadataEncryptionContext(op, k),
+		})
+		if err != nil {
+			return fmt.Errorf("decrypt metadata %q: %w", k, err)
+		}
+		metadata[k] = string(out.Plaintext)
+	}
+	delete(metadata, MetaEncryptedKeys)
+	return nil
+}
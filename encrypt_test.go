@@ -0,0 +1,77 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	qt "github.com/frankban/quicktest"
+)
+
+// fakeKMS "encrypts" by prefixing the plaintext with the encryption context.
+type fakeKMS struct{}
+
+func (fakeKMS) Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	return &kms.EncryptOutput{CiphertextBlob: []byte(fakeKMSContext(params.EncryptionContext) + string(params.Plaintext))}, nil
+}
+
+func (fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	prefix := fakeKMSContext(params.EncryptionContext)
+	b := string(params.CiphertextBlob)
+	if len(b) < len(prefix) || b[:len(prefix)] != prefix {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{Plaintext: []byte(b[len(prefix):])}, nil
+}
+
+func fakeKMSContext(c map[string]string) string {
+	return fmt.Sprintf("%s|%s|", c["s3rpc-op"], c["s3rpc-metadata-key"])
+}
+
+func TestEncryptMetadata(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	c.Assert((&EncryptMetadataOptions{Keys: []string{"token"}}).init(), qt.ErrorMatches, "encrypt metadata: KMS key ID is required")
+	c.Assert((&EncryptMetadataOptions{KMSKeyID: "alias/s3rpc"}).init(), qt.ErrorMatches, "encrypt metadata: keys are required")
+	c.Assert((&EncryptMetadataOptions{KMSKeyID: "alias/s3rpc", Keys: []string{"a,b"}}).init(), qt.ErrorMatches, `encrypt metadata: invalid key "a,b"`)
+	c.Assert((&EncryptMetadataOptions{KMSKeyID: "alias/s3rpc", Keys: []string{MetaIdentityUser}}).init(), qt.ErrorMatches, `encrypt metadata: invalid key "s3rpc-identity-user"`)
+
+	opts := &EncryptMetadataOptions{KMSKeyID: "alias/s3rpc", Keys: []string{"Token", MetaCallbackURL, "missing"}}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Keys, qt.DeepEquals, []string{"token", MetaCallbackURL, "missing"})
+
+	var nilEncrypter *metadataEncrypter
+	c.Assert(nilEncrypter.encrypt(ctx, "ocr", map[string]string{"token": "secret"}), qt.IsNil)
+
+	e := newMetadataEncrypter(opts, fakeKMS{})
+	encrypt := func() map[string]string {
+		metadata := map[string]string{"token": "secret", MetaCallbackURL: "https://example.com/cb", "lang": "en"}
+		c.Assert(e.encrypt(ctx, "ocr", metadata), qt.IsNil)
+		return metadata
+	}
+	metadata := encrypt()
+	c.Assert(metadata["token"], qt.Not(qt.Equals), "secret")
+	c.Assert(metadata["lang"], qt.Equals, "en")
+	c.Assert(metadata[MetaEncryptedKeys], qt.Equals, "s3rpc-callback-url,token")
+
+	c.Assert(decryptMetadata(ctx, fakeKMS{}, "ocr", metadata), qt.IsNil)
+	c.Assert(metadata, qt.DeepEquals, map[string]string{"token": "secret", MetaCallbackURL: "https://example.com/cb", "lang": "en"})
+
+	// Nothing to decrypt.
+	c.Assert(decryptMetadata(ctx, nil, "ocr", map[string]string{"lang": "en"}), qt.IsNil)
+
+	c.Assert(decryptMetadata(ctx, nil, "ocr", encrypt()), qt.ErrorMatches, "request has encrypted metadata, but the server does not decrypt it")
+	c.Assert(decryptMetadata(ctx, fakeKMS{}, "delete", encrypt()), qt.ErrorMatches, `decrypt metadata "s3rpc-callback-url": InvalidCiphertextException`)
+
+	// A value moved to another key.
+	moved := encrypt()
+	moved["token"] = moved[MetaCallbackURL]
+	c.Assert(decryptMetadata(ctx, fakeKMS{}, "ocr", moved), qt.ErrorMatches, `decrypt metadata "token": InvalidCiphertextException`)
+
+	missing := encrypt()
+	delete(missing, "token")
+	c.Assert(decryptMetadata(ctx, fakeKMS{}, "ocr", missing), qt.ErrorMatches, `decrypt metadata "token": invalid value`)
+}
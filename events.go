@@ -0,0 +1,123 @@
+package s3rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types, see Event.Type.
+const (
+	// EventRequestReceived is published when the server takes a request off the queue.
+	EventRequestReceived = "request_received"
+
+	// EventHandlerStarted is published when the server invokes the handler.
+	EventHandlerStarted = "handler_started"
+
+	// EventHandlerFinished is published when the handler returns.
+	// Duration is the handler duration and Err the handler error, if any.
+	EventHandlerFinished = "handler_finished"
+
+	// EventHandlerStuck is published when a handler has run for longer than
+	// StuckHandlerOptions allow. Duration is how long it had run.
+	// Key is empty.
+	EventHandlerStuck = "handler_stuck"
+
+	// EventResponseUploaded is published when the server has uploaded the response.
+	// For an error response, Err is the *ResponseError sent to the client.
+	EventResponseUploaded = "response_uploaded"
+
+	// EventResponseDownloaded is published when the client has downloaded the response.
+	// Duration is the time from the start of the upload.
+	EventResponseDownloaded = "response_downloaded"
+
+	// EventError is published when the server fails to handle a request without a response,
+	// or when a client request to an endpoint fails.
+	EventError = "error"
+)
+
+// Event is a request lifecycle event published to an EventBus.
+type Event struct {
+	// Type is one of the Event* constants.
+	Type string
+
+	// Op, RequestID and Key identify the request.
+	// RequestID and Key are empty for client errors.
+	Op        string
+	RequestID string
+	Key       string
+
+	// Size is the input size for EventHandlerStarted and the response size
+	// for EventResponseUploaded and EventResponseDownloaded.
+	Size int64
+
+	Duration time.Duration
+	Err      error
+	Time     time.Time
+}
+
+// EventBus publishes request lifecycle events to subscribers,
+// e.g. to build dashboards or react to failures without parsing logs.
+// See ServerOptions.Events and ClientOptions.Events.
+// A bus can be shared by clients and servers in the same process.
+type EventBus struct {
+	mu      sync.Mutex
+	subs    map[chan Event]struct{}
+	dropped uint64
+}
+
+// NewEventBus creates a new EventBus.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving the events published from now on
+// and a function that unsubscribes and closes the channel.
+// Events are dropped if the channel's buffer of the given size is full,
+// so a slow subscriber never blocks request handling, see Dropped.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			close(ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Dropped returns the number of events dropped because a subscriber's buffer was full.
+func (b *EventBus) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+func (b *EventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+	e.Time = time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			b.dropped++
+		}
+	}
+}
+
+// event publishes an event for the request with the given key.
+func (s *Server) event(op, key string, e Event) {
+	e.Op = op
+	e.Key = key
+	e.RequestID = requestID(key)
+	s.events.publish(e)
+}
@@ -0,0 +1,56 @@
+package s3rpc
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEventBus(t *testing.T) {
+	c := qt.New(t)
+
+	var nilBus *EventBus
+	nilBus.publish(Event{Type: EventError})
+
+	b := NewEventBus()
+	events, unsubscribe := b.Subscribe(2)
+	other, unsubscribeOther := b.Subscribe(1)
+	defer unsubscribeOther()
+
+	b.publish(Event{Type: EventRequestReceived, Op: "resize"})
+	b.publish(Event{Type: EventError, Op: "resize", Err: errors.New("failed")})
+
+	e := <-events
+	c.Assert(e.Type, qt.Equals, EventRequestReceived)
+	c.Assert(e.Time.IsZero(), qt.IsFalse)
+	e = <-events
+	c.Assert(e.Type, qt.Equals, EventError)
+	c.Assert(e.Err, qt.ErrorMatches, "failed")
+
+	// The second event did not fit in the other subscriber's buffer.
+	c.Assert((<-other).Type, qt.Equals, EventRequestReceived)
+	c.Assert(b.Dropped(), qt.Equals, uint64(1))
+
+	unsubscribe()
+	unsubscribe()
+	_, ok := <-events
+	c.Assert(ok, qt.IsFalse)
+
+	b.publish(Event{Type: EventHandlerStarted})
+	c.Assert((<-other).Type, qt.Equals, EventHandlerStarted)
+}
+
+func TestServerEvent(t *testing.T) {
+	c := qt.New(t)
+
+	b := NewEventBus()
+	events, unsubscribe := b.Subscribe(1)
+	defer unsubscribe()
+
+	s := &Server{events: b}
+	s.event("resize", "to_server/resize/01ARZ3NDEKTSV4RRFFQ69G5FAV_a.jpg", Event{Type: EventHandlerFinished})
+	e := <-events
+	c.Assert(e.Op, qt.Equals, "resize")
+	c.Assert(e.RequestID, qt.Equals, "01ARZ3NDEKTSV4RRFFQ69G5FAV")
+}
@@ -0,0 +1,49 @@
+package s3rpc_test
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/bep/s3rpc"
+	"github.com/bep/s3rpc/handlers/image"
+)
+
+// This server runs a validate, scan, convert and publish pipeline for the convert op:
+// inputs are checked by the validators and clamd before the handler runs,
+// rejected inputs are quarantined and get an error response,
+// and completions are published to SNS. All inputs are archived for replay.
+func ExampleNewServer_pipeline() {
+	server, err := s3rpc.NewServer(s3rpc.ServerOptions{
+		Handlers: s3rpc.Handlers{
+			"convert": image.Convert,
+		},
+		Validators: map[string]s3rpc.Validator{
+			"convert": s3rpc.CombineValidators(
+				s3rpc.MaxSizeValidator(20<<20),
+				s3rpc.ContentTypeValidator("image/"),
+			),
+		},
+		Scan: &s3rpc.ScanOptions{
+			Scan:   s3rpc.ClamdScanner("tcp", "localhost:3310"),
+			Action: s3rpc.ScanQuarantine,
+		},
+		Quarantine: true,
+		Archive:    true,
+		SNS:        &s3rpc.SNSOptions{TopicArn: os.Getenv("S3RPC_TOPIC_ARN")},
+		Queue:      os.Getenv("S3RPC_SERVER_QUEUE"),
+		AWSConfig: s3rpc.AWSConfig{
+			Bucket:          os.Getenv("S3RPC_BUCKET"),
+			AccessKeyID:     os.Getenv("S3RPC_SERVER_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3RPC_SERVER_SECRET_ACCESS_KEY"),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+
+	if err := server.ListenAndServe(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
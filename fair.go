@@ -0,0 +1,191 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FairSchedulingOptions configures the server to interleave the requests of different flows,
+// e.g. ops or tenants, with weighted fair queueing instead of starting them in the order
+// they are received, so a burst from one flow does not monopolize the server.
+//
+// The server receives up to Buffer requests ahead of its free slots and starts the request
+// of the flow that has been served the least relative to its weight.
+// Requests not started within a few seconds are released back to the queue,
+// before their SQS visibility timeout expires.
+type FairSchedulingOptions struct {
+	// Flow returns the flow of the request for op with the given key.
+	// Defaults to the op. Return e.g. the tenant in the key to schedule per tenant.
+	Flow func(op, key string) string
+
+	// Weights maps a flow to its weight, e.g. 2 to get twice the share of a flow with weight 1.
+	// Defaults to 1.
+	Weights map[string]int
+
+	// Buffer is the max number of received requests waiting to be started.
+	// Defaults to 10.
+	Buffer int
+}
+
+func (o *FairSchedulingOptions) init() error {
+	if o.Buffer < 0 {
+		return errors.New("fair scheduling: buffer can not be negative")
+	}
+	for flow, w := range o.Weights {
+		if w <= 0 {
+			return fmt.Errorf("fair scheduling: weight of %q must be positive", flow)
+		}
+	}
+	if o.Flow == nil {
+		o.Flow = func(op, key string) string {
+			return op
+		}
+	}
+	if o.Buffer == 0 {
+		o.Buffer = 10
+	}
+	return nil
+}
+
+// maxScheduledWait is how long a request may wait in the fair scheduler before it is
+// released back to the queue. With the expiry checked every second, this is within visibilitySeconds.
+const maxScheduledWait = 5 * time.Second
+
+// releaseScheduled makes requests taken out of the fair scheduler unstarted available again.
+func (s *Server) releaseScheduled(ctx context.Context, ms []message) {
+	for _, m := range ms {
+		if err := s.retryMessage(ctx, m, 0); err != nil {
+			s.logf(ctx, "Failed to release %q: %s", m.Key, err)
+		}
+	}
+}
+
+// fairScheduler buffers received requests and hands them out with start-time fair queueing:
+// each request gets a virtual start time from when its flow's previous request finishes,
+// with a cost of 1/weight, and the request with the earliest start time is started first.
+// It is only used from the server's receive loop, so it needs no locking.
+type fairScheduler struct {
+	opts FairSchedulingOptions
+	now  func() time.Time
+
+	// vtime is the virtual time, the start time of the last request taken.
+	vtime float64
+
+	// finish maps a flow to the virtual finish time of its last queued request.
+	finish map[string]float64
+
+	seq    int
+	queued []scheduledMessage
+}
+
+type scheduledMessage struct {
+	m        message
+	flow     string
+	start    float64
+	seq      int
+	received time.Time
+}
+
+func newFairScheduler(opts *FairSchedulingOptions) *fairScheduler {
+	if opts == nil {
+		return nil
+	}
+	return &fairScheduler{opts: *opts, now: time.Now, finish: make(map[string]float64)}
+}
+
+// len returns the number of requests waiting.
+func (f *fairScheduler) len() int {
+	return len(f.queued)
+}
+
+// room returns the number of requests that can be added.
+func (f *fairScheduler) room() int {
+	return f.opts.Buffer - len(f.queued)
+}
+
+// expiryCheckInterval returns how often the waiting requests need to be checked with expired,
+// 0 if there are none.
+func (f *fairScheduler) expiryCheckInterval() time.Duration {
+	if f == nil || len(f.queued) == 0 {
+		return 0
+	}
+	return time.Second
+}
+
+// push adds received requests.
+func (f *fairScheduler) push(ms []message) {
+	now := f.now()
+	for _, m := range ms {
+		flow := f.opts.Flow(m.Op, m.Key)
+		weight := f.opts.Weights[flow]
+		if weight == 0 {
+			weight = 1
+		}
+		start := f.vtime
+		if finish := f.finish[flow]; finish > start {
+			start = finish
+		}
+		f.finish[flow] = start + 1/float64(weight)
+		f.seq++
+		f.queued = append(f.queued, scheduledMessage{m: m, flow: flow, start: start, seq: f.seq, received: now})
+	}
+}
+
+// take removes and returns up to n requests in fair order.
+func (f *fairScheduler) take(n int) []message {
+	var ms []message
+	for ; n > 0 && len(f.queued) > 0; n-- {
+		next := 0
+		for i, q := range f.queued {
+			if q.start < f.queued[next].start || q.start == f.queued[next].start && q.seq < f.queued[next].seq {
+				next = i
+			}
+		}
+		q := f.queued[next]
+		f.queued = append(f.queued[:next], f.queued[next+1:]...)
+		f.vtime = q.start
+		ms = append(ms, q.m)
+	}
+	// Forget the flows that are idle, their next request starts at the virtual time.
+	busy := make(map[string]bool, len(f.queued))
+	for _, q := range f.queued {
+		busy[q.flow] = true
+	}
+	for flow, finish := range f.finish {
+		if finish <= f.vtime && !busy[flow] {
+			delete(f.finish, flow)
+		}
+	}
+	return ms
+}
+
+// expired removes and returns the requests that have waited longer than maxScheduledWait.
+func (f *fairScheduler) expired() []message {
+	var ms []message
+	now := f.now()
+	queued := f.queued[:0]
+	for _, q := range f.queued {
+		if now.Sub(q.received) > maxScheduledWait {
+			ms = append(ms, q.m)
+			continue
+		}
+		queued = append(queued, q)
+	}
+	f.queued = queued
+	return ms
+}
+
+// drain removes and returns all requests.
+func (f *fairScheduler) drain() []message {
+	if f == nil {
+		return nil
+	}
+	ms := make([]message, len(f.queued))
+	for i, q := range f.queued {
+		ms[i] = q.m
+	}
+	f.queued = nil
+	return ms
+}
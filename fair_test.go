@@ -0,0 +1,67 @@
+package s3rpc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFairScheduler(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&FairSchedulingOptions{Buffer: -1}).init(), qt.ErrorMatches, "fair scheduling: buffer can not be negative")
+	c.Assert((&FairSchedulingOptions{Weights: map[string]int{"ocr": 0}}).init(), qt.ErrorMatches, `fair scheduling: weight of "ocr" must be positive`)
+
+	var nilScheduler *fairScheduler
+	c.Assert(nilScheduler.drain(), qt.IsNil)
+	c.Assert(nilScheduler.expiryCheckInterval(), qt.Equals, time.Duration(0))
+
+	msgs := func(ops ...string) []message {
+		var ms []message
+		for i, op := range ops {
+			ms = append(ms, message{Op: op, Key: requestKey(op, strings.Repeat("a", i+1), "f.txt", time.Time{})})
+		}
+		return ms
+	}
+	ops := func(ms []message) string {
+		var s []string
+		for _, m := range ms {
+			s = append(s, m.Op)
+		}
+		return strings.Join(s, ",")
+	}
+
+	opts := &FairSchedulingOptions{Weights: map[string]int{"ocr": 2}}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Buffer, qt.Equals, 10)
+	f := newFairScheduler(opts)
+	c.Assert(f.room(), qt.Equals, 10)
+
+	// A burst of resize requests does not hold up the others,
+	// and ocr gets twice the share of resize.
+	f.push(msgs("resize", "resize", "resize", "resize", "resize", "ocr", "ocr", "ocr", "ocr", "pdf"))
+	c.Assert(f.room(), qt.Equals, 0)
+	c.Assert(f.expiryCheckInterval(), qt.Equals, time.Second)
+	c.Assert(ops(f.take(3)), qt.Equals, "resize,ocr,pdf")
+	c.Assert(ops(f.take(4)), qt.Equals, "ocr,resize,ocr,ocr")
+	c.Assert(ops(f.take(10)), qt.Equals, "resize,resize,resize")
+	c.Assert(f.len(), qt.Equals, 0)
+
+	// A flow that was idle does not get credit for it.
+	f.push(msgs("resize", "resize"))
+	c.Assert(ops(f.take(1)), qt.Equals, "resize")
+	f.push(msgs("pdf"))
+	c.Assert(ops(f.take(2)), qt.Equals, "pdf,resize")
+
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	f.push(msgs("resize", "pdf"))
+	c.Assert(f.expired(), qt.HasLen, 0)
+	now = now.Add(maxScheduledWait + time.Second)
+	f.push(msgs("ocr"))
+	c.Assert(ops(f.expired()), qt.Equals, "resize,pdf")
+	c.Assert(ops(f.drain()), qt.Equals, "ocr")
+	c.Assert(f.len(), qt.Equals, 0)
+}
@@ -0,0 +1,50 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+)
+
+// OutputFilter inspects or transforms a handler's Output before it is uploaded,
+// e.g. to verify that the result is a valid PDF or to strip EXIF data from an image.
+// A non-nil error is sent to the client as a ResponseError with code ErrorCodeHandler.
+// See ServerOptions.OutputFilters.
+type OutputFilter func(ctx context.Context, input Input, output Output) (Output, error)
+
+// CombineOutputFilters returns an OutputFilter that runs filters in order,
+// passing the Output of one to the next and stopping at the first error.
+func CombineOutputFilters(filters ...OutputFilter) OutputFilter {
+	return func(ctx context.Context, input Input, output Output) (Output, error) {
+		for _, f := range filters {
+			var err error
+			if output, err = f(ctx, input, output); err != nil {
+				return output, err
+			}
+		}
+		return output, nil
+	}
+}
+
+// ValidateOutput returns an OutputFilter that runs v on the Output, leaving it unchanged,
+// e.g. ValidateOutput(ContentTypeValidator("application/pdf")).
+func ValidateOutput(v Validator) OutputFilter {
+	return func(ctx context.Context, input Input, output Output) (Output, error) {
+		return output, v(ctx, Input{Filename: output.Filename, Metadata: output.Metadata, ContentType: output.ContentType})
+	}
+}
+
+// filterOutput runs the filter for op, if any, on result.
+// Files created by the filter are removed by the returned cleanup function.
+func (s *Server) filterOutput(ctx context.Context, op string, input Input, result Output) (Output, func(), error) {
+	filter := s.outputFilters[op]
+	if filter == nil {
+		return result, func() {}, nil
+	}
+	filtered, err := filter(ctx, input, result)
+	cleanup := func() {
+		if filtered.Filename != "" && filtered.Filename != result.Filename {
+			os.Remove(filtered.Filename)
+		}
+	}
+	return filtered, cleanup, err
+}
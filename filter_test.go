@@ -0,0 +1,56 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestOutputFilters(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	dir := c.TempDir()
+	result := Output{Filename: filepath.Join(dir, "result.txt")}
+	c.Assert(os.WriteFile(result.Filename, []byte("hello"), 0o644), qt.IsNil)
+
+	transformed := filepath.Join(dir, "transformed.txt")
+	transform := func(ctx context.Context, input Input, output Output) (Output, error) {
+		return Output{Filename: transformed, Metadata: map[string]string{"filtered": "true"}}, os.WriteFile(transformed, []byte("HELLO"), 0o644)
+	}
+
+	s := &Server{outputFilters: map[string]OutputFilter{
+		"upper": CombineOutputFilters(ValidateOutput(ContentTypeValidator("text/")), transform),
+		"pdf":   ValidateOutput(ContentTypeValidator("application/pdf")),
+		"fail": func(ctx context.Context, input Input, output Output) (Output, error) {
+			return output, errors.New("fail")
+		},
+	}}
+
+	filtered, cleanup, err := s.filterOutput(ctx, "upper", Input{}, result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(filtered.Filename, qt.Equals, transformed)
+	c.Assert(filtered.Metadata["filtered"], qt.Equals, "true")
+	cleanup()
+	_, err = os.Stat(transformed)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+	_, err = os.Stat(result.Filename)
+	c.Assert(err, qt.IsNil)
+
+	_, _, err = s.filterOutput(ctx, "pdf", Input{}, result)
+	c.Assert(err, qt.ErrorMatches, `content type "text/plain.*" is not allowed`)
+
+	filtered, cleanup, err = s.filterOutput(ctx, "none", Input{}, result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(filtered, qt.DeepEquals, result)
+	cleanup()
+
+	_, err = CombineOutputFilters(s.outputFilters["fail"], transform)(ctx, Input{}, result)
+	c.Assert(err, qt.ErrorMatches, "fail")
+	_, err = os.Stat(transformed)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
@@ -0,0 +1,102 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Metadata keys set on the requests of a group, see Client.ExecuteGroup.
+const (
+	// MetaGroupID holds the ID shared by all requests in the group.
+	MetaGroupID = "s3rpc-group-id"
+
+	// MetaGroupIndex and MetaGroupSize hold the position (0 based) of the request
+	// in the group and the number of requests in the group.
+	MetaGroupIndex = "s3rpc-group-index"
+	MetaGroupSize  = "s3rpc-group-size"
+)
+
+// GroupResult is the result of a Client.ExecuteGroup call.
+type GroupResult struct {
+	// GroupID is the ID shared by the requests, see MetaGroupID.
+	GroupID string
+
+	// Outputs holds the outputs in the order of the inputs.
+	Outputs []Output
+}
+
+// GroupError is returned from Client.ExecuteGroup when a request in the group failed.
+type GroupError struct {
+	GroupID string
+
+	// Index is the index of the failed input.
+	Index int
+
+	Err error
+}
+
+func (e *GroupError) Error() string {
+	return fmt.Sprintf("group %s: input %d: %s", e.GroupID, e.Index, e.Err)
+}
+
+func (e *GroupError) Unwrap() error {
+	return e.Err
+}
+
+// ExecuteGroup executes op for each of the inputs, e.g. the pages of a multi-part document,
+// as one logical batch and returns all the outputs, or the first failure as a *GroupError.
+// The requests share a group ID, which is passed to the handlers with the input's
+// position in the group in the metadata, see MetaGroupID.
+// The requests are executed concurrently, within ClientOptions.MaxInFlight.
+// On failure, the requests still running are cancelled and any outputs already
+// received are removed.
+func (c *Client) ExecuteGroup(ctx context.Context, op string, inputs []Input) (GroupResult, error) {
+	if len(inputs) == 0 {
+		return GroupResult{}, errors.New("apply: group has no inputs")
+	}
+	result := GroupResult{
+		GroupID: newRequestID(),
+		Outputs: make([]Output, len(inputs)),
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for i, input := range inputs {
+		i, input := i, input
+		input.Metadata = groupMetadata(input.Metadata, result.GroupID, i, len(inputs))
+		g.Go(func() error {
+			output, err := c.Execute(gctx, op, input)
+			if err != nil {
+				return &GroupError{GroupID: result.GroupID, Index: i, Err: err}
+			}
+			result.Outputs[i] = output
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		for _, output := range result.Outputs {
+			if output.Filename != "" {
+				os.Remove(output.Filename)
+			}
+		}
+		return GroupResult{}, err
+	}
+	return result, nil
+}
+
+// groupMetadata returns a copy of metadata with the group metadata for the input at index set.
+func groupMetadata(metadata map[string]string, groupID string, index, size int) map[string]string {
+	m := make(map[string]string, len(metadata)+3)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[MetaGroupID] = groupID
+	m[MetaGroupIndex] = strconv.Itoa(index)
+	m[MetaGroupSize] = strconv.Itoa(size)
+	return m
+}
@@ -0,0 +1,34 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestGroupMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	metadata := map[string]string{"lang": "en"}
+	c.Assert(groupMetadata(metadata, "g1", 2, 5), qt.DeepEquals, map[string]string{
+		"lang":         "en",
+		MetaGroupID:    "g1",
+		MetaGroupIndex: "2",
+		MetaGroupSize:  "5",
+	})
+	c.Assert(metadata, qt.HasLen, 1)
+}
+
+func TestGroupError(t *testing.T) {
+	c := qt.New(t)
+
+	err := error(&GroupError{GroupID: "g1", Index: 3, Err: &ResponseError{Code: ErrorCodeInvalidInput, Message: "too large"}})
+	c.Assert(err, qt.ErrorMatches, "group g1: input 3: invalid_input: too large")
+	var respErr *ResponseError
+	c.Assert(errors.As(err, &respErr), qt.IsTrue)
+
+	_, err = (&Client{}).ExecuteGroup(context.Background(), "resize", nil)
+	c.Assert(err, qt.ErrorMatches, ".*group has no inputs")
+}
@@ -0,0 +1,393 @@
+// Package archive provides s3rpc handlers to compress, decompress and repack
+// zip, tar, gzip and zstd files.
+//
+// The format of the input is detected from its filename extension:
+// .zip, .tar, .tar.gz (or .tgz), .tar.zst, .gz and .zst.
+// The output format is read from the "format" key in Input.Metadata, using the same names
+// without the leading dot, e.g. "tar.zst".
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bep/s3rpc"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MetaFormat is the metadata key for the output format.
+const MetaFormat = "format"
+
+// Formats.
+const (
+	FormatZip    = "zip"
+	FormatTar    = "tar"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+	FormatGzip   = "gz"
+	FormatZstd   = "zst"
+)
+
+// Handlers returns the handlers in this package as the ops compress, decompress and repack.
+func Handlers() s3rpc.Handlers {
+	return s3rpc.Handlers{
+		"compress":   Compress,
+		"decompress": Decompress,
+		"repack":     Repack,
+	}
+}
+
+// Compress compresses the input file with gz or zst, or stores it as the only entry
+// in a zip, tar, tar.gz or tar.zst archive. The format defaults to gz.
+func Compress(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+	format := input.Metadata[MetaFormat]
+	if format == "" {
+		format = FormatGzip
+	}
+	if !isFormat(format) {
+		return s3rpc.Output{}, fmt.Errorf("unsupported format %q", format)
+	}
+
+	fi, err := os.Stat(input.Filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	in, err := os.Open(input.Filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer in.Close()
+
+	return writeOutput(input.Filename+"."+format, format, func(w entryWriter) error {
+		return w.add(entry{name: filepath.Base(input.Filename), mode: fi.Mode(), modTime: fi.ModTime(), size: fi.Size(), r: in})
+	})
+}
+
+// Decompress decompresses a gz or zst file, including a .tar.gz or .tar.zst to a .tar.
+func Decompress(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+	format := formatOf(input.Filename)
+	var (
+		name   string
+		decode func(io.Reader) (io.ReadCloser, error)
+	)
+	switch format {
+	case FormatGzip, FormatTarGz:
+		decode = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case FormatZstd, FormatTarZst:
+		decode = func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}
+	default:
+		return s3rpc.Output{}, fmt.Errorf("can not decompress %q, use repack for archives", filepath.Base(input.Filename))
+	}
+	name = strings.TrimSuffix(input.Filename, filepath.Ext(input.Filename))
+	if format == FormatTarGz && strings.HasSuffix(input.Filename, ".tgz") {
+		name += ".tar"
+	}
+
+	in, err := os.Open(input.Filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer in.Close()
+	r, err := decode(in)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer r.Close()
+
+	out, err := os.Create(name)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer out.Close()
+	if _, err := copyContext(ctx, out, r); err != nil {
+		return s3rpc.Output{}, err
+	}
+	return s3rpc.Output{Filename: name}, out.Close()
+}
+
+// Repack converts a zip, tar, tar.gz or tar.zst archive to another of these formats.
+func Repack(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+	from := formatOf(input.Filename)
+	to := input.Metadata[MetaFormat]
+	if !isArchive(from) {
+		return s3rpc.Output{}, fmt.Errorf("%q is not an archive", filepath.Base(input.Filename))
+	}
+	if !isArchive(to) {
+		return s3rpc.Output{}, fmt.Errorf("unsupported archive format %q", to)
+	}
+
+	base := strings.TrimSuffix(input.Filename, "."+from)
+	if from == FormatTarGz && strings.HasSuffix(input.Filename, ".tgz") {
+		base = strings.TrimSuffix(input.Filename, ".tgz")
+	}
+	return writeOutput(base+"-repacked."+to, to, func(w entryWriter) error {
+		return readArchive(ctx, input.Filename, from, w.add)
+	})
+}
+
+type entry struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+	size    int64
+	r       io.Reader
+}
+
+type entryWriter interface {
+	add(e entry) error
+	Close() error
+}
+
+func isFormat(format string) bool {
+	return isArchive(format) || format == FormatGzip || format == FormatZstd
+}
+
+func isArchive(format string) bool {
+	switch format {
+	case FormatZip, FormatTar, FormatTarGz, FormatTarZst:
+		return true
+	}
+	return false
+}
+
+// formatOf returns the format of filename from its extension.
+func formatOf(filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(name, ".tar.zst"):
+		return FormatTarZst
+	}
+	return strings.TrimPrefix(filepath.Ext(name), ".")
+}
+
+// writeOutput creates filename in format and adds entries to it with add.
+func writeOutput(filename, format string, add func(w entryWriter) error) (s3rpc.Output, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer f.Close()
+
+	w, err := newEntryWriter(f, format)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	if err := add(w); err != nil {
+		return s3rpc.Output{}, err
+	}
+	if err := w.Close(); err != nil {
+		return s3rpc.Output{}, err
+	}
+	return s3rpc.Output{Filename: filename, Metadata: map[string]string{MetaFormat: format}}, f.Close()
+}
+
+func newEntryWriter(w io.Writer, format string) (entryWriter, error) {
+	switch format {
+	case FormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	case FormatTar:
+		return &tarWriter{tw: tar.NewWriter(w)}, nil
+	case FormatTarGz:
+		gw := gzip.NewWriter(w)
+		return &tarWriter{tw: tar.NewWriter(gw), closer: gw}, nil
+	case FormatTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarWriter{tw: tar.NewWriter(zw), closer: zw}, nil
+	case FormatGzip:
+		return &streamWriter{wc: gzip.NewWriter(w)}, nil
+	case FormatZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &streamWriter{wc: zw}, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) add(e entry) error {
+	h := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.modTime}
+	h.SetMode(e.mode)
+	if e.mode.IsDir() {
+		h.Name = strings.TrimSuffix(h.Name, "/") + "/"
+		_, err := w.zw.CreateHeader(h)
+		return err
+	}
+	fw, err := w.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, e.r)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+type tarWriter struct {
+	tw     *tar.Writer
+	closer io.Closer
+}
+
+func (w *tarWriter) add(e entry) error {
+	h := &tar.Header{Name: e.name, Mode: int64(e.mode.Perm()), ModTime: e.modTime, Size: e.size, Typeflag: tar.TypeReg}
+	if e.mode.IsDir() {
+		h.Typeflag, h.Size = tar.TypeDir, 0
+		h.Name = strings.TrimSuffix(h.Name, "/") + "/"
+	}
+	if err := w.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if e.mode.IsDir() {
+		return nil
+	}
+	_, err := io.Copy(w.tw, e.r)
+	return err
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if w.closer != nil {
+		return w.closer.Close()
+	}
+	return nil
+}
+
+// streamWriter writes a single entry through a compressor.
+type streamWriter struct {
+	wc    io.WriteCloser
+	added bool
+}
+
+func (w *streamWriter) add(e entry) error {
+	if w.added {
+		return errors.New("gz and zst can only hold one file")
+	}
+	w.added = true
+	_, err := io.Copy(w.wc, e.r)
+	return err
+}
+
+func (w *streamWriter) Close() error {
+	return w.wc.Close()
+}
+
+// readArchive calls fn for each regular file and directory in the archive.
+func readArchive(ctx context.Context, filename, format string, fn func(e entry) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format == FormatZip {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(entry{name: zf.Name, mode: zf.Mode(), modTime: zf.Modified, size: int64(zf.UncompressedSize64), r: r})
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = f
+	switch format {
+	case FormatTarGz:
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case FormatTarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		default:
+			// Links and devices can not be represented in all formats.
+			continue
+		}
+		if err := fn(entry{name: h.Name, mode: h.FileInfo().Mode(), modTime: h.ModTime, size: h.Size, r: tr}); err != nil {
+			return err
+		}
+	}
+}
+
+// copyContext is io.Copy that stops when ctx is done.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, readerFunc(func(p []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return src.Read(p)
+	}))
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,75 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bep/s3rpc"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	for _, format := range []string{FormatGzip, FormatZstd} {
+		filename := filepath.Join(c.TempDir(), "123_01gcabc_data.txt")
+		c.Assert(os.WriteFile(filename, []byte("hello world"), 0o644), qt.IsNil)
+
+		compressed, err := Compress(ctx, s3rpc.Input{Filename: filename, Metadata: map[string]string{MetaFormat: format}})
+		c.Assert(err, qt.IsNil)
+		c.Assert(compressed.Filename, qt.Equals, filename+"."+format)
+
+		c.Assert(os.Remove(filename), qt.IsNil)
+		decompressed, err := Decompress(ctx, s3rpc.Input{Filename: compressed.Filename})
+		c.Assert(err, qt.IsNil)
+		c.Assert(decompressed.Filename, qt.Equals, filename)
+		b, err := os.ReadFile(decompressed.Filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, "hello world")
+	}
+
+	_, err := Compress(ctx, s3rpc.Input{Filename: "foo.txt", Metadata: map[string]string{MetaFormat: "rar"}})
+	c.Assert(err, qt.ErrorMatches, `unsupported format "rar"`)
+	_, err = Decompress(ctx, s3rpc.Input{Filename: "foo.zip"})
+	c.Assert(err, qt.ErrorMatches, `can not decompress "foo.zip", use repack for archives`)
+}
+
+func TestRepack(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	filename := filepath.Join(c.TempDir(), "123_01gcabc_data.txt")
+	c.Assert(os.WriteFile(filename, []byte("hello world"), 0o644), qt.IsNil)
+
+	zipped, err := Compress(ctx, s3rpc.Input{Filename: filename, Metadata: map[string]string{MetaFormat: FormatZip}})
+	c.Assert(err, qt.IsNil)
+
+	// zip -> tar.zst -> tar.gz -> tar -> zip
+	current := zipped.Filename
+	for _, format := range []string{FormatTarZst, FormatTarGz, FormatTar, FormatZip} {
+		out, err := Repack(ctx, s3rpc.Input{Filename: current, Metadata: map[string]string{MetaFormat: format}})
+		c.Assert(err, qt.IsNil, qt.Commentf(format))
+		c.Assert(formatOf(out.Filename), qt.Equals, format)
+		current = out.Filename
+	}
+
+	var names []string
+	var content string
+	c.Assert(readArchive(ctx, current, FormatZip, func(e entry) error {
+		names = append(names, e.name)
+		b, err := io.ReadAll(e.r)
+		content = string(b)
+		return err
+	}), qt.IsNil)
+	c.Assert(names, qt.DeepEquals, []string{"123_01gcabc_data.txt"})
+	c.Assert(content, qt.Equals, "hello world")
+
+	_, err = Repack(ctx, s3rpc.Input{Filename: filename, Metadata: map[string]string{MetaFormat: FormatZip}})
+	c.Assert(err, qt.ErrorMatches, `"123_01gcabc_data.txt" is not an archive`)
+	_, err = Repack(ctx, s3rpc.Input{Filename: current, Metadata: map[string]string{MetaFormat: FormatGzip}})
+	c.Assert(err, qt.ErrorMatches, `unsupported archive format "gz"`)
+}
@@ -0,0 +1,152 @@
+package grpcbridge
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Chunk is a message in the Process stream, see the package documentation.
+type Chunk struct {
+	Op          string
+	Filename    string
+	ContentType string
+	Metadata    map[string]string
+	Data        []byte
+	Error       string
+}
+
+// Marshal encodes c in the protobuf wire format.
+func (c *Chunk) Marshal() []byte {
+	var b []byte
+	appendString := func(num protowire.Number, s string) {
+		if s == "" {
+			return
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	appendString(1, c.Op)
+	appendString(2, c.Filename)
+	appendString(3, c.ContentType)
+
+	keys := make([]string, 0, len(c.Metadata))
+	for k := range c.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, c.Metadata[k])
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	if len(c.Data) > 0 {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, c.Data)
+	}
+	appendString(6, c.Error)
+	return b
+}
+
+// Unmarshal decodes c from the protobuf wire format. Unknown fields are skipped.
+func (c *Chunk) Unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType || num < 1 || num > 6 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			c.Op = string(v)
+		case 2:
+			c.Filename = string(v)
+		case 3:
+			c.ContentType = string(v)
+		case 4:
+			k, val, err := unmarshalMapEntry(v)
+			if err != nil {
+				return err
+			}
+			if c.Metadata == nil {
+				c.Metadata = make(map[string]string)
+			}
+			c.Metadata[k] = val
+		case 5:
+			c.Data = append(c.Data, v...)
+		case 6:
+			c.Error = string(v)
+		}
+	}
+	return nil
+}
+
+func unmarshalMapEntry(b []byte) (string, string, error) {
+	var k, v string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			return "", "", errors.New("invalid metadata entry")
+		}
+		s, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			k = s
+		case 2:
+			v = s
+		}
+	}
+	return k, v, nil
+}
+
+// codec is a grpc encoding.Codec for Chunk messages.
+// It is named proto, as the messages are protobuf encoded.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	c, ok := v.(*Chunk)
+	if !ok {
+		return nil, fmt.Errorf("grpcbridge: can not marshal %T", v)
+	}
+	return c.Marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	c, ok := v.(*Chunk)
+	if !ok {
+		return fmt.Errorf("grpcbridge: can not unmarshal into %T", v)
+	}
+	return c.Unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
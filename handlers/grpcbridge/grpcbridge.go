@@ -0,0 +1,204 @@
+// Package grpcbridge provides an s3rpc handler that forwards requests to a gRPC service,
+// so existing gRPC processors can be used behind the S3 transport.
+//
+// The service implements a bidirectional streaming method wire compatible with:
+//
+//	service Processor {
+//	  rpc Process(stream Chunk) returns (stream Chunk);
+//	}
+//
+//	message Chunk {
+//	  string op = 1;
+//	  string filename = 2;
+//	  string content_type = 3;
+//	  map<string, string> metadata = 4;
+//	  bytes data = 5;
+//	  string error = 6;
+//	}
+//
+// The handler sends the op, the input's base filename, content type and metadata in the
+// first Chunk and the file content in Data, split over as many Chunks as needed.
+// The service replies the same way; a non-empty Error in any reply fails the request.
+package grpcbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bep/s3rpc"
+	"google.golang.org/grpc"
+)
+
+// DefaultMethod is the full gRPC method name used if Options.Method is not set.
+const DefaultMethod = "/s3rpc.Processor/Process"
+
+// Options configures a Handler.
+type Options struct {
+	// Conn is the connection to the service, e.g. from grpc.Dial.
+	Conn grpc.ClientConnInterface
+
+	// Op is sent in the first Chunk. Defaults to the Method name.
+	Op string
+
+	// Method is the full method name. Defaults to DefaultMethod.
+	Method string
+
+	// ChunkSize is the max number of bytes of file content per Chunk.
+	// Defaults to 64 KiB.
+	ChunkSize int
+
+	// CallOptions are passed on to each call.
+	CallOptions []grpc.CallOption
+}
+
+func (opts *Options) init() error {
+	if opts.Conn == nil {
+		return errors.New("grpcbridge: Conn is required")
+	}
+	if opts.Method == "" {
+		opts.Method = DefaultMethod
+	}
+	if opts.Op == "" {
+		opts.Op = opts.Method[strings.LastIndex(opts.Method, "/")+1:]
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 64 << 10
+	}
+	return nil
+}
+
+var streamDesc = &grpc.StreamDesc{
+	StreamName:    "Process",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// Handler returns a handler that streams each request to the gRPC service in opts.
+// The reply is written next to the input file, which is cleaned up by the server.
+func Handler(opts Options) (func(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error), error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	callOpts := append([]grpc.CallOption{grpc.ForceCodec(codec{})}, opts.CallOptions...)
+
+	return func(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stream, err := opts.Conn.NewStream(ctx, streamDesc, opts.Method, callOpts...)
+		if err != nil {
+			return s3rpc.Output{}, fmt.Errorf("failed to open stream: %w", err)
+		}
+
+		// Send and receive concurrently, so a service that replies while reading
+		// doesn't block on flow control.
+		sendErr := make(chan error, 1)
+		go func() {
+			sendErr <- send(stream, opts, input)
+		}()
+
+		output, err := receive(stream, input)
+		if err != nil {
+			return s3rpc.Output{}, err
+		}
+		if err := <-sendErr; err != nil {
+			return s3rpc.Output{}, err
+		}
+		return output, nil
+	}, nil
+}
+
+func send(stream grpc.ClientStream, opts Options, input s3rpc.Input) error {
+	f, err := os.Open(input.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chunk := &Chunk{
+		Op:          opts.Op,
+		Filename:    filepath.Base(input.Filename),
+		ContentType: input.ContentType,
+		Metadata:    input.Metadata,
+	}
+	buf := make([]byte, opts.ChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if n > 0 || chunk.Op != "" {
+			chunk.Data = buf[:n]
+			if err := stream.SendMsg(chunk); err != nil {
+				if err == io.EOF {
+					// The service closed the stream, the reason is returned from RecvMsg.
+					return nil
+				}
+				return fmt.Errorf("failed to send: %w", err)
+			}
+			chunk = &Chunk{}
+		}
+		if last {
+			return stream.CloseSend()
+		}
+	}
+}
+
+func receive(stream grpc.ClientStream, input s3rpc.Input) (s3rpc.Output, error) {
+	var (
+		output s3rpc.Output
+		out    *os.File
+	)
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+
+	for {
+		var chunk Chunk
+		err := stream.RecvMsg(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s3rpc.Output{}, fmt.Errorf("failed to receive: %w", err)
+		}
+		if chunk.Error != "" {
+			return s3rpc.Output{}, errors.New(chunk.Error)
+		}
+		if out == nil {
+			name := filepath.Base(chunk.Filename)
+			if name == "" || name == "." || name == string(filepath.Separator) {
+				name = filepath.Base(input.Filename) + ".out"
+			}
+			output = s3rpc.Output{
+				Filename:    filepath.Join(filepath.Dir(input.Filename), name),
+				Metadata:    chunk.Metadata,
+				ContentType: chunk.ContentType,
+			}
+			if output.Filename == input.Filename {
+				output.Filename += ".out"
+			}
+			if out, err = os.Create(output.Filename); err != nil {
+				return s3rpc.Output{}, err
+			}
+		}
+		if _, err := out.Write(chunk.Data); err != nil {
+			return s3rpc.Output{}, err
+		}
+	}
+
+	if out == nil {
+		return s3rpc.Output{}, errors.New("no reply from service")
+	}
+	err := out.Close()
+	out = nil
+	return output, err
+}
@@ -0,0 +1,115 @@
+package grpcbridge
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bep/s3rpc"
+	qt "github.com/frankban/quicktest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// upperService replies with the uppercased input.
+func upperService(srv interface{}, stream grpc.ServerStream) error {
+	var (
+		first *Chunk
+		data  []byte
+	)
+	for {
+		var chunk Chunk
+		err := stream.RecvMsg(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = &chunk
+		}
+		data = append(data, chunk.Data...)
+	}
+	if first.Metadata["fail"] != "" {
+		return stream.SendMsg(&Chunk{Error: "failed as requested"})
+	}
+	data = bytes.ToUpper(data)
+	reply := &Chunk{Filename: "upper.txt", ContentType: "text/plain", Metadata: map[string]string{"op": first.Op, "input": first.Filename}}
+	for len(data) > 0 {
+		n := 3
+		if n > len(data) {
+			n = len(data)
+		}
+		reply.Data = data[:n]
+		if err := stream.SendMsg(reply); err != nil {
+			return err
+		}
+		data = data[n:]
+		reply = &Chunk{}
+	}
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	c := qt.New(t)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "s3rpc.Processor",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{StreamName: "Process", Handler: upperService, ServerStreams: true, ClientStreams: true},
+		},
+	}, struct{}{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	handler, err := Handler(Options{Conn: conn, Op: "upper", ChunkSize: 4})
+	c.Assert(err, qt.IsNil)
+
+	filename := filepath.Join(c.TempDir(), "123_01gcabc_hello.txt")
+	c.Assert(os.WriteFile(filename, []byte("hello world"), 0o644), qt.IsNil)
+
+	ctx := context.Background()
+	output, err := handler(ctx, s3rpc.Input{Filename: filename})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.Filename, qt.Equals, filepath.Join(filepath.Dir(filename), "upper.txt"))
+	c.Assert(output.ContentType, qt.Equals, "text/plain")
+	c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"op": "upper", "input": "123_01gcabc_hello.txt"})
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "HELLO WORLD")
+
+	_, err = handler(ctx, s3rpc.Input{Filename: filename, Metadata: map[string]string{"fail": "1"}})
+	c.Assert(err, qt.ErrorMatches, "failed as requested")
+
+	_, err = Handler(Options{})
+	c.Assert(err, qt.ErrorMatches, "grpcbridge: Conn is required")
+}
+
+func TestChunkMarshal(t *testing.T) {
+	c := qt.New(t)
+
+	chunk := &Chunk{Op: "op", Filename: "f.txt", ContentType: "text/plain", Metadata: map[string]string{"a": "1", "b": ""}, Data: []byte("data"), Error: "err"}
+	var decoded Chunk
+	c.Assert(decoded.Unmarshal(chunk.Marshal()), qt.IsNil)
+	c.Assert(&decoded, qt.DeepEquals, chunk)
+
+	c.Assert(decoded.Unmarshal([]byte{0x0a, 0x10}), qt.Not(qt.IsNil))
+	_, err := codec{}.Marshal("foo")
+	c.Assert(err, qt.ErrorMatches, "grpcbridge: can not marshal string")
+}
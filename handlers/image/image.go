@@ -0,0 +1,251 @@
+// Package image provides s3rpc handlers for resizing and converting images.
+//
+// The handlers take their parameters from Input.Metadata:
+//
+//   - width and height: the target size in pixels. If only one is set, the aspect ratio is kept.
+//   - format: the output format, jpeg, png or gif. Defaults to the input format.
+//   - quality: the JPEG quality, 1-100. Defaults to 85.
+//   - sizes: a comma separated list of thumbnail sizes for Thumbnails, e.g. "64,128,256".
+package image
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bep/s3rpc"
+	"golang.org/x/image/draw"
+)
+
+// Metadata keys for the handler parameters, see the package documentation.
+const (
+	MetaWidth   = "width"
+	MetaHeight  = "height"
+	MetaFormat  = "format"
+	MetaQuality = "quality"
+	MetaSizes   = "sizes"
+)
+
+// Handlers returns the handlers in this package as the ops resize, convert and thumbnails.
+func Handlers() s3rpc.Handlers {
+	return s3rpc.Handlers{
+		"resize":     Resize,
+		"convert":    Convert,
+		"thumbnails": Thumbnails,
+	}
+}
+
+// Resize resizes the input image to the width and/or height in the metadata.
+func Resize(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+	img, format, err := decode(input.Filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	width, height, err := parseSize(input.Metadata)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	if width == 0 && height == 0 {
+		return s3rpc.Output{}, errors.New("width or height is required")
+	}
+	return encodeOutput(input, resize(img, width, height), format, "resized")
+}
+
+// Convert converts the input image to the format in the metadata.
+func Convert(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+	if input.Metadata[MetaFormat] == "" {
+		return s3rpc.Output{}, errors.New("format is required")
+	}
+	img, format, err := decode(input.Filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	return encodeOutput(input, img, format, "converted")
+}
+
+// Thumbnails creates a thumbnail for each of the sizes in the metadata,
+// scaled to fit within a square of that size, and returns them in a zip archive
+// with entries named thumbnail_<size>.<format>.
+func Thumbnails(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+	sizes, err := parseSizes(input.Metadata[MetaSizes])
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	img, format, err := decode(input.Filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	format = outputFormat(input.Metadata, format)
+
+	filename := outputFilename(input.Filename, "thumbnails", "zip")
+	f, err := os.Create(filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, size := range sizes {
+		if err := ctx.Err(); err != nil {
+			return s3rpc.Output{}, err
+		}
+		w, err := zw.Create(fmt.Sprintf("thumbnail_%d.%s", size, format))
+		if err != nil {
+			return s3rpc.Output{}, err
+		}
+		if err := encode(w, fit(img, size), format, input.Metadata); err != nil {
+			return s3rpc.Output{}, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return s3rpc.Output{}, err
+	}
+
+	return s3rpc.Output{
+		Filename:    filename,
+		ContentType: "application/zip",
+		Metadata:    map[string]string{MetaSizes: input.Metadata[MetaSizes]},
+	}, f.Close()
+}
+
+func decode(filename string) (image.Image, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	img, format, err := image.Decode(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, format, nil
+}
+
+func encodeOutput(input s3rpc.Input, img image.Image, format, suffix string) (s3rpc.Output, error) {
+	format = outputFormat(input.Metadata, format)
+	filename := outputFilename(input.Filename, suffix, format)
+	f, err := os.Create(filename)
+	if err != nil {
+		return s3rpc.Output{}, err
+	}
+	defer f.Close()
+	if err := encode(f, img, format, input.Metadata); err != nil {
+		return s3rpc.Output{}, err
+	}
+	b := img.Bounds()
+	return s3rpc.Output{
+		Filename:    filename,
+		ContentType: "image/" + format,
+		Metadata: map[string]string{
+			MetaWidth:  strconv.Itoa(b.Dx()),
+			MetaHeight: strconv.Itoa(b.Dy()),
+			MetaFormat: format,
+		},
+	}, f.Close()
+}
+
+func encode(w io.Writer, img image.Image, format string, metadata map[string]string) error {
+	switch format {
+	case "jpeg":
+		quality := 85
+		if q := metadata[MetaQuality]; q != "" {
+			var err error
+			if quality, err = strconv.Atoi(q); err != nil || quality < 1 || quality > 100 {
+				return fmt.Errorf("invalid quality %q", q)
+			}
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// outputFormat returns the format in the metadata, if set, else the input format.
+func outputFormat(metadata map[string]string, format string) string {
+	if f := metadata[MetaFormat]; f != "" {
+		format = strings.TrimPrefix(strings.ToLower(f), "image/")
+	}
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	return format
+}
+
+// outputFilename returns a filename next to the input, which is cleaned up by the server.
+func outputFilename(input, suffix, ext string) string {
+	return strings.TrimSuffix(input, filepath.Ext(input)) + "-" + suffix + "." + ext
+}
+
+func parseSize(metadata map[string]string) (int, int, error) {
+	var width, height int
+	for k, v := range map[string]*int{MetaWidth: &width, MetaHeight: &height} {
+		s := metadata[k]
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q", k, s)
+		}
+		*v = n
+	}
+	return width, height, nil
+}
+
+func parseSizes(s string) ([]int, error) {
+	if s == "" {
+		return nil, errors.New("sizes is required")
+	}
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid size %q", part)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// resize scales img to width x height. A zero width or height keeps the aspect ratio.
+func resize(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	if width == 0 {
+		width = b.Dx() * height / b.Dy()
+	}
+	if height == 0 {
+		height = b.Dy() * width / b.Dx()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// fit scales img to fit within a size x size square, keeping the aspect ratio.
+func fit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	if b.Dx() >= b.Dy() {
+		return resize(img, size, 0)
+	}
+	return resize(img, 0, size)
+}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"archive/zip"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bep/s3rpc"
+	qt "github.com/frankban/quicktest"
+)
+
+func writePNG(c *qt.C, width, height int) string {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, x%height, color.RGBA{R: 255, A: 255})
+	}
+	filename := filepath.Join(c.TempDir(), "123_01gcabc_image.png")
+	f, err := os.Create(filename)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	c.Assert(png.Encode(f, img), qt.IsNil)
+	return filename
+}
+
+func TestResize(t *testing.T) {
+	c := qt.New(t)
+
+	filename := writePNG(c, 200, 100)
+	output, err := Resize(context.Background(), s3rpc.Input{Filename: filename, Metadata: map[string]string{"width": "50", "format": "jpg"}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(filepath.Base(output.Filename), qt.Equals, "123_01gcabc_image-resized.jpeg")
+	c.Assert(output.ContentType, qt.Equals, "image/jpeg")
+	c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"width": "50", "height": "25", "format": "jpeg"})
+
+	_, err = Resize(context.Background(), s3rpc.Input{Filename: filename})
+	c.Assert(err, qt.ErrorMatches, "width or height is required")
+	_, err = Resize(context.Background(), s3rpc.Input{Filename: filename, Metadata: map[string]string{"height": "-1"}})
+	c.Assert(err, qt.ErrorMatches, `invalid height "-1"`)
+	_, err = Convert(context.Background(), s3rpc.Input{Filename: filename, Metadata: map[string]string{"format": "bmp"}})
+	c.Assert(err, qt.ErrorMatches, `unsupported format "bmp"`)
+}
+
+func TestThumbnails(t *testing.T) {
+	c := qt.New(t)
+
+	filename := writePNG(c, 100, 200)
+	output, err := Thumbnails(context.Background(), s3rpc.Input{Filename: filename, Metadata: map[string]string{"sizes": "16, 32"}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.ContentType, qt.Equals, "application/zip")
+
+	zr, err := zip.OpenReader(output.Filename)
+	c.Assert(err, qt.IsNil)
+	defer zr.Close()
+	c.Assert(zr.File, qt.HasLen, 2)
+	c.Assert(zr.File[1].Name, qt.Equals, "thumbnail_32.png")
+	f, err := zr.File[1].Open()
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	c.Assert(err, qt.IsNil)
+	c.Assert([]int{cfg.Width, cfg.Height}, qt.DeepEquals, []int{16, 32})
+
+	_, err = Thumbnails(context.Background(), s3rpc.Input{Filename: filename})
+	c.Assert(err, qt.ErrorMatches, "sizes is required")
+}
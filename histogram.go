@@ -0,0 +1,105 @@
+package s3rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of the latency histograms.
+var latencyBounds = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+}
+
+// Histogram is a snapshot of a latency distribution.
+type Histogram struct {
+	// Bounds are the inclusive upper bounds of the buckets, in increasing order.
+	Bounds []time.Duration
+
+	// Counts holds the number of observations per bucket.
+	// It has one more element than Bounds, counting the observations above the last bound.
+	Counts []uint64
+
+	// Count and Sum are the number and the sum of all observations.
+	Count uint64
+	Sum   time.Duration
+}
+
+// Mean returns the mean of the observations, or 0 if there are none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding the q-quantile (0-1), e.g. 0.99 for p99.
+// It returns the last bound if the quantile is above it, and 0 if there are no observations.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen > rank {
+			if i == len(h.Bounds) {
+				break
+			}
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// histogram records a latency distribution.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return Histogram{
+		Bounds: append([]time.Duration(nil), latencyBounds...),
+		Counts: append([]uint64(nil), h.counts...),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
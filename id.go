@@ -0,0 +1,102 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IDGenerator returns a new unique request ID, see ClientOptions.IDGenerator.
+// IDs must be 1 to 64 ASCII letters, digits and hyphens, and should sort by time,
+// so listings of the bucket are ordered.
+type IDGenerator func() string
+
+// maxRequestIDLen is the max length of a request ID.
+const maxRequestIDLen = 64
+
+var uuidv7 struct {
+	mu   sync.Mutex
+	last [16]byte
+}
+
+// NewUUIDv7 returns a new UUID version 7 in lower case, the default IDGenerator.
+// The IDs sort by the time they were created, also within the same millisecond in this process.
+func NewUUIDv7() string {
+	var u [16]byte
+	if _, err := rand.Read(u[6:]); err != nil {
+		panic(fmt.Sprintf("uuid: %s", err))
+	}
+	ms := uint64(time.Now().UnixMilli())
+
+	uuidv7.mu.Lock()
+	lastMS := binary.BigEndian.Uint64(append([]byte{0, 0}, uuidv7.last[:6]...))
+	if ms <= lastMS {
+		// Keep the IDs ordered by incrementing the previous one.
+		u = uuidv7.last
+		for i := 15; i >= 8; i-- {
+			u[i]++
+			if u[i] != 0 {
+				break
+			}
+		}
+		if u[8]&0xc0 != 0x80 {
+			// The random bits overflowed, move on to the next millisecond.
+			ms = lastMS + 1
+		} else {
+			ms = lastMS
+		}
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], ms)
+	copy(u[:6], b[2:])
+	u[6] = 0x70 | u[6]&0x0f
+	u[8] = 0x80 | u[8]&0x3f
+	uuidv7.last = u
+	uuidv7.mu.Unlock()
+
+	var s [36]byte
+	hex.Encode(s[0:8], u[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], u[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], u[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], u[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], u[10:])
+	return string(s[:])
+}
+
+// validateRequestID returns an error if id can not be used as a request ID.
+// The ID is part of the object keys, on the form <prefix>/<op>/<id>_<filename>.
+func validateRequestID(id string) error {
+	if id == "" || len(id) > maxRequestIDLen {
+		return fmt.Errorf("invalid request ID %q: must be 1 to %d characters", id, maxRequestIDLen)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("invalid request ID %q: only ASCII letters, digits and hyphens are allowed", id)
+		}
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context that makes Execute and Submit use id as the request ID
+// instead of a generated one, e.g. an idempotency key from an external system.
+// Retrying with the same ID overwrites the request in the bucket.
+// The ID must be valid as described in IDGenerator.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID set with WithRequestID, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
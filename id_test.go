@@ -0,0 +1,44 @@
+package s3rpc
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNewUUIDv7(t *testing.T) {
+	c := qt.New(t)
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	ids := make([]string, 1000)
+	seen := make(map[string]bool)
+	for i := range ids {
+		ids[i] = NewUUIDv7()
+		c.Assert(re.MatchString(ids[i]), qt.IsTrue, qt.Commentf(ids[i]))
+		c.Assert(seen[ids[i]], qt.IsFalse)
+		seen[ids[i]] = true
+		c.Assert(validateRequestID(ids[i]), qt.IsNil)
+	}
+	c.Assert(sort.StringsAreSorted(ids), qt.IsTrue)
+}
+
+func TestRequestID(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(validateRequestID("order-1234"), qt.IsNil)
+	c.Assert(validateRequestID("01GCZ05N4WQZ4Y0YB7Z4M7H3QK"), qt.IsNil)
+	for _, id := range []string{"", "a_b", "a/b", "a.b", "æ", string(make([]byte, maxRequestIDLen+1))} {
+		c.Assert(validateRequestID(id), qt.ErrorMatches, "invalid request ID .*")
+	}
+
+	ctx := context.Background()
+	c.Assert(requestIDFrom(ctx), qt.Equals, "")
+	c.Assert(requestIDFrom(WithRequestID(ctx, "order-1234")), qt.Equals, "order-1234")
+
+	client := &Client{}
+	_, err := client.Execute(WithRequestID(ctx, "a_b"), "ocr", Input{Filename: "input.csv"})
+	c.Assert(err, qt.ErrorMatches, "apply: invalid request ID .*")
+}
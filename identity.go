@@ -0,0 +1,97 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Metadata keys holding the Identity of the caller of a request.
+const (
+	MetaIdentityService = "s3rpc-identity-service"
+	MetaIdentityUser    = "s3rpc-identity-user"
+	MetaIdentityTenant  = "s3rpc-identity-tenant"
+)
+
+// maxIdentityLen is the max length of each Identity field.
+const maxIdentityLen = 256
+
+// Identity identifies the caller of a request, see ClientOptions.Identity.
+// The server logs it, includes it in AuditRecords and passes it to handlers, see RequestIdentity.
+// It is asserted by the client and not authenticated by the server;
+// AuditRecord.Principal is the AWS principal that uploaded the request.
+// All fields are optional, and must be printable ASCII.
+type Identity struct {
+	// Service is the name of the calling service, e.g. "billing".
+	Service string `json:"service,omitempty"`
+
+	// User is the end user the request is made on behalf of.
+	User string `json:"user,omitempty"`
+
+	// Tenant is the tenant the request is made on behalf of.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// IsZero reports whether no field is set.
+func (id Identity) IsZero() bool {
+	return id == Identity{}
+}
+
+func (id Identity) validate() error {
+	for _, v := range []string{id.Service, id.User, id.Tenant} {
+		if len(v) > maxIdentityLen {
+			return fmt.Errorf("identity: %q is longer than %d characters", v, maxIdentityLen)
+		}
+		for _, r := range v {
+			if r < ' ' || r > '~' {
+				return fmt.Errorf("identity: %q is not printable ASCII", v)
+			}
+		}
+	}
+	return nil
+}
+
+// setMetadata sets the identity's fields in metadata, unless already set there.
+func (id Identity) setMetadata(metadata map[string]string) {
+	for k, v := range map[string]string{MetaIdentityService: id.Service, MetaIdentityUser: id.User, MetaIdentityTenant: id.Tenant} {
+		if _, found := metadata[k]; !found && v != "" {
+			metadata[k] = v
+		}
+	}
+}
+
+// identityFromMetadata returns the identity in the request metadata.
+func identityFromMetadata(metadata map[string]string) Identity {
+	return Identity{
+		Service: metadata[MetaIdentityService],
+		User:    metadata[MetaIdentityUser],
+		Tenant:  metadata[MetaIdentityTenant],
+	}
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context that makes Execute and Submit identify the caller as id,
+// e.g. the user a service makes the request on behalf of.
+// The fields set in id override those in ClientOptions.Identity.
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// RequestIdentity returns the Identity of the caller of the request handled with ctx,
+// the zero Identity if the client did not set one.
+// On the client, it returns the identity set with WithIdentity.
+func RequestIdentity(ctx context.Context) Identity {
+	id, _ := ctx.Value(identityKey{}).(Identity)
+	return id
+}
+
+// withIdentityLogFields returns a context with the fields of id added to the log fields, see common.logf.
+func withIdentityLogFields(ctx context.Context, id Identity) context.Context {
+	fields := make(map[string]interface{})
+	for k, v := range map[string]string{"service": id.Service, "user": id.User, "tenant": id.Tenant} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return withLogFields(ctx, fields)
+}
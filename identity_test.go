@@ -0,0 +1,40 @@
+package s3rpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestIdentity(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(Identity{}.IsZero(), qt.IsTrue)
+	c.Assert(Identity{Service: "billing", User: "user-42", Tenant: "Acme Inc."}.validate(), qt.IsNil)
+	c.Assert(Identity{User: "bjørn"}.validate(), qt.ErrorMatches, `identity: "bjørn" is not printable ASCII`)
+	c.Assert(Identity{Tenant: strings.Repeat("a", maxIdentityLen+1)}.validate(), qt.ErrorMatches, "identity: .* is longer than 256 characters")
+
+	// The per-request identity overrides the fields set in the client's.
+	metadata := map[string]string{"lang": "en"}
+	Identity{User: "user-42"}.setMetadata(metadata)
+	Identity{Service: "billing", User: "service-user"}.setMetadata(metadata)
+	c.Assert(metadata, qt.DeepEquals, map[string]string{
+		"lang":              "en",
+		MetaIdentityService: "billing",
+		MetaIdentityUser:    "user-42",
+	})
+	c.Assert(identityFromMetadata(metadata), qt.Equals, Identity{Service: "billing", User: "user-42"})
+
+	ctx := context.Background()
+	c.Assert(RequestIdentity(ctx).IsZero(), qt.IsTrue)
+	ctx = withRequestLogFields(ctx, "ocr", "to_server/ocr/01gcabc_image.jpg")
+	ctx = withIdentityLogFields(WithIdentity(ctx, Identity{Tenant: "acme"}), Identity{Tenant: "acme"})
+	c.Assert(RequestIdentity(ctx), qt.Equals, Identity{Tenant: "acme"})
+	c.Assert(ctx.Value(logFieldsKey{}), qt.DeepEquals, map[string]interface{}{"op": "ocr", "request_id": "01gcabc", "tenant": "acme"})
+
+	client := &Client{}
+	_, err := client.Execute(WithIdentity(context.Background(), Identity{User: "\n"}), "ocr", Input{Filename: "input.csv"})
+	c.Assert(err, qt.ErrorMatches, "apply: identity: .* is not printable ASCII")
+}
@@ -0,0 +1,331 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// JournalOptions configures a local journal of the requests submitted with Client.Submit,
+// so submitting succeeds while offline, e.g. on laptops and edge devices with intermittent networks.
+// The journaled requests are executed in the background when the endpoints can be reached,
+// and survive restarts of the client.
+//
+// A request interrupted by Close or a crash is executed again on the next start,
+// so handlers may see a request more than once.
+type JournalOptions struct {
+	// Dir is the directory of the journal, created if needed. Required.
+	// A copy of each input is kept there until its request is done.
+	Dir string
+
+	// Concurrency is the number of journaled requests executed concurrently.
+	// Defaults to 1, executing them in the order they were submitted.
+	Concurrency int
+
+	// RetryInterval is how long to wait before retrying requests that failed
+	// because the endpoints could not be reached.
+	// Defaults to 30 seconds.
+	RetryInterval time.Duration
+
+	// OnResult, if set, is called with the result of each journaled request when it is done,
+	// including requests submitted before a restart.
+	// The Output.Filename is temporary, as with Execute.
+	OnResult func(SubmitResult)
+}
+
+func (o *JournalOptions) init() error {
+	if o.Dir == "" {
+		return errors.New("journal: dir is required")
+	}
+	if o.Concurrency < 0 || o.RetryInterval < 0 {
+		return errors.New("journal: concurrency and retry interval can not be negative")
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = 1
+	}
+	if o.RetryInterval == 0 {
+		o.RetryInterval = 30 * time.Second
+	}
+	return nil
+}
+
+// SubmitResult is the result of a request submitted with Client.Submit.
+type SubmitResult struct {
+	// ID is the ID returned from Submit.
+	ID string
+	Op string
+
+	// Output and Err are the result of executing the request, as from Execute.
+	Output Output
+	Err    error
+}
+
+// Submit journals the request to execute op with input and returns its ID without waiting
+// for the request to be executed, succeeding also while the endpoints can not be reached.
+// The input file is copied, so it can be changed or removed when Submit returns.
+// The result is passed to JournalOptions.OnResult.
+// The ID is also used as the request ID, so a request executed again after a restart
+// replaces its earlier attempt. It can be set with WithRequestID.
+// It requires ClientOptions.Journal.
+func (c *Client) Submit(ctx context.Context, op string, input Input) (string, error) {
+	if c.journal == nil {
+		return "", errors.New("submit: ClientOptions.Journal is not set")
+	}
+	if schema := c.schemas[op]; schema != nil {
+		if err := schema.Validate(input.Metadata); err != nil {
+			return "", err
+		}
+	}
+	id := requestIDFrom(ctx)
+	if id == "" {
+		id = c.newID()
+	}
+	if err := validateRequestID(id); err != nil {
+		return "", fmt.Errorf("submit: %w", err)
+	}
+	if identity := RequestIdentity(ctx); !identity.IsZero() {
+		// The request is executed without ctx.
+		if err := identity.validate(); err != nil {
+			return "", fmt.Errorf("submit: %w", err)
+		}
+		metadata := make(map[string]string, len(input.Metadata)+3)
+		for k, v := range input.Metadata {
+			metadata[k] = v
+		}
+		identity.setMetadata(metadata)
+		input.Metadata = metadata
+	}
+	if err := c.journal.add(id, op, input); err != nil {
+		return "", fmt.Errorf("submit: %w", err)
+	}
+	return id, nil
+}
+
+// journalEntry is a journaled request, stored as <id>.json next to the directory
+// <id> holding a copy of the input.
+type journalEntry struct {
+	ID          string            `json:"id"`
+	Op          string            `json:"op"`
+	Filename    string            `json:"filename"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Submitted   time.Time         `json:"submitted"`
+}
+
+// journal executes the journaled requests of a client.
+type journal struct {
+	opts  JournalOptions
+	fsync bool
+
+	// wake is signalled when a request is added.
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newJournal(opts JournalOptions, fsync bool) (*journal, error) {
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	return &journal{opts: opts, fsync: fsync, wake: make(chan struct{}, 1), done: make(chan struct{})}, nil
+}
+
+// add journals a request, making it durable before it returns if fsync is set.
+func (j *journal) add(id, op string, input Input) error {
+	e := journalEntry{
+		ID:          id,
+		Op:          op,
+		Filename:    filepath.Base(input.Filename),
+		Metadata:    input.Metadata,
+		ContentType: input.ContentType,
+		Submitted:   time.Now().UTC(),
+	}
+	dir := filepath.Join(j.opts.Dir, id)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+	if err := j.write(filepath.Join(dir, e.Filename), func(f *os.File) error {
+		src, err := os.Open(input.Filename)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = copyBuffered(f, src)
+		return err
+	}); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	// The entry is committed when <id>.json is renamed into place.
+	if err := j.write(filepath.Join(j.opts.Dir, id+".json"), func(f *os.File) error {
+		_, err := f.Write(b)
+		return err
+	}); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// write writes filename with fn through a .part file renamed into place.
+func (j *journal) write(filename string, fn func(f *os.File) error) error {
+	partial := filename + partialSuffix
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if err == nil && j.fsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, filename)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if j.fsync {
+		return syncDir(filepath.Dir(filename))
+	}
+	return nil
+}
+
+// pending returns the journaled requests in the order they were submitted,
+// removing what is left of requests that were never committed.
+func (j *journal) pending() ([]journalEntry, error) {
+	dirEntries, err := os.ReadDir(j.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	committed := make(map[string]bool)
+	var entries []journalEntry
+	for _, de := range dirEntries {
+		id := strings.TrimSuffix(de.Name(), ".json")
+		if de.IsDir() || id == de.Name() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(j.opts.Dir, de.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e journalEntry
+		if err := json.Unmarshal(b, &e); err != nil || e.ID != id {
+			return nil, fmt.Errorf("journal: invalid entry %q", de.Name())
+		}
+		committed[id] = true
+		entries = append(entries, e)
+	}
+	for _, de := range dirEntries {
+		if name := de.Name(); !committed[strings.TrimSuffix(name, partialSuffix)] && !strings.HasSuffix(name, ".json") {
+			os.RemoveAll(filepath.Join(j.opts.Dir, name))
+		}
+	}
+	// Generated request IDs sort by time.
+	sort.Slice(entries, func(i, k int) bool { return entries[i].ID < entries[k].ID })
+	return entries, nil
+}
+
+// remove removes a request from the journal.
+func (j *journal) remove(id string) {
+	os.Remove(filepath.Join(j.opts.Dir, id+".json"))
+	os.RemoveAll(filepath.Join(j.opts.Dir, id))
+}
+
+// start executes the journaled requests with c until close is called.
+func (j *journal) start(c *Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	go func() {
+		defer close(j.done)
+		for {
+			wait := j.runPending(ctx, c)
+			var retry <-chan time.Time
+			if wait {
+				retry = time.After(j.opts.RetryInterval)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-j.wake:
+			case <-retry:
+			}
+		}
+	}()
+}
+
+// runPending executes the journaled requests, returning true if any of them
+// failed because the endpoints could not be reached.
+func (j *journal) runPending(ctx context.Context, c *Client) bool {
+	entries, err := j.pending()
+	if err != nil {
+		c.infof("Failed to read the journal: %s", err)
+		return true
+	}
+	var (
+		mu      sync.Mutex
+		offline bool
+	)
+	g := &errgroup.Group{}
+	g.SetLimit(j.opts.Concurrency)
+	for _, e := range entries {
+		e := e
+		mu.Lock()
+		stop := offline
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			input := Input{Filename: filepath.Join(j.opts.Dir, e.ID, e.Filename), Metadata: e.Metadata, ContentType: e.ContentType}
+			output, err := c.Execute(WithRequestID(ctx, e.ID), e.Op, input)
+			if ctx.Err() != nil {
+				// Closed, execute it again on the next start.
+				return nil
+			}
+			var epErr *endpointError
+			if errors.As(err, &epErr) || errors.Is(err, ErrUnavailable) {
+				c.infof("Journaled request %q failed, retrying in %s: %s", e.ID, j.opts.RetryInterval, err)
+				mu.Lock()
+				offline = true
+				mu.Unlock()
+				return nil
+			}
+			j.remove(e.ID)
+			if j.opts.OnResult != nil {
+				j.opts.OnResult(SubmitResult{ID: e.ID, Op: e.Op, Output: output, Err: err})
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	return offline
+}
+
+// close stops executing requests, leaving the ones in flight in the journal.
+func (j *journal) close() {
+	j.cancel()
+	<-j.done
+}
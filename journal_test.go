@@ -0,0 +1,77 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestJournalOptions(t *testing.T) {
+	c := qt.New(t)
+
+	opts := JournalOptions{}
+	c.Assert(opts.init(), qt.ErrorMatches, "journal: dir is required")
+	opts = JournalOptions{Dir: "journal", Concurrency: -1}
+	c.Assert(opts.init(), qt.ErrorMatches, "journal: .* can not be negative")
+	opts = JournalOptions{Dir: "journal"}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Concurrency, qt.Equals, 1)
+	c.Assert(opts.RetryInterval, qt.Equals, 30*time.Second)
+}
+
+func TestJournal(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	input := filepath.Join(t.TempDir(), "input.csv")
+	c.Assert(os.WriteFile(input, []byte("a,b,c"), 0o600), qt.IsNil)
+
+	j, err := newJournal(JournalOptions{Dir: filepath.Join(dir, "journal")}, true)
+	c.Assert(err, qt.IsNil)
+	id1, id2 := newRequestID(), newRequestID()
+	c.Assert(j.add(id1, "ocr", Input{Filename: input, Metadata: map[string]string{"lang": "en"}}), qt.IsNil)
+	c.Assert(j.add(id2, "ocr", Input{Filename: input, ContentType: "text/csv"}), qt.IsNil)
+	c.Assert(j.add(id1, "ocr", Input{Filename: input}), qt.Not(qt.IsNil))
+	c.Assert(j.add(newRequestID(), "ocr", Input{Filename: filepath.Join(dir, "missing.csv")}), qt.Not(qt.IsNil))
+
+	// The input is copied.
+	c.Assert(os.Remove(input), qt.IsNil)
+
+	// Left over from a request that was never committed.
+	c.Assert(os.Mkdir(filepath.Join(j.opts.Dir, newRequestID()), 0o700), qt.IsNil)
+
+	// Reopened, e.g. after a restart.
+	j, err = newJournal(JournalOptions{Dir: filepath.Join(dir, "journal")}, false)
+	c.Assert(err, qt.IsNil)
+	entries, err := j.pending()
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Assert(entries[0].ID, qt.Equals, id1)
+	c.Assert(entries[0].Op, qt.Equals, "ocr")
+	c.Assert(entries[0].Metadata, qt.DeepEquals, map[string]string{"lang": "en"})
+	c.Assert(entries[1].ID, qt.Equals, id2)
+	c.Assert(entries[1].ContentType, qt.Equals, "text/csv")
+	b, err := os.ReadFile(filepath.Join(j.opts.Dir, id1, entries[0].Filename))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "a,b,c")
+
+	dirEntries, err := os.ReadDir(j.opts.Dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(dirEntries, qt.HasLen, 4)
+
+	j.remove(id1)
+	entries, err = j.pending()
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].ID, qt.Equals, id2)
+}
+
+func TestSubmitWithoutJournal(t *testing.T) {
+	c := qt.New(t)
+	client := &Client{}
+	_, err := client.Submit(context.Background(), "ocr", Input{Filename: "input.csv"})
+	c.Assert(err, qt.ErrorMatches, "submit: ClientOptions.Journal is not set")
+}
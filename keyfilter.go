@@ -0,0 +1,61 @@
+package s3rpc
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// KeyFilterOptions limits the requests a server handles by key, see ServerOptions.KeyFilter,
+// so independent deployments can share one bucket and queue topology,
+// e.g. one server per tenant with the tenant in the input filename.
+//
+// The patterns use the syntax of path.Match and are matched against the request key,
+// e.g. to_server/<op>/<id>_<filename>, and against each of its parent directories,
+// so "to_server/*/2026" matches all requests in date partitions of 2026.
+// Requests not handled are left for other servers, as requests for unknown ops.
+type KeyFilterOptions struct {
+	// Include, if set, handles only the requests matching one of the patterns.
+	Include []string
+
+	// Exclude skips the requests matching one of the patterns, also if included.
+	Exclude []string
+}
+
+func (o *KeyFilterOptions) init() error {
+	for _, pattern := range append(append([]string(nil), o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("key filter: invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the request with the given key should be handled.
+// A nil filter matches all keys.
+func (o *KeyFilterOptions) matches(key string) bool {
+	if o == nil {
+		return true
+	}
+	if len(o.Include) > 0 && !matchesKeyPattern(o.Include, key) {
+		return false
+	}
+	return !matchesKeyPattern(o.Exclude, key)
+}
+
+// matchesKeyPattern reports whether key or one of its parent directories matches one of the patterns.
+func matchesKeyPattern(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		for dir := key; ; {
+			if ok, _ := path.Match(pattern, dir); ok {
+				return true
+			}
+			i := strings.LastIndexByte(dir, '/')
+			if i == -1 {
+				break
+			}
+			dir = dir[:i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package s3rpc
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestKeyFilter(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&KeyFilterOptions{Include: []string{"to_server/["}}).init(), qt.ErrorMatches, `key filter: invalid pattern "to_server/\[": .*`)
+	c.Assert((&KeyFilterOptions{Exclude: []string{"to_server/*/*_tenant-b-*"}}).init(), qt.IsNil)
+
+	var nilFilter *KeyFilterOptions
+	c.Assert(nilFilter.matches("to_server/resize/01gcabc_image.jpg"), qt.IsTrue)
+
+	f := &KeyFilterOptions{
+		Include: []string{"to_server/*/*_tenant-a-*", "to_server/*/2026"},
+		Exclude: []string{"*/*/*_*.tmp"},
+	}
+	c.Assert(f.matches("to_server/resize/01gcabc_tenant-a-image.jpg"), qt.IsTrue)
+	c.Assert(f.matches("to_server/resize/01gcabc_tenant-b-image.jpg"), qt.IsFalse)
+	c.Assert(f.matches("to_server/resize/2026/10/15/01gcabc_tenant-b-image.jpg"), qt.IsTrue)
+	c.Assert(f.matches("to_server/resize/2025/10/15/01gcabc_tenant-b-image.jpg"), qt.IsFalse)
+	c.Assert(f.matches("to_server/resize/01gcabc_tenant-a-image.tmp"), qt.IsFalse)
+
+	f = &KeyFilterOptions{Exclude: []string{"to_server/compact"}}
+	c.Assert(f.matches("to_server/resize/01gcabc_image.jpg"), qt.IsTrue)
+	c.Assert(f.matches("to_server/compact/01gcabc_image.jpg"), qt.IsFalse)
+}
@@ -0,0 +1,203 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// Intervals of the handler watchdog, see Server.runHandler.
+const (
+	// watchdogInterval is the interval between checks of the heap against OpOptions.MaxMemory.
+	watchdogInterval = 100 * time.Millisecond
+
+	// abandonGrace is how long a handler gets to return after its context is cancelled
+	// before the server abandons it.
+	abandonGrace = 10 * time.Second
+)
+
+// limitError is returned from runHandler when a handler exceeded a limit in OpOptions.
+type limitError struct {
+	// code is the ResponseError code sent to the client.
+	code string
+	err  error
+}
+
+func (e *limitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *limitError) Unwrap() error {
+	return e.err
+}
+
+// abandonedError wraps the error returned from runHandler for a handler it abandoned,
+// which may still be running.
+type abandonedError struct {
+	err error
+}
+
+func (e *abandonedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *abandonedError) Unwrap() error {
+	return e.err
+}
+
+// runHandler runs handle for the request with the given id, enforcing the limits in opts.
+// cancel cancels ctx, which is passed to the handler.
+//
+// A watchdog cancels the handler if the heap grows by more than OpOptions.MaxMemory while it runs.
+// With ServerOptions.StuckHandlers, it also reports, and may cancel, a handler that runs for much
+// longer than its op usually does.
+// A handler that does not return within abandonGrace of its context being cancelled,
+// e.g. on OpOptions.Timeout, is abandoned, so a pathological input can not block the server.
+// The handler's goroutine and resources are then leaked until it returns.
+// A *limitError is returned if a limit was exceeded,
+// and the error wraps an *abandonedError if the handler was abandoned.
+func (s *Server) runHandler(ctx context.Context, cancel context.CancelFunc, op, id string, opts OpOptions, handle func(ctx context.Context, input Input) (Output, error), input Input) (Output, error) {
+	type outcome struct {
+		result Output
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		// Label the handler goroutine, so CPU profiles can be broken down by op.
+		pprof.Do(ctx, pprof.Labels("op", op, "request_id", id), func(ctx context.Context) {
+			result, err := handle(ctx, input)
+			done <- outcome{result, err}
+		})
+	}()
+
+	var (
+		exceeded  *limitError
+		heapStart int64
+		check     <-chan time.Time
+		stuck     <-chan time.Time
+		abandon   <-chan time.Time
+		ctxDone   = ctx.Done()
+		started   = time.Now()
+		threshold = s.stuck.threshold(op)
+	)
+	if opts.MaxMemory > 0 {
+		heapStart = heapInUse()
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	if threshold > 0 {
+		timer := time.NewTimer(threshold)
+		defer timer.Stop()
+		stuck = timer.C
+	}
+
+	for {
+		select {
+		case o := <-done:
+			if exceeded != nil {
+				return Output{}, exceeded
+			}
+			if o.err == nil {
+				s.stuck.observe(op, time.Since(started))
+			}
+			if o.err != nil && opts.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+				return Output{}, &limitError{code: ErrorCodeTimeout, err: fmt.Errorf("handler timed out after %s: %w", opts.Timeout, o.err)}
+			}
+			return o.result, o.err
+		case <-check:
+			if grown := heapInUse() - heapStart; grown > opts.MaxMemory {
+				exceeded = &limitError{
+					code: ErrorCodeResourceLimit,
+					err:  fmt.Errorf("handler exceeded the memory limit of %s", formatBytes(float64(opts.MaxMemory))),
+				}
+				check = nil
+				cancel()
+			}
+		case <-stuck:
+			s.handlerStuck(ctx, op, id, threshold)
+			if s.stuck.opts.Cancel && exceeded == nil {
+				exceeded = stuckError(threshold)
+				check = nil
+				cancel()
+			}
+		case <-ctxDone:
+			ctxDone = nil
+			abandon = time.After(abandonGrace)
+		case <-abandon:
+			s.logf(ctx, "Handler for request %q did not return within %s of being cancelled, abandoning it", id, abandonGrace)
+			if exceeded != nil {
+				exceeded.err = &abandonedError{err: exceeded.err}
+				return Output{}, exceeded
+			}
+			err := &abandonedError{err: fmt.Errorf("handler did not return within %s of being cancelled: %w", abandonGrace, ctx.Err())}
+			if opts.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+				return Output{}, &limitError{code: ErrorCodeTimeout, err: err}
+			}
+			return Output{}, err
+		}
+	}
+}
+
+// heapSample reads the bytes occupied by live and not yet swept heap objects.
+var heapSample = []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+
+// heapInUse returns the bytes of heap in use by the process.
+// Handlers share the process, so the growth during one invocation includes that of
+// concurrent invocations and is only an approximation.
+func heapInUse() int64 {
+	s := make([]metrics.Sample, len(heapSample))
+	copy(s, heapSample)
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(s[0].Value.Uint64())
+}
+
+// PluginLimits limits the resources of one invocation of a plugin command,
+// so a pathological input can not take down the host.
+// The limits are set with ulimit in /bin/sh before the command is started,
+// so they are not supported on Windows.
+type PluginLimits struct {
+	// MaxMemory, if set, is the max virtual memory in bytes (RLIMIT_AS).
+	// Note that some runtimes, e.g. Go and Java, reserve a lot of virtual memory up front.
+	MaxMemory int64 `json:"max_memory,omitempty"`
+
+	// MaxCPUTime, if set, is the max CPU time, e.g. "30s" (RLIMIT_CPU).
+	// It is rounded up to whole seconds.
+	MaxCPUTime string `json:"max_cpu_time,omitempty"`
+}
+
+// limitCommand returns command wrapped in /bin/sh setting the limits.
+func (l *PluginLimits) limitCommand(command []string) ([]string, error) {
+	if l == nil || (l.MaxMemory == 0 && l.MaxCPUTime == "") {
+		return command, nil
+	}
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("limits are not supported on Windows")
+	}
+	var script string
+	if l.MaxMemory != 0 {
+		if l.MaxMemory < 1024 {
+			return nil, fmt.Errorf("invalid max memory %d", l.MaxMemory)
+		}
+		// ulimit -v is in KiB.
+		script += "ulimit -v " + strconv.FormatInt(l.MaxMemory/1024, 10) + " && "
+	}
+	if l.MaxCPUTime != "" {
+		d, err := time.ParseDuration(l.MaxCPUTime)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid max CPU time %q", l.MaxCPUTime)
+		}
+		seconds := int64((d + time.Second - 1) / time.Second)
+		script += "ulimit -t " + strconv.FormatInt(seconds, 10) + " && "
+	}
+	script += `exec "$@"`
+	return append([]string{"/bin/sh", "-c", script, "sh"}, command...), nil
+}
@@ -0,0 +1,76 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRunHandler(t *testing.T) {
+	c := qt.New(t)
+
+	s := &Server{common: &common{infof: func(format string, args ...interface{}) {}}}
+	waitForCancel := func(ctx context.Context, input Input) (Output, error) {
+		<-ctx.Done()
+		return Output{}, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	output, err := s.runHandler(ctx, cancel, "resize", "01h", OpOptions{}, func(ctx context.Context, input Input) (Output, error) {
+		return Output{Filename: input.Filename}, nil
+	}, Input{Filename: "a.jpg"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.Filename, qt.Equals, "a.jpg")
+
+	opts := OpOptions{Timeout: 10 * time.Millisecond}
+	ctx, cancel = context.WithTimeout(context.Background(), opts.Timeout)
+	_, err = s.runHandler(ctx, cancel, "resize", "01h", opts, waitForCancel, Input{})
+	var limitErr *limitError
+	c.Assert(errors.As(err, &limitErr), qt.IsTrue)
+	c.Assert(limitErr.code, qt.Equals, ErrorCodeTimeout)
+	c.Assert(err, qt.ErrorMatches, "handler timed out after 10ms: context deadline exceeded")
+
+	opts = OpOptions{MaxMemory: 1 << 20}
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = s.runHandler(ctx, cancel, "resize", "01h", opts, func(ctx context.Context, input Input) (Output, error) {
+		b := make([]byte, 64<<20)
+		for i := range b {
+			b[i] = 1
+		}
+		<-ctx.Done()
+		runtime.KeepAlive(b)
+		return Output{}, ctx.Err()
+	}, Input{})
+	c.Assert(errors.As(err, &limitErr), qt.IsTrue)
+	c.Assert(limitErr.code, qt.Equals, ErrorCodeResourceLimit)
+	c.Assert(err, qt.ErrorMatches, "handler exceeded the memory limit of 1.0 MiB")
+}
+
+func TestPluginLimits(t *testing.T) {
+	c := qt.New(t)
+
+	var limits *PluginLimits
+	command, err := limits.limitCommand([]string{"convert", "-v"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(command, qt.DeepEquals, []string{"convert", "-v"})
+
+	if runtime.GOOS == "windows" {
+		c.Skip("limits are not supported on Windows")
+	}
+
+	limits = &PluginLimits{MaxMemory: 512 << 20, MaxCPUTime: "1500ms"}
+	command, err = limits.limitCommand([]string{"sh", "-c", "ulimit -v; ulimit -t"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(command[:4], qt.DeepEquals, []string{"/bin/sh", "-c", `ulimit -v 524288 && ulimit -t 2 && exec "$@"`, "sh"})
+	out, err := exec.Command(command[0], command[1:]...).Output()
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(out), qt.Equals, "524288\n2\n")
+
+	_, err = (&PluginLimits{MaxCPUTime: "soon"}).limitCommand([]string{"true"})
+	c.Assert(err, qt.ErrorMatches, `invalid max CPU time "soon"`)
+}
@@ -0,0 +1,275 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ListPollingOptions configures a server that finds requests by listing
+// to_server/<op>/ instead of receiving from a queue,
+// e.g. for S3 compatible object stores without a queue service.
+// The wait after a listing that found nothing is tuned as the long poll wait for a queue,
+// between 1 second under load and 20 seconds when idle.
+//
+// A server claims a request by writing an object below claims/ with a conditional write,
+// which the object store must support, so each request is handled by one server only.
+// When the request is done, a claims/<op>/<id>_<filename>.done marker is written,
+// which tells the servers to skip the request without trying to claim it.
+// The claims are not removed; expire them with a lifecycle rule, but only after the requests:
+// a request whose claim is gone is handled again.
+// ProvisionerOptions.ListPolling sets this up.
+// Use it with clients with ClientOptions.ResponsePollInterval.
+type ListPollingOptions struct {
+	// ClaimTimeout is how long a claimed request may wait to be started,
+	// e.g. for a singleton lock, before another server may take it over,
+	// e.g. after a crash. As with a queue, a started request is never handled again.
+	// Defaults to 5 minutes.
+	ClaimTimeout time.Duration
+}
+
+func (o *ListPollingOptions) init() error {
+	if o.ClaimTimeout < 0 {
+		return errors.New("list polling: claim timeout can not be negative")
+	}
+	if o.ClaimTimeout == 0 {
+		o.ClaimTimeout = 5 * time.Minute
+	}
+	return nil
+}
+
+const claims = "claims"
+
+// claimDoneSuffix is appended to the claim key to mark the request as done.
+const claimDoneSuffix = ".done"
+
+// metaClaimExpires holds the Unix time a claim expires.
+const metaClaimExpires = "s3rpc-claim-expires"
+
+// claimKey returns the claim key for the request key to_server/<op>/<id>_<filename>.
+func claimKey(key string) string {
+	return claims + strings.TrimPrefix(key, toServer)
+}
+
+// listRequests lists the requests for the ops with a handler and claims up to max of them,
+// oldest first.
+func (s *Server) listRequests(ctx context.Context, max int) ([]message, error) {
+	s.handlersMu.RLock()
+	ops := make([]string, 0, len(s.handlers))
+	for op := range s.handlers {
+		ops = append(ops, op)
+	}
+	s.handlersMu.RUnlock()
+	sort.Strings(ops)
+
+	var messages []message
+	for _, op := range ops {
+		claimed, done, err := s.listClaims(ctx, op)
+		if err != nil {
+			return nil, err
+		}
+
+		// Request IDs sort by time, so the keys are listed oldest first.
+		p := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(toServer + "/" + op + "/"),
+		})
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list requests: %w", err)
+			}
+			for _, o := range page.Contents {
+				key := aws.ToString(o.Key)
+				info, ok := parseRequestKey(key)
+				if !ok || done[key] || !s.keyFilter.matches(key) {
+					continue
+				}
+				var ours bool
+				if claimed[key] {
+					ours, err = s.takeOverClaim(ctx, key)
+				} else {
+					ours, err = s.claim(ctx, key)
+				}
+				if err != nil {
+					return nil, err
+				}
+				if !ours {
+					continue
+				}
+				messages = append(messages, message{
+					Bucket:    s.bucket,
+					Key:       key,
+					Op:        info.Op,
+					RequestID: info.RequestID,
+					EventTime: aws.ToTime(o.LastModified),
+				})
+				if len(messages) == max {
+					return messages, nil
+				}
+			}
+		}
+	}
+	return messages, nil
+}
+
+// listClaims lists the claims for op and returns the request keys with a claim
+// and those that are done.
+func (s *Server) listClaims(ctx context.Context, op string) (claimed, done map[string]bool, err error) {
+	claimed, done = make(map[string]bool), make(map[string]bool)
+	p := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(claims + "/" + op + "/"),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list claims: %w", err)
+		}
+		for _, o := range page.Contents {
+			key := toServer + strings.TrimPrefix(aws.ToString(o.Key), claims)
+			if strings.HasSuffix(key, claimDoneSuffix) {
+				done[strings.TrimSuffix(key, claimDoneSuffix)] = true
+			} else {
+				claimed[key] = true
+			}
+		}
+	}
+	return claimed, done, nil
+}
+
+// claim claims the request with the given key for this server.
+// It returns false if the request is done or claimed by another server.
+func (s *Server) claim(ctx context.Context, key string) (bool, error) {
+	ok, err := s.putClaim(ctx, key, time.Now().Add(s.listPolling.ClaimTimeout), smithyhttp.SetHeaderValue("If-None-Match", "*"))
+	if ok || err != nil {
+		return ok, err
+	}
+	return s.takeOverClaim(ctx, key)
+}
+
+// takeOverClaim claims the request with the given key for this server if its claim has expired.
+// It returns false if the claim is still held.
+func (s *Server) takeOverClaim(ctx context.Context, key string) (bool, error) {
+	o, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(claimKey(key)),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			// Released in the meantime, try again next time.
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read claim for %q: %w", key, err)
+	}
+	expires, err := strconv.ParseInt(o.Metadata[metaClaimExpires], 10, 64)
+	if err != nil || time.Now().Unix() < expires {
+		return false, nil
+	}
+	s.infof("Claim for %q expired, taking it over", key)
+	return s.putClaim(ctx, key, time.Now().Add(s.listPolling.ClaimTimeout), smithyhttp.SetHeaderValue("If-Match", aws.ToString(o.ETag)))
+}
+
+// putClaim writes the claim for the request with the given key, expiring at expires.
+// It returns false if the write was rejected by the condition in conditions.
+func (s *Server) putClaim(ctx context.Context, key string, expires time.Time, conditions ...func(*middleware.Stack) error) (bool, error) {
+	_, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(claimKey(key)),
+		Body:   strings.NewReader(""),
+		Metadata: map[string]string{
+			MetaInstanceID:   s.stats.instanceID,
+			metaClaimExpires: strconv.FormatInt(expires.Unix(), 10),
+		},
+	}, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, conditions...)
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict") {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to claim %q: %w", key, err)
+	}
+	return true, nil
+}
+
+// ackMessage removes m from the queue, or with ListPollingOptions,
+// marks its claim as done, so it is not handled again.
+func (s *Server) ackMessage(ctx context.Context, m message) error {
+	if s.listPolling == nil {
+		return s.deleteMessage(ctx, m.ReceiptHandle)
+	}
+	if _, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(claimKey(m.Key) + claimDoneSuffix),
+		Body:     strings.NewReader(""),
+		Metadata: map[string]string{MetaInstanceID: s.stats.instanceID},
+	}); err != nil {
+		return fmt.Errorf("failed to mark %q as done: %w", m.Key, err)
+	}
+	return nil
+}
+
+// retryMessage makes m available to other servers again after d.
+func (s *Server) retryMessage(ctx context.Context, m message, d time.Duration) error {
+	if s.listPolling == nil {
+		return s.changeMessageVisibility(ctx, m.ReceiptHandle, d)
+	}
+	if d == 0 {
+		_, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(claimKey(m.Key)),
+		})
+		return err
+	}
+	_, err := s.putClaim(ctx, m.Key, time.Now().Add(d))
+	return err
+}
+
+// pollResponse polls the endpoint's bucket until the response to the request with the given key
+// exists and returns its key.
+func (c *Client) pollResponse(ctx context.Context, ep *common, op, key, inputChecksum string) (string, error) {
+	parent := ctx
+	responseWait := c.timeoutsFor(op).responseWait
+	ctx, cancel := context.WithTimeout(ctx, responseWait)
+	defer cancel()
+
+	resultKey := responseKey(op, key)
+	for {
+		metadata, err := ep.headObject(ctx, resultKey)
+		if err == nil {
+			if c.verifyResponses {
+				if err := verifyResponse(metadata, op, requestID(key), inputChecksum); err != nil {
+					return "", err
+				}
+			}
+			return resultKey, nil
+		}
+		var notFound *types.NotFound
+		if !errors.As(err, &notFound) && ctx.Err() == nil {
+			return "", &endpointError{err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := parent.Err(); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("timed out after %s waiting for the response: %w", responseWait, context.DeadlineExceeded)
+		case <-time.After(c.responsePollInterval):
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestListPollingOptions(t *testing.T) {
+	c := qt.New(t)
+
+	var opts ListPollingOptions
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.ClaimTimeout, qt.Equals, 5*time.Minute)
+	c.Assert((&ListPollingOptions{ClaimTimeout: -1}).init(), qt.ErrorMatches, ".*can not be negative")
+
+	c.Assert(claimKey("to_server/resize/01gcabc_image.jpg"), qt.Equals, "claims/resize/01gcabc_image.jpg")
+
+	sopts := ServerOptions{AWSConfig: AWSConfig{AccessKeyID: "a", SecretAccessKey: "s", Region: "eu-north-1"}}
+	c.Assert(sopts.init(), qt.ErrorMatches, "queue is required")
+	sopts.ListPolling = &ListPollingOptions{}
+	c.Assert(sopts.init(), qt.IsNil)
+
+	copts := ClientOptions{AWSConfig: AWSConfig{AccessKeyID: "a", SecretAccessKey: "s", Region: "eu-north-1"}}
+	c.Assert(copts.init(), qt.ErrorMatches, "queue is required")
+	copts.ResponsePollInterval = time.Second
+	c.Assert(copts.init(), qt.IsNil)
+}
+
+func TestListRequests(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	newServer := func(f *fakeS3) *Server {
+		return &Server{
+			handlers:    Handlers{"resize": nil},
+			listPolling: &ListPollingOptions{ClaimTimeout: time.Minute},
+			stats:       newServerStats("server1"),
+			common: &common{
+				bucket:   "s3fptest",
+				s3Client: f.client(c),
+				infof:    func(format string, args ...interface{}) {},
+			},
+		}
+	}
+	claim := func(expires time.Time) map[string]string {
+		return map[string]string{MetaInstanceID: "server2", metaClaimExpires: strconv.FormatInt(expires.Unix(), 10)}
+	}
+	keys := func(ms []message) []string {
+		var keys []string
+		for _, m := range ms {
+			keys = append(keys, m.Key)
+		}
+		return keys
+	}
+
+	c.Run("Claim already taken", func(c *qt.C) {
+		f := newFakeS3()
+		s := newServer(f)
+		f.put("to_server/resize/01a_a.jpg", nil)
+		f.put("to_server/resize/01b_b.jpg", nil)
+		f.put("claims/resize/01a_a.jpg", claim(time.Now().Add(time.Hour)))
+
+		ms, err := s.listRequests(ctx, 10)
+		c.Assert(err, qt.IsNil)
+		c.Assert(keys(ms), qt.DeepEquals, []string{"to_server/resize/01b_b.jpg"})
+		c.Assert(f.get("claims/resize/01a_a.jpg")[MetaInstanceID], qt.Equals, "server2")
+		c.Assert(f.get("claims/resize/01b_b.jpg")[MetaInstanceID], qt.Equals, "server1")
+		c.Assert(f.requestsFor("claims/resize/01a_a.jpg"), qt.DeepEquals, []string{"HEAD"})
+		c.Assert(f.requestsFor("claims/resize/01b_b.jpg"), qt.DeepEquals, []string{"PUT If-None-Match"})
+
+		// Claimed by another server between the listing and the claim.
+		ok, err := s.claim(ctx, "to_server/resize/01a_a.jpg")
+		c.Assert(err, qt.IsNil)
+		c.Assert(ok, qt.IsFalse)
+	})
+
+	c.Run("Expired claim", func(c *qt.C) {
+		f := newFakeS3()
+		s := newServer(f)
+		f.put("to_server/resize/01a_a.jpg", nil)
+		f.put("claims/resize/01a_a.jpg", claim(time.Now().Add(-time.Second)))
+
+		// Taken over by another server after we read the claim.
+		ok, err := s.putClaim(ctx, "to_server/resize/01a_a.jpg", time.Now(), smithyhttp.SetHeaderValue("If-Match", `"stale"`))
+		c.Assert(err, qt.IsNil)
+		c.Assert(ok, qt.IsFalse)
+
+		ms, err := s.listRequests(ctx, 10)
+		c.Assert(err, qt.IsNil)
+		c.Assert(keys(ms), qt.DeepEquals, []string{"to_server/resize/01a_a.jpg"})
+		c.Assert(f.get("claims/resize/01a_a.jpg")[MetaInstanceID], qt.Equals, "server1")
+		c.Assert(f.requestsFor("claims/resize/01a_a.jpg"), qt.DeepEquals, []string{"PUT If-Match", "HEAD", "PUT If-Match"})
+
+		// Released for a retry.
+		c.Assert(s.retryMessage(ctx, ms[0], 0), qt.IsNil)
+		ms, err = s.listRequests(ctx, 10)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ms, qt.HasLen, 1)
+	})
+
+	c.Run("Done", func(c *qt.C) {
+		f := newFakeS3()
+		s := newServer(f)
+		f.put("to_server/resize/01a_a.jpg", nil)
+
+		ms, err := s.listRequests(ctx, 10)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ms, qt.HasLen, 1)
+		c.Assert(s.ackMessage(ctx, ms[0]), qt.IsNil)
+		// Let the claim expire.
+		f.put("claims/resize/01a_a.jpg", claim(time.Now().Add(-time.Second)))
+		f.requests = nil
+
+		ms, err = s.listRequests(ctx, 10)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ms, qt.HasLen, 0)
+		c.Assert(f.requestsFor("claims/resize/01a_a.jpg"), qt.HasLen, 0)
+	})
+
+	c.Run("Max", func(c *qt.C) {
+		f := newFakeS3()
+		s := newServer(f)
+		for _, id := range []string{"01e", "01a", "01d", "01c", "01b"} {
+			f.put("to_server/resize/"+id+"_a.jpg", nil)
+		}
+
+		ms, err := s.listRequests(ctx, 3)
+		c.Assert(err, qt.IsNil)
+		c.Assert(keys(ms), qt.DeepEquals, []string{"to_server/resize/01a_a.jpg", "to_server/resize/01b_a.jpg", "to_server/resize/01c_a.jpg"})
+		c.Assert(f.get("claims/resize/01d_a.jpg"), qt.IsNil)
+
+		ms, err = s.listRequests(ctx, 3)
+		c.Assert(err, qt.IsNil)
+		c.Assert(keys(ms), qt.DeepEquals, []string{"to_server/resize/01d_a.jpg", "to_server/resize/01e_a.jpg"})
+	})
+}
+
+// fakeS3 is an in-memory S3 bucket served over HTTP,
+// supporting the object operations and conditional writes used by the list polling server.
+// Listings are paged two keys at a time.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	etags   int
+
+	// fail, if set, rejects all requests with 403 Access Denied.
+	fail bool
+
+	// echo, if set, answers the requests put below to_server/ with their input,
+	// as a server would.
+	echo bool
+
+	// requests holds the object requests made, as "<key> <method>[ <condition>]".
+	requests []string
+}
+
+type fakeObject struct {
+	body     []byte
+	etag     string
+	metadata map[string]string
+	modified time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]fakeObject)}
+}
+
+// client returns a client for the fake, closed when c's test is done.
+func (f *fakeS3) client(c *qt.C) *s3.Client {
+	ts := httptest.NewServer(f)
+	c.Cleanup(ts.Close)
+	// The signing region is set up front, or the resolver sets it on first use, racing with concurrent requests.
+	return s3.New(s3.Options{
+		Region:           "eu-north-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("a", "s", ""),
+		EndpointResolver: s3.EndpointResolverFromURL(ts.URL, func(e *aws.Endpoint) { e.SigningRegion = "eu-north-1" }),
+		UsePathStyle:     true,
+	})
+}
+
+func (f *fakeS3) put(key string, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.etags++
+	f.objects[key] = fakeObject{etag: fmt.Sprintf(`"%d"`, f.etags), metadata: metadata, modified: time.Now()}
+}
+
+// putBody puts an object with the given body and no metadata.
+func (f *fakeS3) putBody(key, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.etags++
+	f.objects[key] = fakeObject{body: []byte(body), etag: fmt.Sprintf(`"%d"`, f.etags), modified: time.Now()}
+}
+
+// body returns the body of the object with the given key.
+func (f *fakeS3) body(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.objects[key].body)
+}
+
+// get returns the metadata of the object with the given key, or nil if it does not exist.
+func (f *fakeS3) get(key string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[key]
+	if !ok {
+		return nil
+	}
+	if o.metadata == nil {
+		return map[string]string{}
+	}
+	return o.metadata
+}
+
+// requestsFor returns the requests made for the object with the given key.
+func (f *fakeS3) requestsFor(key string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var requests []string
+	for _, r := range f.requests {
+		if k, r, _ := strings.Cut(r, " "); k == key {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+		return
+	}
+
+	request := key + " " + r.Method
+	for _, h := range []string{"If-None-Match", "If-Match"} {
+		if r.Header.Get(h) != "" {
+			request += " " + h
+		}
+	}
+	f.requests = append(f.requests, request)
+
+	o, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			}
+			return
+		}
+		for k, v := range o.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.body)))
+		if r.Method == http.MethodGet {
+			w.Write(o.body)
+		}
+	case http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && exists || r.Header.Get("If-Match") != "" && (!exists || r.Header.Get("If-Match") != o.etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+			return
+		}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			_, srcKey, _ := strings.Cut(src, "/")
+			from, found := f.objects[srcKey]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+				return
+			}
+			f.etags++
+			f.objects[key] = fakeObject{body: from.body, etag: fmt.Sprintf(`"%d"`, f.etags), metadata: from.metadata, modified: time.Now()}
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>"%d"</ETag></CopyObjectResult>`, f.etags)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		metadata := make(map[string]string)
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				metadata[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = r.Header.Get(k)
+			}
+		}
+		f.etags++
+		f.objects[key] = fakeObject{body: body, etag: fmt.Sprintf(`"%d"`, f.etags), metadata: metadata, modified: time.Now()}
+		if f.echo && strings.HasPrefix(key, toServer+"/") {
+			f.etags++
+			f.objects[toClient+strings.TrimPrefix(key, toServer)] = fakeObject{
+				body:     body,
+				etag:     fmt.Sprintf(`"%d"`, f.etags),
+				metadata: map[string]string{MetaProtocolVersion: "1"},
+				modified: time.Now(),
+			}
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, after string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated, result.NextContinuationToken = true, keys[1]
+	}
+	for _, key := range keys {
+		o := f.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, LastModified: o.modified.UTC().Format(time.RFC3339), ETag: o.etag})
+	}
+	b, _ := xml.Marshal(result)
+	w.Write(b)
+}
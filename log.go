@@ -0,0 +1,117 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONLogger writes structured log lines as JSON,
+// suitable for ingestion by e.g. CloudWatch Logs or Fluent Bit:
+//
+//	{"level":"info","msg":"Downloading mybucket/to_server/resize/01gc..._image.jpg","op":"resize","request_id":"01gc...","ts":"2022-09-12T10:15:32.123Z"}
+//
+// Set it as ServerOptions.Logger or ClientOptions.Logger to have the op and request ID
+// added to the log lines for a request.
+type JSONLogger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	fields map[string]interface{}
+}
+
+// NewJSONLogger returns a JSONLogger writing to w.
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{mu: &sync.Mutex{}, w: w}
+}
+
+// With returns a logger that adds fields to every line.
+func (l *JSONLogger) With(fields map[string]interface{}) *JSONLogger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &JSONLogger{mu: l.mu, w: l.w, fields: merged}
+}
+
+// Infof logs an info message.
+func (l *JSONLogger) Infof(format string, args ...interface{}) {
+	l.log("info", nil, format, args...)
+}
+
+// Errorf logs an error message.
+func (l *JSONLogger) Errorf(format string, args ...interface{}) {
+	l.log("error", nil, format, args...)
+}
+
+func (l *JSONLogger) log(level string, fields map[string]interface{}, format string, args ...interface{}) {
+	entry := make(map[string]interface{}, len(l.fields)+len(fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["level"] = level
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": fmt.Sprintf("failed to marshal log entry: %s", err)})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(append(b, '\n'))
+}
+
+type logFieldsKey struct{}
+
+// withRequestLogFields returns a context with the op and request ID
+// of the request with the given object key, used by common.logf.
+func withRequestLogFields(ctx context.Context, op, key string) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, map[string]interface{}{
+		"op":         op,
+		"request_id": requestID(key),
+	})
+}
+
+// withLogFields returns a context with fields added to the log fields in ctx.
+func withLogFields(ctx context.Context, fields map[string]interface{}) context.Context {
+	if len(fields) == 0 {
+		return ctx
+	}
+	existing, _ := ctx.Value(logFieldsKey{}).(map[string]interface{})
+	merged := make(map[string]interface{}, len(existing)+len(fields))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// requestID returns the request ID from an object key on the form <prefix>/<op>/<id>_<filename>.
+func requestID(key string) string {
+	id, _, _ := strings.Cut(path.Base(key), "_")
+	return id
+}
+
+// logf logs an info message with the request fields in ctx, if any, when a JSONLogger is configured.
+func (c *common) logf(ctx context.Context, format string, args ...interface{}) {
+	if c.logger != nil {
+		fields, _ := ctx.Value(logFieldsKey{}).(map[string]interface{})
+		c.logger.log("info", fields, format, args...)
+		return
+	}
+	c.infof(format, args...)
+}
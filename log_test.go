@@ -0,0 +1,46 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestJSONLogger(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf).With(map[string]interface{}{"instance_id": "myinstance"})
+	cm := &common{logger: logger}
+
+	ctx := withRequestLogFields(context.Background(), "resize", "to_server/resize/01gcabc_image.jpg")
+	cm.logf(ctx, "Downloading %s", "image.jpg")
+	logger.Errorf("failed: %d", 42)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, qt.HasLen, 2)
+
+	var entry map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &entry), qt.IsNil)
+	c.Assert(entry["level"], qt.Equals, "info")
+	c.Assert(entry["msg"], qt.Equals, "Downloading image.jpg")
+	c.Assert(entry["op"], qt.Equals, "resize")
+	c.Assert(entry["request_id"], qt.Equals, "01gcabc")
+	c.Assert(entry["instance_id"], qt.Equals, "myinstance")
+	c.Assert(entry["ts"], qt.Not(qt.Equals), "")
+
+	entry = nil
+	c.Assert(json.Unmarshal([]byte(lines[1]), &entry), qt.IsNil)
+	c.Assert(entry["level"], qt.Equals, "error")
+	c.Assert(entry["msg"], qt.Equals, "failed: 42")
+	c.Assert(entry["op"], qt.IsNil)
+
+	var infos []string
+	cm = &common{infof: func(format string, args ...interface{}) { infos = append(infos, format) }}
+	cm.logf(ctx, "plain")
+	c.Assert(infos, qt.DeepEquals, []string{"plain"})
+}
@@ -0,0 +1,108 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// MemoryWorkspaceOptions configures memory-backed workspaces for the ops with
+// OpOptions.MemoryWorkspace, so small inputs, and the files handlers write next to them,
+// never touch the disk, e.g. for latency-sensitive ops.
+// Each request gets its own directory below Dir, removed after the response is sent.
+// An input that grows above MaxSize while it is downloaded is moved to disk,
+// as without memory-backed workspaces.
+type MemoryWorkspaceOptions struct {
+	// Dir is a memory-backed directory, e.g. a tmpfs mount.
+	// Defaults to /dev/shm.
+	Dir string
+
+	// MaxSize is the size in bytes above which an input is moved to disk.
+	// Defaults to 8 MiB.
+	MaxSize int64
+}
+
+func (o *MemoryWorkspaceOptions) init() error {
+	if o.Dir == "" {
+		o.Dir = "/dev/shm"
+	}
+	if fi, err := os.Stat(o.Dir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("memory workspace: %q is not a directory", o.Dir)
+	}
+	if o.MaxSize < 0 {
+		return errors.New("memory workspace: max size can not be negative")
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = 8 << 20
+	}
+	return nil
+}
+
+// spillFile is a request input in a memory-backed directory that is moved to
+// diskDir when it grows above max bytes.
+type spillFile struct {
+	*os.File
+
+	memDir  string
+	diskDir string
+	max     int64
+	n       int64
+}
+
+// newSpillFile creates the file for the request with the given key in a new directory below memDir.
+func newSpillFile(memDir, diskDir, key string, max int64) (*spillFile, error) {
+	dir, err := os.MkdirTemp(memDir, "req")
+	if err != nil {
+		return nil, fmt.Errorf("memory workspace: %w", err)
+	}
+	f, err := os.Create(filepath.Join(dir, safeFilename(path.Base(key))))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("memory workspace: %w", err)
+	}
+	return &spillFile{File: f, memDir: dir, diskDir: diskDir, max: max}, nil
+}
+
+func (f *spillFile) Write(p []byte) (int, error) {
+	if f.memDir != "" && f.n+int64(len(p)) > f.max {
+		if err := f.spill(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.File.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// spill moves the file to disk.
+func (f *spillFile) spill() error {
+	disk, err := createTemp(f.diskDir, f.Name())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err == nil {
+		_, err = copyBuffered(disk, f.File)
+	}
+	if err != nil {
+		disk.Close()
+		os.Remove(disk.Name())
+		return fmt.Errorf("memory workspace: failed to move input to disk: %w", err)
+	}
+	f.File.Close()
+	os.RemoveAll(f.memDir)
+	f.File, f.memDir = disk, ""
+	return nil
+}
+
+// remove closes and removes the file, and with it everything written next to it in memory.
+func (f *spillFile) remove() {
+	f.File.Close()
+	if f.memDir != "" {
+		os.RemoveAll(f.memDir)
+	} else {
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,59 @@
+package s3rpc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestMemoryWorkspaceOptions(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &MemoryWorkspaceOptions{Dir: t.TempDir()}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.MaxSize, qt.Equals, int64(8<<20))
+	c.Assert((&MemoryWorkspaceOptions{Dir: filepath.Join(t.TempDir(), "missing")}).init(), qt.IsNotNil)
+	c.Assert((&MemoryWorkspaceOptions{Dir: t.TempDir(), MaxSize: -1}).init(), qt.IsNotNil)
+}
+
+func TestSpillFile(t *testing.T) {
+	c := qt.New(t)
+
+	memDir, diskDir := t.TempDir(), t.TempDir()
+
+	// Small inputs stay in memory.
+	f, err := newSpillFile(memDir, diskDir, "to_server/resize/01h_a:b.jpg", 10)
+	c.Assert(err, qt.IsNil)
+	_, err = copyBuffered(f, strings.NewReader("0123456789"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(strings.HasPrefix(f.Name(), memDir), qt.IsTrue)
+	c.Assert(filepath.Base(f.Name()), qt.Equals, "01h_a_b.jpg")
+	// A handler output next to the input.
+	c.Assert(os.WriteFile(filepath.Join(filepath.Dir(f.Name()), "out.jpg"), []byte("out"), 0o600), qt.IsNil)
+	f.remove()
+	entries, err := os.ReadDir(memDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+
+	// Larger inputs are moved to disk.
+	f, err = newSpillFile(memDir, diskDir, "to_server/resize/01h_a.jpg", 10)
+	c.Assert(err, qt.IsNil)
+	_, err = f.Write([]byte("01234"))
+	c.Assert(err, qt.IsNil)
+	_, err = f.Write([]byte("56789abc"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(strings.HasPrefix(f.Name(), diskDir), qt.IsTrue)
+	entries, err = os.ReadDir(memDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+	b, err := os.ReadFile(f.Name())
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "0123456789abc")
+	f.remove()
+	entries, err = os.ReadDir(diskDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+}
@@ -0,0 +1,72 @@
+package s3rpc
+
+import (
+	"encoding/base64"
+	"mime"
+	"strings"
+)
+
+// S3 user metadata is sent as HTTP headers, so values must be printable ASCII
+// without leading or trailing whitespace, or the request fails with SignatureDoesNotMatch.
+// Other values are sent as RFC 2047 base64 encoded words and decoded on read,
+// so any UTF-8 or binary value round-trips.
+
+// metadataDecoder passes UTF-8 words through as is, so binary values are preserved.
+var metadataDecoder = new(mime.WordDecoder)
+
+// encodeMetadata returns m with the values that can not be sent as is encoded.
+// m is not modified.
+func encodeMetadata(m map[string]string) map[string]string {
+	var encoded map[string]string
+	for k, v := range m {
+		if !needsEncoding(v) {
+			continue
+		}
+		if encoded == nil {
+			encoded = make(map[string]string, len(m))
+			for k, v := range m {
+				encoded[k] = v
+			}
+		}
+		// mime.BEncoding.Encode leaves printable values, such as an encoded word, as is,
+		// so build the word here.
+		encoded[k] = "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(v)) + "?="
+	}
+	if encoded == nil {
+		return m
+	}
+	return encoded
+}
+
+// decodeMetadata decodes the values in m encoded by encodeMetadata, in place.
+func decodeMetadata(m map[string]string) map[string]string {
+	for k, v := range m {
+		if !isEncodedWord(v) {
+			continue
+		}
+		if decoded, err := metadataDecoder.DecodeHeader(v); err == nil {
+			m[k] = decoded
+		}
+	}
+	return m
+}
+
+func needsEncoding(v string) bool {
+	if v == "" {
+		return false
+	}
+	if v[0] == ' ' || v[len(v)-1] == ' ' || isEncodedWord(v) {
+		// Whitespace is trimmed and encoded words decoded on read.
+		return true
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 || c > 0x7e {
+			return true
+		}
+	}
+	return false
+}
+
+func isEncodedWord(v string) bool {
+	return strings.HasPrefix(v, "=?") && strings.HasSuffix(v, "?=")
+}
@@ -0,0 +1,37 @@
+package s3rpc
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	m := map[string]string{
+		"ascii":   "hello world",
+		"utf8":    "blåbærsyltetøy",
+		"binary":  "\x00\xff\xfe",
+		"space":   " padded ",
+		"word":    "=?UTF-8?B?aGVsbG8=?=",
+		"newline": "a\nb",
+		"long":    string(make([]byte, 200)) + "æ",
+		"empty":   "",
+	}
+	encoded := encodeMetadata(m)
+	c.Assert(encoded["ascii"], qt.Equals, "hello world")
+	for k, v := range encoded {
+		for i := 0; i < len(v); i++ {
+			c.Assert(v[i] >= 0x20 && v[i] <= 0x7e, qt.IsTrue, qt.Commentf("%s: %q", k, v))
+		}
+	}
+	c.Assert(m["utf8"], qt.Equals, "blåbærsyltetøy", qt.Commentf("input must not be modified"))
+
+	decoded := decodeMetadata(encoded)
+	c.Assert(decoded, qt.DeepEquals, m)
+
+	plain := map[string]string{"a": "b"}
+	c.Assert(encodeMetadata(plain), qt.DeepEquals, plain)
+	c.Assert(encodeMetadata(nil), qt.IsNil)
+}
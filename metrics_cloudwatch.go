@@ -0,0 +1,276 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// CloudWatchOptions configures the server to publish metrics to CloudWatch.
+//
+// The following metrics are published every Interval:
+//
+//   - Processed and Failed: the number of requests handled, per Op.
+//   - HandlerDuration: the handler duration in milliseconds, per Op.
+//   - BacklogAge: the time in seconds from a request was uploaded until the server picked it up.
+//   - MessageAge: the time in milliseconds from a request was uploaded until its handler started, per Op.
+//   - QuotaExceeded: the number of requests rejected by ServerOptions.Quotas, per Op.
+//   - StuckHandlers: the number of handlers detected as stuck by ServerOptions.StuckHandlers, per Op.
+//   - UploadThroughput and DownloadThroughput: the throughput in bytes per second of the server's transfers.
+//
+// The server user needs the cloudwatch:PutMetricData permission.
+type CloudWatchOptions struct {
+	// Namespace is the CloudWatch namespace. Defaults to "s3rpc".
+	Namespace string
+
+	// Dimensions are added to all metrics, e.g. {"Environment": "production"}.
+	Dimensions map[string]string
+
+	// Interval is the publishing interval. Defaults to 1 minute.
+	Interval time.Duration
+}
+
+func (opts *CloudWatchOptions) init() error {
+	if opts.Namespace == "" {
+		opts.Namespace = "s3rpc"
+	}
+	if opts.Interval == 0 {
+		opts.Interval = time.Minute
+	}
+	if len(opts.Dimensions) > 29 {
+		// CloudWatch allows 30 dimensions, and we use one for the op.
+		return fmt.Errorf("cloudwatch: too many dimensions")
+	}
+	return nil
+}
+
+// maxMetricDataPerRequest is the number of metrics allowed in one PutMetricData call.
+const maxMetricDataPerRequest = 20
+
+type cloudWatchMetrics struct {
+	opts   CloudWatchOptions
+	client *cloudwatch.Client
+	infof  func(format string, args ...interface{})
+
+	mu        sync.Mutex
+	ops       map[string]*opMetrics
+	ages      types.StatisticSet
+	uploads   types.StatisticSet
+	downloads types.StatisticSet
+}
+
+type opMetrics struct {
+	processed, failed int
+	quotaExceeded     int
+	stuck             int
+	durations         types.StatisticSet
+	messageAges       types.StatisticSet
+}
+
+func newCloudWatchMetrics(opts *CloudWatchOptions, awsCfg aws.Config, infof func(format string, args ...interface{})) *cloudWatchMetrics {
+	if opts == nil {
+		return nil
+	}
+	return &cloudWatchMetrics{
+		opts:   *opts,
+		client: cloudwatch.NewFromConfig(awsCfg),
+		infof:  infof,
+		ops:    make(map[string]*opMetrics),
+	}
+}
+
+// observe records a handler invocation.
+func (m *cloudWatchMetrics) observe(op string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	om := m.opMetrics(op)
+	if err != nil {
+		om.failed++
+	} else {
+		om.processed++
+	}
+	addSample(&om.durations, float64(d.Milliseconds()))
+}
+
+// observeQuotaExceeded records a request rejected by the quotas.
+func (m *cloudWatchMetrics) observeQuotaExceeded(op string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.opMetrics(op).quotaExceeded++
+	m.mu.Unlock()
+}
+
+// observeStuck records a handler detected as stuck.
+func (m *cloudWatchMetrics) observeStuck(op string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.opMetrics(op).stuck++
+	m.mu.Unlock()
+}
+
+// observeMessageAge records the age of a request when its handler started.
+func (m *cloudWatchMetrics) observeMessageAge(op string, age time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	addSample(&m.opMetrics(op).messageAges, float64(age.Milliseconds()))
+	m.mu.Unlock()
+}
+
+// observeTransfer records the throughput of an upload or download.
+func (m *cloudWatchMetrics) observeTransfer(direction string, bytesPerSecond float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if direction == TransferUpload {
+		addSample(&m.uploads, bytesPerSecond)
+	} else {
+		addSample(&m.downloads, bytesPerSecond)
+	}
+	m.mu.Unlock()
+}
+
+// opMetrics returns the metrics for op, creating them if needed.
+// m.mu must be held.
+func (m *cloudWatchMetrics) opMetrics(op string) *opMetrics {
+	om := m.ops[op]
+	if om == nil {
+		om = &opMetrics{}
+		m.ops[op] = om
+	}
+	return om
+}
+
+// observeAge records the age of a request when picked up.
+func (m *cloudWatchMetrics) observeAge(age time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	addSample(&m.ages, age.Seconds())
+	m.mu.Unlock()
+}
+
+func addSample(s *types.StatisticSet, v float64) {
+	if s.SampleCount == nil || *s.SampleCount == 0 {
+		s.SampleCount, s.Sum, s.Minimum, s.Maximum = aws.Float64(1), aws.Float64(v), aws.Float64(v), aws.Float64(v)
+		return
+	}
+	*s.SampleCount++
+	*s.Sum += v
+	if v < *s.Minimum {
+		*s.Minimum = v
+	}
+	if v > *s.Maximum {
+		*s.Maximum = v
+	}
+}
+
+// run publishes the metrics every interval until ctx is done or quit is closed.
+func (m *cloudWatchMetrics) run(ctx context.Context, quit <-chan struct{}) {
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.publish(ctx)
+			continue
+		case <-ctx.Done():
+		case <-quit:
+		}
+		// Use a fresh context, to publish the last metrics on shutdown.
+		m.publish(context.Background())
+		return
+	}
+}
+
+func (m *cloudWatchMetrics) publish(ctx context.Context) {
+	data := m.collect(time.Now())
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxMetricDataPerRequest {
+			n = maxMetricDataPerRequest
+		}
+		if _, err := m.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(m.opts.Namespace),
+			MetricData: data[:n],
+		}); err != nil {
+			m.infof("Failed to publish CloudWatch metrics: %s", err)
+			return
+		}
+		data = data[n:]
+	}
+}
+
+// collect returns the metrics observed since the previous call.
+func (m *cloudWatchMetrics) collect(now time.Time) []types.MetricDatum {
+	m.mu.Lock()
+	ops, ages, uploads, downloads := m.ops, m.ages, m.uploads, m.downloads
+	m.ops, m.ages, m.uploads, m.downloads = make(map[string]*opMetrics), types.StatisticSet{}, types.StatisticSet{}, types.StatisticSet{}
+	m.mu.Unlock()
+
+	dimensions := func(op string) []types.Dimension {
+		var dims []types.Dimension
+		if op != "" {
+			dims = append(dims, types.Dimension{Name: aws.String("Op"), Value: aws.String(op)})
+		}
+		for k, v := range m.opts.Dimensions {
+			dims = append(dims, types.Dimension{Name: aws.String(k), Value: aws.String(v)})
+		}
+		sort.Slice(dims, func(i, j int) bool { return *dims[i].Name < *dims[j].Name })
+		return dims
+	}
+
+	var names []string
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+
+	var data []types.MetricDatum
+	for _, op := range names {
+		om := ops[op]
+		data = append(data,
+			types.MetricDatum{MetricName: aws.String("Processed"), Dimensions: dimensions(op), Timestamp: aws.Time(now), Unit: types.StandardUnitCount, Value: aws.Float64(float64(om.processed))},
+			types.MetricDatum{MetricName: aws.String("Failed"), Dimensions: dimensions(op), Timestamp: aws.Time(now), Unit: types.StandardUnitCount, Value: aws.Float64(float64(om.failed))},
+		)
+		if om.quotaExceeded > 0 {
+			data = append(data, types.MetricDatum{MetricName: aws.String("QuotaExceeded"), Dimensions: dimensions(op), Timestamp: aws.Time(now), Unit: types.StandardUnitCount, Value: aws.Float64(float64(om.quotaExceeded))})
+		}
+		if om.stuck > 0 {
+			data = append(data, types.MetricDatum{MetricName: aws.String("StuckHandlers"), Dimensions: dimensions(op), Timestamp: aws.Time(now), Unit: types.StandardUnitCount, Value: aws.Float64(float64(om.stuck))})
+		}
+		if om.durations.SampleCount != nil {
+			data = append(data, types.MetricDatum{MetricName: aws.String("HandlerDuration"), Dimensions: dimensions(op), Timestamp: aws.Time(now), Unit: types.StandardUnitMilliseconds, StatisticValues: &om.durations})
+		}
+		if om.messageAges.SampleCount != nil {
+			data = append(data, types.MetricDatum{MetricName: aws.String("MessageAge"), Dimensions: dimensions(op), Timestamp: aws.Time(now), Unit: types.StandardUnitMilliseconds, StatisticValues: &om.messageAges})
+		}
+	}
+	if ages.SampleCount != nil {
+		data = append(data, types.MetricDatum{MetricName: aws.String("BacklogAge"), Dimensions: dimensions(""), Timestamp: aws.Time(now), Unit: types.StandardUnitSeconds, StatisticValues: &ages})
+	}
+	if uploads.SampleCount != nil {
+		data = append(data, types.MetricDatum{MetricName: aws.String("UploadThroughput"), Dimensions: dimensions(""), Timestamp: aws.Time(now), Unit: types.StandardUnitBytesSecond, StatisticValues: &uploads})
+	}
+	if downloads.SampleCount != nil {
+		data = append(data, types.MetricDatum{MetricName: aws.String("DownloadThroughput"), Dimensions: dimensions(""), Timestamp: aws.Time(now), Unit: types.StandardUnitBytesSecond, StatisticValues: &downloads})
+	}
+
+	return data
+}
@@ -0,0 +1,64 @@
+package s3rpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestCloudWatchMetrics(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &CloudWatchOptions{Dimensions: map[string]string{"Environment": "test"}}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Namespace, qt.Equals, "s3rpc")
+	c.Assert(opts.Interval, qt.Equals, time.Minute)
+
+	var nilMetrics *cloudWatchMetrics
+	nilMetrics.observe("op", time.Second, nil)
+	nilMetrics.observeAge(time.Second)
+	nilMetrics.observeMessageAge("op", time.Second)
+
+	m := newCloudWatchMetrics(opts, aws.Config{Region: defaultRegion}, func(format string, args ...interface{}) {})
+	m.observe("resize", 100*time.Millisecond, nil)
+	m.observe("resize", 300*time.Millisecond, errors.New("failed"))
+	m.observe("compact", time.Second, nil)
+	m.observeAge(2 * time.Second)
+	m.observeAge(4 * time.Second)
+	m.observeMessageAge("resize", 5*time.Second)
+
+	data := m.collect(time.Now())
+	c.Assert(data, qt.HasLen, 8)
+
+	byName := make(map[string]float64)
+	for _, d := range data {
+		dims := make(map[string]string)
+		for _, dim := range d.Dimensions {
+			dims[*dim.Name] = *dim.Value
+		}
+		c.Assert(dims["Environment"], qt.Equals, "test")
+		key := *d.MetricName + "/" + dims["Op"]
+		if d.Value != nil {
+			byName[key] = *d.Value
+		} else {
+			byName[key] = *d.StatisticValues.Maximum
+		}
+	}
+	c.Assert(byName, qt.DeepEquals, map[string]float64{
+		"Processed/compact":       1,
+		"Failed/compact":          0,
+		"HandlerDuration/compact": 1000,
+		"Processed/resize":        1,
+		"Failed/resize":           1,
+		"HandlerDuration/resize":  300,
+		"MessageAge/resize":       5000,
+		"BacklogAge/":             4,
+	})
+
+	// Collect resets.
+	c.Assert(m.collect(time.Now()), qt.HasLen, 0)
+}
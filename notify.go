@@ -0,0 +1,74 @@
+package s3rpc
+
+import (
+	"context"
+	"time"
+)
+
+// Completion statuses, see Completion.Status.
+const (
+	CompletionSucceeded = "succeeded"
+	CompletionFailed    = "failed"
+)
+
+// Completion describes a finished request.
+// It is sent to the configured notification targets, see ServerOptions.SNS, ServerOptions.EventBridge,
+// ServerOptions.Webhooks and ServerOptions.StepFunctions.
+type Completion struct {
+	Op        string `json:"op"`
+	RequestID string `json:"request_id"`
+
+	// Key is the key of the request input.
+	Key string `json:"key"`
+
+	// Status is CompletionSucceeded or CompletionFailed.
+	Status string `json:"status"`
+
+	// ResultKey is the key of the response object.
+	// It is empty if the request failed without a response being sent.
+	ResultKey string `json:"result_key,omitempty"`
+
+	// ErrorCode and Error are set for failed requests.
+	// ErrorCode is one of the ErrorCode* constants.
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	// Metadata is the response metadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	InstanceID string    `json:"instance_id"`
+	Time       time.Time `json:"time"`
+}
+
+// notifier sends Completion notifications.
+type notifier interface {
+	notify(ctx context.Context, c Completion) error
+}
+
+// notify sends c to all notifiers.
+// The response is already sent, so errors are only logged.
+func (s *Server) notify(ctx context.Context, c Completion) {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	c.RequestID = requestID(c.Key)
+	c.InstanceID = s.stats.instanceID
+	c.Time = time.Now().UTC()
+	for _, n := range s.notifiers {
+		if err := n.notify(ctx, c); err != nil {
+			s.logf(ctx, "Failed to send completion notification for %q: %s", c.Key, err)
+		}
+	}
+}
+
+type requestMetadataKey struct{}
+
+// withRequestMetadata stores the request's metadata in ctx for the notifiers.
+func withRequestMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, requestMetadataKey{}, metadata)
+}
+
+func requestMetadataFromContext(ctx context.Context) map[string]string {
+	m, _ := ctx.Value(requestMetadataKey{}).(map[string]string)
+	return m
+}
@@ -0,0 +1,88 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// EventBridgeOptions configures sending an event with a Completion as its detail
+// to an EventBridge bus for each finished request.
+type EventBridgeOptions struct {
+	// BusName is the event bus name or ARN.
+	// The server user needs events:PutEvents on it.
+	// Defaults to "default".
+	BusName string
+
+	// Source is the event source.
+	// Defaults to "s3rpc".
+	Source string
+
+	// DetailTypeSucceeded and DetailTypeFailed are the detail-type of events
+	// for succeeded and failed requests.
+	// Default to "s3rpc Job Completed" and "s3rpc Job Failed".
+	DetailTypeSucceeded string
+	DetailTypeFailed    string
+}
+
+func (o *EventBridgeOptions) init() error {
+	if o.BusName == "" {
+		o.BusName = "default"
+	}
+	if o.Source == "" {
+		o.Source = "s3rpc"
+	}
+	if o.DetailTypeSucceeded == "" {
+		o.DetailTypeSucceeded = "s3rpc Job Completed"
+	}
+	if o.DetailTypeFailed == "" {
+		o.DetailTypeFailed = "s3rpc Job Failed"
+	}
+	return nil
+}
+
+type eventBridgeNotifier struct {
+	opts   EventBridgeOptions
+	client *eventbridge.Client
+}
+
+func newEventBridgeNotifier(opts EventBridgeOptions, awsCfg aws.Config) *eventBridgeNotifier {
+	return &eventBridgeNotifier{opts: opts, client: eventbridge.NewFromConfig(awsCfg)}
+}
+
+func (n *eventBridgeNotifier) notify(ctx context.Context, c Completion) error {
+	entry, err := n.entry(c)
+	if err != nil {
+		return err
+	}
+	out, err := n.client.PutEvents(ctx, &eventbridge.PutEventsInput{Entries: []types.PutEventsRequestEntry{entry}})
+	if err != nil {
+		return fmt.Errorf("failed to put event on %s: %w", n.opts.BusName, err)
+	}
+	if out.FailedEntryCount > 0 {
+		return fmt.Errorf("failed to put event on %s: %s", n.opts.BusName, aws.ToString(out.Entries[0].ErrorMessage))
+	}
+	return nil
+}
+
+func (n *eventBridgeNotifier) entry(c Completion) (types.PutEventsRequestEntry, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return types.PutEventsRequestEntry{}, err
+	}
+	detailType := n.opts.DetailTypeSucceeded
+	if c.Status == CompletionFailed {
+		detailType = n.opts.DetailTypeFailed
+	}
+	return types.PutEventsRequestEntry{
+		EventBusName: aws.String(n.opts.BusName),
+		Source:       aws.String(n.opts.Source),
+		DetailType:   aws.String(detailType),
+		Detail:       aws.String(string(b)),
+		Time:         aws.Time(c.Time),
+	}, nil
+}
@@ -0,0 +1,57 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// SNSOptions configures publishing a Completion to an SNS topic for each finished request,
+// so systems other than the requesting client can react to finished jobs.
+type SNSOptions struct {
+	// TopicArn is the topic to publish to.
+	// The server user needs sns:Publish on it.
+	TopicArn string
+}
+
+func (o *SNSOptions) init() error {
+	if o.TopicArn == "" {
+		return errors.New("sns: topic ARN is required")
+	}
+	return nil
+}
+
+type snsNotifier struct {
+	topicArn string
+	client   *sns.Client
+}
+
+func newSNSNotifier(opts SNSOptions, awsCfg aws.Config) *snsNotifier {
+	return &snsNotifier{topicArn: opts.TopicArn, client: sns.NewFromConfig(awsCfg)}
+}
+
+// notify publishes c as JSON.
+// The op and status are also set as message attributes for use in subscription filter policies.
+func (n *snsNotifier) notify(ctx context.Context, c Completion) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = n.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(n.topicArn),
+		Message:  aws.String(string(b)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"op":     {DataType: aws.String("String"), StringValue: aws.String(c.Op)},
+			"status": {DataType: aws.String("String"), StringValue: aws.String(c.Status)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", n.topicArn, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+)
+
+// Limits on the SendTaskFailure error and cause.
+const (
+	maxTaskErrorLen = 256
+	maxTaskCauseLen = 32768
+)
+
+// StepFunctionsOptions configures completing Step Functions callback tasks.
+//
+// A state machine starts a request with a .waitForTaskToken task that uploads the input
+// with the task token in the MetaTaskToken metadata, e.g. with the s3:putObject SDK integration
+// or a Lambda function using the Client. When the request finishes, the server calls
+// SendTaskSuccess with the Completion as output, or SendTaskFailure with the
+// ErrorCode as error and the message as cause.
+// The server user needs states:SendTaskSuccess and states:SendTaskFailure on the state machine.
+type StepFunctionsOptions struct {
+	// Output, if set, returns the value to send as JSON task output for a succeeded request.
+	// Defaults to the Completion.
+	Output func(c Completion) (interface{}, error)
+}
+
+type stepFunctionsNotifier struct {
+	opts   StepFunctionsOptions
+	client *sfn.Client
+}
+
+func newStepFunctionsNotifier(opts StepFunctionsOptions, awsCfg aws.Config) *stepFunctionsNotifier {
+	return &stepFunctionsNotifier{opts: opts, client: sfn.NewFromConfig(awsCfg)}
+}
+
+func (n *stepFunctionsNotifier) notify(ctx context.Context, c Completion) error {
+	token := requestMetadataFromContext(ctx)[MetaTaskToken]
+	if token == "" {
+		return nil
+	}
+
+	if c.Status != CompletionSucceeded {
+		_, err := n.client.SendTaskFailure(ctx, taskFailure(token, c))
+		if err != nil {
+			return fmt.Errorf("failed to send task failure: %w", err)
+		}
+		return nil
+	}
+
+	output, err := n.output(c)
+	if err != nil {
+		return err
+	}
+	_, err = n.client.SendTaskSuccess(ctx, &sfn.SendTaskSuccessInput{
+		TaskToken: aws.String(token),
+		Output:    aws.String(output),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send task success: %w", err)
+	}
+	return nil
+}
+
+func (n *stepFunctionsNotifier) output(c Completion) (string, error) {
+	var v interface{} = c
+	if n.opts.Output != nil {
+		var err error
+		if v, err = n.opts.Output(c); err != nil {
+			return "", fmt.Errorf("failed to create task output: %w", err)
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func taskFailure(token string, c Completion) *sfn.SendTaskFailureInput {
+	code, cause := c.ErrorCode, c.Error
+	if code == "" {
+		code = ErrorCodeHandler
+	}
+	if len(code) > maxTaskErrorLen {
+		code = code[:maxTaskErrorLen]
+	}
+	if len(cause) > maxTaskCauseLen {
+		cause = cause[:maxTaskCauseLen]
+	}
+	return &sfn.SendTaskFailureInput{
+		TaskToken: aws.String(token),
+		Error:     aws.String(code),
+		Cause:     aws.String(cause),
+	}
+}
@@ -0,0 +1,134 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type testNotifier struct {
+	completions []Completion
+	err         error
+}
+
+func (n *testNotifier) notify(ctx context.Context, c Completion) error {
+	n.completions = append(n.completions, c)
+	return n.err
+}
+
+func TestNotify(t *testing.T) {
+	c := qt.New(t)
+
+	var logged []string
+	n1, n2 := &testNotifier{err: errors.New("unavailable")}, &testNotifier{}
+	s := &Server{
+		stats:     newServerStats("server1"),
+		notifiers: []notifier{n1, n2},
+		common: &common{infof: func(format string, args ...interface{}) {
+			logged = append(logged, format)
+		}},
+	}
+
+	s.notify(context.Background(), Completion{Op: "resize", Key: "to_server/resize/01gcabc_image.jpg", Status: CompletionSucceeded})
+	c.Assert(n2.completions, qt.HasLen, 1)
+	comp := n2.completions[0]
+	c.Assert(comp.RequestID, qt.Equals, "01gcabc")
+	c.Assert(comp.InstanceID, qt.Equals, "server1")
+	c.Assert(comp.Time.IsZero(), qt.IsFalse)
+	c.Assert(n1.completions, qt.HasLen, 1)
+	c.Assert(logged, qt.HasLen, 1)
+
+	c.Assert((&SNSOptions{}).init(), qt.ErrorMatches, "sns: topic ARN is required")
+}
+
+func TestEventBridgeEntry(t *testing.T) {
+	c := qt.New(t)
+
+	opts := EventBridgeOptions{DetailTypeFailed: "Resize Failed"}
+	c.Assert(opts.init(), qt.IsNil)
+	n := &eventBridgeNotifier{opts: opts}
+
+	entry, err := n.entry(Completion{Op: "resize", RequestID: "01gcabc", Status: CompletionSucceeded})
+	c.Assert(err, qt.IsNil)
+	c.Assert(*entry.EventBusName, qt.Equals, "default")
+	c.Assert(*entry.Source, qt.Equals, "s3rpc")
+	c.Assert(*entry.DetailType, qt.Equals, "s3rpc Job Completed")
+	c.Assert(*entry.Detail, qt.Contains, `"request_id":"01gcabc"`)
+
+	entry, err = n.entry(Completion{Op: "resize", Status: CompletionFailed})
+	c.Assert(err, qt.IsNil)
+	c.Assert(*entry.DetailType, qt.Equals, "Resize Failed")
+}
+
+func TestWebhook(t *testing.T) {
+	c := qt.New(t)
+
+	secret := []byte("secret")
+	var got WebhookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhook(secret, r.Header.Get(WebhookSignatureHeader), body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer ts.Close()
+
+	opts := WebhookOptions{Secret: secret}
+	c.Assert(opts.init(), qt.IsNil)
+	n := &webhookNotifier{opts: opts, httpClient: ts.Client()}
+
+	ctx := withRequestMetadata(context.Background(), map[string]string{MetaCallbackURL: ts.URL})
+	c.Assert(n.notify(ctx, Completion{Op: "resize", RequestID: "01gcabc", Status: CompletionFailed, ErrorCode: ErrorCodeInvalidInput}), qt.IsNil)
+	c.Assert(got.RequestID, qt.Equals, "01gcabc")
+	c.Assert(got.ErrorCode, qt.Equals, ErrorCodeInvalidInput)
+
+	// No callback URL.
+	c.Assert(n.notify(context.Background(), Completion{}), qt.IsNil)
+
+	n.opts.Secret = []byte("other")
+	c.Assert(n.notify(ctx, Completion{}), qt.ErrorMatches, ".*401 Unauthorized")
+
+	n.opts.AllowedHosts = []string{"example.com"}
+	c.Assert(n.notify(ctx, Completion{}), qt.ErrorMatches, `webhook: host "127.0.0.1" is not allowed`)
+	c.Assert(n.checkURL("file:///etc/passwd"), qt.ErrorMatches, `.*invalid callback URL scheme "file"`)
+
+	body := []byte(`{}`)
+	old := signWebhook(secret, body, time.Now().Add(-time.Hour))
+	c.Assert(VerifyWebhook(secret, old, body, time.Minute), qt.ErrorMatches, "webhook signature is 1h0m.*s old")
+	c.Assert(VerifyWebhook(secret, "foo", body, time.Minute), qt.ErrorMatches, "invalid webhook signature")
+}
+
+func TestStepFunctionsNotifier(t *testing.T) {
+	c := qt.New(t)
+
+	n := &stepFunctionsNotifier{}
+	output, err := n.output(Completion{Op: "resize", RequestID: "01gcabc", Status: CompletionSucceeded})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output, qt.Contains, `"request_id":"01gcabc"`)
+
+	n.opts.Output = func(c Completion) (interface{}, error) {
+		return map[string]string{"result": c.ResultKey}, nil
+	}
+	output, err = n.output(Completion{ResultKey: "to_client/resize/01gcabc_image.jpg"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output, qt.Equals, `{"result":"to_client/resize/01gcabc_image.jpg"}`)
+
+	failure := taskFailure("token", Completion{Status: CompletionFailed, ErrorCode: ErrorCodeInfected, Error: strings.Repeat("a", maxTaskCauseLen+1)})
+	c.Assert(*failure.TaskToken, qt.Equals, "token")
+	c.Assert(*failure.Error, qt.Equals, ErrorCodeInfected)
+	c.Assert(*failure.Cause, qt.HasLen, maxTaskCauseLen)
+	c.Assert(*taskFailure("token", Completion{Status: CompletionFailed}).Error, qt.Equals, ErrorCodeHandler)
+
+	// No task token, nothing to do.
+	c.Assert(n.notify(context.Background(), Completion{}), qt.IsNil)
+}
@@ -0,0 +1,187 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// WebhookSignatureHeader is the header holding the signature of a webhook payload,
+// on the form t=<unix time>,v1=<hex encoded HMAC-SHA256 of "<unix time>.<body>">.
+// See VerifyWebhook.
+const WebhookSignatureHeader = "S3rpc-Signature"
+
+// WebhookOptions configures POSTing a WebhookPayload to the URL in the request's
+// MetaCallbackURL metadata when a request finishes, for clients that can not poll SQS.
+type WebhookOptions struct {
+	// Secret signs the payloads, see VerifyWebhook.
+	Secret []byte
+
+	// AllowedHosts, if set, limits the callback URLs to these hosts.
+	AllowedHosts []string
+
+	// PresignExpiry is how long the presigned URL to the result is valid.
+	// The server user needs s3:GetObject on to_client/* for the URL to work.
+	// Defaults to 1 hour.
+	PresignExpiry time.Duration
+
+	// Timeout is the timeout for each POST.
+	// Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+func (o *WebhookOptions) init() error {
+	if len(o.Secret) == 0 {
+		return errors.New("webhook: secret is required")
+	}
+	if o.PresignExpiry == 0 {
+		o.PresignExpiry = time.Hour
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON body POSTed to callback URLs.
+type WebhookPayload struct {
+	Completion
+
+	// PresignedURL is a presigned GET URL to the result, if any.
+	PresignedURL string `json:"presigned_url,omitempty"`
+}
+
+type webhookNotifier struct {
+	opts       WebhookOptions
+	bucket     string
+	presign    *s3.PresignClient
+	httpClient *http.Client
+}
+
+func newWebhookNotifier(opts WebhookOptions, bucket string, s3Client *s3.Client) *webhookNotifier {
+	return &webhookNotifier{
+		opts:       opts,
+		bucket:     bucket,
+		presign:    s3.NewPresignClient(s3Client),
+		httpClient: &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+func (n *webhookNotifier) notify(ctx context.Context, c Completion) error {
+	callbackURL := requestMetadataFromContext(ctx)[MetaCallbackURL]
+	if callbackURL == "" {
+		return nil
+	}
+	if err := n.checkURL(callbackURL); err != nil {
+		return err
+	}
+
+	payload := WebhookPayload{Completion: c}
+	if c.ResultKey != "" && c.Status == CompletionSucceeded {
+		req, err := n.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(n.bucket),
+			Key:    aws.String(c.ResultKey),
+		}, s3.WithPresignExpires(n.opts.PresignExpiry))
+		if err != nil {
+			return fmt.Errorf("webhook: failed to presign %q: %w", c.ResultKey, err)
+		}
+		payload.PresignedURL = req.URL
+	}
+
+	return n.post(ctx, callbackURL, payload, time.Now())
+}
+
+func (n *webhookNotifier) post(ctx context.Context, callbackURL string, payload WebhookPayload, now time.Time) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signWebhook(n.opts.Secret, body, now))
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+func (n *webhookNotifier) checkURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("webhook: invalid callback URL: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("webhook: invalid callback URL scheme %q", u.Scheme)
+	}
+	if len(n.opts.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, host := range n.opts.AllowedHosts {
+		if strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook: host %q is not allowed", u.Hostname())
+}
+
+func signWebhook(secret, body []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + webhookMAC(secret, ts, body)
+}
+
+func webhookMAC(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook verifies the WebhookSignatureHeader value signature of body with secret.
+// Signatures older than maxAge are rejected to prevent replays.
+func VerifyWebhook(secret []byte, signature string, body []byte, maxAge time.Duration) error {
+	var ts, mac string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			mac = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || mac == "" {
+		return errors.New("invalid webhook signature")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxAge {
+		return fmt.Errorf("webhook signature is %s old", age.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(mac), []byte(webhookMAC(secret, ts, body))) {
+		return errors.New("webhook signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package s3rpc
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestObjectLockOptions(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&ObjectLockOptions{}).init(), qt.IsNil)
+	c.Assert((&ObjectLockOptions{Mode: "GOVERNANCE"}).init(), qt.ErrorMatches, ".*RetainFor is required.*")
+	c.Assert((&ObjectLockOptions{RetainFor: time.Hour}).init(), qt.ErrorMatches, ".*Mode is required.*")
+	c.Assert((&ObjectLockOptions{Mode: "foo", RetainFor: time.Hour}).init(), qt.ErrorMatches, `.*unknown mode "foo"`)
+
+	opts := &ObjectLockOptions{Mode: "COMPLIANCE", RetainFor: time.Hour, SkipDeletes: true}
+	c.Assert(opts.init(), qt.IsNil)
+	in := &s3.PutObjectInput{}
+	opts.apply(in)
+	c.Assert(in.ObjectLockMode, qt.Equals, types.ObjectLockModeCompliance)
+	c.Assert(in.ChecksumAlgorithm, qt.Equals, types.ChecksumAlgorithmSha256)
+	c.Assert(time.Until(*in.ObjectLockRetainUntilDate) > 59*time.Minute, qt.IsTrue)
+	c.Assert(opts.skipDeletes(), qt.IsTrue)
+
+	var nilOpts *ObjectLockOptions
+	in = &s3.PutObjectInput{}
+	nilOpts.apply(in)
+	c.Assert(in.ChecksumAlgorithm, qt.Equals, types.ChecksumAlgorithm(""))
+	c.Assert(nilOpts.skipDeletes(), qt.IsFalse)
+}
@@ -0,0 +1,225 @@
+package s3rpc
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// OpOptions overrides the server defaults for one op,
+// e.g. a quick thumbnail op and a slow transcode op need very different settings.
+// See ServerOptions.Ops.
+type OpOptions struct {
+	// Timeout, if set, is the maximum duration of the handler.
+	// The handler's context is cancelled when it expires,
+	// and the client gets a ResponseError with code ErrorCodeTimeout.
+	Timeout time.Duration
+
+	// MaxConcurrency, if set, is the maximum number of requests for this op
+	// this server handles concurrently, within ServerOptions.MaxConcurrency.
+	// Requests above the limit are left for other servers or retried after a few seconds.
+	MaxConcurrency int
+
+	// MaxMemory, if set, cancels the handler if the heap grows by more than this many bytes
+	// while it runs. Handlers share the process, so this is approximate with concurrent requests;
+	// run heavy ops as plugins with PluginLimits for hard limits.
+	// The client gets a ResponseError with code ErrorCodeResourceLimit.
+	// A handler that ignores the cancellation, here and on Timeout, is abandoned after 10 seconds.
+	MaxMemory int64
+
+	// MaxInputSize, if set, rejects inputs larger than this many bytes
+	// with ErrorCodeInvalidInput before they are scanned, validated and handled.
+	MaxInputSize int64
+
+	// Compress, if set, gzip compresses the response before upload.
+	// The client decompresses it, so handlers and callers see the uncompressed file.
+	Compress bool
+
+	// Dictionary, if set, compresses the response with zstd and the dictionary with this name
+	// instead of gzip, see Client.UploadDictionary. It implies Compress.
+	Dictionary string
+
+	// StorageClass, if set, is the S3 storage class of the response, e.g. "STANDARD_IA".
+	StorageClass string
+
+	// MemoryWorkspace, if set, downloads inputs up to MemoryWorkspaceOptions.MaxSize
+	// into a memory-backed directory, avoiding disk I/O for small files.
+	// Larger inputs are moved to disk while they are downloaded.
+	MemoryWorkspace bool
+
+	// HandlerRetry, if set, overrides ServerOptions.HandlerRetry.
+	HandlerRetry *HandlerRetryOptions
+}
+
+func (o OpOptions) validate(op string) error {
+	if o.Timeout < 0 || o.MaxConcurrency < 0 || o.MaxMemory < 0 || o.MaxInputSize < 0 {
+		return fmt.Errorf("op %q: timeout, max concurrency, max memory and max input size can not be negative", op)
+	}
+	return validateStorageClass(op, o.StorageClass)
+}
+
+// ClientOpOptions overrides the client defaults for one op, see ClientOptions.Ops.
+type ClientOpOptions struct {
+	// ResponseWaitTimeout, if set, overrides ClientOptions.ResponseWaitTimeout.
+	ResponseWaitTimeout time.Duration
+
+	// TotalTimeout, if set, overrides ClientOptions.TotalTimeout.
+	TotalTimeout time.Duration
+
+	// Compress, if set, gzip compresses the input before upload.
+	// The server decompresses it, so handlers see the uncompressed file.
+	Compress bool
+
+	// Dictionary, if set, compresses the input with zstd and the dictionary with this name
+	// instead of gzip, e.g. for many small, similar JSON documents, see UploadDictionary.
+	// It implies Compress.
+	Dictionary string
+
+	// StorageClass, if set, is the S3 storage class of the request input.
+	StorageClass string
+
+	// PartSize, if set, is the part size in bytes of the multipart upload of large inputs,
+	// at least 5 MiB. Defaults to 5 MiB.
+	PartSize int64
+
+	// UploadConcurrency, if set, is the number of parts uploaded concurrently.
+	// Defaults to 5.
+	UploadConcurrency int
+}
+
+func (o ClientOpOptions) validate(op string) error {
+	if o.ResponseWaitTimeout < 0 || o.TotalTimeout < 0 {
+		return fmt.Errorf("op %q: timeouts can not be negative", op)
+	}
+	if o.PartSize != 0 && o.PartSize < manager.MinUploadPartSize {
+		return fmt.Errorf("op %q: part size must be at least %d bytes", op, manager.MinUploadPartSize)
+	}
+	if o.UploadConcurrency < 0 {
+		return fmt.Errorf("op %q: upload concurrency can not be negative", op)
+	}
+	return validateStorageClass(op, o.StorageClass)
+}
+
+func validateStorageClass(op, storageClass string) error {
+	if storageClass == "" {
+		return nil
+	}
+	for _, v := range types.StorageClass("").Values() {
+		if string(v) == storageClass {
+			return nil
+		}
+	}
+	return fmt.Errorf("op %q: unknown storage class %q", op, storageClass)
+}
+
+// opRetryAfter is how long a request for an op at its OpOptions.MaxConcurrency
+// is left for other servers before it is retried.
+const opRetryAfter = 5 * time.Second
+
+// opSlots counts the requests in flight per op with an OpOptions.MaxConcurrency.
+type opSlots struct {
+	limits map[string]int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newOpSlots(ops map[string]OpOptions) *opSlots {
+	limits := make(map[string]int)
+	for op, o := range ops {
+		if o.MaxConcurrency > 0 {
+			limits[op] = o.MaxConcurrency
+		}
+	}
+	return &opSlots{limits: limits, inFlight: make(map[string]int)}
+}
+
+// tryAcquire takes a slot for op, returning false if op is at its limit.
+func (s *opSlots) tryAcquire(op string) bool {
+	limit, found := s.limits[op]
+	if !found {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[op] >= limit {
+		return false
+	}
+	s.inFlight[op]++
+	return true
+}
+
+func (s *opSlots) release(op string) {
+	if _, found := s.limits[op]; !found {
+		return
+	}
+	s.mu.Lock()
+	s.inFlight[op]--
+	s.mu.Unlock()
+}
+
+// contentEncodingGzip is the MetaContentEncoding of gzip compressed objects.
+const contentEncodingGzip = "gzip"
+
+// gzipFile writes a gzip compressed copy of filename to a temp file in dir and returns its name.
+func gzipFile(dir, filename string) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := createTemp(dir, filepath.Base(filename)+".gz")
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = copyBuffered(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("compress: %w", err)
+	}
+	return dst.Name(), nil
+}
+
+// decompressBody returns body decompressed if metadata says it is compressed
+// and removes MetaContentEncoding from metadata.
+// Dictionaries are loaded from dicts.
+func decompressBody(ctx context.Context, body io.Reader, metadata map[string]string, dicts *dictionaryCache) (io.Reader, error) {
+	encoding, found := metadata[MetaContentEncoding]
+	if !found {
+		return body, nil
+	}
+	var (
+		r   io.Reader
+		err error
+	)
+	switch encoding {
+	case contentEncodingGzip:
+		if r, err = gzip.NewReader(body); err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+	case contentEncodingZstd:
+		if r, err = dicts.decompressZstd(ctx, body, metadata); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	delete(metadata, MetaContentEncoding)
+	return r, nil
+}
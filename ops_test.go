@@ -0,0 +1,71 @@
+package s3rpc
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestOpOptions(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(OpOptions{Timeout: time.Minute, StorageClass: "STANDARD_IA"}.validate("resize"), qt.IsNil)
+	c.Assert(OpOptions{MaxConcurrency: -1}.validate("resize"), qt.ErrorMatches, `op "resize": .*can not be negative`)
+	c.Assert(OpOptions{StorageClass: "COLD"}.validate("resize"), qt.ErrorMatches, `op "resize": unknown storage class "COLD"`)
+	c.Assert(ClientOpOptions{TotalTimeout: -1}.validate("resize"), qt.ErrorMatches, `op "resize": timeouts can not be negative`)
+	c.Assert(ClientOpOptions{PartSize: 64 << 20, UploadConcurrency: 8}.validate("resize"), qt.IsNil)
+	c.Assert(ClientOpOptions{PartSize: 1 << 20}.validate("resize"), qt.ErrorMatches, `op "resize": part size must be at least .*`)
+
+	client := &Client{
+		timeouts: clientTimeouts{responseWait: 5 * time.Minute, upload: time.Minute},
+		ops:      map[string]ClientOpOptions{"transcode": {ResponseWaitTimeout: time.Hour, TotalTimeout: 2 * time.Hour}},
+	}
+	c.Assert(client.timeoutsFor("resize"), qt.Equals, client.timeouts)
+	c.Assert(client.timeoutsFor("transcode"), qt.Equals, clientTimeouts{responseWait: time.Hour, upload: time.Minute, total: 2 * time.Hour})
+}
+
+func TestOpSlots(t *testing.T) {
+	c := qt.New(t)
+
+	slots := newOpSlots(map[string]OpOptions{"transcode": {MaxConcurrency: 2}, "resize": {Timeout: time.Second}})
+	c.Assert(slots.tryAcquire("transcode"), qt.IsTrue)
+	c.Assert(slots.tryAcquire("transcode"), qt.IsTrue)
+	c.Assert(slots.tryAcquire("transcode"), qt.IsFalse)
+	slots.release("transcode")
+	c.Assert(slots.tryAcquire("transcode"), qt.IsTrue)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(slots.tryAcquire("resize"), qt.IsTrue)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "a.txt")
+	content := []byte("Hello, hello, hello, hello, hello!")
+	c.Assert(os.WriteFile(filename, content, 0o644), qt.IsNil)
+
+	compressed, err := gzipFile(dir, filename)
+	c.Assert(err, qt.IsNil)
+	f, err := os.Open(compressed)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+
+	metadata := map[string]string{MetaContentEncoding: contentEncodingGzip, "foo": "bar"}
+	body, err := decompressBody(context.Background(), f, metadata, nil)
+	c.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, string(content))
+	c.Assert(metadata, qt.DeepEquals, map[string]string{"foo": "bar"})
+
+	_, err = decompressBody(context.Background(), f, map[string]string{MetaContentEncoding: "br"}, nil)
+	c.Assert(err, qt.ErrorMatches, `unsupported content encoding "br"`)
+}
@@ -0,0 +1,69 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// apiOptions returns the APIOptions for the AWS SDK clients created from cfg.
+func (cfg AWSConfig) apiOptions() []func(*middleware.Stack) error {
+	if cfg.ExpectedBucketOwner == "" {
+		return cfg.APIOptions
+	}
+	return append(append([]func(*middleware.Stack) error(nil), cfg.APIOptions...), expectedBucketOwnerMiddleware(cfg.ExpectedBucketOwner))
+}
+
+// expectedBucketOwnerMiddleware sets the expected bucket owner on the S3 calls made by this package,
+// so S3 rejects them with 403 Access Denied if the bucket is owned by another account.
+func expectedBucketOwnerMiddleware(owner string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("s3rpcExpectedBucketOwner",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				setExpectedBucketOwner(in.Parameters, aws.String(owner))
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+	}
+}
+
+func setExpectedBucketOwner(params interface{}, owner *string) {
+	switch v := params.(type) {
+	case *s3.GetObjectInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.HeadObjectInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.PutObjectInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.DeleteObjectInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.CopyObjectInput:
+		v.ExpectedBucketOwner = owner
+		v.ExpectedSourceBucketOwner = owner
+	case *s3.ListObjectsV2Input:
+		v.ExpectedBucketOwner = owner
+	case *s3.HeadBucketInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.CreateMultipartUploadInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.UploadPartInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.CompleteMultipartUploadInput:
+		v.ExpectedBucketOwner = owner
+	case *s3.AbortMultipartUploadInput:
+		v.ExpectedBucketOwner = owner
+	}
+}
+
+// checkBucketOwner checks that the bucket is owned by the ExpectedBucketOwner set on the client.
+// This needs s3:ListBucket permission on the bucket.
+func checkBucketOwner(ctx context.Context, client *s3.Client, bucket string) error {
+	ctx, cancel := context.WithTimeout(ctx, regionDetectTimeout)
+	defer cancel()
+	if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return fmt.Errorf("failed to verify the owner of bucket %q: %w", bucket, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package s3rpc
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func TestExpectedBucketOwner(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(AWSConfig{}.apiOptions(), qt.HasLen, 0)
+	noop := func(*middleware.Stack) error { return nil }
+	cfg := AWSConfig{ExpectedBucketOwner: "123456789012", APIOptions: []func(*middleware.Stack) error{noop}}
+	c.Assert(cfg.apiOptions(), qt.HasLen, 2)
+	c.Assert(cfg.APIOptions, qt.HasLen, 1)
+
+	owner := aws.String("123456789012")
+	get := &s3.GetObjectInput{}
+	setExpectedBucketOwner(get, owner)
+	c.Assert(aws.ToString(get.ExpectedBucketOwner), qt.Equals, "123456789012")
+
+	cp := &s3.CopyObjectInput{}
+	setExpectedBucketOwner(cp, owner)
+	c.Assert(aws.ToString(cp.ExpectedSourceBucketOwner), qt.Equals, "123456789012")
+
+	// Other calls are left alone.
+	setExpectedBucketOwner(&sqs.ReceiveMessageInput{}, owner)
+}
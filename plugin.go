@@ -0,0 +1,171 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PluginRequest is written as JSON to the stdin of a plugin command.
+type PluginRequest struct {
+	Op          string            `json:"op"`
+	Filename    string            `json:"filename"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+}
+
+// PluginResponse is read as JSON from the stdout of a plugin command.
+// A relative Filename is resolved against the directory of the input file.
+// A non-empty Error fails the request.
+type PluginResponse struct {
+	Filename    string            `json:"filename"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// PluginConfig declares an op handled by an external command, see LoadPlugins.
+type PluginConfig struct {
+	// Op is the operation the plugin handles.
+	Op string `json:"op"`
+
+	// Command is the command and its arguments.
+	Command []string `json:"command"`
+
+	// Protocol is how the server talks to the command,
+	// PluginProtocolExec (the default) or PluginProtocolGRPC.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Env is added to the environment of the command, as KEY=value.
+	Env []string `json:"env,omitempty"`
+
+	// Timeout, if set, is the max duration of one invocation, e.g. "5m".
+	Timeout string `json:"timeout,omitempty"`
+
+	// Limits, if set, limits the memory and CPU time of one invocation.
+	Limits *PluginLimits `json:"limits,omitempty"`
+}
+
+// PluginHandler returns a handler that runs the command in cfg once per request,
+// in the directory of the input file. Anything written to stderr is included
+// in the error if the command fails.
+//
+// With PluginProtocolExec, the command gets a PluginRequest on stdin and writes
+// a PluginResponse to stdout.
+// With PluginProtocolGRPC, the command is a hashicorp/go-plugin plugin calling ServePlugin;
+// it is killed when the request is handled.
+func PluginHandler(cfg PluginConfig) (func(ctx context.Context, input Input) (Output, error), error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("plugin %q: command is required", cfg.Op)
+	}
+	run := func(ctx context.Context, op string, command, env []string, input Input) (Output, error) {
+		return runPlugin(ctx, "plugin", op, command, env, input)
+	}
+	switch cfg.Protocol {
+	case "", PluginProtocolExec:
+	case PluginProtocolGRPC:
+		run = runGRPCPlugin
+	default:
+		return nil, fmt.Errorf("plugin %q: unknown protocol %q", cfg.Op, cfg.Protocol)
+	}
+	command, err := cfg.Limits.limitCommand(cfg.Command)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %q: %w", cfg.Op, err)
+	}
+	var timeout time.Duration
+	if cfg.Timeout != "" {
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("plugin %q: invalid timeout: %w", cfg.Op, err)
+		}
+	}
+
+	return func(ctx context.Context, input Input) (Output, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return run(ctx, cfg.Op, command, append(os.Environ(), cfg.Env...), input)
+	}, nil
+}
+
+// runPlugin runs command with env for the input to op, as described in PluginHandler.
+// Errors are prefixed with kind and op.
+func runPlugin(ctx context.Context, kind, op string, command, env []string, input Input) (Output, error) {
+	req, err := json.Marshal(PluginRequest{Op: op, Filename: input.Filename, Metadata: input.Metadata, ContentType: input.ContentType})
+	if err != nil {
+		return Output{}, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = filepath.Dir(input.Filename)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return Output{}, fmt.Errorf("%s %q: %w: %s", kind, op, err, msg)
+		}
+		return Output{}, fmt.Errorf("%s %q: %w", kind, op, err)
+	}
+
+	var resp PluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return Output{}, fmt.Errorf("%s %q: failed to decode response: %w", kind, op, err)
+	}
+	if resp.Error != "" {
+		return Output{}, fmt.Errorf("%s %q: %s", kind, op, resp.Error)
+	}
+	if resp.Filename == "" {
+		return Output{}, fmt.Errorf("%s %q: no filename in response", kind, op)
+	}
+	filename := resp.Filename
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(cmd.Dir, filename)
+	}
+	return Output{Filename: filename, Metadata: resp.Metadata, ContentType: resp.ContentType}, nil
+}
+
+// LoadPlugins reads a JSON file with a list of PluginConfig and returns their handlers,
+// so a generic server binary can gain new ops without recompilation:
+//
+//	[
+//		{"op": "convert", "command": ["/usr/local/bin/convert-plugin", "--fast"]},
+//		{"op": "resize", "command": ["/usr/local/bin/resize-plugin"], "protocol": "grpc"}
+//	]
+//
+// Use it in ServerOptions.ReloadHandlers to pick up changes on ControlReloadHandlers.
+func LoadPlugins(filename string) (Handlers, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugins: %w", err)
+	}
+	var configs []PluginConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("failed to decode plugins: %w", err)
+	}
+	handlers := make(Handlers)
+	for _, cfg := range configs {
+		if cfg.Op == "" {
+			return nil, errors.New("plugin op is required")
+		}
+		if _, found := handlers[cfg.Op]; found {
+			return nil, fmt.Errorf("plugin %q is declared more than once", cfg.Op)
+		}
+		h, err := PluginHandler(cfg)
+		if err != nil {
+			return nil, err
+		}
+		handlers[cfg.Op] = h
+	}
+	return handlers, nil
+}
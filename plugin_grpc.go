@@ -0,0 +1,209 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// PluginProtocolExec runs the plugin command with a PluginRequest on stdin
+	// and reads the PluginResponse from stdout. This is the default.
+	PluginProtocolExec = "exec"
+
+	// PluginProtocolGRPC runs the plugin command as a hashicorp/go-plugin gRPC plugin,
+	// see ServePlugin.
+	PluginProtocolGRPC = "grpc"
+)
+
+// PluginHandshake is the go-plugin handshake of PluginProtocolGRPC plugins.
+// The protocol version is bumped on incompatible changes.
+var PluginHandshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "S3RPC_PLUGIN",
+	MagicCookieValue: "handler",
+}
+
+// pluginName is the name of the go-plugin plugin dispensed from a PluginProtocolGRPC plugin process.
+const pluginName = "handler"
+
+// ServePlugin serves handler as a PluginProtocolGRPC plugin. Call it from main in the plugin
+// command; it blocks until the server kills the plugin process.
+// The handler gets the Input of the request as is, it runs on the same host as the server.
+func ServePlugin(handler func(ctx context.Context, input Input) (Output, error)) {
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: PluginHandshake,
+		Plugins:         plugin.PluginSet{pluginName: &grpcPlugin{handler: handler}},
+		GRPCServer:      plugin.DefaultGRPCServer,
+	})
+}
+
+// runGRPCPlugin starts command as a PluginProtocolGRPC plugin, sends it the input to op
+// and kills it when done, so the plugin process lives as long as one invocation.
+// Errors are prefixed as in runPlugin.
+func runGRPCPlugin(ctx context.Context, op string, command, env []string, input Input) (Output, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = filepath.Dir(input.Filename)
+	cmd.Env = env
+
+	var stderr lockedBuffer
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  PluginHandshake,
+		Plugins:          plugin.PluginSet{pluginName: &grpcPlugin{}},
+		Cmd:              cmd,
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		Stderr:           &stderr,
+		Logger:           hclog.NewNullLogger(),
+	})
+	defer client.Kill()
+
+	failed := func(err error) (Output, error) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return Output{}, fmt.Errorf("plugin %q: %w: %s", op, err, msg)
+		}
+		return Output{}, fmt.Errorf("plugin %q: %w", op, err)
+	}
+
+	rpcClient, err := client.Client()
+	if err != nil {
+		return failed(err)
+	}
+	raw, err := rpcClient.Dispense(pluginName)
+	if err != nil {
+		return failed(err)
+	}
+
+	resp, err := raw.(*grpcPluginClient).handle(ctx, PluginRequest{Op: op, Filename: input.Filename, Metadata: input.Metadata, ContentType: input.ContentType})
+	if err != nil {
+		return failed(err)
+	}
+	if resp.Error != "" {
+		return Output{}, fmt.Errorf("plugin %q: %s", op, resp.Error)
+	}
+	if resp.Filename == "" {
+		return Output{}, fmt.Errorf("plugin %q: no filename in response", op)
+	}
+	filename := resp.Filename
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(cmd.Dir, filename)
+	}
+	return Output{Filename: filename, Metadata: resp.Metadata, ContentType: resp.ContentType}, nil
+}
+
+// grpcPlugin is the go-plugin plugin of PluginProtocolGRPC.
+// The request and response are sent as the JSON encoded PluginRequest and PluginResponse
+// wrapped in a google.protobuf.BytesValue, so no generated code is needed.
+type grpcPlugin struct {
+	plugin.NetRPCUnsupportedPlugin
+
+	// handler is set in the plugin process.
+	handler func(ctx context.Context, input Input) (Output, error)
+}
+
+func (p *grpcPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
+	s.RegisterService(&grpcPluginServiceDesc, p)
+	return nil
+}
+
+func (p *grpcPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, conn *grpc.ClientConn) (interface{}, error) {
+	return &grpcPluginClient{conn: conn}, nil
+}
+
+// handle runs the handler for the JSON encoded PluginRequest in req.
+// Handler errors are returned in the PluginResponse.
+func (p *grpcPlugin) handle(ctx context.Context, req *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	var preq PluginRequest
+	if err := json.Unmarshal(req.Value, &preq); err != nil {
+		return nil, err
+	}
+	var resp PluginResponse
+	output, err := p.handler(ctx, Input{Filename: preq.Filename, Metadata: preq.Metadata, ContentType: preq.ContentType})
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp = PluginResponse{Filename: output.Filename, Metadata: output.Metadata, ContentType: output.ContentType}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return wrapperspb.Bytes(b), nil
+}
+
+// grpcPluginServer is implemented by grpcPlugin in the plugin process.
+type grpcPluginServer interface {
+	handle(ctx context.Context, req *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error)
+}
+
+var grpcPluginServiceDesc = grpc.ServiceDesc{
+	ServiceName: "s3rpc.Plugin",
+	HandlerType: (*grpcPluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Handle",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(wrapperspb.BytesValue)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handle := srv.(grpcPluginServer).handle
+				if interceptor == nil {
+					return handle(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/s3rpc.Plugin/Handle"}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return handle(ctx, req.(*wrapperspb.BytesValue))
+				})
+			},
+		},
+	},
+}
+
+// grpcPluginClient is dispensed from a PluginProtocolGRPC plugin in the server.
+type grpcPluginClient struct {
+	conn *grpc.ClientConn
+}
+
+func (c *grpcPluginClient) handle(ctx context.Context, req PluginRequest) (PluginResponse, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return PluginResponse{}, err
+	}
+	out := new(wrapperspb.BytesValue)
+	if err := c.conn.Invoke(ctx, "/s3rpc.Plugin/Handle", wrapperspb.Bytes(b), out); err != nil {
+		return PluginResponse{}, err
+	}
+	var resp PluginResponse
+	if err := json.Unmarshal(out.Value, &resp); err != nil {
+		return PluginResponse{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return resp, nil
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
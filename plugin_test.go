@@ -0,0 +1,128 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// TestPluginHelperProcess is not a real test, it is run as a plugin command by the tests below.
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("S3RPC_TEST_PLUGIN") != "1" {
+		return
+	}
+	var req PluginRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.Metadata["fail"] != "" {
+		fmt.Fprintln(os.Stderr, "failed as requested")
+		os.Exit(2)
+	}
+	b, _ := os.ReadFile(req.Filename)
+	os.WriteFile("out.txt", append(b, "!"...), 0o644)
+	json.NewEncoder(os.Stdout).Encode(PluginResponse{Filename: "out.txt", Metadata: map[string]string{"op": req.Op}})
+	os.Exit(0)
+}
+
+// TestGRPCPluginHelperProcess is not a real test, it is run as a PluginProtocolGRPC plugin command by the tests below.
+func TestGRPCPluginHelperProcess(t *testing.T) {
+	if os.Getenv("S3RPC_TEST_GRPC_PLUGIN") != "1" {
+		return
+	}
+	ServePlugin(func(ctx context.Context, input Input) (Output, error) {
+		if input.Metadata["fail"] != "" {
+			return Output{}, errors.New("failed as requested")
+		}
+		b, err := os.ReadFile(input.Filename)
+		if err != nil {
+			return Output{}, err
+		}
+		if err := os.WriteFile("out.txt", append(b, "!"...), 0o644); err != nil {
+			return Output{}, err
+		}
+		return Output{Filename: "out.txt", Metadata: map[string]string{"protocol": "grpc"}}, nil
+	})
+	os.Exit(0)
+}
+
+func TestLoadPlugins(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+
+	configs := []PluginConfig{{
+		Op:      "shout",
+		Command: []string{os.Args[0], "-test.run=TestPluginHelperProcess"},
+		Env:     []string{"S3RPC_TEST_PLUGIN=1"},
+		Timeout: "1m",
+		Limits:  &PluginLimits{MaxCPUTime: "1m"},
+	}}
+	b, err := json.Marshal(configs)
+	c.Assert(err, qt.IsNil)
+	config := filepath.Join(dir, "plugins.json")
+	c.Assert(os.WriteFile(config, b, 0o644), qt.IsNil)
+
+	handlers, err := LoadPlugins(config)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handlers["shout"], qt.IsNotNil)
+
+	input := filepath.Join(dir, "in.txt")
+	c.Assert(os.WriteFile(input, []byte("hello"), 0o644), qt.IsNil)
+	output, err := handlers["shout"](context.Background(), Input{Filename: input})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.Filename, qt.Equals, filepath.Join(dir, "out.txt"))
+	c.Assert(output.Metadata["op"], qt.Equals, "shout")
+	b, err = os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "hello!")
+
+	_, err = handlers["shout"](context.Background(), Input{Filename: input, Metadata: map[string]string{"fail": "1"}})
+	c.Assert(err, qt.ErrorMatches, `plugin "shout": exit status 2: failed as requested`)
+
+	_, err = PluginHandler(PluginConfig{Op: "nocommand"})
+	c.Assert(err, qt.ErrorMatches, `plugin "nocommand": command is required`)
+	_, err = PluginHandler(PluginConfig{Op: "shout", Command: []string{"true"}, Protocol: "http"})
+	c.Assert(err, qt.ErrorMatches, `plugin "shout": unknown protocol "http"`)
+	_, err = PluginHandler(PluginConfig{Op: "shout", Command: []string{"true"}, Timeout: "soon"})
+	c.Assert(err, qt.ErrorMatches, `plugin "shout": invalid timeout.*`)
+}
+
+func TestGRPCPlugin(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+
+	handle, err := PluginHandler(PluginConfig{
+		Op:       "shout",
+		Command:  []string{os.Args[0], "-test.run=TestGRPCPluginHelperProcess"},
+		Env:      []string{"S3RPC_TEST_GRPC_PLUGIN=1"},
+		Protocol: PluginProtocolGRPC,
+		Timeout:  "1m",
+	})
+	c.Assert(err, qt.IsNil)
+
+	input := filepath.Join(dir, "in.txt")
+	c.Assert(os.WriteFile(input, []byte("hello"), 0o644), qt.IsNil)
+	output, err := handle(context.Background(), Input{Filename: input})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.Filename, qt.Equals, filepath.Join(dir, "out.txt"))
+	c.Assert(output.Metadata["protocol"], qt.Equals, "grpc")
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "hello!")
+
+	_, err = handle(context.Background(), Input{Filename: input, Metadata: map[string]string{"fail": "1"}})
+	c.Assert(err, qt.ErrorMatches, `plugin "shout": failed as requested`)
+
+	// Not a go-plugin plugin.
+	handle, err = PluginHandler(PluginConfig{Op: "shout", Command: []string{"true"}, Protocol: PluginProtocolGRPC})
+	c.Assert(err, qt.IsNil)
+	_, err = handle(context.Background(), Input{Filename: input})
+	c.Assert(err, qt.ErrorMatches, `(?s)plugin "shout": Unrecognized remote plugin message.*`)
+}
@@ -0,0 +1,52 @@
+package s3rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds of the wait tuned by pollTuner.
+// SQS allows long poll waits of up to 20 seconds.
+const (
+	minPollWait = time.Second
+	maxPollWait = 20 * time.Second
+)
+
+// pollTuner tunes how long the server waits for new requests from the observed arrival rate:
+// The wait is halved for each poll that returned requests, so a busy server polls often for low latency,
+// and doubled for each empty poll, so an idle server makes as few, cheap, calls as possible.
+//
+// With a queue, the wait is the long poll wait (WaitTimeSeconds), which returns as soon as a message arrives.
+// With ListPollingOptions, it is the sleep between listings that found nothing.
+type pollTuner struct {
+	mu   sync.Mutex
+	wait time.Duration
+}
+
+func newPollTuner() *pollTuner {
+	return &pollTuner{wait: maxPollWait}
+}
+
+// next returns the wait for the next poll.
+func (t *pollTuner) next() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.wait
+}
+
+// observe records that a poll returned n requests.
+func (t *pollTuner) observe(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n > 0 {
+		t.wait /= 2
+	} else {
+		t.wait *= 2
+	}
+	if t.wait < minPollWait {
+		t.wait = minPollWait
+	}
+	if t.wait > maxPollWait {
+		t.wait = maxPollWait
+	}
+}
@@ -0,0 +1,29 @@
+package s3rpc
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPollTuner(t *testing.T) {
+	c := qt.New(t)
+
+	tuner := newPollTuner()
+	c.Assert(tuner.next(), qt.Equals, maxPollWait)
+
+	tuner.observe(3)
+	c.Assert(tuner.next(), qt.Equals, 10*time.Second)
+	for i := 0; i < 10; i++ {
+		tuner.observe(1)
+	}
+	c.Assert(tuner.next(), qt.Equals, minPollWait)
+
+	tuner.observe(0)
+	c.Assert(tuner.next(), qt.Equals, 2*time.Second)
+	for i := 0; i < 10; i++ {
+		tuner.observe(0)
+	}
+	c.Assert(tuner.next(), qt.Equals, maxPollWait)
+}
@@ -0,0 +1,77 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// ProtocolVersion is the version of the request/response protocol implemented by this package.
+// It is bumped when requests use features older servers can not handle.
+const ProtocolVersion = 1
+
+// MetaProtocolVersion holds the protocol version in requests and responses.
+// In requests it is the version needed to handle the request, which may be below ProtocolVersion
+// for requests that do not use newer features, so new clients keep working with old servers.
+// In responses it is the ProtocolVersion of the server.
+// Objects without it are from before protocol versions were added, and are treated as version 1.
+const MetaProtocolVersion = "s3rpc-protocol-version"
+
+// ErrorCodeProtocolVersion means that the request needs a newer protocol version than the server supports.
+const ErrorCodeProtocolVersion = "protocol_version"
+
+// ErrProtocolVersion is returned from Client.Execute when the request needs a newer
+// protocol version than the server supports, see ProtocolVersion.
+// Check for it with errors.Is.
+var ErrProtocolVersion = errors.New("unsupported protocol version")
+
+// protocolVersion returns the protocol version in metadata.
+func protocolVersion(metadata map[string]string) (int, error) {
+	s, found := metadata[MetaProtocolVersion]
+	if !found {
+		return 1, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("%w: invalid version %q", ErrProtocolVersion, s)
+	}
+	return v, nil
+}
+
+// checkRequestProtocol returns an error wrapping ErrProtocolVersion if the request with
+// the given metadata needs a newer protocol version than this server supports.
+func checkRequestProtocol(metadata map[string]string) error {
+	v, err := protocolVersion(metadata)
+	if err != nil {
+		return err
+	}
+	if v > ProtocolVersion {
+		return fmt.Errorf("%w: request needs version %d, server supports %d", ErrProtocolVersion, v, ProtocolVersion)
+	}
+	return nil
+}
+
+// checkResponseProtocol returns an error wrapping ErrProtocolVersion if the response with
+// the given metadata is from a server older than the required protocol version.
+func checkResponseProtocol(metadata map[string]string, required int) error {
+	v, err := protocolVersion(metadata)
+	if err != nil {
+		return err
+	}
+	if v < required {
+		return fmt.Errorf("%w: request needs version %d, server supports %d", ErrProtocolVersion, required, v)
+	}
+	return nil
+}
+
+// requestProtocolVersion is the protocol version stamped on requests.
+// All requests can currently be handled by version 1 servers.
+const requestProtocolVersion = 1
+
+// ServerProtocolVersion returns the ProtocolVersion of the server that sent the last response
+// on the primary endpoint, or 0 if there has been none yet,
+// e.g. to hold off on newer features until all servers are upgraded.
+func (c *Client) ServerProtocolVersion() int {
+	return int(atomic.LoadInt32(&c.serverProtocol))
+}
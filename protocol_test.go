@@ -0,0 +1,43 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	c := qt.New(t)
+
+	v, err := protocolVersion(map[string]string{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(v, qt.Equals, 1)
+	v, err = protocolVersion(map[string]string{MetaProtocolVersion: "3"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(v, qt.Equals, 3)
+	for _, s := range []string{"", "0", "v2"} {
+		_, err = protocolVersion(map[string]string{MetaProtocolVersion: s})
+		c.Assert(errors.Is(err, ErrProtocolVersion), qt.IsTrue)
+	}
+
+	c.Assert(checkRequestProtocol(map[string]string{}), qt.IsNil)
+	c.Assert(checkRequestProtocol(map[string]string{MetaProtocolVersion: fmt.Sprint(ProtocolVersion)}), qt.IsNil)
+	err = checkRequestProtocol(map[string]string{MetaProtocolVersion: fmt.Sprint(ProtocolVersion + 1)})
+	c.Assert(errors.Is(err, ErrProtocolVersion), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "unsupported protocol version: request needs version 2, server supports 1")
+
+	// Servers from before protocol versions are version 1.
+	c.Assert(checkResponseProtocol(map[string]string{}, 1), qt.IsNil)
+	err = checkResponseProtocol(map[string]string{}, 2)
+	c.Assert(errors.Is(err, ErrProtocolVersion), qt.IsTrue)
+
+	s := &Server{stats: newServerStats("server1")}
+	c.Assert(checkResponseProtocol(s.responseMetadata("ocr", "id", ""), ProtocolVersion), qt.IsNil)
+
+	var respErr error = &ResponseError{Code: ErrorCodeProtocolVersion, Message: err.Error()}
+	c.Assert(errors.Is(respErr, ErrProtocolVersion), qt.IsTrue)
+	respErr = &ResponseError{Code: ErrorCodeHandler}
+	c.Assert(errors.Is(respErr, ErrProtocolVersion), qt.IsFalse)
+}
@@ -1,20 +1,43 @@
 package s3rpc
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
 	"github.com/bep/awscreate"
-	"github.com/bep/awscreate/s3rpccreate"
 )
 
 // NewProvisioner returns a new Provisioner that can be used to create and destroy an AWS environment
 // with all the users, buckets and queues needed for s3rpc.
-// Pass the result into PrintProvisionResults.
-func NewProvisioner(name, region string) (awscreate.Provisioner[s3rpccreate.CreateResults], error) {
+// Pass the result of Create into PrintProvisionResults.
+func NewProvisioner(name, region string) (*Provisioner, error) {
+	return NewProvisionerWithOptions(ProvisionerOptions{Name: name, Region: region})
+}
+
+// NewProvisionerWithOptions is like NewProvisioner, but with the given options.
+func NewProvisionerWithOptions(opts ProvisionerOptions) (*Provisioner, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+
 	keyID := os.Getenv("S3RPC_ADMIN_ACCESS_KEY_ID")
 	keySecret := os.Getenv("S3RPC_ADMIN_ACCESS_KEY_SECRET")
 
@@ -23,36 +46,917 @@ func NewProvisioner(name, region string) (awscreate.Provisioner[s3rpccreate.Crea
 	}
 
 	awsCfg := aws.Config{
-		Region:      region,
+		Region:      opts.Region,
 		Credentials: credentials.NewStaticCredentialsProvider(keyID, keySecret, ""),
 	}
 
-	return s3rpccreate.New(
-		s3rpccreate.Options{
-			AdminCfg: awsCfg,
-			Name:     name,
-			Region:   region,
-		}), nil
+	return &Provisioner{
+		opts:      opts,
+		cwClient:  cloudwatch.NewFromConfig(awsCfg),
+		iamClient: iam.NewFromConfig(awsCfg),
+		s3Client:  s3.NewFromConfig(awsCfg),
+		sqsClient: sqs.NewFromConfig(awsCfg),
+	}, nil
+
+}
+
+// ProvisionerOptions are options for the provisioner.
+type ProvisionerOptions struct {
+	// Name is the base name of the environment.
+	// With the default NameTemplate it is used as the bucket name
+	// and as the prefix for the users and queues.
+	Name string
+
+	// Region is the AWS region to create the environment in.
+	// Defaults to eu-north-1.
+	Region string
+
+	// ExpirationDays is the number of days after which objects below
+	// to_server/ and to_client/ are removed by S3.
+	// This cleans up requests and responses orphaned by e.g. client timeouts.
+	// Defaults to 1.
+	ExpirationDays int32
+
+	// ArchiveExpirationDays, if set, allows the server to archive request inputs below archive/
+	// (see ServerOptions.Archive), which S3 removes after this many days.
+	ArchiveExpirationDays int32
+
+	// QuarantineExpirationDays, if set, allows the server to quarantine rejected inputs below quarantine/
+	// (see ServerOptions.Quarantine), which S3 removes after this many days.
+	QuarantineExpirationDays int32
+
+	// AuditExpirationDays, if set, allows the server to write audit records below audit/
+	// (see AuditOptions.S3), which S3 removes after this many days.
+	AuditExpirationDays int32
+
+	// Chunks, if set, allows the server to emit partial results below chunks/
+	// (see EmitChunk) and the client to fetch and remove them.
+	// They are removed after ExpirationDays, as requests and responses.
+	Chunks bool
+
+	// Checkpoints, if set, allows the server to store the handler checkpoints below checkpoints/
+	// (see Checkpoint). They are removed after ExpirationDays, as requests and responses.
+	Checkpoints bool
+
+	// ListPolling, if set, allows the server to list the requests below to_server/
+	// and to claim them below claims/ (see ServerOptions.ListPolling),
+	// and the client to poll for responses (see ClientOptions.ResponsePollInterval).
+	// The claims are removed a day after the requests, as a request whose claim
+	// is gone is handled again.
+	ListPolling bool
+
+	// HandlerRequeue, if set, allows the server to send requests back to its queues
+	// (see HandlerRetryOptions.Requeue).
+	HandlerRequeue bool
+
+	// Baselines, if set, allows the client to upload baselines below baselines/
+	// (see Client.UploadBaseline) and the server to read them to rebuild delta inputs.
+	// Baselines do not expire.
+	Baselines bool
+
+	// Dictionaries, if set, allows the client to upload compression dictionaries below
+	// dictionaries/ (see Client.UploadDictionary) and the client and server to read them.
+	Dictionaries bool
+
+	// PublicKeys, if set, allows the server to read the public keys below public_keys/
+	// (see SignatureOptions.KeysInBucket and Admin.PutPublicKey).
+	PublicKeys bool
+
+	// Ops, if set, gives each op its own server queue fed by a bucket notification
+	// filtered on to_server/<op>/, so each op can be served by a separate fleet.
+	// The shared server queue is then not created.
+	Ops []string
+
+	// DirectSubmit, if set, does not configure bucket event notifications,
+	// for buckets where they can not be configured.
+	// Instead the client may send to the server queues and the server to the client queue,
+	// see ClientOptions.DirectSubmit and ServerOptions.DirectSubmit.
+	DirectSubmit bool
+
+	// MaxReceiveCount, if set, creates a dead-letter queue for each server queue,
+	// named <queue>_dlq, that messages are moved to after being received this
+	// many times without being deleted, e.g. requests for an op no server handles.
+	MaxReceiveCount int
+
+	// Alarms, if set, creates CloudWatch alarms for the queues.
+	Alarms *AlarmOptions
+
+	// NameTemplate is a Go template used to name the bucket, users and queues.
+	// It is executed with a ResourceName.
+	// Defaults to DefaultNameTemplate.
+	NameTemplate string
+
+	// Tags are applied to the bucket, users, queues and alarms.
+	Tags map[string]string
+
+	nameTemplate *template.Template
+}
+
+// DefaultNameTemplate names the bucket <Name>, the users and their queues <Name>_<Role>
+// and the op queues <Name>_server_<Op>.
+const DefaultNameTemplate = "{{ .Name }}{{ with .Role }}_{{ . }}{{ end }}{{ with .Op }}_{{ . }}{{ end }}"
+
+// ResourceName is passed to ProvisionerOptions.NameTemplate.
+type ResourceName struct {
+	// Name is ProvisionerOptions.Name.
+	Name string
+
+	// Region is ProvisionerOptions.Region.
+	Region string
+
+	// Role is either "client" or "server", "replication" for the replication role
+	// created by the MultiRegionProvisioner, or empty for the bucket.
+	Role string
+
+	// Op is set for the op queues, see ProvisionerOptions.Ops.
+	Op string
+}
+
+func (opts *ProvisionerOptions) init() error {
+	if opts.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if opts.Region == "" {
+		opts.Region = defaultRegion
+	}
+
+	if opts.ExpirationDays == 0 {
+		opts.ExpirationDays = 1
+	}
+
+	if opts.ExpirationDays < 0 {
+		return fmt.Errorf("expiration days must be positive, got %d", opts.ExpirationDays)
+	}
+
+	if opts.ArchiveExpirationDays < 0 || opts.QuarantineExpirationDays < 0 || opts.AuditExpirationDays < 0 {
+		return fmt.Errorf("archive, quarantine and audit expiration days must be positive")
+	}
+
+	if opts.Alarms != nil {
+		if err := opts.Alarms.init(); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range opts.Ops {
+		if !validOpRe.MatchString(op) {
+			return fmt.Errorf("invalid op %q: must be non-empty and contain only letters, digits, '-' and '_'", op)
+		}
+	}
+
+	if opts.NameTemplate == "" {
+		opts.NameTemplate = DefaultNameTemplate
+	}
+
+	var err error
+	opts.nameTemplate, err = template.New("name").Option("missingkey=error").Parse(opts.NameTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid name template: %w", err)
+	}
+
+	// Validate the template against all the names we need up front.
+	names := []ResourceName{
+		{Name: opts.Name, Region: opts.Region},
+		{Name: opts.Name, Region: opts.Region, Role: "client"},
+		{Name: opts.Name, Region: opts.Region, Role: "server"},
+	}
+	for _, op := range opts.Ops {
+		names = append(names, ResourceName{Name: opts.Name, Region: opts.Region, Role: "server", Op: op})
+	}
+	seen := make(map[string]bool)
+	for _, n := range names {
+		name, err := opts.executeNameTemplate(n)
+		if err != nil {
+			return fmt.Errorf("failed to execute name template: %w", err)
+		}
+		if n.Role != "" && !validOpRe.MatchString(name) {
+			return fmt.Errorf("invalid name %q from name template: must contain only letters, digits, '-' and '_'", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("name template produces the name %q more than once", name)
+		}
+		seen[name] = true
+	}
+
+	return nil
+}
+
+func (opts *ProvisionerOptions) executeNameTemplate(n ResourceName) (string, error) {
+	var sb strings.Builder
+	if err := opts.nameTemplate.Execute(&sb, n); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// ProvisionResults holds the resources created by the Provisioner.
+type ProvisionResults struct {
+	Bucket string
+	Region string
+
+	Client ProvisionedPrincipal
+	Server ProvisionedPrincipal
+}
+
+// ProvisionedPrincipal holds the user and queue created for the client or the server.
+type ProvisionedPrincipal struct {
+	UserName        string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SecretUnavailable is set when Create adopted an existing access key:
+	// its secret can not be retrieved, so SecretAccessKey is empty.
+	// Create a new access key with RotateKeys.
+	SecretUnavailable bool
+
+	// The queue this principal listens to.
+	// This is empty for the server if ProvisionerOptions.Ops is set.
+	QueueURL string
+
+	// OpQueueURLs maps an op to its dedicated queue.
+	// This is only set for the server and only if ProvisionerOptions.Ops is set.
+	OpQueueURLs map[string]string
+}
+
+// Provisioner creates and destroys the AWS resources needed for s3rpc.
+type Provisioner struct {
+	opts ProvisionerOptions
+
+	cwClient  provisionerCloudWatch
+	iamClient provisionerIAM
+	s3Client  provisionerS3
+	sqsClient provisionerSQS
+}
+
+// provisionerIAM is the subset of the IAM API used by the Provisioner.
+type provisionerIAM interface {
+	CreateAccessKey(ctx context.Context, params *iam.CreateAccessKeyInput, optFns ...func(*iam.Options)) (*iam.CreateAccessKeyOutput, error)
+	CreateRole(ctx context.Context, params *iam.CreateRoleInput, optFns ...func(*iam.Options)) (*iam.CreateRoleOutput, error)
+	CreateUser(ctx context.Context, params *iam.CreateUserInput, optFns ...func(*iam.Options)) (*iam.CreateUserOutput, error)
+	DeleteAccessKey(ctx context.Context, params *iam.DeleteAccessKeyInput, optFns ...func(*iam.Options)) (*iam.DeleteAccessKeyOutput, error)
+	DeleteRole(ctx context.Context, params *iam.DeleteRoleInput, optFns ...func(*iam.Options)) (*iam.DeleteRoleOutput, error)
+	DeleteRolePolicy(ctx context.Context, params *iam.DeleteRolePolicyInput, optFns ...func(*iam.Options)) (*iam.DeleteRolePolicyOutput, error)
+	DeleteUser(ctx context.Context, params *iam.DeleteUserInput, optFns ...func(*iam.Options)) (*iam.DeleteUserOutput, error)
+	GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error)
+	GetUser(ctx context.Context, params *iam.GetUserInput, optFns ...func(*iam.Options)) (*iam.GetUserOutput, error)
+	ListAccessKeys(ctx context.Context, params *iam.ListAccessKeysInput, optFns ...func(*iam.Options)) (*iam.ListAccessKeysOutput, error)
+	PutRolePolicy(ctx context.Context, params *iam.PutRolePolicyInput, optFns ...func(*iam.Options)) (*iam.PutRolePolicyOutput, error)
+	TagUser(ctx context.Context, params *iam.TagUserInput, optFns ...func(*iam.Options)) (*iam.TagUserOutput, error)
+}
+
+// provisionerSQS is the subset of the SQS API used by the Provisioner.
+type provisionerSQS interface {
+	CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error)
+	DeleteQueue(ctx context.Context, params *sqs.DeleteQueueInput, optFns ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+	GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error)
+	ListQueues(ctx context.Context, params *sqs.ListQueuesInput, optFns ...func(*sqs.Options)) (*sqs.ListQueuesOutput, error)
+	SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error)
+	TagQueue(ctx context.Context, params *sqs.TagQueueInput, optFns ...func(*sqs.Options)) (*sqs.TagQueueOutput, error)
+}
+
+// provisionerS3 is the subset of the S3 API used by the Provisioner.
+type provisionerS3 interface {
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+	DeleteBucket(ctx context.Context, params *s3.DeleteBucketInput, optFns ...func(*s3.Options)) (*s3.DeleteBucketOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	GetBucketLifecycleConfiguration(ctx context.Context, params *s3.GetBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLifecycleConfigurationOutput, error)
+	GetBucketNotificationConfiguration(ctx context.Context, params *s3.GetBucketNotificationConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketNotificationConfigurationOutput, error)
+	GetBucketPolicy(ctx context.Context, params *s3.GetBucketPolicyInput, optFns ...func(*s3.Options)) (*s3.GetBucketPolicyOutput, error)
+	GetPublicAccessBlock(ctx context.Context, params *s3.GetPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.GetPublicAccessBlockOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error)
+	PutBucketNotificationConfiguration(ctx context.Context, params *s3.PutBucketNotificationConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketNotificationConfigurationOutput, error)
+	PutBucketPolicy(ctx context.Context, params *s3.PutBucketPolicyInput, optFns ...func(*s3.Options)) (*s3.PutBucketPolicyOutput, error)
+	PutBucketReplication(ctx context.Context, params *s3.PutBucketReplicationInput, optFns ...func(*s3.Options)) (*s3.PutBucketReplicationOutput, error)
+	PutBucketTagging(ctx context.Context, params *s3.PutBucketTaggingInput, optFns ...func(*s3.Options)) (*s3.PutBucketTaggingOutput, error)
+	PutBucketVersioning(ctx context.Context, params *s3.PutBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.PutBucketVersioningOutput, error)
+	PutPublicAccessBlock(ctx context.Context, params *s3.PutPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.PutPublicAccessBlockOutput, error)
+}
+
+// provisionerCloudWatch is the subset of the CloudWatch API used by the Provisioner.
+type provisionerCloudWatch interface {
+	DeleteAlarms(ctx context.Context, params *cloudwatch.DeleteAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DeleteAlarmsOutput, error)
+	DescribeAlarms(ctx context.Context, params *cloudwatch.DescribeAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error)
+	PutMetricAlarm(ctx context.Context, params *cloudwatch.PutMetricAlarmInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricAlarmOutput, error)
+	TagResource(ctx context.Context, params *cloudwatch.TagResourceInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.TagResourceOutput, error)
+}
+
+var _ awscreate.Provisioner[ProvisionResults] = (*Provisioner)(nil)
+
+// Create creates the users, access keys, queues and the bucket.
+//
+// Create is safe to run repeatedly: resources that already exist are adopted and
+// their policies, attributes, lifecycle rules and notifications are reconciled.
+// Note that the secret of an existing access key cannot be retrieved,
+// so SecretAccessKey is only set for access keys created in this run;
+// for the newest active key adopted otherwise, SecretUnavailable is set.
+func (p *Provisioner) Create(ctx context.Context) (ProvisionResults, error) {
+	res := ProvisionResults{
+		Bucket: p.bucketName(),
+		Region: p.opts.Region,
+		Client: ProvisionedPrincipal{UserName: p.clientName()},
+		Server: ProvisionedPrincipal{UserName: p.serverName()},
+	}
+
+	adminAccount, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{})
+	if err != nil {
+		return res, err
+	}
+	accountID := strings.Split(*adminAccount.User.Arn, ":")[4]
+
+	var (
+		principalArns []string
+		usersCreated  bool
+	)
+	for _, principal := range []*ProvisionedPrincipal{&res.Client, &res.Server} {
+		arn, created, err := p.createUser(ctx, principal)
+		if err != nil {
+			return res, err
+		}
+		usersCreated = usersCreated || created
+		principalArns = append(principalArns, arn)
+	}
+
+	if usersCreated {
+		// Newly created IAM users are not immediately usable as policy principals.
+		time.Sleep(61 * time.Second)
+	}
+
+	if err := p.createQueues(ctx, accountID, principalArns, &res); err != nil {
+		return res, err
+	}
+
+	if err := p.createBucket(ctx, principalArns); err != nil {
+		return res, err
+	}
+
+	if !p.opts.DirectSubmit {
+		if err := p.createNotifications(ctx, accountID); err != nil {
+			return res, err
+		}
+	}
 
+	if err := p.createAlarms(ctx, accountID); err != nil {
+		return res, err
+	}
+
+	return res, nil
 }
 
-// PrintProvisionResults prints the config releventa parts of the provision results to stdout,
-// sutiable for sourcing in a shell script.
-func PrintProvisionResults(outputs s3rpccreate.CreateResults) {
-	for i, q := range outputs.Queues {
-		name := "CLIENT"
-		if i == 1 {
-			name = "SERVER"
+// Destroy removes everything created by Create.
+// Resources that do not exist are ignored.
+func (p *Provisioner) Destroy(ctx context.Context) error {
+	if err := p.deleteAlarms(ctx); err != nil {
+		return err
+	}
+
+	bucket := aws.String(p.bucketName())
+	if err := p.drainBucket(ctx); err != nil {
+		return fmt.Errorf("failed to drain bucket: %w", err)
+	}
+	if _, err := p.s3Client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: bucket}); err != nil && !isNoSuchEntityErr(err) {
+		return fmt.Errorf("failed to delete bucket: %w", err)
+	}
+
+	for _, userName := range []string{p.clientName(), p.serverName()} {
+		if err := p.deleteUser(ctx, userName); err != nil {
+			return err
 		}
-		fmt.Printf("S3RPC_%s_QUEUE=%s\n", name, *q.QueueUrl)
 	}
 
-	for i, k := range outputs.AccessKeys {
-		name := "CLIENT"
-		if i == 1 {
-			name = "SERVER"
+	time.Sleep(10 * time.Second)
+
+	if _, err := p.CleanupResponseQueues(ctx, 0); err != nil {
+		return err
+	}
+
+	var queueDeleted bool
+	for _, queueName := range p.queueNames() {
+		q, err := p.sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(queueName)})
+		if err != nil {
+			if isNoSuchEntityErr(err) {
+				continue
+			}
+			return fmt.Errorf("failed to get queue URL: %w", err)
+		}
+		if _, err := p.sqsClient.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: q.QueueUrl}); err != nil && !isNoSuchEntityErr(err) {
+			return fmt.Errorf("failed to delete queue: %w", err)
 		}
-		fmt.Printf("S3RPC_%s_ACCESS_KEY_ID=%s\n", name, *k.AccessKey.AccessKeyId)
-		fmt.Printf("S3RPC_%s_SECRET_ACCESS_KEY=%s\n", name, *k.AccessKey.SecretAccessKey)
+		queueDeleted = true
+	}
+
+	if queueDeleted {
+		// Must wait 60 seconds after deleting a queue before one can create another queue with the same name.
+		time.Sleep(60 * time.Second)
+	}
+
+	return nil
+}
+
+// name returns the name of the resource for role and op.
+// The template is validated in init, so this does not fail.
+func (p *Provisioner) name(role, op string) string {
+	name, _ := p.opts.executeNameTemplate(ResourceName{Name: p.opts.Name, Region: p.opts.Region, Role: role, Op: op})
+	return name
+}
+
+func (p *Provisioner) bucketName() string {
+	return p.name("", "")
+}
+
+func (p *Provisioner) clientName() string {
+	return p.name("client", "")
+}
+
+func (p *Provisioner) serverName() string {
+	return p.name("server", "")
+}
+
+func (p *Provisioner) queueArn(accountID, name string) string {
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", p.opts.Region, accountID, name)
+}
+
+// createUser creates the user and an access key for principal, adopting them if they already exist.
+// It returns the user ARN and whether the user was created.
+func (p *Provisioner) createUser(ctx context.Context, principal *ProvisionedPrincipal) (string, bool, error) {
+	var (
+		user    *iamtypes.User
+		created bool
+	)
+
+	u, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{UserName: aws.String(principal.UserName)})
+	if err == nil {
+		user = u.User
+	} else if isNoSuchEntityErr(err) {
+		u, err := p.iamClient.CreateUser(ctx, &iam.CreateUserInput{
+			UserName: aws.String(principal.UserName),
+			Path:     aws.String("/"),
+		})
+		if err != nil {
+			return "", false, fmt.Errorf("failed to create user: %w", err)
+		}
+		user, created = u.User, true
+	} else {
+		return "", false, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if len(p.opts.Tags) > 0 {
+		var tags []iamtypes.Tag
+		for k, v := range p.opts.Tags {
+			tags = append(tags, iamtypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		if _, err := p.iamClient.TagUser(ctx, &iam.TagUserInput{UserName: user.UserName, Tags: tags}); err != nil {
+			return "", false, fmt.Errorf("failed to tag user: %w", err)
+		}
+	}
+
+	accessKeys, err := p.iamClient.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: user.UserName})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to list access keys: %w", err)
+	}
+
+	if key, ok := newestActiveKey(accessKeys.AccessKeyMetadata); ok {
+		// The secret of an existing key can not be retrieved.
+		principal.AccessKeyID = *key.AccessKeyId
+		principal.SecretUnavailable = true
+		return *user.Arn, created, nil
+	}
+	if len(accessKeys.AccessKeyMetadata) >= 2 {
+		return "", false, fmt.Errorf("user %q has no active access key and no room for a new one", *user.UserName)
+	}
+
+	a, err := p.iamClient.CreateAccessKey(ctx, &iam.CreateAccessKeyInput{UserName: user.UserName})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create access key: %w", err)
+	}
+	principal.AccessKeyID = *a.AccessKey.AccessKeyId
+	principal.SecretAccessKey = *a.AccessKey.SecretAccessKey
+
+	return *user.Arn, created, nil
+}
+
+func (p *Provisioner) createQueues(ctx context.Context, accountID string, principalArns []string, res *ProvisionResults) error {
+	createQueue := func(name string) (string, error) {
+		attrs, err := p.queueAttributes(accountID, name)
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(p.queuePolicyFor(accountID, name, principalArns))
+		if err != nil {
+			return "", err
+		}
+
+		// An empty attribute is cleared after the queue is created.
+		setAttrs := map[string]string{"Policy": string(b)}
+		for k, v := range attrs {
+			if v == "" {
+				setAttrs[k] = v
+				delete(attrs, k)
+			}
+		}
+
+		q, err := p.sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{
+			QueueName:  aws.String(name),
+			Attributes: attrs,
+		})
+		if err != nil {
+			if !isAlreadyExistsErr(err) {
+				return "", fmt.Errorf("failed to create queue: %w", err)
+			}
+			// The queue exists with different attributes.
+			qu, err := p.sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+			if err != nil {
+				return "", fmt.Errorf("failed to get queue URL: %w", err)
+			}
+			if _, err := p.sqsClient.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+				QueueUrl:   qu.QueueUrl,
+				Attributes: attrs,
+			}); err != nil {
+				return "", fmt.Errorf("failed to set queue attributes: %w", err)
+			}
+			q = &sqs.CreateQueueOutput{QueueUrl: qu.QueueUrl}
+		}
+
+		_, err = p.sqsClient.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+			QueueUrl:   q.QueueUrl,
+			Attributes: setAttrs,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to set queue policy: %w", err)
+		}
+
+		if len(p.opts.Tags) > 0 {
+			if _, err := p.sqsClient.TagQueue(ctx, &sqs.TagQueueInput{QueueUrl: q.QueueUrl, Tags: p.opts.Tags}); err != nil {
+				return "", fmt.Errorf("failed to tag queue: %w", err)
+			}
+		}
+
+		return *q.QueueUrl, nil
+	}
+
+	var err error
+	if res.Client.QueueURL, err = createQueue(p.clientName()); err != nil {
+		return err
+	}
+
+	for op, name := range p.serverQueueNames() {
+		if p.opts.MaxReceiveCount > 0 {
+			// The dead-letter queue must exist before it is set in the redrive policy.
+			if _, err := createQueue(deadLetterQueueName(name)); err != nil {
+				return err
+			}
+		}
+
+		queueURL, err := createQueue(name)
+		if err != nil {
+			return err
+		}
+		if op == "" {
+			res.Server.QueueURL = queueURL
+			continue
+		}
+		if res.Server.OpQueueURLs == nil {
+			res.Server.OpQueueURLs = make(map[string]string)
+		}
+		res.Server.OpQueueURLs[op] = queueURL
+	}
+
+	return nil
+}
+
+// queueAttributes returns the attributes for the queue name, one of queueNames.
+func (p *Provisioner) queueAttributes(accountID, name string) (map[string]string, error) {
+	if strings.HasSuffix(name, deadLetterQueueName("")) {
+		return map[string]string{"MessageRetentionPeriod": "1209600"}, nil // 14 days
+	}
+
+	attrs := map[string]string{
+		"MessageRetentionPeriod":        "7200", // 2 hours
+		"ReceiveMessageWaitTimeSeconds": "10",   // 10 seconds
+	}
+	if name == p.clientName() {
+		return attrs, nil
+	}
+	if p.opts.MaxReceiveCount <= 0 {
+		// Clears the redrive policy of a queue created with MaxReceiveCount set.
+		attrs["RedrivePolicy"] = ""
+		return attrs, nil
+	}
+
+	redrivePolicy, err := json.Marshal(map[string]string{
+		"deadLetterTargetArn": p.queueArn(accountID, deadLetterQueueName(name)),
+		"maxReceiveCount":     strconv.Itoa(p.opts.MaxReceiveCount),
+	})
+	if err != nil {
+		return nil, err
+	}
+	attrs["RedrivePolicy"] = string(redrivePolicy)
+	return attrs, nil
+}
+
+// deadLetterQueueName returns the name of the dead-letter queue for the queue name.
+func deadLetterQueueName(name string) string {
+	return name + "_dlq"
+}
+
+// serverQueueNames returns the names of the queues the server listens to keyed by op,
+// with the empty op for the shared queue.
+func (p *Provisioner) serverQueueNames() map[string]string {
+	if len(p.opts.Ops) == 0 {
+		return map[string]string{"": p.serverName()}
+	}
+	names := make(map[string]string)
+	for _, op := range p.opts.Ops {
+		names[op] = p.name("server", op)
+	}
+	return names
+}
+
+// queueNames returns the names of all the queues created.
+func (p *Provisioner) queueNames() []string {
+	names := []string{p.clientName()}
+	for _, name := range p.serverQueueNames() {
+		names = append(names, name)
+		if p.opts.MaxReceiveCount > 0 {
+			names = append(names, deadLetterQueueName(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *Provisioner) createBucket(ctx context.Context, principalArns []string) error {
+	bucket := aws.String(p.bucketName())
+
+	input := &s3.CreateBucketInput{Bucket: bucket}
+	if p.opts.Region != "us-east-1" {
+		// us-east-1 is the default and must not be set as a location constraint.
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(p.opts.Region),
+		}
+	}
+	if _, err := p.s3Client.CreateBucket(ctx, input); err != nil && !isAlreadyExistsErr(err) {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	if len(p.opts.Tags) > 0 {
+		var tags []types.Tag
+		for k, v := range p.opts.Tags {
+			tags = append(tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		if _, err := p.s3Client.PutBucketTagging(ctx, &s3.PutBucketTaggingInput{
+			Bucket:  bucket,
+			Tagging: &types.Tagging{TagSet: tags},
+		}); err != nil {
+			return fmt.Errorf("failed to tag bucket: %w", err)
+		}
+	}
+
+	_, err := p.s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: bucket,
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{
+			Rules: p.lifecycleRules(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set bucket lifecycle: %w", err)
+	}
+
+	b, err := json.Marshal(p.bucketPolicy(principalArns[0], principalArns[1]))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.s3Client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{
+		Bucket: bucket,
+		Policy: aws.String(string(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set bucket policy: %w", err)
+	}
+
+	_, err = p.s3Client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: bucket,
+		PublicAccessBlockConfiguration: &types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       true,
+			BlockPublicPolicy:     true,
+			IgnorePublicAcls:      true,
+			RestrictPublicBuckets: true,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set public access block: %w", err)
+	}
+
+	return nil
+}
+
+// lifecycleRules expires requests and responses (and any incomplete multipart uploads)
+// left behind below the working prefixes.
+func (p *Provisioner) lifecycleRules() []types.LifecycleRule {
+	type expiration struct {
+		prefix string
+		days   int32
+	}
+	expirations := []expiration{
+		{toServer, p.opts.ExpirationDays},
+		{toClient, p.opts.ExpirationDays},
+	}
+	if p.opts.ArchiveExpirationDays > 0 {
+		expirations = append(expirations, expiration{archive, p.opts.ArchiveExpirationDays})
+	}
+	if p.opts.QuarantineExpirationDays > 0 {
+		expirations = append(expirations, expiration{quarantine, p.opts.QuarantineExpirationDays})
+	}
+	if p.opts.AuditExpirationDays > 0 {
+		expirations = append(expirations, expiration{audit, p.opts.AuditExpirationDays})
+	}
+	if p.opts.Chunks {
+		expirations = append(expirations, expiration{chunks, p.opts.ExpirationDays})
+	}
+	if p.opts.Checkpoints {
+		expirations = append(expirations, expiration{checkpoints, p.opts.ExpirationDays})
+	}
+	if p.opts.ListPolling {
+		// The claims must outlive the requests.
+		expirations = append(expirations, expiration{claims, p.opts.ExpirationDays + 1})
+	}
+
+	var rules []types.LifecycleRule
+	for _, e := range expirations {
+		rules = append(rules, types.LifecycleRule{
+			ID: aws.String(fmt.Sprintf("Expire %s/ after %d days", e.prefix, e.days)),
+			Filter: &types.LifecycleRuleFilterMemberPrefix{
+				Value: e.prefix + "/",
+			},
+			Status: types.ExpirationStatusEnabled,
+			Expiration: &types.LifecycleExpiration{
+				Days: e.days,
+			},
+			// Only relevant for versioned buckets, see MultiRegionOptions.ReplicatePrefixes.
+			NoncurrentVersionExpiration: &types.NoncurrentVersionExpiration{
+				NoncurrentDays: e.days,
+			},
+			AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: e.days,
+			},
+		})
+	}
+	return rules
+}
+
+func (p *Provisioner) createNotifications(ctx context.Context, accountID string) error {
+	_, err := p.s3Client.PutBucketNotificationConfiguration(ctx, &s3.PutBucketNotificationConfigurationInput{
+		Bucket: aws.String(p.bucketName()),
+		NotificationConfiguration: &types.NotificationConfiguration{
+			QueueConfigurations: p.queueConfigurations(accountID),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create bucket notification: %w", err)
+	}
+
+	return nil
+}
+
+// queueConfigurations routes new objects to the queues.
+// Note that S3 does not allow overlapping prefixes for the same event type,
+// which is why the shared server queue and the op queues are mutually exclusive.
+func (p *Provisioner) queueConfigurations(accountID string) []types.QueueConfiguration {
+	queueConfiguration := func(id, prefix, queueName string) types.QueueConfiguration {
+		return types.QueueConfiguration{
+			Id: aws.String(id),
+			Events: []types.Event{
+				"s3:ObjectCreated:*",
+			},
+			Filter: &types.NotificationConfigurationFilter{
+				Key: &types.S3KeyFilter{
+					FilterRules: []types.FilterRule{
+						{
+							Name:  "prefix",
+							Value: aws.String(prefix + "/"),
+						},
+					},
+				},
+			},
+			QueueArn: aws.String(p.queueArn(accountID, queueName)),
+		}
+	}
+
+	configs := []types.QueueConfiguration{
+		queueConfiguration("To Client", toClient, p.clientName()),
+	}
+
+	if len(p.opts.Ops) == 0 {
+		return append(configs, queueConfiguration("To Server", toServer, p.serverName()))
+	}
+
+	queueNames := p.serverQueueNames()
+	for _, op := range p.opts.Ops {
+		configs = append(configs, queueConfiguration("To Server "+op, toServer+"/"+op, queueNames[op]))
+	}
+
+	return configs
+}
+
+func (p *Provisioner) deleteUser(ctx context.Context, userName string) error {
+	accessKeys, err := p.iamClient.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: aws.String(userName)})
+	if err != nil {
+		if isNoSuchEntityErr(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list access keys: %w", err)
+	}
+
+	for _, accessKey := range accessKeys.AccessKeyMetadata {
+		_, err := p.iamClient.DeleteAccessKey(ctx, &iam.DeleteAccessKeyInput{
+			AccessKeyId: accessKey.AccessKeyId,
+			UserName:    aws.String(userName),
+		})
+		if err != nil && !isNoSuchEntityErr(err) {
+			return fmt.Errorf("failed to delete access key: %w", err)
+		}
+	}
+
+	if _, err := p.iamClient.DeleteUser(ctx, &iam.DeleteUserInput{UserName: aws.String(userName)}); err != nil && !isNoSuchEntityErr(err) {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return nil
+}
+
+// drainBucket deletes all objects in the bucket, including any old versions.
+func (p *Provisioner) drainBucket(ctx context.Context) error {
+	bucket := aws.String(p.bucketName())
+	input := &s3.ListObjectVersionsInput{Bucket: bucket}
+
+	for {
+		page, err := p.s3Client.ListObjectVersions(ctx, input)
+		if err != nil {
+			if isNoSuchEntityErr(err) {
+				return nil
+			}
+			return err
+		}
+
+		var objects []types.ObjectIdentifier
+		for _, v := range page.Versions {
+			objects = append(objects, types.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, v := range page.DeleteMarkers {
+			objects = append(objects, types.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+
+		if len(objects) > 0 {
+			_, err := p.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: bucket,
+				Delete: &types.Delete{Objects: objects, Quiet: true},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated {
+			return nil
+		}
+		input.KeyMarker, input.VersionIdMarker = page.NextKeyMarker, page.NextVersionIdMarker
+	}
+}
+
+var validOpRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// isAlreadyExistsErr reports whether err means that the queue or bucket to create already exists.
+// BucketAlreadyExists is deliberately not matched, as that bucket is owned by someone else.
+func isAlreadyExistsErr(err error) bool {
+	switch apiErrorCode(err) {
+	case "QueueAlreadyExists", "BucketAlreadyOwnedByYou":
+		return true
+	}
+	return false
+}
+
+// isNoSuchEntityErr reports whether err means that the IAM entity, queue, bucket
+// or bucket configuration looked up does not exist.
+func isNoSuchEntityErr(err error) bool {
+	switch apiErrorCode(err) {
+	case "NoSuchEntity",
+		"AWS.SimpleQueueService.NonExistentQueue", "QueueDoesNotExist",
+		"NoSuchBucket", "NotFound", "NoSuchBucketPolicy", "NoSuchLifecycleConfiguration",
+		"NoSuchPublicAccessBlockConfiguration":
+		return true
+	}
+	return false
+}
+
+// apiErrorCode returns the error code of the AWS API error in err, if any.
+func apiErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
 	}
+	return ""
 }
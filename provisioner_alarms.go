@@ -0,0 +1,150 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// AlarmOptions configures the CloudWatch alarms created by the Provisioner.
+type AlarmOptions struct {
+	// TopicArn is the SNS topic to notify when an alarm fires.
+	TopicArn string
+
+	// MaxMessageAge is the age of the oldest message in a queue above which the alarm fires.
+	// A high value means that requests (or responses) are not picked up.
+	// Defaults to 5 minutes.
+	MaxMessageAge time.Duration
+}
+
+func (opts *AlarmOptions) init() error {
+	if opts.TopicArn == "" {
+		return errors.New("alarms: topic ARN is required")
+	}
+
+	if opts.MaxMessageAge == 0 {
+		opts.MaxMessageAge = 5 * time.Minute
+	}
+
+	return nil
+}
+
+type alarm struct {
+	name      string
+	queueName string
+	metric    string
+	threshold float64
+}
+
+// alarms returns the alarms to create: one on the age of the oldest message in every queue,
+// and one on any message arriving in the dead-letter queues.
+func (p *Provisioner) alarms() []alarm {
+	if p.opts.Alarms == nil {
+		return nil
+	}
+
+	var alarms []alarm
+	for _, name := range p.queueNames() {
+		if strings.HasSuffix(name, deadLetterQueueName("")) {
+			alarms = append(alarms, alarm{
+				name:      name + "-messages",
+				queueName: name,
+				metric:    "ApproximateNumberOfMessagesVisible",
+				threshold: 0,
+			})
+			continue
+		}
+		alarms = append(alarms, alarm{
+			name:      name + "-oldest-message",
+			queueName: name,
+			metric:    "ApproximateAgeOfOldestMessage",
+			threshold: p.opts.Alarms.MaxMessageAge.Seconds(),
+		})
+	}
+	return alarms
+}
+
+func (p *Provisioner) alarmNames() []string {
+	var names []string
+	for _, a := range p.alarms() {
+		names = append(names, a.name)
+	}
+	return names
+}
+
+func (p *Provisioner) createAlarms(ctx context.Context, accountID string) error {
+	var tags []types.Tag
+	for k, v := range p.opts.Tags {
+		tags = append(tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	for _, a := range p.alarms() {
+		_, err := p.cwClient.PutMetricAlarm(ctx, p.alarmInput(a))
+		if err != nil {
+			return fmt.Errorf("failed to create alarm: %w", err)
+		}
+
+		if len(tags) > 0 {
+			// PutMetricAlarm ignores tags when updating an existing alarm.
+			if _, err := p.cwClient.TagResource(ctx, &cloudwatch.TagResourceInput{
+				ResourceARN: aws.String(fmt.Sprintf("arn:aws:cloudwatch:%s:%s:alarm:%s", p.opts.Region, accountID, a.name)),
+				Tags:        tags,
+			}); err != nil {
+				return fmt.Errorf("failed to tag alarm: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) alarmInput(a alarm) *cloudwatch.PutMetricAlarmInput {
+	return &cloudwatch.PutMetricAlarmInput{
+		AlarmName:          aws.String(a.name),
+		AlarmDescription:   aws.String(fmt.Sprintf("s3rpc: %s above %g for queue %s", a.metric, a.threshold, a.queueName)),
+		AlarmActions:       []string{p.opts.Alarms.TopicArn},
+		Namespace:          aws.String("AWS/SQS"),
+		MetricName:         aws.String(a.metric),
+		Dimensions:         []types.Dimension{{Name: aws.String("QueueName"), Value: aws.String(a.queueName)}},
+		Statistic:          types.StatisticMaximum,
+		Period:             aws.Int32(60),
+		EvaluationPeriods:  aws.Int32(1),
+		Threshold:          aws.Float64(a.threshold),
+		ComparisonOperator: types.ComparisonOperatorGreaterThanThreshold,
+		TreatMissingData:   aws.String("notBreaching"),
+	}
+}
+
+// alarmMatches reports whether the existing alarm m is configured as in.
+func alarmMatches(m types.MetricAlarm, in *cloudwatch.PutMetricAlarmInput) bool {
+	return aws.ToString(m.AlarmDescription) == aws.ToString(in.AlarmDescription) &&
+		reflect.DeepEqual(m.AlarmActions, in.AlarmActions) &&
+		aws.ToString(m.Namespace) == aws.ToString(in.Namespace) &&
+		aws.ToString(m.MetricName) == aws.ToString(in.MetricName) &&
+		len(m.Dimensions) == 1 && aws.ToString(m.Dimensions[0].Name) == aws.ToString(in.Dimensions[0].Name) &&
+		aws.ToString(m.Dimensions[0].Value) == aws.ToString(in.Dimensions[0].Value) &&
+		m.Statistic == in.Statistic &&
+		aws.ToInt32(m.Period) == aws.ToInt32(in.Period) &&
+		aws.ToInt32(m.EvaluationPeriods) == aws.ToInt32(in.EvaluationPeriods) &&
+		aws.ToFloat64(m.Threshold) == aws.ToFloat64(in.Threshold) &&
+		m.ComparisonOperator == in.ComparisonOperator &&
+		aws.ToString(m.TreatMissingData) == aws.ToString(in.TreatMissingData)
+}
+
+func (p *Provisioner) deleteAlarms(ctx context.Context) error {
+	names := p.alarmNames()
+	if len(names) == 0 {
+		return nil
+	}
+	// DeleteAlarms ignores alarms that do not exist.
+	if _, err := p.cwClient.DeleteAlarms(ctx, &cloudwatch.DeleteAlarmsInput{AlarmNames: names}); err != nil {
+		return fmt.Errorf("failed to delete alarms: %w", err)
+	}
+	return nil
+}
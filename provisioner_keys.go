@@ -0,0 +1,108 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// RotateKeys creates new access keys for the client and server users and returns them.
+//
+// The previous keys are kept active so running clients and servers can be
+// redeployed with the new keys; delete them with DeleteOldKeys when that is done.
+// IAM allows at most two access keys per user, so RotateKeys fails without creating
+// any keys if a user already has two.
+// Only the user names and access keys are set in the result.
+// On error, the result holds the keys created before the failure.
+func (p *Provisioner) RotateKeys(ctx context.Context) (ProvisionResults, error) {
+	res := ProvisionResults{
+		Bucket: p.bucketName(),
+		Region: p.opts.Region,
+		Client: ProvisionedPrincipal{UserName: p.clientName()},
+		Server: ProvisionedPrincipal{UserName: p.serverName()},
+	}
+
+	for _, principal := range []*ProvisionedPrincipal{&res.Client, &res.Server} {
+		accessKeys, err := p.iamClient.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: aws.String(principal.UserName)})
+		if err != nil {
+			return res, fmt.Errorf("failed to list access keys: %w", err)
+		}
+		if len(accessKeys.AccessKeyMetadata) >= 2 {
+			return res, fmt.Errorf("user %q already has two access keys, run DeleteOldKeys first", principal.UserName)
+		}
+	}
+
+	for _, principal := range []*ProvisionedPrincipal{&res.Client, &res.Server} {
+		a, err := p.iamClient.CreateAccessKey(ctx, &iam.CreateAccessKeyInput{UserName: aws.String(principal.UserName)})
+		if err != nil {
+			return res, fmt.Errorf("failed to create access key for user %q: %w", principal.UserName, err)
+		}
+		principal.AccessKeyID = *a.AccessKey.AccessKeyId
+		principal.SecretAccessKey = *a.AccessKey.SecretAccessKey
+	}
+
+	return res, nil
+}
+
+// DeleteOldKeys deletes all but the newest access key of the client and server users.
+// Run this when all clients and servers use the keys returned from RotateKeys.
+func (p *Provisioner) DeleteOldKeys(ctx context.Context) error {
+	for _, userName := range []string{p.clientName(), p.serverName()} {
+		if err := p.deleteOldKeys(ctx, userName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) deleteOldKeys(ctx context.Context, userName string) error {
+	accessKeys, err := p.iamClient.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: aws.String(userName)})
+	if err != nil {
+		return fmt.Errorf("failed to list access keys: %w", err)
+	}
+
+	for _, accessKey := range oldKeys(accessKeys.AccessKeyMetadata) {
+		_, err := p.iamClient.DeleteAccessKey(ctx, &iam.DeleteAccessKeyInput{
+			AccessKeyId: accessKey.AccessKeyId,
+			UserName:    aws.String(userName),
+		})
+		if err != nil && !isNoSuchEntityErr(err) {
+			return fmt.Errorf("failed to delete access key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// oldKeys returns all but the newest of keys.
+func oldKeys(keys []types.AccessKeyMetadata) []types.AccessKeyMetadata {
+	if len(keys) < 2 {
+		return nil
+	}
+	keys = append([]types.AccessKeyMetadata(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreateDate.Before(*keys[j].CreateDate)
+	})
+	return keys[:len(keys)-1]
+}
+
+// newestActiveKey returns the newest of keys with status Active.
+func newestActiveKey(keys []types.AccessKeyMetadata) (types.AccessKeyMetadata, bool) {
+	var (
+		newest types.AccessKeyMetadata
+		found  bool
+	)
+	for _, key := range keys {
+		if key.Status != types.StatusTypeActive {
+			continue
+		}
+		if !found || key.CreateDate.After(*newest.CreateDate) {
+			newest, found = key, true
+		}
+	}
+	return newest, found
+}
@@ -0,0 +1,306 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DefaultMultiRegionNameTemplate is the default NameTemplate for the MultiRegionProvisioner.
+// It is the same as DefaultNameTemplate, but with the region appended to the bucket name,
+// as bucket names are global.
+const DefaultMultiRegionNameTemplate = "{{ .Name }}{{ with .Role }}_{{ . }}{{ else }}-{{ .Region }}{{ end }}{{ with .Op }}_{{ . }}{{ end }}"
+
+// MultiRegionOptions are options for the MultiRegionProvisioner.
+type MultiRegionOptions struct {
+	// ProvisionerOptions is used for every region.
+	// Region is ignored.
+	// The bucket name produced by NameTemplate must be different for every region;
+	// NameTemplate defaults to DefaultMultiRegionNameTemplate.
+	ProvisionerOptions
+
+	// Regions to create the environment in.
+	// The first region is the primary.
+	Regions []string
+
+	// ReplicatePrefixes, if set, replicates objects below these prefixes from the primary bucket
+	// to the buckets in the other regions. This enables versioning on all buckets.
+	// Note that replicating to_server/ means that servers in all regions will
+	// process the same requests.
+	ReplicatePrefixes []string
+}
+
+// MultiRegionProvisioner creates and destroys mirrored s3rpc environments in multiple regions.
+// The users are global and shared between the regions, the buckets and queues are regional.
+type MultiRegionProvisioner struct {
+	opts         MultiRegionOptions
+	provisioners []*Provisioner
+}
+
+// MultiRegionResults holds the resources created by the MultiRegionProvisioner,
+// one ProvisionResults per region in the order given in MultiRegionOptions.Regions.
+type MultiRegionResults []ProvisionResults
+
+// NewMultiRegionProvisioner returns a new MultiRegionProvisioner.
+// See NewProvisioner for how the AWS credentials are configured.
+func NewMultiRegionProvisioner(opts MultiRegionOptions) (*MultiRegionProvisioner, error) {
+	if len(opts.Regions) == 0 {
+		return nil, errors.New("at least one region is required")
+	}
+
+	if opts.NameTemplate == "" {
+		opts.NameTemplate = DefaultMultiRegionNameTemplate
+	}
+
+	m := &MultiRegionProvisioner{opts: opts}
+	buckets := make(map[string]bool)
+	for _, region := range opts.Regions {
+		popts := opts.ProvisionerOptions
+		popts.Region = region
+		p, err := NewProvisionerWithOptions(popts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", region, err)
+		}
+		if buckets[p.bucketName()] {
+			return nil, fmt.Errorf("name template produces the bucket name %q for more than one region", p.bucketName())
+		}
+		buckets[p.bucketName()] = true
+		m.provisioners = append(m.provisioners, p)
+	}
+
+	if name := m.replicationRoleName(); len(opts.ReplicatePrefixes) > 0 && !validOpRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid replication role name %q from name template", name)
+	}
+
+	return m, nil
+}
+
+// Create creates the environment in all regions.
+// Like Provisioner.Create, this is safe to run repeatedly.
+func (m *MultiRegionProvisioner) Create(ctx context.Context) (MultiRegionResults, error) {
+	var results MultiRegionResults
+	for _, p := range m.provisioners {
+		res, err := p.Create(ctx)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", p.opts.Region, err)
+		}
+		results = append(results, res)
+	}
+
+	// The users are shared, so the access keys are only created (and the secrets known)
+	// in the first region reporting them.
+	for _, res := range results {
+		for i := range results {
+			for _, v := range []struct{ from, to *ProvisionedPrincipal }{
+				{&res.Client, &results[i].Client},
+				{&res.Server, &results[i].Server},
+			} {
+				if v.from.SecretAccessKey != "" && v.to.SecretAccessKey == "" {
+					v.to.AccessKeyID, v.to.SecretAccessKey = v.from.AccessKeyID, v.from.SecretAccessKey
+					v.to.SecretUnavailable = false
+				}
+			}
+		}
+	}
+
+	if len(m.opts.ReplicatePrefixes) > 0 && len(m.provisioners) > 1 {
+		if err := m.createReplication(ctx); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// Destroy removes the environment in all regions.
+func (m *MultiRegionProvisioner) Destroy(ctx context.Context) error {
+	primary := m.provisioners[0]
+	if err := primary.deleteRole(ctx, m.replicationRoleName()); err != nil {
+		return err
+	}
+	for _, p := range m.provisioners {
+		if err := p.Destroy(ctx); err != nil {
+			return fmt.Errorf("%s: %w", p.opts.Region, err)
+		}
+	}
+	return nil
+}
+
+func (m *MultiRegionProvisioner) replicationRoleName() string {
+	return m.provisioners[0].name("replication", "")
+}
+
+func (m *MultiRegionProvisioner) createReplication(ctx context.Context) error {
+	primary := m.provisioners[0]
+
+	for _, p := range m.provisioners {
+		_, err := p.s3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  aws.String(p.bucketName()),
+			VersioningConfiguration: &types.VersioningConfiguration{Status: types.BucketVersioningStatusEnabled},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable bucket versioning: %w", err)
+		}
+	}
+
+	roleArn, err := primary.createRole(ctx, m.replicationRoleName(), m.replicationPolicy())
+	if err != nil {
+		return err
+	}
+
+	_, err = primary.s3Client.PutBucketReplication(ctx, &s3.PutBucketReplicationInput{
+		Bucket: aws.String(primary.bucketName()),
+		ReplicationConfiguration: &types.ReplicationConfiguration{
+			Role:  aws.String(roleArn),
+			Rules: m.replicationRules(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set bucket replication: %w", err)
+	}
+
+	return nil
+}
+
+func (m *MultiRegionProvisioner) replicationRules() []types.ReplicationRule {
+	var rules []types.ReplicationRule
+	for _, p := range m.provisioners[1:] {
+		for _, prefix := range m.opts.ReplicatePrefixes {
+			rules = append(rules, types.ReplicationRule{
+				ID:       aws.String(fmt.Sprintf("Replicate %s to %s", prefix, p.opts.Region)),
+				Priority: int32(len(rules) + 1),
+				Status:   types.ReplicationRuleStatusEnabled,
+				Filter:   &types.ReplicationRuleFilterMemberPrefix{Value: prefix},
+				Destination: &types.Destination{
+					Bucket: aws.String(p.bucketArn()),
+				},
+				DeleteMarkerReplication: &types.DeleteMarkerReplication{
+					Status: types.DeleteMarkerReplicationStatusDisabled,
+				},
+			})
+		}
+	}
+	return rules
+}
+
+// replicationPolicy allows S3 to replicate objects from the primary bucket to the other buckets.
+func (m *MultiRegionProvisioner) replicationPolicy() policyDocument {
+	primary := m.provisioners[0]
+
+	var destinations []string
+	for _, p := range m.provisioners[1:] {
+		destinations = append(destinations, p.bucketArn()+"/*")
+	}
+
+	return policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetReplicationConfiguration", "s3:ListBucket"},
+				Resource: []string{primary.bucketArn()},
+			},
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObjectVersionForReplication", "s3:GetObjectVersionAcl", "s3:GetObjectVersionTagging"},
+				Resource: []string{primary.bucketArn() + "/*"},
+			},
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:ReplicateObject", "s3:ReplicateTags"},
+				Resource: destinations,
+			},
+		},
+	}
+}
+
+// createRole creates the role name assumable by S3 with the inline policy, adopting it if it exists.
+// It returns the role ARN.
+func (p *Provisioner) createRole(ctx context.Context, name string, policy policyDocument) (string, error) {
+	trust, err := json.Marshal(policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			{
+				Effect:    "Allow",
+				Principal: map[string]any{"Service": "s3.amazonaws.com"},
+				Action:    []string{"sts:AssumeRole"},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var roleArn string
+	r, err := p.iamClient.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(name)})
+	if err == nil {
+		roleArn = *r.Role.Arn
+	} else if isNoSuchEntityErr(err) {
+		r, err := p.iamClient.CreateRole(ctx, &iam.CreateRoleInput{
+			RoleName:                 aws.String(name),
+			AssumeRolePolicyDocument: aws.String(string(trust)),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create role: %w", err)
+		}
+		roleArn = *r.Role.Arn
+	} else {
+		return "", fmt.Errorf("failed to get role: %w", err)
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.iamClient.PutRolePolicy(ctx, &iam.PutRolePolicyInput{
+		RoleName:       aws.String(name),
+		PolicyName:     aws.String(name),
+		PolicyDocument: aws.String(string(b)),
+	}); err != nil {
+		return "", fmt.Errorf("failed to set role policy: %w", err)
+	}
+
+	return roleArn, nil
+}
+
+func (p *Provisioner) deleteRole(ctx context.Context, name string) error {
+	if _, err := p.iamClient.DeleteRolePolicy(ctx, &iam.DeleteRolePolicyInput{
+		RoleName:   aws.String(name),
+		PolicyName: aws.String(name),
+	}); err != nil && !isNoSuchEntityErr(err) {
+		return fmt.Errorf("failed to delete role policy: %w", err)
+	}
+	if _, err := p.iamClient.DeleteRole(ctx, &iam.DeleteRoleInput{RoleName: aws.String(name)}); err != nil && !isNoSuchEntityErr(err) {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	return nil
+}
+
+// WriteJSON writes r to w as indented JSON.
+func (r MultiRegionResults) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteDotenv writes the config relevant parts of r to w in .env format,
+// with the variables for each region prefixed with S3RPC_<REGION>_, e.g. S3RPC_EU_NORTH_1_CLIENT_QUEUE.
+func (r MultiRegionResults) WriteDotenv(w io.Writer) error {
+	for _, res := range r {
+		prefix := "S3RPC_" + envName(res.Region) + "_"
+		for _, v := range res.vars() {
+			if _, err := fmt.Fprintf(w, "%s=%s\n", prefix+strings.TrimPrefix(v.name, "S3RPC_"), v.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package s3rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrintProvisionResults prints the config relevant parts of the provision results to stdout,
+// suitable for sourcing in a shell script.
+func PrintProvisionResults(outputs ProvisionResults) {
+	_ = outputs.WriteDotenv(os.Stdout)
+}
+
+// WriteJSON writes r to w as indented JSON.
+func (r ProvisionResults) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteDotenv writes the config relevant parts of r to w in .env format,
+// using the same variable names as the tests in this repository.
+// Secrets that are not available are noted in comments.
+func (r ProvisionResults) WriteDotenv(w io.Writer) error {
+	for _, v := range r.vars() {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", v.name, v.value); err != nil {
+			return err
+		}
+	}
+	for _, note := range r.notes() {
+		if _, err := fmt.Fprintf(w, "# %s\n", note); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTerraform writes the config relevant parts of r to w as a Terraform locals block,
+// with the secrets marked as sensitive.
+func (r ProvisionResults) WriteTerraform(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("locals {\n")
+	for _, v := range r.vars() {
+		value := strconv.Quote(v.value)
+		if strings.HasSuffix(v.name, "_SECRET_ACCESS_KEY") {
+			value = fmt.Sprintf("sensitive(%s)", value)
+		}
+		fmt.Fprintf(&sb, "  %s = %s\n", strings.ToLower(v.name), value)
+	}
+	for _, note := range r.notes() {
+		fmt.Fprintf(&sb, "  # %s\n", note)
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteCloudFormation writes the config relevant parts of r to w as the Parameters section
+// of a CloudFormation template in JSON, with the secrets marked as NoEcho.
+// The parameter names are the environment variable names in CamelCase, e.g. S3rpcBucket.
+// Secrets that are not available are noted in the template Metadata.
+func (r ProvisionResults) WriteCloudFormation(w io.Writer) error {
+	type parameter struct {
+		Type    string
+		Default string
+		NoEcho  bool `json:",omitempty"`
+	}
+	template := struct {
+		Metadata   map[string][]string `json:",omitempty"`
+		Parameters map[string]parameter
+	}{
+		Parameters: make(map[string]parameter),
+	}
+	for _, v := range r.vars() {
+		template.Parameters[cloudFormationName(v.name)] = parameter{
+			Type:    "String",
+			Default: v.value,
+			NoEcho:  strings.HasSuffix(v.name, "_SECRET_ACCESS_KEY"),
+		}
+	}
+	if notes := r.notes(); len(notes) > 0 {
+		template.Metadata = map[string][]string{"S3rpcNotes": notes}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(template)
+}
+
+type provisionVar struct {
+	name  string
+	value string
+}
+
+// vars returns the config relevant parts of r as environment variables.
+// Empty values are omitted.
+func (r ProvisionResults) vars() []provisionVar {
+	var vars []provisionVar
+	add := func(name, value string) {
+		if value != "" {
+			vars = append(vars, provisionVar{name: "S3RPC_" + name, value: value})
+		}
+	}
+
+	add("BUCKET", r.Bucket)
+	add("REGION", r.Region)
+
+	for _, v := range []struct {
+		name      string
+		principal ProvisionedPrincipal
+	}{
+		{"CLIENT", r.Client},
+		{"SERVER", r.Server},
+	} {
+		add(v.name+"_QUEUE", v.principal.QueueURL)
+		add(v.name+"_ACCESS_KEY_ID", v.principal.AccessKeyID)
+		add(v.name+"_SECRET_ACCESS_KEY", v.principal.SecretAccessKey)
+	}
+
+	var ops []string
+	for op := range r.Server.OpQueueURLs {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		add("SERVER_QUEUE_"+envName(op), r.Server.OpQueueURLs[op])
+	}
+
+	return vars
+}
+
+// notes returns what the user needs to know about the values left out of vars.
+func (r ProvisionResults) notes() []string {
+	var notes []string
+	for _, v := range []struct {
+		name      string
+		principal ProvisionedPrincipal
+	}{
+		{"CLIENT", r.Client},
+		{"SERVER", r.Server},
+	} {
+		if v.principal.SecretUnavailable {
+			notes = append(notes, fmt.Sprintf("S3RPC_%s_SECRET_ACCESS_KEY is not available for the existing access key %s, create a new one with Provisioner.RotateKeys", v.name, v.principal.AccessKeyID))
+		}
+	}
+	return notes
+}
+
+// cloudFormationName converts the environment variable name s to a CloudFormation logical ID,
+// e.g. S3RPC_CLIENT_QUEUE to S3rpcClientQueue.
+func cloudFormationName(s string) string {
+	var sb strings.Builder
+	for _, part := range strings.Split(strings.ToLower(s), "_") {
+		if part != "" {
+			sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return sb.String()
+}
+
+// envName converts s into something usable as part of an environment variable name.
+func envName(s string) string {
+	return strings.ToUpper(strings.ReplaceAll(s, "-", "_"))
+}
@@ -0,0 +1,350 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// ProvisionAction is the action Create or Destroy would take on a resource.
+type ProvisionAction string
+
+const (
+	// ProvisionActionCreate means that the resource does not exist and will be created.
+	ProvisionActionCreate ProvisionAction = "create"
+
+	// ProvisionActionUpdate means that the resource exists, but is configured differently
+	// from what Create would set, and will be overwritten.
+	ProvisionActionUpdate ProvisionAction = "update"
+
+	// ProvisionActionDelete means that the resource exists and will be deleted.
+	ProvisionActionDelete ProvisionAction = "delete"
+
+	// ProvisionActionNone means that nothing will be done to the resource,
+	// e.g. because Create adopts it as is or it is already configured as Create would set.
+	ProvisionActionNone ProvisionAction = "none"
+)
+
+// ProvisionChange is a planned change to a single resource.
+type ProvisionChange struct {
+	Action ProvisionAction
+
+	// Kind is the resource kind, e.g. "user" or "queue".
+	Kind string
+
+	// Name is the resource name.
+	Name string
+}
+
+func (c ProvisionChange) String() string {
+	return fmt.Sprintf("%-8s %-22s %s", c.Action, c.Kind, c.Name)
+}
+
+// ProvisionPlan holds the changes Create and Destroy would make.
+type ProvisionPlan struct {
+	Create  []ProvisionChange
+	Destroy []ProvisionChange
+}
+
+func (p ProvisionPlan) String() string {
+	var sb strings.Builder
+	for _, v := range []struct {
+		name    string
+		changes []ProvisionChange
+	}{
+		{"Create", p.Create},
+		{"Destroy", p.Destroy},
+	} {
+		sb.WriteString(v.name + ":\n")
+		for _, c := range v.changes {
+			sb.WriteString("  " + c.String() + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// Plan reports what Create and Destroy would change given the current state of the AWS account.
+// The configuration of existing resources, e.g. policies and lifecycle rules,
+// is compared with what Create would set. It only reads from AWS.
+func (p *Provisioner) Plan(ctx context.Context) (ProvisionPlan, error) {
+	var plan ProvisionPlan
+
+	exists, err := p.existingResources(ctx)
+	if err != nil {
+		return plan, err
+	}
+
+	accountID, principalArns, err := p.principalArns(ctx)
+	if err != nil {
+		return plan, err
+	}
+
+	for _, r := range p.resources() {
+		createAction, destroyAction := ProvisionActionCreate, ProvisionActionNone
+		if exists[r] {
+			createAction, destroyAction = ProvisionActionNone, ProvisionActionDelete
+			if r.configurable {
+				ok, err := p.configured(ctx, r, accountID, principalArns)
+				if err != nil {
+					return plan, fmt.Errorf("failed to read %s %q: %w", r.kind, r.name, err)
+				}
+				if !ok {
+					createAction = ProvisionActionUpdate
+				}
+			}
+		}
+		plan.Create = append(plan.Create, ProvisionChange{Action: createAction, Kind: r.kind, Name: r.name})
+		plan.Destroy = append(plan.Destroy, ProvisionChange{Action: destroyAction, Kind: r.kind, Name: r.name})
+	}
+
+	return plan, nil
+}
+
+// principalArns returns the account ID and the ARNs of the client and the server users,
+// empty for users that do not exist.
+func (p *Provisioner) principalArns(ctx context.Context) (string, []string, error) {
+	adminAccount, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{})
+	if err != nil {
+		return "", nil, err
+	}
+	accountID := strings.Split(*adminAccount.User.Arn, ":")[4]
+
+	var principalArns []string
+	for _, userName := range []string{p.clientName(), p.serverName()} {
+		u, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{UserName: aws.String(userName)})
+		if err != nil {
+			if !isNoSuchEntityErr(err) {
+				return "", nil, err
+			}
+			principalArns = append(principalArns, "")
+			continue
+		}
+		principalArns = append(principalArns, *u.User.Arn)
+	}
+	return accountID, principalArns, nil
+}
+
+// configured reports whether the existing configurable resource r is configured as Create would configure it.
+func (p *Provisioner) configured(ctx context.Context, r provisionResource, accountID string, principalArns []string) (bool, error) {
+	bucket := aws.String(p.bucketName())
+
+	switch r.kind {
+	case "queue", "queue policy":
+		q, err := p.sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(r.name)})
+		if err != nil {
+			return false, err
+		}
+		attrs, err := p.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       q.QueueUrl,
+			AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameAll},
+		})
+		if err != nil {
+			return false, err
+		}
+		if r.kind == "queue policy" {
+			policy, ok := attrs.Attributes["Policy"]
+			if !ok {
+				return false, nil
+			}
+			return equalPolicy(policy, p.queuePolicyFor(accountID, r.name, principalArns))
+		}
+		expected, err := p.queueAttributes(accountID, r.name)
+		if err != nil {
+			return false, err
+		}
+		for k, v := range expected {
+			if !equalQueueAttribute(k, attrs.Attributes[k], v) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "bucket lifecycle":
+		lifecycle, err := p.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: bucket})
+		if err != nil {
+			if isNoSuchEntityErr(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		expected := p.lifecycleRules()
+		if len(lifecycle.Rules) != len(expected) {
+			return false, nil
+		}
+		for _, e := range expected {
+			var found bool
+			for _, rule := range lifecycle.Rules {
+				found = found || lifecycleRuleMatches(rule, e)
+			}
+			if !found {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "bucket policy":
+		policy, err := p.s3Client.GetBucketPolicy(ctx, &s3.GetBucketPolicyInput{Bucket: bucket})
+		if err != nil {
+			if isNoSuchEntityErr(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return equalPolicy(aws.ToString(policy.Policy), p.bucketPolicy(principalArns[0], principalArns[1]))
+	case "public access block":
+		block, err := p.s3Client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: bucket})
+		if err != nil {
+			if isNoSuchEntityErr(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		cfg := block.PublicAccessBlockConfiguration
+		return cfg != nil && cfg.BlockPublicAcls && cfg.BlockPublicPolicy && cfg.IgnorePublicAcls && cfg.RestrictPublicBuckets, nil
+	case "bucket notifications":
+		notifications, err := p.s3Client.GetBucketNotificationConfiguration(ctx, &s3.GetBucketNotificationConfigurationInput{Bucket: bucket})
+		if err != nil {
+			return false, err
+		}
+		expected := p.queueConfigurations(accountID)
+		if len(notifications.QueueConfigurations) != len(expected) ||
+			len(notifications.TopicConfigurations) > 0 || len(notifications.LambdaFunctionConfigurations) > 0 {
+			return false, nil
+		}
+		for _, e := range expected {
+			var found bool
+			for _, qc := range notifications.QueueConfigurations {
+				found = found || queueConfigurationMatches(qc, e)
+			}
+			if !found {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "alarm":
+		for _, a := range p.alarms() {
+			if a.name != r.name {
+				continue
+			}
+			alarms, err := p.cwClient.DescribeAlarms(ctx, &cloudwatch.DescribeAlarmsInput{AlarmNames: []string{r.name}})
+			if err != nil {
+				return false, err
+			}
+			return len(alarms.MetricAlarms) == 1 && alarmMatches(alarms.MetricAlarms[0], p.alarmInput(a)), nil
+		}
+	}
+
+	return false, fmt.Errorf("unknown resource kind %q", r.kind)
+}
+
+// equalQueueAttribute reports whether the queue attribute k has the expected value.
+// A missing attribute equals the empty string and the redrive policy, which SQS
+// returns with a numeric maxReceiveCount, is compared by value.
+func equalQueueAttribute(k, actual, expected string) bool {
+	if k != "RedrivePolicy" || actual == "" || expected == "" {
+		return actual == expected
+	}
+	var m1, m2 map[string]interface{}
+	if json.Unmarshal([]byte(actual), &m1) != nil || json.Unmarshal([]byte(expected), &m2) != nil || len(m1) != len(m2) {
+		return false
+	}
+	for k, v := range m2 {
+		if fmt.Sprint(m1[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+type provisionResource struct {
+	kind string
+	name string
+
+	// The kind of the resource this is attached to, if any.
+	// These are assumed to exist if their owner exists.
+	owner string
+
+	// Whether Create overwrites the resource if it exists.
+	configurable bool
+}
+
+// resources returns all the resources managed by the Provisioner in the order they are created.
+func (p *Provisioner) resources() []provisionResource {
+	var resources []provisionResource
+	for _, name := range []string{p.clientName(), p.serverName()} {
+		resources = append(resources,
+			provisionResource{kind: "user", name: name},
+			provisionResource{kind: "access key", name: name},
+		)
+	}
+	for _, name := range p.queueNames() {
+		resources = append(resources,
+			provisionResource{kind: "queue", name: name, configurable: true},
+			provisionResource{kind: "queue policy", name: name, owner: "queue", configurable: true},
+		)
+	}
+	resources = append(resources, provisionResource{kind: "bucket", name: p.bucketName()})
+	bucketKinds := []string{"bucket lifecycle", "bucket policy", "public access block"}
+	if !p.opts.DirectSubmit {
+		bucketKinds = append(bucketKinds, "bucket notifications")
+	}
+	for _, kind := range bucketKinds {
+		resources = append(resources, provisionResource{kind: kind, name: p.bucketName(), owner: "bucket", configurable: true})
+	}
+	for _, name := range p.alarmNames() {
+		resources = append(resources, provisionResource{kind: "alarm", name: name, configurable: true})
+	}
+	return resources
+}
+
+// existingResources looks up which of the resources that already exist.
+func (p *Provisioner) existingResources(ctx context.Context) (map[provisionResource]bool, error) {
+	exists := make(map[provisionResource]bool)
+	owners := make(map[string]bool)
+
+	// Owners are always listed before the resources attached to them.
+	for _, r := range p.resources() {
+		if r.owner != "" {
+			exists[r] = owners[r.owner+"/"+r.name]
+			continue
+		}
+
+		var err error
+		switch r.kind {
+		case "user":
+			_, err = p.iamClient.GetUser(ctx, &iam.GetUserInput{UserName: aws.String(r.name)})
+		case "access key":
+			var keys *iam.ListAccessKeysOutput
+			keys, err = p.iamClient.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: aws.String(r.name)})
+			if err == nil && len(keys.AccessKeyMetadata) == 0 {
+				continue
+			}
+		case "queue":
+			_, err = p.sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(r.name)})
+		case "bucket":
+			_, err = p.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(r.name)})
+		case "alarm":
+			var alarms *cloudwatch.DescribeAlarmsOutput
+			alarms, err = p.cwClient.DescribeAlarms(ctx, &cloudwatch.DescribeAlarmsInput{AlarmNames: []string{r.name}})
+			if err == nil && len(alarms.MetricAlarms) == 0 {
+				continue
+			}
+		}
+		if err != nil {
+			if isNoSuchEntityErr(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to look up %s %q: %w", r.kind, r.name, err)
+		}
+		exists[r] = true
+		owners[r.kind+"/"+r.name] = true
+	}
+
+	return exists, nil
+}
@@ -0,0 +1,209 @@
+package s3rpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// policyDocument is an IAM policy document.
+type policyDocument struct {
+	Version   string
+	Statement []policyStatement
+}
+
+type policyStatement struct {
+	Sid       string `json:",omitempty"`
+	Effect    string
+	Principal map[string]any `json:",omitempty"`
+	Action    []string
+	Resource  []string                     `json:",omitempty"`
+	Condition map[string]map[string]string `json:",omitempty"`
+}
+
+// queuePolicyFor returns the policy for the queue name, one of queueNames.
+// principalArns holds the client and the server user ARNs.
+func (p *Provisioner) queuePolicyFor(accountID, name string, principalArns []string) policyDocument {
+	if name == p.clientName() {
+		return p.queuePolicy(accountID, name, principalArns[0], principalArns[1])
+	}
+	policy := p.queuePolicy(accountID, name, principalArns[1], principalArns[0])
+	if strings.HasSuffix(name, deadLetterQueueName("")) {
+		// Nothing but SQS itself sends to the dead-letter queue.
+		policy.Statement = policy.Statement[:1]
+		return policy
+	}
+	if p.opts.HandlerRequeue {
+		policy.Statement = append(policy.Statement, policyStatement{
+			Sid:       "ServerRequeue",
+			Effect:    "Allow",
+			Principal: map[string]any{"AWS": principalArns[1]},
+			Action:    []string{"sqs:SendMessage"},
+			Resource:  []string{p.queueArn(accountID, name)},
+		})
+	}
+	return policy
+}
+
+// queuePolicy allows the user principalArn to consume from the queue name
+// and the bucket to send its event notifications to it,
+// or with ProvisionerOptions.DirectSubmit, the user senderArn to send to it.
+func (p *Provisioner) queuePolicy(accountID, name, principalArn, senderArn string) policyDocument {
+	queueArns := []string{p.queueArn(accountID, name)}
+	if p.opts.DirectSubmit {
+		return policyDocument{
+			Version: "2012-10-17",
+			Statement: []policyStatement{
+				consumeStatement(principalArn, queueArns),
+				{
+					Sid:       "DirectSubmit",
+					Effect:    "Allow",
+					Principal: map[string]any{"AWS": senderArn},
+					Action:    []string{"sqs:SendMessage"},
+					Resource:  queueArns,
+				},
+			},
+		}
+	}
+	return policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			consumeStatement(principalArn, queueArns),
+			{
+				Sid:       "BucketNotifications",
+				Effect:    "Allow",
+				Principal: map[string]any{"Service": "s3.amazonaws.com"},
+				Action:    []string{"sqs:SendMessage"},
+				Resource:  queueArns,
+				Condition: map[string]map[string]string{
+					"ArnEquals":    {"aws:SourceArn": p.bucketArn()},
+					"StringEquals": {"aws:SourceAccount": accountID},
+				},
+			},
+		},
+	}
+}
+
+func consumeStatement(principalArn string, queueArns []string) policyStatement {
+	return policyStatement{
+		Sid:       "Consume",
+		Effect:    "Allow",
+		Principal: map[string]any{"AWS": principalArn},
+		Action: []string{
+			"sqs:ReceiveMessage",
+			"sqs:DeleteMessage",
+			"sqs:ChangeMessageVisibility",
+			"sqs:GetQueueAttributes",
+		},
+		Resource: queueArns,
+	}
+}
+
+// bucketPolicy restricts the client and the server to the prefixes they need:
+// The client writes requests to to_server/ and reads responses from to_client/,
+// the server does the inverse.
+// The client also removes both objects when it is done with a request.
+func (p *Provisioner) bucketPolicy(clientArn, serverArn string) policyDocument {
+	var (
+		toServerObjects = []string{p.bucketArn() + "/" + toServer + "/*"}
+		toClientObjects = []string{p.bucketArn() + "/" + toClient + "/*"}
+		allObjects      = []string{toServerObjects[0], toClientObjects[0]}
+	)
+
+	statement := func(sid, principalArn string, resources []string, actions ...string) policyStatement {
+		return policyStatement{
+			Sid:       sid,
+			Effect:    "Allow",
+			Principal: map[string]any{"AWS": principalArn},
+			Action:    actions,
+			Resource:  resources,
+		}
+	}
+
+	policy := policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			statement("ClientWriteRequests", clientArn, toServerObjects, "s3:PutObject", "s3:AbortMultipartUpload"),
+			statement("ClientReadResponses", clientArn, toClientObjects, "s3:GetObject"),
+			statement("ClientCleanup", clientArn, allObjects, "s3:DeleteObject"),
+			statement("ServerReadRequests", serverArn, toServerObjects, "s3:GetObject"),
+			statement("ServerWriteResponses", serverArn, toClientObjects, "s3:PutObject", "s3:AbortMultipartUpload"),
+		},
+	}
+
+	if p.opts.ArchiveExpirationDays > 0 {
+		policy.Statement = append(policy.Statement,
+			statement("ServerArchiveRequests", serverArn, []string{p.bucketArn() + "/" + archive + "/*"}, "s3:PutObject"),
+		)
+	}
+
+	if p.opts.QuarantineExpirationDays > 0 {
+		policy.Statement = append(policy.Statement,
+			statement("ServerQuarantineRequests", serverArn, []string{p.bucketArn() + "/" + quarantine + "/*"}, "s3:PutObject"),
+		)
+	}
+
+	if p.opts.AuditExpirationDays > 0 {
+		policy.Statement = append(policy.Statement,
+			statement("ServerWriteAudit", serverArn, []string{p.bucketArn() + "/" + audit + "/*"}, "s3:PutObject"),
+		)
+	}
+
+	if p.opts.Chunks {
+		chunkObjects := []string{p.bucketArn() + "/" + chunks + "/*"}
+		policy.Statement = append(policy.Statement,
+			statement("ServerWriteChunks", serverArn, chunkObjects, "s3:PutObject", "s3:AbortMultipartUpload"),
+			statement("ClientReadChunks", clientArn, chunkObjects, "s3:GetObject", "s3:DeleteObject"),
+		)
+	}
+
+	if p.opts.Checkpoints {
+		policy.Statement = append(policy.Statement,
+			statement("ServerCheckpoints", serverArn, []string{p.bucketArn() + "/" + checkpoints + "/*"}, "s3:PutObject", "s3:GetObject", "s3:DeleteObject", "s3:AbortMultipartUpload"),
+			// Without s3:ListBucket, S3 responds 403 instead of 404 when there is no checkpoint to load.
+			statement("ServerListBucket", serverArn, []string{p.bucketArn()}, "s3:ListBucket"),
+		)
+	}
+
+	if p.opts.ListPolling {
+		policy.Statement = append(policy.Statement,
+			statement("ServerClaimRequests", serverArn, []string{p.bucketArn() + "/" + claims + "/*"}, "s3:PutObject", "s3:GetObject", "s3:DeleteObject"),
+			statement("ServerListRequests", serverArn, []string{p.bucketArn()}, "s3:ListBucket"),
+		)
+	}
+
+	if p.opts.Chunks || p.opts.ListPolling {
+		// Without s3:ListBucket, S3 responds 403 instead of 404 to the client's checks
+		// for chunks not yet emitted and for responses not yet written.
+		policy.Statement = append(policy.Statement,
+			statement("ClientListBucket", clientArn, []string{p.bucketArn()}, "s3:ListBucket"),
+		)
+	}
+
+	if p.opts.Baselines {
+		baselineObjects := []string{p.bucketArn() + "/" + baselines + "/*"}
+		policy.Statement = append(policy.Statement,
+			statement("ClientWriteBaselines", clientArn, baselineObjects, "s3:PutObject", "s3:GetObject", "s3:AbortMultipartUpload"),
+			statement("ServerReadBaselines", serverArn, baselineObjects, "s3:GetObject"),
+		)
+	}
+
+	if p.opts.Dictionaries {
+		dictionaryObjects := []string{p.bucketArn() + "/" + dictionaries + "/*"}
+		policy.Statement = append(policy.Statement,
+			statement("ClientWriteDictionaries", clientArn, dictionaryObjects, "s3:PutObject", "s3:GetObject"),
+			statement("ServerReadDictionaries", serverArn, dictionaryObjects, "s3:GetObject"),
+		)
+	}
+
+	if p.opts.PublicKeys {
+		policy.Statement = append(policy.Statement,
+			statement("ServerReadPublicKeys", serverArn, []string{p.bucketArn() + "/" + publicKeys + "/*"}, "s3:GetObject"),
+		)
+	}
+
+	return policy
+}
+
+func (p *Provisioner) bucketArn() string {
+	return fmt.Sprintf("arn:aws:s3:::%s", p.bucketName())
+}
@@ -0,0 +1,162 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// ResponseQueues creates and deletes response queues dedicated to one client instance,
+// see ClientOptions.ResponseQueues. It is implemented by *Provisioner.
+type ResponseQueues interface {
+	// CreateResponseQueue creates a response queue for the client instance with the given id
+	// and returns its URL.
+	CreateResponseQueue(ctx context.Context, id string) (string, error)
+
+	// DeleteResponseQueue deletes the queue created by CreateResponseQueue.
+	DeleteResponseQueue(ctx context.Context, queueURL string) error
+}
+
+var _ ResponseQueues = (*Provisioner)(nil)
+
+// validResponseQueueID matches the ids allowed in CreateResponseQueue.
+var validResponseQueueID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,40}$`)
+
+// responseQueuePrefix returns the name prefix of the dedicated response queues.
+func (p *Provisioner) responseQueuePrefix() string {
+	return p.clientName() + "_rq_"
+}
+
+// CreateResponseQueue creates a response queue dedicated to one client instance,
+// named <client queue>_rq_<id>, that the client consumes and the server sends its
+// reply messages to. The id may hold up to 40 letters, digits, hyphens and underscores.
+//
+// S3 event notifications only go to the shared client queue, so clients
+// and servers using it need DirectSubmit.
+// Remove queues left behind by clients that did not delete theirs with CleanupResponseQueues.
+func (p *Provisioner) CreateResponseQueue(ctx context.Context, id string) (string, error) {
+	if !validResponseQueueID.MatchString(id) {
+		return "", fmt.Errorf("invalid response queue id %q", id)
+	}
+
+	var principalArns []string
+	for _, userName := range []string{p.clientName(), p.serverName()} {
+		u, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{UserName: aws.String(userName)})
+		if err != nil {
+			return "", fmt.Errorf("failed to get user: %w", err)
+		}
+		principalArns = append(principalArns, *u.User.Arn)
+	}
+	accountID := strings.Split(principalArns[0], ":")[4]
+
+	name := p.responseQueuePrefix() + id
+	b, err := json.Marshal(p.responseQueuePolicy(accountID, name, principalArns[0], principalArns[1]))
+	if err != nil {
+		return "", err
+	}
+	q, err := p.sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{
+		QueueName: aws.String(name),
+		Attributes: map[string]string{
+			"MessageRetentionPeriod":        "7200", // 2 hours
+			"ReceiveMessageWaitTimeSeconds": "10",   // 10 seconds
+			"Policy":                        string(b),
+		},
+		Tags: p.opts.Tags,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create response queue: %w", err)
+	}
+	return *q.QueueUrl, nil
+}
+
+// responseQueuePolicy allows the client user clientArn to consume from the response queue name
+// and the server user serverArn to send to it.
+func (p *Provisioner) responseQueuePolicy(accountID, name, clientArn, serverArn string) policyDocument {
+	queueArns := []string{p.queueArn(accountID, name)}
+	return policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			consumeStatement(clientArn, queueArns),
+			{
+				Sid:       "ServerReplies",
+				Effect:    "Allow",
+				Principal: map[string]any{"AWS": serverArn},
+				Action:    []string{"sqs:SendMessage"},
+				Resource:  queueArns,
+			},
+		},
+	}
+}
+
+// DeleteResponseQueue deletes a queue created with CreateResponseQueue.
+// A queue that does not exist is ignored.
+func (p *Provisioner) DeleteResponseQueue(ctx context.Context, queueURL string) error {
+	if !strings.Contains(queueURL, "/"+p.responseQueuePrefix()) {
+		return fmt.Errorf("%q is not a response queue", queueURL)
+	}
+	if _, err := p.sqsClient.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL)}); err != nil && !isNoSuchEntityErr(err) {
+		return fmt.Errorf("failed to delete response queue: %w", err)
+	}
+	return nil
+}
+
+// CleanupResponseQueues deletes the queues created with CreateResponseQueue more than maxAge ago,
+// e.g. those left behind by clients that crashed, and returns their URLs.
+// Use a maxAge well above the lifetime of a client instance.
+func (p *Provisioner) CleanupResponseQueues(ctx context.Context, maxAge time.Duration) ([]string, error) {
+	var (
+		deleted   []string
+		nextToken *string
+	)
+	for {
+		list, err := p.sqsClient.ListQueues(ctx, &sqs.ListQueuesInput{
+			QueueNamePrefix: aws.String(p.responseQueuePrefix()),
+			NextToken:       nextToken,
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list response queues: %w", err)
+		}
+		for _, queueURL := range list.QueueUrls {
+			attrs, err := p.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(queueURL),
+				AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameCreatedTimestamp},
+			})
+			if err != nil {
+				if isNoSuchEntityErr(err) {
+					continue
+				}
+				return deleted, fmt.Errorf("failed to get response queue attributes: %w", err)
+			}
+			if !responseQueueExpired(attrs.Attributes[string(sqstypes.QueueAttributeNameCreatedTimestamp)], maxAge, time.Now()) {
+				continue
+			}
+			if err := p.DeleteResponseQueue(ctx, queueURL); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, queueURL)
+		}
+		if list.NextToken == nil {
+			return deleted, nil
+		}
+		nextToken = list.NextToken
+	}
+}
+
+// responseQueueExpired reports whether a queue with the CreatedTimestamp attribute created,
+// in seconds since the epoch, is older than maxAge at now.
+func responseQueueExpired(created string, maxAge time.Duration, now time.Time) bool {
+	seconds, err := strconv.ParseInt(created, 10, 64)
+	if err != nil {
+		return false
+	}
+	return now.Sub(time.Unix(seconds, 0)) > maxAge
+}
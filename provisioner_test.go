@@ -0,0 +1,950 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestProvisionerLifecycleRules(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest", ExpirationDays: 3}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+
+	rules := p.lifecycleRules()
+	c.Assert(rules, qt.HasLen, 2)
+	for i, prefix := range []string{"to_server/", "to_client/"} {
+		c.Assert(rules[i].Filter.(*types.LifecycleRuleFilterMemberPrefix).Value, qt.Equals, prefix)
+		c.Assert(rules[i].Expiration.Days, qt.Equals, int32(3))
+		c.Assert(rules[i].AbortIncompleteMultipartUpload.DaysAfterInitiation, qt.Equals, int32(3))
+	}
+
+	opts = ProvisionerOptions{Name: "s3fptest"}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.ExpirationDays, qt.Equals, int32(1))
+	c.Assert(opts.Region, qt.Equals, defaultRegion)
+
+	opts = ProvisionerOptions{Name: "s3fptest", ExpirationDays: -1}
+	c.Assert(opts.init(), qt.IsNotNil)
+
+	opts = ProvisionerOptions{Name: "s3fptest", ArchiveExpirationDays: 30}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	rules = p.lifecycleRules()
+	c.Assert(rules, qt.HasLen, 3)
+	c.Assert(rules[2].Filter.(*types.LifecycleRuleFilterMemberPrefix).Value, qt.Equals, "archive/")
+	c.Assert(rules[2].Expiration.Days, qt.Equals, int32(30))
+	policy := p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Sid, qt.Equals, "ServerArchiveRequests")
+
+	opts = ProvisionerOptions{Name: "s3fptest", AuditExpirationDays: 365}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	rules = p.lifecycleRules()
+	c.Assert(rules, qt.HasLen, 3)
+	c.Assert(rules[2].Filter.(*types.LifecycleRuleFilterMemberPrefix).Value, qt.Equals, "audit/")
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Sid, qt.Equals, "ServerWriteAudit")
+
+	opts = ProvisionerOptions{Name: "s3fptest", Chunks: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	rules = p.lifecycleRules()
+	c.Assert(rules, qt.HasLen, 3)
+	c.Assert(rules[2].Filter.(*types.LifecycleRuleFilterMemberPrefix).Value, qt.Equals, "chunks/")
+	c.Assert(rules[2].Expiration.Days, qt.Equals, int32(1))
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-3].Sid, qt.Equals, "ServerWriteChunks")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Action, qt.DeepEquals, []string{"s3:ListBucket"})
+
+	opts = ProvisionerOptions{Name: "s3fptest", Checkpoints: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	rules = p.lifecycleRules()
+	c.Assert(rules, qt.HasLen, 3)
+	c.Assert(rules[2].Filter.(*types.LifecycleRuleFilterMemberPrefix).Value, qt.Equals, "checkpoints/")
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-2].Sid, qt.Equals, "ServerCheckpoints")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Sid, qt.Equals, "ServerListBucket")
+
+	opts = ProvisionerOptions{Name: "s3fptest", ExpirationDays: 2, ListPolling: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	rules = p.lifecycleRules()
+	c.Assert(rules, qt.HasLen, 3)
+	c.Assert(rules[2].Filter.(*types.LifecycleRuleFilterMemberPrefix).Value, qt.Equals, "claims/")
+	c.Assert(rules[2].Expiration.Days, qt.Equals, int32(3))
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-3].Sid, qt.Equals, "ServerClaimRequests")
+	c.Assert(policy.Statement[len(policy.Statement)-3].Resource, qt.DeepEquals, []string{"arn:aws:s3:::s3fptest/claims/*"})
+	c.Assert(policy.Statement[len(policy.Statement)-2].Sid, qt.Equals, "ServerListRequests")
+	clientList := policy.Statement[len(policy.Statement)-1]
+	c.Assert(clientList.Sid, qt.Equals, "ClientListBucket")
+	c.Assert(clientList.Principal["AWS"], qt.Equals, "arn:client")
+	c.Assert(clientList.Action, qt.DeepEquals, []string{"s3:ListBucket"})
+	c.Assert(clientList.Resource, qt.DeepEquals, []string{"arn:aws:s3:::s3fptest"})
+
+	opts = ProvisionerOptions{Name: "s3fptest", Chunks: true, ListPolling: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	sids := make(map[string]bool)
+	for _, s := range p.bucketPolicy("arn:client", "arn:server").Statement {
+		c.Assert(sids[s.Sid], qt.IsFalse, qt.Commentf("duplicate Sid %q", s.Sid))
+		sids[s.Sid] = true
+	}
+	c.Assert(sids["ClientListBucket"], qt.IsTrue)
+
+	opts = ProvisionerOptions{Name: "s3fptest", Baselines: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	c.Assert(p.lifecycleRules(), qt.HasLen, 2)
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-2].Sid, qt.Equals, "ClientWriteBaselines")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Action, qt.DeepEquals, []string{"s3:GetObject"})
+
+	opts = ProvisionerOptions{Name: "s3fptest", Dictionaries: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-2].Sid, qt.Equals, "ClientWriteDictionaries")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Sid, qt.Equals, "ServerReadDictionaries")
+
+	opts = ProvisionerOptions{Name: "s3fptest", PublicKeys: true}
+	c.Assert(opts.init(), qt.IsNil)
+	p = &Provisioner{opts: opts}
+	policy = p.bucketPolicy("arn:client", "arn:server")
+	c.Assert(policy.Statement[len(policy.Statement)-1].Sid, qt.Equals, "ServerReadPublicKeys")
+}
+
+func TestProvisionerOpQueues(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest", Ops: []string{"resize", "convert"}}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+
+	c.Assert(p.queueNames(), qt.DeepEquals, []string{"s3fptest_client", "s3fptest_server_convert", "s3fptest_server_resize"})
+
+	configs := p.queueConfigurations("1234")
+	c.Assert(configs, qt.HasLen, 3)
+	c.Assert(*configs[1].Filter.Key.FilterRules[0].Value, qt.Equals, "to_server/resize/")
+	c.Assert(*configs[1].QueueArn, qt.Equals, "arn:aws:sqs:eu-north-1:1234:s3fptest_server_resize")
+
+	opts = ProvisionerOptions{Name: "s3fptest", Ops: []string{"to/server"}}
+	c.Assert(opts.init(), qt.ErrorMatches, `invalid op "to/server".*`)
+}
+
+func TestProvisionerOldKeys(t *testing.T) {
+	c := qt.New(t)
+
+	key := func(id string, created time.Time) iamtypes.AccessKeyMetadata {
+		return iamtypes.AccessKeyMetadata{AccessKeyId: aws.String(id), CreateDate: aws.Time(created)}
+	}
+
+	now := time.Now()
+	c.Assert(oldKeys(nil), qt.HasLen, 0)
+	c.Assert(oldKeys([]iamtypes.AccessKeyMetadata{key("a", now)}), qt.HasLen, 0)
+
+	old := oldKeys([]iamtypes.AccessKeyMetadata{key("new", now), key("old", now.Add(-time.Hour))})
+	c.Assert(old, qt.HasLen, 1)
+	c.Assert(*old[0].AccessKeyId, qt.Equals, "old")
+
+	inactive := key("newest", now.Add(time.Hour))
+	inactive.Status = iamtypes.StatusTypeInactive
+	active := func(id string, created time.Time) iamtypes.AccessKeyMetadata {
+		k := key(id, created)
+		k.Status = iamtypes.StatusTypeActive
+		return k
+	}
+	_, ok := newestActiveKey([]iamtypes.AccessKeyMetadata{inactive})
+	c.Assert(ok, qt.IsFalse)
+	newest, ok := newestActiveKey([]iamtypes.AccessKeyMetadata{active("old", now.Add(-time.Hour)), inactive, active("new", now)})
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(*newest.AccessKeyId, qt.Equals, "new")
+}
+
+func TestProvisionerPolicies(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest"}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+
+	b, err := json.Marshal(p.bucketPolicy("arn:client", "arn:server"))
+	c.Assert(err, qt.IsNil)
+	s := string(b)
+	// No wildcard actions.
+	c.Assert(s, qt.Not(qt.Matches), `.*"s3:[A-Za-z]*\*".*`)
+	c.Assert(s, qt.Contains, `{"Sid":"ClientWriteRequests","Effect":"Allow","Principal":{"AWS":"arn:client"},"Action":["s3:PutObject","s3:AbortMultipartUpload"],"Resource":["arn:aws:s3:::s3fptest/to_server/*"]}`)
+	c.Assert(s, qt.Contains, `{"Sid":"ServerWriteResponses","Effect":"Allow","Principal":{"AWS":"arn:server"},"Action":["s3:PutObject","s3:AbortMultipartUpload"],"Resource":["arn:aws:s3:::s3fptest/to_client/*"]}`)
+
+	qp := p.queuePolicy("1234", "s3fptest_client", "arn:client", "arn:server")
+	c.Assert(qp.Statement, qt.HasLen, 2)
+	c.Assert(qp.Statement[0].Resource, qt.DeepEquals, []string{"arn:aws:sqs:eu-north-1:1234:s3fptest_client"})
+	c.Assert(qp.Statement[1].Condition["ArnEquals"]["aws:SourceArn"], qt.Equals, "arn:aws:s3:::s3fptest")
+
+	p.opts.DirectSubmit = true
+	qp = p.queuePolicyFor("1234", "s3fptest_server", []string{"arn:client", "arn:server"})
+	c.Assert(qp.Statement, qt.HasLen, 2)
+	c.Assert(qp.Statement[0].Principal["AWS"], qt.Equals, "arn:server")
+	c.Assert(qp.Statement[1].Sid, qt.Equals, "DirectSubmit")
+	c.Assert(qp.Statement[1].Principal["AWS"], qt.Equals, "arn:client")
+	c.Assert(qp.Statement[1].Action, qt.DeepEquals, []string{"sqs:SendMessage"})
+	for _, r := range p.resources() {
+		c.Assert(r.kind, qt.Not(qt.Equals), "bucket notifications")
+	}
+
+	p.opts.HandlerRequeue = true
+	qp = p.queuePolicyFor("1234", "s3fptest_server", []string{"arn:client", "arn:server"})
+	c.Assert(qp.Statement, qt.HasLen, 3)
+	c.Assert(qp.Statement[2].Sid, qt.Equals, "ServerRequeue")
+	c.Assert(qp.Statement[2].Principal["AWS"], qt.Equals, "arn:server")
+	c.Assert(qp.Statement[2].Resource, qt.DeepEquals, []string{"arn:aws:sqs:eu-north-1:1234:s3fptest_server"})
+	c.Assert(p.queuePolicyFor("1234", "s3fptest_client", []string{"arn:client", "arn:server"}).Statement, qt.HasLen, 2)
+	c.Assert(p.queuePolicyFor("1234", deadLetterQueueName("s3fptest_server"), []string{"arn:client", "arn:server"}).Statement, qt.HasLen, 1)
+}
+
+func TestProvisionResultsOutput(t *testing.T) {
+	c := qt.New(t)
+
+	res := ProvisionResults{
+		Bucket: "s3fptest",
+		Region: "eu-north-1",
+		Client: ProvisionedPrincipal{UserName: "s3fptest_client", AccessKeyID: "ckey", SecretAccessKey: "csecret", QueueURL: "https://cqueue"},
+		Server: ProvisionedPrincipal{UserName: "s3fptest_server", AccessKeyID: "skey", OpQueueURLs: map[string]string{"re-size": "https://squeue"}},
+	}
+
+	var buf bytes.Buffer
+	c.Assert(res.WriteDotenv(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `S3RPC_BUCKET=s3fptest
+S3RPC_REGION=eu-north-1
+S3RPC_CLIENT_QUEUE=https://cqueue
+S3RPC_CLIENT_ACCESS_KEY_ID=ckey
+S3RPC_CLIENT_SECRET_ACCESS_KEY=csecret
+S3RPC_SERVER_ACCESS_KEY_ID=skey
+S3RPC_SERVER_QUEUE_RE_SIZE=https://squeue
+`)
+
+	buf.Reset()
+	c.Assert(res.WriteTerraform(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, `  s3rpc_client_secret_access_key = sensitive("csecret")`)
+	c.Assert(buf.String(), qt.Contains, `  s3rpc_bucket = "s3fptest"`)
+
+	buf.Reset()
+	c.Assert(res.WriteCloudFormation(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `{
+  "Parameters": {
+    "S3rpcBucket": {
+      "Type": "String",
+      "Default": "s3fptest"
+    },
+    "S3rpcClientAccessKeyId": {
+      "Type": "String",
+      "Default": "ckey"
+    },
+    "S3rpcClientQueue": {
+      "Type": "String",
+      "Default": "https://cqueue"
+    },
+    "S3rpcClientSecretAccessKey": {
+      "Type": "String",
+      "Default": "csecret",
+      "NoEcho": true
+    },
+    "S3rpcRegion": {
+      "Type": "String",
+      "Default": "eu-north-1"
+    },
+    "S3rpcServerAccessKeyId": {
+      "Type": "String",
+      "Default": "skey"
+    },
+    "S3rpcServerQueueReSize": {
+      "Type": "String",
+      "Default": "https://squeue"
+    }
+  }
+}
+`)
+
+	res.Server.SecretUnavailable = true
+	buf.Reset()
+	c.Assert(res.WriteDotenv(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, "\n# S3RPC_SERVER_SECRET_ACCESS_KEY is not available for the existing access key skey, create a new one with Provisioner.RotateKeys\n")
+
+	buf.Reset()
+	c.Assert(res.WriteCloudFormation(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, `"S3rpcNotes": [
+      "S3RPC_SERVER_SECRET_ACCESS_KEY is not available for the existing access key skey, create a new one with Provisioner.RotateKeys"
+    ]`)
+
+	buf.Reset()
+	c.Assert(res.WriteJSON(&buf), qt.IsNil)
+	var res2 ProvisionResults
+	c.Assert(json.Unmarshal(buf.Bytes(), &res2), qt.IsNil)
+	c.Assert(res2, qt.DeepEquals, res)
+}
+
+func TestProvisionerAlarms(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest", MaxReceiveCount: 5, Alarms: &AlarmOptions{TopicArn: "arn:topic"}}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+
+	c.Assert(p.queueNames(), qt.DeepEquals, []string{"s3fptest_client", "s3fptest_server", "s3fptest_server_dlq"})
+	c.Assert(p.alarmNames(), qt.DeepEquals, []string{"s3fptest_client-oldest-message", "s3fptest_server-oldest-message", "s3fptest_server_dlq-messages"})
+	c.Assert(p.alarms()[0].threshold, qt.Equals, float64(300))
+
+	opts = ProvisionerOptions{Name: "s3fptest", Alarms: &AlarmOptions{}}
+	c.Assert(opts.init(), qt.ErrorMatches, "alarms: topic ARN is required")
+}
+
+func TestProvisionerPlan(t *testing.T) {
+	c := qt.New(t)
+
+	changes := func(cs []ProvisionChange) []string {
+		var s []string
+		for _, c := range cs {
+			s = append(s, fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name))
+		}
+		return s
+	}
+
+	for _, test := range []struct {
+		name         string
+		directSubmit bool
+		existing     []string
+		create       []string
+		destroy      []string
+	}{
+		{
+			name: "Absent",
+			create: []string{
+				"create user s3fptest_client",
+				"create access key s3fptest_client",
+				"create user s3fptest_server",
+				"create access key s3fptest_server",
+				"create queue s3fptest_client",
+				"create queue policy s3fptest_client",
+				"create queue s3fptest_server",
+				"create queue policy s3fptest_server",
+				"create bucket s3fptest",
+				"create bucket lifecycle s3fptest",
+				"create bucket policy s3fptest",
+				"create public access block s3fptest",
+				"create bucket notifications s3fptest",
+			},
+			destroy: []string{
+				"none user s3fptest_client",
+				"none access key s3fptest_client",
+				"none user s3fptest_server",
+				"none access key s3fptest_server",
+				"none queue s3fptest_client",
+				"none queue policy s3fptest_client",
+				"none queue s3fptest_server",
+				"none queue policy s3fptest_server",
+				"none bucket s3fptest",
+				"none bucket lifecycle s3fptest",
+				"none bucket policy s3fptest",
+				"none public access block s3fptest",
+				"none bucket notifications s3fptest",
+			},
+		},
+		{
+			name:     "Partial",
+			existing: []string{"user/s3fptest_client", "user/s3fptest_server", "access key/s3fptest_server", "queue/s3fptest_server"},
+			create: []string{
+				"none user s3fptest_client",
+				"create access key s3fptest_client",
+				"none user s3fptest_server",
+				"none access key s3fptest_server",
+				"create queue s3fptest_client",
+				"create queue policy s3fptest_client",
+				"update queue s3fptest_server",
+				"update queue policy s3fptest_server",
+				"create bucket s3fptest",
+				"create bucket lifecycle s3fptest",
+				"create bucket policy s3fptest",
+				"create public access block s3fptest",
+				"create bucket notifications s3fptest",
+			},
+			destroy: []string{
+				"delete user s3fptest_client",
+				"none access key s3fptest_client",
+				"delete user s3fptest_server",
+				"delete access key s3fptest_server",
+				"none queue s3fptest_client",
+				"none queue policy s3fptest_client",
+				"delete queue s3fptest_server",
+				"delete queue policy s3fptest_server",
+				"none bucket s3fptest",
+				"none bucket lifecycle s3fptest",
+				"none bucket policy s3fptest",
+				"none public access block s3fptest",
+				"none bucket notifications s3fptest",
+			},
+		},
+		{
+			name:         "Existing with direct submit",
+			directSubmit: true,
+			existing: []string{
+				"user/s3fptest_client", "access key/s3fptest_client", "user/s3fptest_server", "access key/s3fptest_server",
+				"queue/s3fptest_client", "queue/s3fptest_server", "bucket/s3fptest",
+			},
+			create: []string{
+				"none user s3fptest_client",
+				"none access key s3fptest_client",
+				"none user s3fptest_server",
+				"none access key s3fptest_server",
+				"update queue s3fptest_client",
+				"update queue policy s3fptest_client",
+				"update queue s3fptest_server",
+				"update queue policy s3fptest_server",
+				"none bucket s3fptest",
+				"update bucket lifecycle s3fptest",
+				"update bucket policy s3fptest",
+				"update public access block s3fptest",
+			},
+			destroy: []string{
+				"delete user s3fptest_client",
+				"delete access key s3fptest_client",
+				"delete user s3fptest_server",
+				"delete access key s3fptest_server",
+				"delete queue s3fptest_client",
+				"delete queue policy s3fptest_client",
+				"delete queue s3fptest_server",
+				"delete queue policy s3fptest_server",
+				"delete bucket s3fptest",
+				"delete bucket lifecycle s3fptest",
+				"delete bucket policy s3fptest",
+				"delete public access block s3fptest",
+			},
+		},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			opts := ProvisionerOptions{Name: "s3fptest", DirectSubmit: test.directSubmit}
+			c.Assert(opts.init(), qt.IsNil)
+			fake := newFakeProvisionerAWS(test.existing...)
+			p := &Provisioner{opts: opts, cwClient: fake, iamClient: fake, s3Client: fake, sqsClient: fake}
+
+			plan, err := p.Plan(context.Background())
+			c.Assert(err, qt.IsNil)
+			c.Assert(changes(plan.Create), qt.DeepEquals, test.create)
+			c.Assert(changes(plan.Destroy), qt.DeepEquals, test.destroy)
+		})
+	}
+
+	c.Run("Unchanged", func(c *qt.C) {
+		ctx := context.Background()
+		opts := ProvisionerOptions{Name: "s3fptest", MaxReceiveCount: 5, Alarms: &AlarmOptions{TopicArn: "arn:topic"}}
+		c.Assert(opts.init(), qt.IsNil)
+		fake := newFakeProvisionerAWS("user/s3fptest_client", "access key/s3fptest_client", "user/s3fptest_server", "access key/s3fptest_server")
+		p := &Provisioner{opts: opts, cwClient: fake, iamClient: fake, s3Client: fake, sqsClient: fake}
+
+		_, err := p.Create(ctx)
+		c.Assert(err, qt.IsNil)
+		plan, err := p.Plan(ctx)
+		c.Assert(err, qt.IsNil)
+		c.Assert(plan.Create, qt.HasLen, 18)
+		for _, change := range plan.Create {
+			c.Assert(change.Action, qt.Equals, ProvisionActionNone, qt.Commentf("%s", change))
+		}
+
+		// SQS returns the redrive policy with a numeric maxReceiveCount.
+		fake.queueAttributes["s3fptest_server"]["RedrivePolicy"] = `{"deadLetterTargetArn":"arn:aws:sqs:eu-north-1:1234:s3fptest_server_dlq","maxReceiveCount":5}`
+		plan, err = p.Plan(ctx)
+		c.Assert(err, qt.IsNil)
+		c.Assert(plan.Create[6], qt.Equals, ProvisionChange{Action: ProvisionActionNone, Kind: "queue", Name: "s3fptest_server"})
+
+		// Drift.
+		delete(fake.queueAttributes["s3fptest_server"], "RedrivePolicy")
+		fake.bucketPolicy = strings.Replace(fake.bucketPolicy, "ClientCleanup", "ClientCleanupAltered", 1)
+		fake.alarms["s3fptest_client-oldest-message"].Threshold = aws.Float64(60)
+		plan, err = p.Plan(ctx)
+		c.Assert(err, qt.IsNil)
+		var updated []string
+		for _, change := range plan.Create {
+			if change.Action != ProvisionActionNone {
+				updated = append(updated, fmt.Sprintf("%s %s %s", change.Action, change.Kind, change.Name))
+			}
+		}
+		c.Assert(updated, qt.DeepEquals, []string{
+			"update queue s3fptest_server",
+			"update bucket policy s3fptest",
+			"update alarm s3fptest_client-oldest-message",
+		})
+	})
+
+	opts := ProvisionerOptions{Name: "s3fptest"}
+	c.Assert(opts.init(), qt.IsNil)
+	fake := newFakeProvisionerAWS()
+	fake.err = &smithy.GenericAPIError{Code: "AccessDenied"}
+	p := &Provisioner{opts: opts, cwClient: fake, iamClient: fake, s3Client: fake, sqsClient: fake}
+	_, err := p.Plan(context.Background())
+	c.Assert(err, qt.ErrorMatches, `failed to look up user "s3fptest_client": .*AccessDenied.*`)
+}
+
+// fakeProvisionerAWS fakes the AWS APIs used by Provisioner.Create and Provisioner.Plan
+// for an account with the ID 1234.
+// The resources in existing, keyed by <kind>/<name>, exist.
+type fakeProvisionerAWS struct {
+	provisionerCloudWatch
+	provisionerIAM
+	provisionerS3
+	provisionerSQS
+
+	existing map[string]bool
+
+	// accessKeys holds the access keys created, by user name.
+	accessKeys map[string][]iamtypes.AccessKeyMetadata
+
+	queueAttributes   map[string]map[string]string
+	bucketPolicy      string
+	lifecycle         []types.LifecycleRule
+	publicAccessBlock *types.PublicAccessBlockConfiguration
+	notifications     []types.QueueConfiguration
+	alarms            map[string]*cwtypes.MetricAlarm
+
+	// err, if set, is returned from all calls.
+	err error
+
+	// errs holds errors to return from calls for a resource, keyed by <method>/<name>.
+	errs map[string]error
+}
+
+func newFakeProvisionerAWS(existing ...string) *fakeProvisionerAWS {
+	f := &fakeProvisionerAWS{
+		existing:        make(map[string]bool),
+		accessKeys:      make(map[string][]iamtypes.AccessKeyMetadata),
+		errs:            make(map[string]error),
+		queueAttributes: make(map[string]map[string]string),
+		alarms:          make(map[string]*cwtypes.MetricAlarm),
+	}
+	for _, r := range existing {
+		f.existing[r] = true
+	}
+	return f
+}
+
+func (f *fakeProvisionerAWS) GetUser(ctx context.Context, params *iam.GetUserInput, optFns ...func(*iam.Options)) (*iam.GetUserOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if params.UserName == nil {
+		return &iam.GetUserOutput{User: &iamtypes.User{UserName: aws.String("admin"), Arn: aws.String("arn:aws:iam::1234:user/admin")}}, nil
+	}
+	if !f.existing["user/"+*params.UserName] {
+		return nil, &iamtypes.NoSuchEntityException{}
+	}
+	return &iam.GetUserOutput{User: &iamtypes.User{UserName: params.UserName, Arn: aws.String("arn:aws:iam::1234:user/" + *params.UserName)}}, nil
+}
+
+func (f *fakeProvisionerAWS) ListAccessKeys(ctx context.Context, params *iam.ListAccessKeysInput, optFns ...func(*iam.Options)) (*iam.ListAccessKeysOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if !f.existing["user/"+*params.UserName] {
+		return nil, &iamtypes.NoSuchEntityException{}
+	}
+	var out iam.ListAccessKeysOutput
+	if f.existing["access key/"+*params.UserName] {
+		out.AccessKeyMetadata = []iamtypes.AccessKeyMetadata{{UserName: params.UserName, AccessKeyId: aws.String("AKIA"), Status: iamtypes.StatusTypeActive, CreateDate: aws.Time(time.Now().Add(-time.Hour))}}
+	}
+	out.AccessKeyMetadata = append(out.AccessKeyMetadata, f.accessKeys[*params.UserName]...)
+	return &out, nil
+}
+
+func (f *fakeProvisionerAWS) DeleteAccessKey(ctx context.Context, params *iam.DeleteAccessKeyInput, optFns ...func(*iam.Options)) (*iam.DeleteAccessKeyOutput, error) {
+	if *params.AccessKeyId == "AKIA" {
+		delete(f.existing, "access key/"+*params.UserName)
+		return &iam.DeleteAccessKeyOutput{}, nil
+	}
+	keys := f.accessKeys[*params.UserName]
+	for i, k := range keys {
+		if *k.AccessKeyId == *params.AccessKeyId {
+			f.accessKeys[*params.UserName] = append(keys[:i:i], keys[i+1:]...)
+			return &iam.DeleteAccessKeyOutput{}, nil
+		}
+	}
+	return nil, &iamtypes.NoSuchEntityException{}
+}
+
+func (f *fakeProvisionerAWS) CreateAccessKey(ctx context.Context, params *iam.CreateAccessKeyInput, optFns ...func(*iam.Options)) (*iam.CreateAccessKeyOutput, error) {
+	if err := f.errs["CreateAccessKey/"+*params.UserName]; err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("AKIA%s%d", *params.UserName, len(f.accessKeys[*params.UserName]))
+	f.accessKeys[*params.UserName] = append(f.accessKeys[*params.UserName], iamtypes.AccessKeyMetadata{
+		UserName: params.UserName, AccessKeyId: aws.String(id), Status: iamtypes.StatusTypeActive, CreateDate: aws.Time(time.Now()),
+	})
+	return &iam.CreateAccessKeyOutput{AccessKey: &iamtypes.AccessKey{UserName: params.UserName, AccessKeyId: aws.String(id), SecretAccessKey: aws.String("secret")}}, nil
+}
+
+func (f *fakeProvisionerAWS) CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	name := *params.QueueName
+	if f.existing["queue/"+name] {
+		for k, v := range params.Attributes {
+			if f.queueAttributes[name][k] != v {
+				return nil, &smithy.GenericAPIError{Code: "QueueAlreadyExists"}
+			}
+		}
+	}
+	f.existing["queue/"+name] = true
+	if f.queueAttributes[name] == nil {
+		f.queueAttributes[name] = make(map[string]string)
+	}
+	for k, v := range params.Attributes {
+		f.queueAttributes[name][k] = v
+	}
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String("https://sqs.eu-north-1.amazonaws.com/1234/" + name)}, nil
+}
+
+func (f *fakeProvisionerAWS) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if !f.existing["queue/"+*params.QueueName] {
+		return nil, &sqstypes.QueueDoesNotExist{}
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.eu-north-1.amazonaws.com/1234/" + *params.QueueName)}, nil
+}
+
+func (f *fakeProvisionerAWS) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	name := (*params.QueueUrl)[strings.LastIndex(*params.QueueUrl, "/")+1:]
+	attrs := make(map[string]string)
+	for k, v := range f.queueAttributes[name] {
+		attrs[k] = v
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: attrs}, nil
+}
+
+func (f *fakeProvisionerAWS) SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+	name := (*params.QueueUrl)[strings.LastIndex(*params.QueueUrl, "/")+1:]
+	for k, v := range params.Attributes {
+		if v == "" {
+			delete(f.queueAttributes[name], k)
+			continue
+		}
+		f.queueAttributes[name][k] = v
+	}
+	return &sqs.SetQueueAttributesOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	if f.existing["bucket/"+*params.Bucket] {
+		return nil, &types.BucketAlreadyOwnedByYou{}
+	}
+	f.existing["bucket/"+*params.Bucket] = true
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if !f.existing["bucket/"+*params.Bucket] {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	f.lifecycle = params.LifecycleConfiguration.Rules
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) GetBucketLifecycleConfiguration(ctx context.Context, params *s3.GetBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if f.lifecycle == nil {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchLifecycleConfiguration"}
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: f.lifecycle}, nil
+}
+
+func (f *fakeProvisionerAWS) PutBucketPolicy(ctx context.Context, params *s3.PutBucketPolicyInput, optFns ...func(*s3.Options)) (*s3.PutBucketPolicyOutput, error) {
+	f.bucketPolicy = *params.Policy
+	return &s3.PutBucketPolicyOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) GetBucketPolicy(ctx context.Context, params *s3.GetBucketPolicyInput, optFns ...func(*s3.Options)) (*s3.GetBucketPolicyOutput, error) {
+	if f.bucketPolicy == "" {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchBucketPolicy"}
+	}
+	return &s3.GetBucketPolicyOutput{Policy: aws.String(f.bucketPolicy)}, nil
+}
+
+func (f *fakeProvisionerAWS) PutPublicAccessBlock(ctx context.Context, params *s3.PutPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.PutPublicAccessBlockOutput, error) {
+	f.publicAccessBlock = params.PublicAccessBlockConfiguration
+	return &s3.PutPublicAccessBlockOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) GetPublicAccessBlock(ctx context.Context, params *s3.GetPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.GetPublicAccessBlockOutput, error) {
+	if f.publicAccessBlock == nil {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchPublicAccessBlockConfiguration"}
+	}
+	return &s3.GetPublicAccessBlockOutput{PublicAccessBlockConfiguration: f.publicAccessBlock}, nil
+}
+
+func (f *fakeProvisionerAWS) PutBucketNotificationConfiguration(ctx context.Context, params *s3.PutBucketNotificationConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketNotificationConfigurationOutput, error) {
+	f.notifications = params.NotificationConfiguration.QueueConfigurations
+	return &s3.PutBucketNotificationConfigurationOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) GetBucketNotificationConfiguration(ctx context.Context, params *s3.GetBucketNotificationConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketNotificationConfigurationOutput, error) {
+	return &s3.GetBucketNotificationConfigurationOutput{QueueConfigurations: f.notifications}, nil
+}
+
+func (f *fakeProvisionerAWS) PutMetricAlarm(ctx context.Context, params *cloudwatch.PutMetricAlarmInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricAlarmOutput, error) {
+	f.existing["alarm/"+*params.AlarmName] = true
+	f.alarms[*params.AlarmName] = &cwtypes.MetricAlarm{
+		AlarmName:          params.AlarmName,
+		AlarmDescription:   params.AlarmDescription,
+		AlarmActions:       params.AlarmActions,
+		Namespace:          params.Namespace,
+		MetricName:         params.MetricName,
+		Dimensions:         params.Dimensions,
+		Statistic:          params.Statistic,
+		Period:             params.Period,
+		EvaluationPeriods:  params.EvaluationPeriods,
+		Threshold:          params.Threshold,
+		ComparisonOperator: params.ComparisonOperator,
+		TreatMissingData:   params.TreatMissingData,
+	}
+	return &cloudwatch.PutMetricAlarmOutput{}, nil
+}
+
+func (f *fakeProvisionerAWS) DescribeAlarms(ctx context.Context, params *cloudwatch.DescribeAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var out cloudwatch.DescribeAlarmsOutput
+	for _, name := range params.AlarmNames {
+		if !f.existing["alarm/"+name] {
+			continue
+		}
+		alarm := cwtypes.MetricAlarm{AlarmName: aws.String(name)}
+		if a, ok := f.alarms[name]; ok {
+			alarm = *a
+		}
+		out.MetricAlarms = append(out.MetricAlarms, alarm)
+	}
+	return &out, nil
+}
+
+func TestProvisionerRotateKeys(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	opts := ProvisionerOptions{Name: "s3fptest"}
+	c.Assert(opts.init(), qt.IsNil)
+	fake := newFakeProvisionerAWS("user/s3fptest_client", "access key/s3fptest_client", "user/s3fptest_server", "access key/s3fptest_server")
+	p := &Provisioner{opts: opts, cwClient: fake, iamClient: fake, s3Client: fake, sqsClient: fake}
+
+	// Fails midway: The old keys are kept and the key created is returned.
+	fake.errs["CreateAccessKey/s3fptest_server"] = &smithy.GenericAPIError{Code: "ServiceFailure"}
+	res, err := p.RotateKeys(ctx)
+	c.Assert(err, qt.ErrorMatches, `failed to create access key for user "s3fptest_server": .*ServiceFailure.*`)
+	c.Assert(res.Client.AccessKeyID, qt.Equals, "AKIAs3fptest_client0")
+	c.Assert(res.Client.SecretAccessKey, qt.Equals, "secret")
+	c.Assert(res.Server.AccessKeyID, qt.Equals, "")
+	c.Assert(fake.existing["access key/s3fptest_server"], qt.IsTrue)
+
+	// The client has no room for another key.
+	delete(fake.errs, "CreateAccessKey/s3fptest_server")
+	_, err = p.RotateKeys(ctx)
+	c.Assert(err, qt.ErrorMatches, `user "s3fptest_client" already has two access keys, run DeleteOldKeys first`)
+	c.Assert(fake.accessKeys["s3fptest_server"], qt.HasLen, 0)
+
+	c.Assert(p.DeleteOldKeys(ctx), qt.IsNil)
+	c.Assert(fake.existing["access key/s3fptest_client"], qt.IsFalse)
+	c.Assert(fake.existing["access key/s3fptest_server"], qt.IsTrue)
+	res, err = p.RotateKeys(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(res.Client.AccessKeyID, qt.Equals, "AKIAs3fptest_client1")
+	c.Assert(res.Server.AccessKeyID, qt.Equals, "AKIAs3fptest_server0")
+}
+
+func TestProvisionerCreateQueues(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	fake := newFakeProvisionerAWS("user/s3fptest_client", "access key/s3fptest_client", "user/s3fptest_server", "access key/s3fptest_server")
+	create := func(maxReceiveCount int) {
+		opts := ProvisionerOptions{Name: "s3fptest", MaxReceiveCount: maxReceiveCount}
+		c.Assert(opts.init(), qt.IsNil)
+		p := &Provisioner{opts: opts, cwClient: fake, iamClient: fake, s3Client: fake, sqsClient: fake}
+		_, err := p.Create(ctx)
+		c.Assert(err, qt.IsNil)
+	}
+
+	create(5)
+	c.Assert(fake.queueAttributes["s3fptest_server"]["RedrivePolicy"], qt.Equals, `{"deadLetterTargetArn":"arn:aws:sqs:eu-north-1:1234:s3fptest_server_dlq","maxReceiveCount":"5"}`)
+	c.Assert(fake.queueAttributes["s3fptest_client"]["RedrivePolicy"], qt.Equals, "")
+
+	// MaxReceiveCount unset.
+	create(0)
+	_, found := fake.queueAttributes["s3fptest_server"]["RedrivePolicy"]
+	c.Assert(found, qt.IsFalse)
+	c.Assert(fake.queueAttributes["s3fptest_server"]["MessageRetentionPeriod"], qt.Equals, "7200")
+	c.Assert(fake.queueAttributes["s3fptest_server"]["Policy"], qt.Not(qt.Equals), "")
+}
+
+func TestProvisionerNameTemplate(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{
+		Name:         "acme",
+		NameTemplate: "{{ .Name }}-s3rpc{{ with .Role }}-{{ . }}{{ end }}{{ with .Op }}-{{ . }}{{ end }}",
+		Ops:          []string{"resize"},
+	}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+
+	c.Assert(p.bucketName(), qt.Equals, "acme-s3rpc")
+	c.Assert(p.clientName(), qt.Equals, "acme-s3rpc-client")
+	c.Assert(p.queueNames(), qt.DeepEquals, []string{"acme-s3rpc-client", "acme-s3rpc-server-resize"})
+
+	opts = ProvisionerOptions{Name: "acme", NameTemplate: "{{ .Name }}"}
+	c.Assert(opts.init(), qt.ErrorMatches, `name template produces the name "acme" more than once`)
+
+	opts = ProvisionerOptions{Name: "acme", NameTemplate: "{{ .Name }}{{ .Role }}:"}
+	c.Assert(opts.init(), qt.ErrorMatches, `invalid name "acmeclient:".*`)
+}
+
+func TestEqualPolicy(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest"}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+	policy := p.queuePolicyFor("1234", "s3fptest_client", []string{"arn:client", "arn:server"})
+
+	b, err := json.MarshalIndent(policy, "", "    ")
+	c.Assert(err, qt.IsNil)
+	ok, err := equalPolicy(string(b), policy)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+
+	ok, err = equalPolicy(string(b), p.queuePolicyFor("1234", "s3fptest_server", []string{"arn:client", "arn:server"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+
+	// As returned by SQS: Single element lists collapsed, statements and actions reordered.
+	collapsed := `{
+  "Version": "2012-10-17",
+  "Id": "arn:aws:sqs:eu-north-1:1234:s3fptest_client/SQSDefaultPolicy",
+  "Statement": [
+    {
+      "Sid": "BucketNotifications",
+      "Effect": "Allow",
+      "Principal": {"Service": "s3.amazonaws.com"},
+      "Action": "sqs:SendMessage",
+      "Resource": "arn:aws:sqs:eu-north-1:1234:s3fptest_client",
+      "Condition": {
+        "StringEquals": {"aws:SourceAccount": "1234"},
+        "ArnEquals": {"aws:SourceArn": "arn:aws:s3:::s3fptest"}
+      }
+    },
+    {
+      "Sid": "Consume",
+      "Effect": "Allow",
+      "Principal": {"AWS": "arn:client"},
+      "Action": ["sqs:GetQueueAttributes", "sqs:ChangeMessageVisibility", "sqs:DeleteMessage", "sqs:ReceiveMessage"],
+      "Resource": "arn:aws:sqs:eu-north-1:1234:s3fptest_client"
+    }
+  ]
+}`
+	ok, err = equalPolicy(collapsed, policy)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+
+	ok, err = equalPolicy(strings.Replace(collapsed, `"arn:client"`, `"arn:other"`, 1), policy)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestProvisionerErrors(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(isNoSuchEntityErr(&iamtypes.NoSuchEntityException{}), qt.IsTrue)
+	c.Assert(isNoSuchEntityErr(fmt.Errorf("failed: %w", &sqstypes.QueueDoesNotExist{})), qt.IsTrue)
+	c.Assert(isNoSuchEntityErr(&types.NoSuchBucket{}), qt.IsTrue)
+	c.Assert(isNoSuchEntityErr(&smithy.GenericAPIError{Code: "NoSuchLifecycleConfiguration"}), qt.IsTrue)
+	c.Assert(isNoSuchEntityErr(&smithy.GenericAPIError{Code: "AccessDenied", Message: "NoSuchEntity"}), qt.IsFalse)
+	c.Assert(isNoSuchEntityErr(errors.New("NoSuchEntity")), qt.IsFalse)
+	c.Assert(isNoSuchEntityErr(nil), qt.IsFalse)
+
+	c.Assert(isAlreadyExistsErr(&sqstypes.QueueNameExists{}), qt.IsTrue)
+	c.Assert(isAlreadyExistsErr(&types.BucketAlreadyOwnedByYou{}), qt.IsTrue)
+	c.Assert(isAlreadyExistsErr(&types.BucketAlreadyExists{}), qt.IsFalse)
+}
+
+func TestMultiRegionProvisioner(t *testing.T) {
+	c := qt.New(t)
+
+	m := &MultiRegionProvisioner{opts: MultiRegionOptions{ReplicatePrefixes: []string{"archive/"}}}
+	for _, region := range []string{"eu-north-1", "us-east-1"} {
+		opts := ProvisionerOptions{Name: "s3fptest", Region: region, NameTemplate: DefaultMultiRegionNameTemplate}
+		c.Assert(opts.init(), qt.IsNil)
+		m.provisioners = append(m.provisioners, &Provisioner{opts: opts})
+	}
+
+	c.Assert(m.provisioners[0].bucketName(), qt.Equals, "s3fptest-eu-north-1")
+	c.Assert(m.provisioners[1].bucketName(), qt.Equals, "s3fptest-us-east-1")
+	c.Assert(m.provisioners[1].clientName(), qt.Equals, "s3fptest_client")
+	c.Assert(m.replicationRoleName(), qt.Equals, "s3fptest_replication")
+
+	rules := m.replicationRules()
+	c.Assert(rules, qt.HasLen, 1)
+	c.Assert(*rules[0].Destination.Bucket, qt.Equals, "arn:aws:s3:::s3fptest-us-east-1")
+
+	var buf bytes.Buffer
+	c.Assert(MultiRegionResults{{Region: "eu-north-1", Bucket: "b1"}, {Region: "us-east-1", Bucket: "b2"}}.WriteDotenv(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, "S3RPC_EU_NORTH_1_BUCKET=b1\nS3RPC_EU_NORTH_1_REGION=eu-north-1\nS3RPC_US_EAST_1_BUCKET=b2\nS3RPC_US_EAST_1_REGION=us-east-1\n")
+}
+
+func TestProvisionerResponseQueues(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest"}
+	c.Assert(opts.init(), qt.IsNil)
+	p := &Provisioner{opts: opts}
+	ctx := context.Background()
+
+	c.Assert(p.responseQueuePrefix(), qt.Equals, "s3fptest_client_rq_")
+	_, err := p.CreateResponseQueue(ctx, "host.example.com")
+	c.Assert(err, qt.ErrorMatches, `invalid response queue id "host.example.com"`)
+	c.Assert(p.DeleteResponseQueue(ctx, "https://sqs.eu-north-1.amazonaws.com/1234/s3fptest_client"), qt.ErrorMatches, `".*/s3fptest_client" is not a response queue`)
+
+	policy := p.responseQueuePolicy("1234", "s3fptest_client_rq_42-ab", "arn:client", "arn:server")
+	c.Assert(policy.Statement, qt.HasLen, 2)
+	c.Assert(policy.Statement[0].Principal["AWS"], qt.Equals, "arn:client")
+	c.Assert(policy.Statement[1].Principal["AWS"], qt.Equals, "arn:server")
+	c.Assert(policy.Statement[1].Action, qt.DeepEquals, []string{"sqs:SendMessage"})
+	c.Assert(policy.Statement[1].Resource, qt.DeepEquals, []string{"arn:aws:sqs:eu-north-1:1234:s3fptest_client_rq_42-ab"})
+
+	now := time.Unix(1700000000, 0)
+	c.Assert(responseQueueExpired("1699990000", time.Hour, now), qt.IsTrue)
+	c.Assert(responseQueueExpired("1699999000", time.Hour, now), qt.IsFalse)
+	c.Assert(responseQueueExpired("invalid", time.Hour, now), qt.IsFalse)
+}
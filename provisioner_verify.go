@@ -0,0 +1,284 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// VerifyProblem is a discrepancy between the expected and the actual state of a resource.
+type VerifyProblem struct {
+	// Kind is the resource kind, e.g. "user" or "queue".
+	Kind string
+
+	// Name is the resource name.
+	Name string
+
+	// Problem describes what is wrong.
+	Problem string
+}
+
+func (p VerifyProblem) String() string {
+	return fmt.Sprintf("%s %q: %s", p.Kind, p.Name, p.Problem)
+}
+
+// VerifyResult is the result of Verify.
+type VerifyResult struct {
+	Problems []VerifyProblem
+}
+
+// OK reports whether no problems were found.
+func (r VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r VerifyResult) String() string {
+	if r.OK() {
+		return "OK\n"
+	}
+	var sb strings.Builder
+	for _, p := range r.Problems {
+		sb.WriteString(p.String() + "\n")
+	}
+	return sb.String()
+}
+
+// Verify checks the health of an existing environment and reports any discrepancies
+// from what Create would set up, e.g. a missing bucket, altered notifications or
+// queue policies, or users without an active access key.
+// It only reads from AWS. Run Create to fix the problems found.
+func (p *Provisioner) Verify(ctx context.Context) (VerifyResult, error) {
+	var res VerifyResult
+	problem := func(kind, name, format string, args ...interface{}) {
+		res.Problems = append(res.Problems, VerifyProblem{Kind: kind, Name: name, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	adminAccount, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{})
+	if err != nil {
+		return res, err
+	}
+	accountID := strings.Split(*adminAccount.User.Arn, ":")[4]
+
+	var principalArns []string
+	for _, userName := range []string{p.clientName(), p.serverName()} {
+		u, err := p.iamClient.GetUser(ctx, &iam.GetUserInput{UserName: aws.String(userName)})
+		if err != nil {
+			if !isNoSuchEntityErr(err) {
+				return res, err
+			}
+			problem("user", userName, "does not exist")
+			// Keep going with a placeholder so the remaining checks still run.
+			principalArns = append(principalArns, "")
+			continue
+		}
+		principalArns = append(principalArns, *u.User.Arn)
+
+		keys, err := p.iamClient.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: aws.String(userName)})
+		if err != nil {
+			return res, err
+		}
+		var active bool
+		for _, k := range keys.AccessKeyMetadata {
+			active = active || k.Status == iamtypes.StatusTypeActive
+		}
+		if !active {
+			problem("user", userName, "has no active access key")
+		}
+	}
+
+	for _, name := range p.queueNames() {
+		q, err := p.sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+		if err != nil {
+			if !isNoSuchEntityErr(err) {
+				return res, err
+			}
+			problem("queue", name, "does not exist")
+			continue
+		}
+		attrs, err := p.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       q.QueueUrl,
+			AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNamePolicy},
+		})
+		if err != nil {
+			return res, err
+		}
+		if ok, err := equalPolicy(attrs.Attributes["Policy"], p.queuePolicyFor(accountID, name, principalArns)); err != nil || !ok {
+			problem("queue", name, "policy differs from the expected")
+		}
+	}
+
+	bucket := aws.String(p.bucketName())
+	if _, err := p.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket}); err != nil {
+		if !isNoSuchEntityErr(err) {
+			return res, err
+		}
+		problem("bucket", p.bucketName(), "does not exist")
+		return res, nil
+	}
+
+	policy, err := p.s3Client.GetBucketPolicy(ctx, &s3.GetBucketPolicyInput{Bucket: bucket})
+	if err != nil && !isNoSuchEntityErr(err) {
+		return res, err
+	}
+	if policy == nil || policy.Policy == nil {
+		problem("bucket", p.bucketName(), "has no policy")
+	} else if ok, err := equalPolicy(*policy.Policy, p.bucketPolicy(principalArns[0], principalArns[1])); err != nil || !ok {
+		problem("bucket", p.bucketName(), "policy differs from the expected")
+	}
+
+	lifecycle, err := p.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: bucket})
+	if err != nil && !isNoSuchEntityErr(err) {
+		return res, err
+	}
+	for _, expected := range p.lifecycleRules() {
+		var found bool
+		if lifecycle != nil {
+			for _, rule := range lifecycle.Rules {
+				if lifecycleRuleMatches(rule, expected) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			problem("bucket", p.bucketName(), "lifecycle rule %q is missing or altered", *expected.ID)
+		}
+	}
+
+	if p.opts.DirectSubmit {
+		return res, nil
+	}
+
+	notifications, err := p.s3Client.GetBucketNotificationConfiguration(ctx, &s3.GetBucketNotificationConfigurationInput{Bucket: bucket})
+	if err != nil {
+		return res, err
+	}
+	for _, expected := range p.queueConfigurations(accountID) {
+		var found bool
+		for _, qc := range notifications.QueueConfigurations {
+			if queueConfigurationMatches(qc, expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problem("bucket", p.bucketName(), "notification %q is missing or altered", *expected.Id)
+		}
+	}
+
+	return res, nil
+}
+
+// lifecycleRuleMatches reports whether the existing rule is the expected rule.
+func lifecycleRuleMatches(rule, expected types.LifecycleRule) bool {
+	return aws.ToString(rule.ID) == *expected.ID && rule.Status == expected.Status && rule.Expiration != nil && rule.Expiration.Days == expected.Expiration.Days
+}
+
+// queueConfigurationMatches reports whether the existing notification qc sends
+// the objects below the expected prefix to the expected queue.
+func queueConfigurationMatches(qc, expected types.QueueConfiguration) bool {
+	if aws.ToString(qc.QueueArn) != *expected.QueueArn || qc.Filter == nil || qc.Filter.Key == nil {
+		return false
+	}
+	for _, rule := range qc.Filter.Key.FilterRules {
+		if strings.EqualFold(string(rule.Name), "prefix") && aws.ToString(rule.Value) == *expected.Filter.Key.FilterRules[0].Value {
+			return true
+		}
+	}
+	return false
+}
+
+// equalPolicy reports whether the policy document s is equal to v marshaled to JSON,
+// ignoring formatting, key order and the forms AWS normalizes policies to:
+// A single element list may be returned as a scalar, the statements are compared by Sid
+// and the order of e.g. actions and resources is not significant.
+func equalPolicy(s string, v interface{}) (bool, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	var m1, m2 map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m1); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &m2); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(normalizePolicy(m1), normalizePolicy(m2)), nil
+}
+
+// normalizePolicy returns the version and the statements by Sid of the policy document m,
+// with all list values as sorted lists.
+func normalizePolicy(m map[string]interface{}) map[string]interface{} {
+	statements := make(map[string]interface{})
+	for i, v := range policyList(m["Statement"]) {
+		statement, ok := v.(map[string]interface{})
+		if !ok {
+			statements[fmt.Sprintf("#%d", i)] = v
+			continue
+		}
+		normalized := make(map[string]interface{})
+		for k, v := range statement {
+			switch k {
+			case "Action", "NotAction", "Resource", "NotResource":
+				v = policyList(v)
+			case "Principal", "NotPrincipal", "Condition":
+				v = normalizePolicyMap(v)
+			}
+			normalized[k] = v
+		}
+		sid, _ := statement["Sid"].(string)
+		if sid == "" {
+			sid = fmt.Sprintf("#%d", i)
+		}
+		statements[sid] = normalized
+	}
+	return map[string]interface{}{
+		"Version":   m["Version"],
+		"Statement": statements,
+	}
+}
+
+// normalizePolicyMap normalizes the values of a principal or condition map,
+// e.g. {"AWS": "arn"} or {"ArnEquals": {"aws:SourceArn": "arn"}}, to sorted lists.
+func normalizePolicyMap(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		// E.g. the "*" principal.
+		return v
+	}
+	normalized := make(map[string]interface{})
+	for k, v := range m {
+		if _, ok := v.(map[string]interface{}); ok {
+			normalized[k] = normalizePolicyMap(v)
+		} else {
+			normalized[k] = policyList(v)
+		}
+	}
+	return normalized
+}
+
+// policyList returns v as a sorted list, wrapping it if it is a scalar.
+func policyList(v interface{}) []interface{} {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	sorted := make([]interface{}, len(list))
+	copy(sorted, list)
+	sort.Slice(sorted, func(i, j int) bool {
+		return fmt.Sprint(sorted[i]) < fmt.Sprint(sorted[j])
+	})
+	return sorted
+}
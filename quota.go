@@ -0,0 +1,129 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrorCodeQuotaExceeded means that the caller's Identity exceeded its Quota, see ServerOptions.Quotas.
+const ErrorCodeQuotaExceeded = "quota_exceeded"
+
+// ErrQuotaExceeded is returned from Client.Execute when the server rejected the request
+// because the caller exceeded its quota. Check for it with errors.Is.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the requests of a caller. A zero field means no limit.
+type Quota struct {
+	// RequestsPerHour is the max number of requests per clock hour.
+	RequestsPerHour int
+
+	// BytesPerDay is the max total input size per UTC day.
+	BytesPerDay int64
+}
+
+// QuotaOptions configures per-caller quotas, see ServerOptions.Quotas,
+// so a shared server can protect itself from noisy callers.
+// Callers are identified by the Identity set with ClientOptions.Identity.
+// Rejected requests get a ResponseError with code ErrorCodeQuotaExceeded,
+// and are counted in ServerStats.QuotaExceeded and the QuotaExceeded CloudWatch metric.
+//
+// The usage is counted per server instance, so with several servers,
+// each caller gets up to the quota on each of them.
+type QuotaOptions struct {
+	// Key returns the key the quota of id is looked up and counted by.
+	// Defaults to the tenant, or the service if there is no tenant.
+	// Callers without an identity share the quota of the empty key.
+	Key func(id Identity) string
+
+	// Quotas maps a key to its quota.
+	Quotas map[string]Quota
+
+	// Default is the quota of keys not in Quotas.
+	Default Quota
+}
+
+func (o *QuotaOptions) init() error {
+	for key, q := range o.Quotas {
+		if q.RequestsPerHour < 0 || q.BytesPerDay < 0 {
+			return fmt.Errorf("quota %q: limits can not be negative", key)
+		}
+	}
+	if o.Default.RequestsPerHour < 0 || o.Default.BytesPerDay < 0 {
+		return errors.New("quota: default limits can not be negative")
+	}
+	if o.Key == nil {
+		o.Key = func(id Identity) string {
+			if id.Tenant != "" {
+				return id.Tenant
+			}
+			return id.Service
+		}
+	}
+	return nil
+}
+
+// quotaUsage is the usage of a key in the current hour and day.
+type quotaUsage struct {
+	hour     time.Time
+	requests int
+	day      time.Time
+	bytes    int64
+}
+
+// quotas enforces QuotaOptions.
+type quotas struct {
+	opts QuotaOptions
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+func newQuotas(opts *QuotaOptions) *quotas {
+	if opts == nil {
+		return nil
+	}
+	return &quotas{opts: *opts, usage: make(map[string]*quotaUsage)}
+}
+
+// admit counts a request of size bytes from id at now, returning an error wrapping
+// ErrQuotaExceeded if it would exceed the quota, in which case it is not counted.
+// A nil quotas admits all requests.
+func (q *quotas) admit(id Identity, size int64, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	key := q.opts.Key(id)
+	quota, found := q.opts.Quotas[key]
+	if !found {
+		quota = q.opts.Default
+	}
+	if quota == (Quota{}) {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage[key]
+	if u == nil {
+		u = &quotaUsage{}
+		q.usage[key] = u
+	}
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); !u.hour.Equal(hour) {
+		u.hour, u.requests = hour, 0
+	}
+	if day := now.Truncate(24 * time.Hour); !u.day.Equal(day) {
+		u.day, u.bytes = day, 0
+	}
+	if quota.RequestsPerHour > 0 && u.requests+1 > quota.RequestsPerHour {
+		return fmt.Errorf("%w: %q has made %d requests this hour, max is %d", ErrQuotaExceeded, key, u.requests, quota.RequestsPerHour)
+	}
+	if quota.BytesPerDay > 0 && u.bytes+size > quota.BytesPerDay {
+		return fmt.Errorf("%w: %q has sent %d bytes today, max is %d", ErrQuotaExceeded, key, u.bytes, quota.BytesPerDay)
+	}
+	u.requests++
+	u.bytes += size
+	return nil
+}
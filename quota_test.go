@@ -0,0 +1,54 @@
+package s3rpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestQuotas(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&QuotaOptions{Default: Quota{RequestsPerHour: -1}}).init(), qt.ErrorMatches, "quota: default limits can not be negative")
+	c.Assert((&QuotaOptions{Quotas: map[string]Quota{"acme": {BytesPerDay: -1}}}).init(), qt.ErrorMatches, `quota "acme": limits can not be negative`)
+
+	var nilQuotas *quotas
+	c.Assert(nilQuotas.admit(Identity{}, 1<<40, time.Now()), qt.IsNil)
+
+	opts := &QuotaOptions{
+		Quotas:  map[string]Quota{"acme": {RequestsPerHour: 2}, "billing": {BytesPerDay: 100}, "free": {}},
+		Default: Quota{RequestsPerHour: 1},
+	}
+	c.Assert(opts.init(), qt.IsNil)
+	q := newQuotas(opts)
+	now := time.Date(2026, 10, 15, 10, 30, 0, 0, time.UTC)
+
+	acme := Identity{Service: "billing", Tenant: "acme"}
+	c.Assert(q.admit(acme, 1000, now), qt.IsNil)
+	c.Assert(q.admit(acme, 1000, now), qt.IsNil)
+	err := q.admit(acme, 1000, now)
+	c.Assert(errors.Is(err, ErrQuotaExceeded), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `quota exceeded: "acme" has made 2 requests this hour, max is 2`)
+	c.Assert(q.admit(acme, 1000, now.Add(30*time.Minute)), qt.IsNil)
+
+	billing := Identity{Service: "billing"}
+	c.Assert(q.admit(billing, 60, now), qt.IsNil)
+	c.Assert(q.admit(billing, 60, now), qt.ErrorMatches, `quota exceeded: "billing" has sent 60 bytes today, max is 100`)
+	c.Assert(q.admit(billing, 40, now), qt.IsNil)
+	c.Assert(q.admit(billing, 60, now.Add(24*time.Hour)), qt.IsNil)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(q.admit(Identity{Tenant: "free"}, 1000, now), qt.IsNil)
+	}
+
+	// Callers without a quota of their own, including those without an identity, get the default.
+	c.Assert(q.admit(Identity{}, 1, now), qt.IsNil)
+	c.Assert(errors.Is(q.admit(Identity{}, 1, now), ErrQuotaExceeded), qt.IsTrue)
+	c.Assert(q.admit(Identity{Service: "search"}, 1, now), qt.IsNil)
+
+	var respErr error = &ResponseError{Code: ErrorCodeQuotaExceeded}
+	c.Assert(errors.Is(respErr, ErrQuotaExceeded), qt.IsTrue)
+	c.Assert(errors.Is(respErr, ErrProtocolVersion), qt.IsFalse)
+}
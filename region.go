@@ -0,0 +1,67 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// regionDetectTimeout is the max time spent looking up the bucket region.
+const regionDetectTimeout = 10 * time.Second
+
+// resolveRegion sets Region if empty, from the queue URL if set, else from the bucket location.
+// It falls back to defaultRegion only if UseDefaultRegion is set.
+func (cfg *AWSConfig) resolveRegion(queue string) error {
+	if cfg.Region != "" {
+		return nil
+	}
+	if region := regionFromQueueURL(queue); region != "" {
+		cfg.Region = region
+		return nil
+	}
+	if cfg.Bucket != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), regionDetectTimeout)
+		defer cancel()
+		region, err := manager.GetBucketRegion(ctx, s3.New(s3.Options{Region: "us-east-1"}), cfg.Bucket)
+		if err == nil {
+			cfg.Region = region
+			return nil
+		}
+		if !cfg.UseDefaultRegion {
+			return fmt.Errorf("region is not set and could not be detected from bucket %q: %w", cfg.Bucket, err)
+		}
+	}
+	if cfg.UseDefaultRegion {
+		cfg.Region = defaultRegion
+		return nil
+	}
+	return errors.New("region is required")
+}
+
+// regionFromQueueURL returns the region in an SQS queue URL, e.g.
+// https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue
+// or the legacy https://eu-north-1.queue.amazonaws.com/123456789012/myqueue.
+// It returns an empty string if not found.
+func regionFromQueueURL(queue string) string {
+	u, err := url.Parse(queue)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) < 4 {
+		return ""
+	}
+	switch {
+	case parts[0] == "sqs":
+		return parts[1]
+	case parts[1] == "queue":
+		return parts[0]
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package s3rpc
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestResolveRegion(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(regionFromQueueURL("https://sqs.us-west-2.amazonaws.com/123456789012/myqueue"), qt.Equals, "us-west-2")
+	c.Assert(regionFromQueueURL("https://eu-west-1.queue.amazonaws.com/123456789012/myqueue"), qt.Equals, "eu-west-1")
+	c.Assert(regionFromQueueURL("myqueue"), qt.Equals, "")
+	c.Assert(regionFromQueueURL("http://localhost:4566/000000000000/myqueue"), qt.Equals, "")
+
+	cfg := AWSConfig{Region: "us-east-1"}
+	c.Assert(cfg.resolveRegion("https://sqs.us-west-2.amazonaws.com/123456789012/myqueue"), qt.IsNil)
+	c.Assert(cfg.Region, qt.Equals, "us-east-1")
+
+	cfg = AWSConfig{}
+	c.Assert(cfg.resolveRegion("https://sqs.us-west-2.amazonaws.com/123456789012/myqueue"), qt.IsNil)
+	c.Assert(cfg.Region, qt.Equals, "us-west-2")
+
+	cfg = AWSConfig{}
+	c.Assert(cfg.resolveRegion("myqueue"), qt.ErrorMatches, "region is required")
+
+	cfg = AWSConfig{UseDefaultRegion: true}
+	c.Assert(cfg.resolveRegion("myqueue"), qt.IsNil)
+	c.Assert(cfg.Region, qt.Equals, defaultRegion)
+}
@@ -0,0 +1,129 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryOptions configures retries with exponential backoff and full jitter
+// of the client's upload and response download.
+type RetryOptions struct {
+	// MaxAttempts is the max number of attempts per upload or download, including the first.
+	// Defaults to 3.
+	MaxAttempts int
+
+	// InitialBackoff is the max backoff before the first retry, doubled for each retry.
+	// The actual backoff is a random duration up to this.
+	// Defaults to 100 milliseconds.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the backoff.
+	// Defaults to 5 seconds.
+	MaxBackoff time.Duration
+
+	// Budget is the max number of retries per minute across all requests of the client,
+	// so retries don't add to the load during an outage.
+	// Defaults to 100.
+	Budget int
+
+	// BusyAttempts is the max number of attempts of a request the server rejected with ErrBusy,
+	// including the first, waiting ResponseError.RetryAfter between them.
+	// Defaults to 3.
+	BusyAttempts int
+}
+
+func (o *RetryOptions) init() error {
+	if o.MaxAttempts < 0 || o.InitialBackoff < 0 || o.MaxBackoff < 0 || o.Budget < 0 || o.BusyAttempts < 0 {
+		return errors.New("retry: options can not be negative")
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 3
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 5 * time.Second
+	}
+	if o.Budget == 0 {
+		o.Budget = 100
+	}
+	if o.BusyAttempts == 0 {
+		o.BusyAttempts = 3
+	}
+	return nil
+}
+
+// retryBudgetWindow is the window of RetryOptions.Budget.
+const retryBudgetWindow = time.Minute
+
+type retrier struct {
+	opts RetryOptions
+	now  func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	used        int
+}
+
+func newRetrier(opts *RetryOptions) *retrier {
+	if opts == nil {
+		return nil
+	}
+	return &retrier{opts: *opts, now: time.Now}
+}
+
+// do calls fn until it succeeds, the attempts or the budget are used up, or ctx is done.
+// onRetry is called before each retry.
+func (r *retrier) do(ctx context.Context, fn func() error, onRetry func(attempt int, backoff time.Duration, err error)) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || r == nil || attempt >= r.opts.MaxAttempts || ctx.Err() != nil || !isRetryable(err) || !r.take() {
+			return err
+		}
+		backoff := r.backoff(attempt)
+		onRetry(attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// take takes a retry from the budget and reports whether there was one.
+func (r *retrier) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.windowStart) >= retryBudgetWindow {
+		r.windowStart, r.used = now, 0
+	}
+	if r.used >= r.opts.Budget {
+		return false
+	}
+	r.used++
+	return true
+}
+
+// backoff returns a random duration up to InitialBackoff*2^(attempt-1), capped at MaxBackoff.
+func (r *retrier) backoff(attempt int) time.Duration {
+	d := r.opts.MaxBackoff
+	if attempt < 32 {
+		if exp := r.opts.InitialBackoff << (attempt - 1); exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// isRetryable reports whether err may succeed on retry.
+// Local file errors, e.g. a missing input file, and context errors are not.
+func isRetryable(err error) bool {
+	var pathErr *fs.PathError
+	return !errors.As(err, &pathErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,75 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRetrier(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &RetryOptions{InitialBackoff: time.Millisecond, Budget: 3}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.MaxAttempts, qt.Equals, 3)
+	c.Assert(opts.BusyAttempts, qt.Equals, 3)
+	c.Assert((&RetryOptions{MaxAttempts: -1}).init(), qt.Not(qt.IsNil))
+
+	r := newRetrier(opts)
+	ctx := context.Background()
+	failing := errors.New("throttled")
+
+	var calls, retries int
+	fn := func() error {
+		calls++
+		if calls < 3 {
+			return failing
+		}
+		return nil
+	}
+	onRetry := func(attempt int, backoff time.Duration, err error) {
+		retries++
+		c.Assert(backoff <= time.Duration(1<<(attempt-1))*time.Millisecond, qt.IsTrue)
+	}
+	c.Assert(r.do(ctx, fn, onRetry), qt.IsNil)
+	c.Assert(calls, qt.Equals, 3)
+	c.Assert(retries, qt.Equals, 2)
+
+	// One retry left in the budget.
+	calls = 0
+	c.Assert(r.do(ctx, func() error { calls++; return failing }, onRetry), qt.Equals, failing)
+	c.Assert(calls, qt.Equals, 2)
+
+	// A new window refills the budget.
+	r.now = func() time.Time { return time.Now().Add(time.Hour) }
+	calls = 0
+	c.Assert(r.do(ctx, func() error { calls++; return failing }, onRetry), qt.Equals, failing)
+	c.Assert(calls, qt.Equals, 3)
+
+	// Local file errors are not retried.
+	calls = 0
+	_, statErr := os.Stat("/does/not/exist")
+	c.Assert(r.do(ctx, func() error { calls++; return statErr }, onRetry), qt.Equals, statErr)
+	c.Assert(calls, qt.Equals, 1)
+
+	var nilRetrier *retrier
+	calls = 0
+	c.Assert(nilRetrier.do(ctx, func() error { calls++; return failing }, onRetry), qt.Equals, failing)
+	c.Assert(calls, qt.Equals, 1)
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &RetryOptions{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	c.Assert(opts.init(), qt.IsNil)
+	r := newRetrier(opts)
+	for attempt := 1; attempt < 70; attempt++ {
+		d := r.backoff(attempt)
+		c.Assert(d >= 0 && d <= 4*time.Second, qt.IsTrue)
+	}
+}
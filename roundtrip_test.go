@@ -22,9 +22,10 @@ func TestProcessFile(t *testing.T) {
 
 	client, err := NewClient(
 		ClientOptions{
-			Queue:   os.Getenv("S3RPC_CLIENT_QUEUE"),
-			Timeout: 5 * time.Minute,
-			Infof:   infofc,
+			Queue:               os.Getenv("S3RPC_CLIENT_QUEUE"),
+			ResponseWaitTimeout: 5 * time.Minute,
+			Fsync:               true,
+			Infof:               infofc,
 			AWSConfig: AWSConfig{
 				Bucket:          "s3fptest",
 				AccessKeyID:     os.Getenv("S3RPC_CLIENT_ACCESS_KEY_ID"),
@@ -130,10 +131,7 @@ func TestSetup(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := prov.Destroy(context.Background()); err != nil {
-		t.Fatal(err)
-	}
-
+	// Create adopts and reconciles any existing resources.
 	outputs, err := prov.Create(context.Background())
 	if err != nil {
 		t.Fatal(err)
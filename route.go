@@ -0,0 +1,69 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoRoute is returned from a handler created with Route when no HandlerRoute matches the input.
+// The client gets a ResponseError with code ErrorCodeNoRoute.
+var ErrNoRoute = errors.New("no handler matches the input")
+
+// HandlerRoute is a handler selected by the input's file extension or content type.
+type HandlerRoute struct {
+	// Extensions matches filename extensions, e.g. ".docx", case insensitive.
+	Extensions []string
+
+	// ContentTypes matches Input.ContentType against patterns, e.g. "text/markdown" or "image/*".
+	ContentTypes []string
+
+	// Handler handles matching inputs.
+	Handler func(ctx context.Context, input Input) (Output, error)
+}
+
+func (r HandlerRoute) matches(input Input) bool {
+	ext := filepath.Ext(input.Filename)
+	for _, e := range r.Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	if input.ContentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(input.ContentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range r.ContentTypes {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns a handler that passes the input to the first matching route,
+// so e.g. a "convert" op can handle .docx and .md files with different implementations:
+//
+//	Handlers{
+//		"convert": Route(
+//			HandlerRoute{Extensions: []string{".docx"}, Handler: convertDocx},
+//			HandlerRoute{ContentTypes: []string{"text/markdown"}, Handler: convertMarkdown},
+//		),
+//	}
+func Route(routes ...HandlerRoute) func(ctx context.Context, input Input) (Output, error) {
+	return func(ctx context.Context, input Input) (Output, error) {
+		for _, r := range routes {
+			if r.matches(input) {
+				return r.Handler(ctx, input)
+			}
+		}
+		return Output{}, fmt.Errorf("%w: %s (%s)", ErrNoRoute, filepath.Ext(input.Filename), input.ContentType)
+	}
+}
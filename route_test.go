@@ -0,0 +1,42 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRoute(t *testing.T) {
+	c := qt.New(t)
+
+	handler := func(name string) func(ctx context.Context, input Input) (Output, error) {
+		return func(ctx context.Context, input Input) (Output, error) {
+			return Output{Filename: name}, nil
+		}
+	}
+
+	convert := Route(
+		HandlerRoute{Extensions: []string{".docx"}, Handler: handler("docx")},
+		HandlerRoute{ContentTypes: []string{"text/markdown"}, Handler: handler("markdown")},
+		HandlerRoute{ContentTypes: []string{"image/*"}, Handler: handler("image")},
+	)
+
+	for _, test := range []struct {
+		input    Input
+		expected string
+	}{
+		{Input{Filename: "/tmp/123_01gcabc_report.DOCX"}, "docx"},
+		{Input{Filename: "/tmp/123_01gcabc_readme.md", ContentType: "text/markdown; charset=utf-8"}, "markdown"},
+		{Input{Filename: "/tmp/123_01gcabc_image", ContentType: "image/png"}, "image"},
+	} {
+		output, err := convert(context.Background(), test.input)
+		c.Assert(err, qt.IsNil)
+		c.Assert(output.Filename, qt.Equals, test.expected)
+	}
+
+	_, err := convert(context.Background(), Input{Filename: "/tmp/123_01gcabc_data.bin", ContentType: "application/octet-stream"})
+	c.Assert(errors.Is(err, ErrNoRoute), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `no handler matches the input: .bin \(application/octet-stream\)`)
+}
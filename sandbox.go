@@ -0,0 +1,119 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sandboxWorkerEnv marks a process started as a sandbox worker, see RunSandboxWorker.
+const sandboxWorkerEnv = "S3RPC_SANDBOX_WORKER"
+
+// SandboxOptions configures running handlers in a worker subprocess per request,
+// isolating crashes, leaks and memory bloat from the server process.
+// The OS frees everything the worker held when it exits.
+//
+// By default the worker is the server's own executable, which must call RunSandboxWorker
+// with the same handlers first thing in main.
+// The worker talks to the server over stdin and stdout with the PluginRequest and
+// PluginResponse protocol, so handlers in the worker can not use EmitChunk.
+type SandboxOptions struct {
+	// Ops are the ops to sandbox. If empty, all ops are sandboxed.
+	Ops []string
+
+	// Command, if set, is the worker command and its arguments.
+	// Defaults to the running executable.
+	Command []string
+
+	// Env is the environment of the worker, as KEY=value.
+	// The worker does not inherit the server's environment, e.g. its AWS credentials;
+	// it only gets PATH, Env and the variable marking it as a worker.
+	Env []string
+
+	// Limits, if set, limits the memory and CPU time of each worker.
+	Limits *PluginLimits
+
+	// command is Command wrapped to apply Limits.
+	command []string
+	ops     map[string]bool
+}
+
+func (o *SandboxOptions) init() error {
+	if len(o.Command) == 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("sandbox: failed to find the executable: %w", err)
+		}
+		o.Command = []string{exe}
+	}
+	command, err := o.Limits.limitCommand(o.Command)
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	o.command = command
+	if len(o.Ops) > 0 {
+		o.ops = make(map[string]bool, len(o.Ops))
+		for _, op := range o.Ops {
+			o.ops[op] = true
+		}
+	}
+	return nil
+}
+
+// sandboxed reports whether op is run in a worker.
+func (o *SandboxOptions) sandboxed(op string) bool {
+	return o != nil && (o.ops == nil || o.ops[op])
+}
+
+// handle runs the input to op in a new worker.
+func (o *SandboxOptions) handle(ctx context.Context, op string, input Input) (Output, error) {
+	env := append([]string{sandboxWorkerEnv + "=1", "PATH=" + os.Getenv("PATH")}, o.Env...)
+	return runPlugin(ctx, "sandbox", op, o.command, env, input)
+}
+
+// RunSandboxWorker handles the request on stdin and exits if the process was started
+// as a worker by a server with ServerOptions.Sandbox, else it returns immediately.
+// Call it first thing in main with the same handlers as passed to the server:
+//
+//	func main() {
+//		s3rpc.RunSandboxWorker(handlers)
+//		// Start the server.
+//	}
+func RunSandboxWorker(handlers Handlers) {
+	if os.Getenv(sandboxWorkerEnv) != "1" {
+		return
+	}
+	if err := serveSandboxWorker(os.Stdin, os.Stdout, handlers); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// serveSandboxWorker reads a PluginRequest from r, handles it and writes the PluginResponse to w.
+// Handler errors are sent in the response.
+func serveSandboxWorker(r io.Reader, w io.Writer, handlers Handlers) error {
+	var req PluginRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return fmt.Errorf("sandbox worker: failed to decode request: %w", err)
+	}
+	handle := handlers[req.Op]
+	if handle == nil {
+		return fmt.Errorf("sandbox worker: no handler for op %q", req.Op)
+	}
+
+	var resp PluginResponse
+	output, err := handle(context.Background(), Input{Filename: req.Filename, Metadata: req.Metadata, ContentType: req.ContentType})
+	if err == nil && output.Filename == "" {
+		err = errors.New("no output filename")
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp = PluginResponse{Filename: output.Filename, Metadata: output.Metadata, ContentType: output.ContentType}
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
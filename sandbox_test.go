@@ -0,0 +1,79 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var sandboxTestHandlers = Handlers{
+	"upper": func(ctx context.Context, input Input) (Output, error) {
+		b, err := os.ReadFile(input.Filename)
+		if err != nil {
+			return Output{}, err
+		}
+		if os.Getenv("S3RPC_TEST_SECRET") != "" {
+			return Output{}, errors.New("the worker inherited the server's environment")
+		}
+		filename := input.Filename + ".upper"
+		return Output{Filename: filename, Metadata: map[string]string{"env": os.Getenv("GREETING")}}, os.WriteFile(filename, bytes.ToUpper(b), 0o644)
+	},
+	"crash": func(ctx context.Context, input Input) (Output, error) {
+		panic("boom")
+	},
+}
+
+// TestSandboxWorkerProcess is not a real test, it is run as the sandbox worker by the tests below.
+func TestSandboxWorkerProcess(t *testing.T) {
+	RunSandboxWorker(sandboxTestHandlers)
+}
+
+func TestSandbox(t *testing.T) {
+	c := qt.New(t)
+	t.Setenv("S3RPC_TEST_SECRET", "secret")
+
+	opts := &SandboxOptions{
+		Ops:     []string{"upper", "crash"},
+		Command: []string{os.Args[0], "-test.run=TestSandboxWorkerProcess"},
+		Env:     []string{"GREETING=hello"},
+	}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.sandboxed("upper"), qt.IsTrue)
+	c.Assert(opts.sandboxed("resize"), qt.IsFalse)
+	c.Assert((*SandboxOptions)(nil).sandboxed("upper"), qt.IsFalse)
+
+	input := filepath.Join(t.TempDir(), "in.txt")
+	c.Assert(os.WriteFile(input, []byte("hello"), 0o644), qt.IsNil)
+
+	ctx := context.Background()
+	output, err := opts.handle(ctx, "upper", Input{Filename: input})
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.Metadata["env"], qt.Equals, "hello")
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "HELLO")
+
+	_, err = opts.handle(ctx, "crash", Input{Filename: input})
+	c.Assert(err, qt.ErrorMatches, `(?s)sandbox "crash": exit status 2: panic: boom.*`)
+
+	_, err = opts.handle(ctx, "resize", Input{Filename: input})
+	c.Assert(err, qt.ErrorMatches, `sandbox "resize": exit status 1: sandbox worker: no handler for op "resize"`)
+}
+
+func TestServeSandboxWorker(t *testing.T) {
+	c := qt.New(t)
+
+	var out bytes.Buffer
+	err := serveSandboxWorker(strings.NewReader(`{"op":"upper","filename":"/does/not/exist"}`), &out, sandboxTestHandlers)
+	c.Assert(err, qt.IsNil)
+	c.Assert(out.String(), qt.Contains, `"error":"open /does/not/exist`)
+
+	err = serveSandboxWorker(strings.NewReader(`{`), &out, sandboxTestHandlers)
+	c.Assert(err, qt.ErrorMatches, "sandbox worker: failed to decode request.*")
+}
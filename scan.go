@@ -0,0 +1,176 @@
+package s3rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScanFunc scans a downloaded input, e.g. with an antivirus scanner.
+// It returns the name of the threat detected, or an empty string if the input is clean.
+// See ClamdScanner.
+type ScanFunc func(ctx context.Context, input Input) (threat string, err error)
+
+// Actions taken when a ScanFunc detects a threat, see ScanOptions.Action.
+const (
+	// ScanReject sends a ResponseError with code ErrorCodeInfected to the client.
+	ScanReject = "reject"
+
+	// ScanQuarantine copies the input below quarantine/ and rejects it as ScanReject.
+	ScanQuarantine = "quarantine"
+
+	// ScanAllow passes the input on to the handler.
+	// Use it with ScanOptions.OnDetect to only alert on detection.
+	ScanAllow = "allow"
+)
+
+// ScanOptions configures scanning of request inputs before they are handled.
+type ScanOptions struct {
+	// Scan is the scanner to run on each input.
+	Scan ScanFunc
+
+	// Ops, if set, limits scanning to these ops.
+	Ops []string
+
+	// Action is the action taken on detection, one of ScanReject, ScanQuarantine or ScanAllow.
+	// Defaults to ScanReject.
+	Action string
+
+	// OnDetect, if set, is called when a threat is detected, e.g. to send an alert.
+	OnDetect func(ctx context.Context, op, key, threat string)
+}
+
+func (o *ScanOptions) init() error {
+	if o.Scan == nil {
+		return errors.New("scan: Scan is required")
+	}
+	switch o.Action {
+	case "":
+		o.Action = ScanReject
+	case ScanReject, ScanQuarantine, ScanAllow:
+	default:
+		return fmt.Errorf("scan: unknown action %q", o.Action)
+	}
+	return nil
+}
+
+func (o *ScanOptions) isScanned(op string) bool {
+	if o == nil {
+		return false
+	}
+	if len(o.Ops) == 0 {
+		return true
+	}
+	for _, scanned := range o.Ops {
+		if scanned == op {
+			return true
+		}
+	}
+	return false
+}
+
+// scan scans the input if configured to and returns whether the request should be handled.
+func (s *Server) scan(ctx context.Context, op, key string, input Input) (bool, error) {
+	if !s.scanOpts.isScanned(op) {
+		return true, nil
+	}
+	threat, err := s.scanOpts.Scan(ctx, input)
+	if err != nil {
+		return false, fmt.Errorf("scan: %w", err)
+	}
+	if threat == "" {
+		return true, nil
+	}
+
+	s.logf(ctx, "Detected %q in %q", threat, key)
+	if s.scanOpts.OnDetect != nil {
+		s.scanOpts.OnDetect(ctx, op, key, threat)
+	}
+
+	switch s.scanOpts.Action {
+	case ScanAllow:
+		return true, nil
+	case ScanQuarantine:
+		if err := s.copyObject(ctx, key, quarantineKey(key)); err != nil {
+			s.logf(ctx, "Failed to quarantine %q: %s", key, err)
+		}
+	}
+	return false, s.respondError(ctx, op, key, ErrorCodeInfected, fmt.Errorf("detected %s", threat))
+}
+
+// ClamdScanner returns a ScanFunc that streams inputs to a clamd daemon
+// listening on the given network and address, e.g. "tcp" and "localhost:3310",
+// using the INSTREAM command.
+// Note that clamd rejects streams larger than its StreamMaxLength setting.
+func ClamdScanner(network, address string) ScanFunc {
+	return func(ctx context.Context, input Input) (string, error) {
+		f, err := os.Open(input.Filename)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return "", fmt.Errorf("failed to connect to clamd: %w", err)
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		} else {
+			conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		}
+
+		if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+			return "", err
+		}
+		buf := make([]byte, 4+32*1024)
+		for {
+			n, err := f.Read(buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf[:4], uint32(n))
+				if _, err := conn.Write(buf[:4+n]); err != nil {
+					return "", err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		// A zero length chunk ends the stream.
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return "", err
+		}
+
+		reply, err := bufio.NewReader(conn).ReadString(0)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read clamd reply: %w", err)
+		}
+		return parseClamdReply(reply)
+	}
+}
+
+// parseClamdReply parses replies such as "stream: OK" and "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimRight(reply, "\x00\n")
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,110 @@
+package s3rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClamdScanner(t *testing.T) {
+	c := qt.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+
+	// A fake clamd that reports anything containing "EICAR" as infected.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			cmd, _ := r.ReadString(0)
+			var data []byte
+			for cmd == "zINSTREAM\x00" {
+				var size [4]byte
+				if _, err := io.ReadFull(r, size[:]); err != nil {
+					break
+				}
+				n := binary.BigEndian.Uint32(size[:])
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				if _, err := io.ReadFull(r, chunk); err != nil {
+					break
+				}
+				data = append(data, chunk...)
+			}
+			reply := "stream: OK\x00"
+			if strings.Contains(string(data), "EICAR") {
+				reply = "stream: Eicar-Signature FOUND\x00"
+			}
+			io.WriteString(conn, reply)
+			conn.Close()
+		}
+	}()
+
+	dir := c.TempDir()
+	scan := ClamdScanner("tcp", l.Addr().String())
+	for _, test := range []struct {
+		content string
+		threat  string
+	}{
+		{"hello", ""},
+		{strings.Repeat("a", 100000) + "EICAR", "Eicar-Signature"},
+	} {
+		filename := filepath.Join(dir, "input.txt")
+		c.Assert(os.WriteFile(filename, []byte(test.content), 0o644), qt.IsNil)
+		threat, err := scan(context.Background(), Input{Filename: filename})
+		c.Assert(err, qt.IsNil)
+		c.Assert(threat, qt.Equals, test.threat)
+	}
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR\x00")
+	c.Assert(err, qt.ErrorMatches, "clamd: INSTREAM size limit exceeded. ERROR")
+}
+
+func TestScanOptions(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&ScanOptions{}).init(), qt.ErrorMatches, "scan: Scan is required")
+	opts := &ScanOptions{Scan: ClamdScanner("tcp", "localhost:3310"), Ops: []string{"upload"}}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Action, qt.Equals, ScanReject)
+	c.Assert(opts.isScanned("upload"), qt.IsTrue)
+	c.Assert(opts.isScanned("resize"), qt.IsFalse)
+	opts.Action = "foo"
+	c.Assert(opts.init(), qt.ErrorMatches, `scan: unknown action "foo"`)
+
+	var nilOpts *ScanOptions
+	c.Assert(nilOpts.isScanned("upload"), qt.IsFalse)
+
+	var detected string
+	s := &Server{
+		common: &common{infof: func(format string, args ...interface{}) {}},
+		scanOpts: &ScanOptions{
+			Scan: func(ctx context.Context, input Input) (string, error) {
+				return "Eicar-Signature", nil
+			},
+			Action: ScanAllow,
+			OnDetect: func(ctx context.Context, op, key, threat string) {
+				detected = threat
+			},
+		},
+	}
+	ok, err := s.scan(context.Background(), "upload", "to_server/upload/01gcabc_file.txt", Input{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(detected, qt.Equals, "Eicar-Signature")
+}
@@ -0,0 +1,175 @@
+package s3rpc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of a MetadataField, see MetadataField.Type.
+const (
+	// MetadataString accepts any value.
+	MetadataString = "string"
+
+	// MetadataInt accepts a base 10 integer, e.g. "-42".
+	MetadataInt = "int"
+
+	// MetadataFloat accepts a floating point number, e.g. "1.5".
+	MetadataFloat = "float"
+
+	// MetadataBool accepts the values accepted by strconv.ParseBool, e.g. "true" or "0".
+	MetadataBool = "bool"
+)
+
+// MetadataSchema describes the request metadata accepted by an op.
+// Keys are matched case insensitively, as S3 lower cases metadata keys.
+// Keys set by s3rpc, such as MetaInputChecksum, are always accepted.
+// See ClientOptions.MetadataSchemas and ServerOptions.MetadataSchemas.
+type MetadataSchema struct {
+	// Fields maps a metadata key to its field definition.
+	Fields map[string]MetadataField
+
+	// AllowUnknown, if set, accepts keys not in Fields.
+	AllowUnknown bool
+}
+
+// MetadataField describes a metadata value.
+type MetadataField struct {
+	// Required, if set, rejects metadata without this key.
+	Required bool
+
+	// Type is one of MetadataString, MetadataInt, MetadataFloat or MetadataBool.
+	// Defaults to MetadataString.
+	Type string
+
+	// Enum, if set, lists the allowed values.
+	Enum []string
+}
+
+func (s *MetadataSchema) init() error {
+	for k, f := range s.Fields {
+		switch f.Type {
+		case "", MetadataString, MetadataInt, MetadataFloat, MetadataBool:
+		default:
+			return fmt.Errorf("metadata schema: key %q: unknown type %q", k, f.Type)
+		}
+	}
+	return nil
+}
+
+// Validate validates metadata against the schema.
+// The returned error is a *MetadataValidationError listing all invalid keys.
+func (s *MetadataSchema) Validate(metadata map[string]string) error {
+	var (
+		errs  []MetadataFieldError
+		found = make(map[string]bool, len(metadata))
+	)
+
+	for k, v := range metadata {
+		key := strings.ToLower(k)
+		if strings.HasPrefix(key, "s3rpc-") {
+			continue
+		}
+		f, ok := s.field(key)
+		if !ok {
+			if !s.AllowUnknown {
+				errs = append(errs, MetadataFieldError{Key: key, Message: "unknown key"})
+			}
+			continue
+		}
+		found[key] = true
+		if msg := f.validate(v); msg != "" {
+			errs = append(errs, MetadataFieldError{Key: key, Message: msg})
+		}
+	}
+
+	for k, f := range s.Fields {
+		if key := strings.ToLower(k); f.Required && !found[key] {
+			errs = append(errs, MetadataFieldError{Key: key, Message: "required"})
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+	return &MetadataValidationError{Errors: errs}
+}
+
+func (s *MetadataSchema) field(key string) (MetadataField, bool) {
+	if f, ok := s.Fields[key]; ok {
+		return f, true
+	}
+	for k, f := range s.Fields {
+		if strings.EqualFold(k, key) {
+			return f, true
+		}
+	}
+	return MetadataField{}, false
+}
+
+// validate returns a description of why v is invalid, or an empty string if it is valid.
+func (f MetadataField) validate(v string) string {
+	var err error
+	switch f.Type {
+	case MetadataInt:
+		_, err = strconv.ParseInt(v, 10, 64)
+	case MetadataFloat:
+		_, err = strconv.ParseFloat(v, 64)
+	case MetadataBool:
+		_, err = strconv.ParseBool(v)
+	}
+	if err != nil {
+		return fmt.Sprintf("%q is not a valid %s", v, f.Type)
+	}
+	if len(f.Enum) == 0 {
+		return ""
+	}
+	for _, e := range f.Enum {
+		if v == e {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%q is not one of %s", v, strings.Join(f.Enum, ", "))
+}
+
+// MetadataFieldError describes an invalid metadata key.
+type MetadataFieldError struct {
+	Key     string
+	Message string
+}
+
+// MetadataValidationError is returned from Client.Execute when the request metadata
+// does not match the op's MetadataSchema.
+// A server rejecting the metadata responds with a ResponseError with code ErrorCodeInvalidMetadata
+// and this error's message.
+type MetadataValidationError struct {
+	// Errors is sorted by key.
+	Errors []MetadataFieldError
+}
+
+func (e *MetadataValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("invalid metadata: ")
+	for i, fe := range e.Errors {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%s: %s", fe.Key, fe.Message)
+	}
+	return sb.String()
+}
+
+// initMetadataSchemas validates the schemas in schemas.
+func initMetadataSchemas(schemas map[string]*MetadataSchema) error {
+	for op, s := range schemas {
+		if s == nil {
+			return fmt.Errorf("metadata schema for op %q is nil", op)
+		}
+		if err := s.init(); err != nil {
+			return fmt.Errorf("op %q: %w", op, err)
+		}
+	}
+	return nil
+}
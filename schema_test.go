@@ -0,0 +1,37 @@
+package s3rpc
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestMetadataSchema(t *testing.T) {
+	c := qt.New(t)
+
+	schema := &MetadataSchema{
+		Fields: map[string]MetadataField{
+			"Width":  {Required: true, Type: MetadataInt},
+			"format": {Enum: []string{"jpg", "png"}},
+			"sharp":  {Type: MetadataBool},
+		},
+	}
+	c.Assert(schema.init(), qt.IsNil)
+
+	c.Assert(schema.Validate(map[string]string{"width": "100", "format": "png", MetaInputChecksum: "abc"}), qt.IsNil)
+	c.Assert(schema.Validate(map[string]string{"WIDTH": "100"}), qt.IsNil)
+
+	err := schema.Validate(map[string]string{"format": "gif", "sharp": "maybe", "height": "10"})
+	c.Assert(err, qt.ErrorMatches, `invalid metadata: format: "gif" is not one of jpg, png; height: unknown key; sharp: "maybe" is not a valid bool; width: required`)
+	var verr *MetadataValidationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(verr.Errors, qt.HasLen, 4)
+	c.Assert(verr.Errors[3], qt.Equals, MetadataFieldError{Key: "width", Message: "required"})
+
+	schema.AllowUnknown = true
+	c.Assert(schema.Validate(map[string]string{"width": "1", "height": "10"}), qt.IsNil)
+	c.Assert(schema.Validate(map[string]string{"width": "1.5"}), qt.ErrorMatches, `invalid metadata: width: "1.5" is not a valid int`)
+
+	c.Assert(initMetadataSchemas(map[string]*MetadataSchema{"resize": {Fields: map[string]MetadataField{"a": {Type: "date"}}}}), qt.ErrorMatches, `op "resize": metadata schema: key "a": unknown type "date"`)
+}
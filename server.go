@@ -4,15 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
-	"strings"
+	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -25,15 +26,28 @@ func NewServer(opts ServerOptions) (*Server, error) {
 	awsCfg := aws.Config{
 		Region:      opts.Region,
 		Credentials: credentials.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, ""),
+		APIOptions:  opts.apiOptions(),
 	}
 
-	if opts.PollInterval == 0 {
-		opts.PollInterval = 10 * time.Second
+	if opts.InstanceID == "" {
+		opts.InstanceID = newInstanceID()
 	}
 
-	if opts.Infof == nil {
+	var logger *JSONLogger
+	if opts.Logger != nil {
+		logger = opts.Logger.With(map[string]interface{}{"instance_id": opts.InstanceID})
+		opts.Infof = logger.Infof
+	} else {
+		if opts.Infof == nil {
+			opts.Infof = func(format string, args ...interface{}) {
+				fmt.Println("server: " + fmt.Sprintf(format, args...))
+			}
+		}
+
+		infof := opts.Infof
+		instanceID := opts.InstanceID
 		opts.Infof = func(format string, args ...interface{}) {
-			fmt.Println("server: " + fmt.Sprintf(format, args...))
+			infof("[%s] "+format, append([]interface{}{instanceID}, args...)...)
 		}
 	}
 
@@ -42,19 +56,96 @@ func NewServer(opts ServerOptions) (*Server, error) {
 		return nil, err
 	}
 
-	return &Server{
-		handlers:      opts.Handlers,
-		pollIntervall: opts.PollInterval,
-		quit:          make(chan struct{}),
-		common: &common{
-			bucket:    opts.Bucket,
-			queue:     opts.Queue,
-			s3Client:  s3.NewFromConfig(awsCfg),
-			sqsClient: sqs.NewFromConfig(awsCfg),
-			tempDir:   tempDir,
-			infof:     opts.Infof,
-		},
-	}, nil
+	var workspaces *workspacePool
+	if opts.WorkspacePool != nil {
+		if workspaces, err = newWorkspacePool(tempDir, opts.WorkspacePool.Size); err != nil {
+			os.RemoveAll(tempDir)
+			return nil, err
+		}
+	}
+
+	var memoryDir string
+	if opts.MemoryWorkspace != nil {
+		if memoryDir, err = os.MkdirTemp(opts.MemoryWorkspace.Dir, "s3rpc_server"); err != nil {
+			os.RemoveAll(tempDir)
+			return nil, fmt.Errorf("memory workspace: %w", err)
+		}
+	}
+
+	server := &Server{
+		handlers:       opts.Handlers,
+		reloadHandlers: opts.ReloadHandlers,
+		control:        newControl(),
+		controlQueue:   opts.ControlQueue,
+		archive:        opts.Archive,
+		validators:     opts.Validators,
+		schemas:        opts.MetadataSchemas,
+		quarantine:     opts.Quarantine,
+		outputFilters:  opts.OutputFilters,
+		scanOpts:       opts.Scan,
+		listPolling:    opts.ListPolling,
+		keyFilter:      opts.KeyFilter,
+		quotas:         newQuotas(opts.Quotas),
+		ops:            opts.Ops,
+		opSlots:        newOpSlots(opts.Ops),
+		sandbox:        opts.Sandbox,
+		workspaces:     workspaces,
+		memory:         opts.MemoryWorkspace,
+		streamHandlers: opts.StreamHandlers,
+		stream:         opts.Stream,
+		memoryDir:      memoryDir,
+		events:         opts.Events,
+		pollTuner:      newPollTuner(),
+		quit:           make(chan struct{}),
+		stats:          newServerStats(opts.InstanceID),
+		singleton:      newSingleton(opts.Singleton, awsCfg, opts.InstanceID),
+		limiter:        newLimiter(opts.MaxConcurrency, opts.AdaptiveConcurrency),
+		pricing:        opts.Pricing,
+		metrics:        newCloudWatchMetrics(opts.CloudWatch, awsCfg, opts.Infof),
+		audit:          newAuditLog(opts.Audit, awsCfg, opts.Infof),
+		common:         newCommon(awsCfg, opts.Bucket, opts.Queue, tempDir, opts.Infof, logger),
+	}
+
+	server.objectLock = opts.ObjectLock
+	server.transfers = newTransferMonitor(opts.SlowTransfer, server.metrics)
+	server.directSubmit = opts.DirectSubmit
+	server.signatures = newSignatureVerifier(opts.Signatures, server.fetchPublicKey)
+	server.signing = opts.ResponseSigning
+	server.accessLog = opts.AccessLog
+	server.backpressure = opts.Backpressure
+	server.handlerRetries = opts.HandlerRetry
+	server.stuck = newStuckDetector(opts.StuckHandlers)
+	server.scheduler = newFairScheduler(opts.FairScheduling)
+	if opts.DecryptMetadata {
+		server.kms = kms.NewFromConfig(awsCfg)
+	}
+
+	if opts.Audit != nil && opts.Audit.S3 && opts.Audit.Write == nil {
+		server.audit.write = server.s3AuditWriter()
+	}
+
+	if opts.SNS != nil {
+		server.notifiers = append(server.notifiers, newSNSNotifier(*opts.SNS, awsCfg))
+	}
+	if opts.EventBridge != nil {
+		server.notifiers = append(server.notifiers, newEventBridgeNotifier(*opts.EventBridge, awsCfg))
+	}
+	if opts.Webhooks != nil {
+		server.notifiers = append(server.notifiers, newWebhookNotifier(*opts.Webhooks, server.bucket, server.s3Client))
+	}
+	if opts.StepFunctions != nil {
+		server.notifiers = append(server.notifiers, newStepFunctionsNotifier(*opts.StepFunctions, awsCfg))
+	}
+
+	if opts.ExpvarName != "" {
+		if err := publishExpvar(opts.ExpvarName, server); err != nil {
+			server.Close()
+			return nil, err
+		}
+		server.expvarName = opts.ExpvarName
+	}
+
+	return server, nil
 
 }
 
@@ -62,31 +153,102 @@ func NewServer(opts ServerOptions) (*Server, error) {
 type Output struct {
 	Filename string
 	Metadata map[string]string
+
+	// ContentType is the MIME type of the file.
+	// If empty, it is detected from the filename extension or content on upload.
+	ContentType string
+
+	// Timeline is set by Client.Execute. It is ignored in handler outputs.
+	Timeline Timeline
 }
 
 // Input is the input to a handler invocation.
 type Input struct {
 	Filename string
 	Metadata map[string]string
+
+	// ContentType is the MIME type of the file.
+	// If empty, it is detected from the filename extension or content on upload.
+	ContentType string
+
+	// Attempt is the attempt of the handler for this request, starting at 1.
+	// It is above 1 when the handler is retried after a Retryable error, see HandlerRetryOptions.
+	Attempt int
 }
 
 // Handlers is a map of operation names to handler functions.
 type Handlers map[string]func(ctx context.Context, input Input) (Output, error)
 
 // Server is a server that processes files from an S3 bucket.
+// Any number of servers can listen to the same queue;
+// each one is identified by its ServerOptions.InstanceID.
 type Server struct {
-	handlers      Handlers
-	pollIntervall time.Duration
-	quit          chan struct{}
+	handlersMu     sync.RWMutex
+	handlers       Handlers
+	reloadHandlers func() (Handlers, error)
+	control        *control
+	controlQueue   string
+	archive        bool
+	validators     map[string]Validator
+	schemas        map[string]*MetadataSchema
+	quarantine     bool
+	scanOpts       *ScanOptions
+	listPolling    *ListPollingOptions
+	keyFilter      *KeyFilterOptions
+	quotas         *quotas
+	signatures     *signatureVerifier
+	signing        *SigningOptions
+	accessLog      func(r AccessRecord)
+	backpressure   *BackpressureOptions
+	handlerRetries *HandlerRetryOptions
+	stuck          *stuckDetector
+	scheduler      *fairScheduler
+	kms            kmsClient
+	ops            map[string]OpOptions
+	opSlots        *opSlots
+	sandbox        *SandboxOptions
+	workspaces     *workspacePool
+	memory         *MemoryWorkspaceOptions
+	memoryDir      string
+	streamHandlers map[string]StreamHandler
+	stream         *StreamOptions
+	events         *EventBus
+	outputFilters  map[string]OutputFilter
+	expvarName     string
+
+	pollTuner *pollTuner
+	quit      chan struct{}
+	stats     *serverStats
+	singleton *singleton
+	limiter   *limiter
+	pricing   *Pricing
+	metrics   *cloudWatchMetrics
+	notifiers []notifier
+	audit     *auditLog
 	*common
 }
 
+// Stats returns a snapshot of the statistics for this server instance.
+func (s *Server) Stats() ServerStats {
+	stats := s.stats.snapshot()
+	stats.Concurrency = s.limiter.currentLimit()
+	stats.Paused = s.control.paused()
+	stats.Uploads, stats.Downloads = s.transfers.snapshot()
+	return stats
+}
+
 // Close closes the server.
 func (s *Server) Close() error {
 	var err error
 	s.closeOnce.Do(func() {
 		close(s.quit)
+		if s.expvarName != "" {
+			unpublishExpvar(s.expvarName)
+		}
 		err = os.RemoveAll(s.tempDir)
+		if s.memoryDir != "" {
+			os.RemoveAll(s.memoryDir)
+		}
 	})
 	return err
 }
@@ -95,88 +257,534 @@ func (s *Server) Close() error {
 // It blocks until the server is closed.
 func (s *Server) ListenAndServe(ctx context.Context) error {
 	g, ctx := errgroup.WithContext(ctx)
+
+	if s.metrics != nil {
+		g.Go(func() error {
+			s.metrics.run(ctx, s.quit)
+			return nil
+		})
+	}
+
+	if s.audit != nil {
+		g.Go(func() error {
+			s.audit.run(ctx, s.quit)
+			return nil
+		})
+	}
+
+	if s.controlQueue != "" {
+		g.Go(func() error {
+			return s.listenControl(ctx)
+		})
+	}
+
 	g.Go(func() error {
 		for {
+			if s.control.paused() {
+				// Do not hold on to requests while paused.
+				s.releaseScheduled(ctx, s.scheduler.drain())
+			}
+			s.control.waitIfPaused(ctx, s.quit)
+
+			// Wait for a free slot before receiving,
+			// so we don't hold on to messages we cannot handle yet.
+			// Requests waiting in the fair scheduler are checked for expiry every second.
+			available := s.limiter.waitFor(s.quit, s.scheduler.expiryCheckInterval())
+
 			select {
 			case <-s.quit:
+				s.releaseScheduled(ctx, s.scheduler.drain())
 				s.infof("Closed")
 				return nil
 			case <-ctx.Done():
 				return nil
 			default:
-				s.infof("Checking queue %q for new messages", s.queue)
-				ms, err := s.Receive(ctx)
-				if err != nil {
-					return err
+				var (
+					ms  []message
+					err error
+				)
+				max, wait := available, s.pollTuner.next()
+				if s.scheduler != nil {
+					s.releaseScheduled(ctx, s.scheduler.expired())
+					if available == 0 {
+						// Timed out waiting for a slot.
+						continue
+					}
+					max = s.scheduler.room()
+					if s.scheduler.len() > 0 {
+						// Do not hold up the buffered requests waiting for new ones.
+						wait = 0
+					}
+				}
+				if max > 0 {
+					if s.listPolling != nil {
+						s.infof("Listing %s/%s/ for new requests", s.bucket, toServer)
+						ms, err = s.listRequests(ctx, max)
+					} else {
+						s.infof("Checking queue %q for new messages, waiting up to %s", s.queue, wait)
+						ms, err = s.receive(ctx, max, wait)
+					}
+					if err != nil {
+						return err
+					}
+					s.pollTuner.observe(len(ms))
+				}
+				if s.scheduler != nil {
+					s.scheduler.push(ms)
+					ms = s.scheduler.take(available)
 				}
 
 				for _, m := range ms {
-					if m.Bucket != s.bucket {
-						return fmt.Errorf("expected bucket %q, got %q", s.bucket, m.Bucket)
+					m := m
+					s.limiter.acquire()
+					g.Go(func() error {
+						err := s.handleMessage(ctx, m)
+						if err != nil {
+							if m.Op != "" {
+								s.auditEvent(ctx, m.Op, m.Key, AuditRecord{Event: AuditFailed, Error: err.Error()})
+								s.event(m.Op, m.Key, Event{Type: EventError, Err: err})
+							}
+						}
+						return err
+					})
+				}
+
+				if len(ms) == 0 && s.listPolling != nil {
+					// Stop waiting when the server is closed.
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+					case <-s.quit:
 					}
+				}
+			}
+		}
+	})
 
-					s.infof("Got message with key %q", m.Key)
+	return g.Wait()
 
-					op := strings.Split(m.Key, "/")[1]
-					handle := s.handlers[op]
-					if handle == nil {
-						if err := s.releaseMessage(ctx, m.ReceiptHandle); err != nil {
-							return err
-						}
-						continue
-					}
+}
 
-					// We have a handler for this operation, so we can process the file.
-					// Delete the message from the queue before the visibility timeout expires.
-					if err := s.deleteMessage(ctx, m.ReceiptHandle); err != nil {
-						return err
-					}
+// handleMessage handles m in a slot acquired from s.limiter.
+func (s *Server) handleMessage(ctx context.Context, m message) (err error) {
+	op := m.Op
+	started := time.Now()
+	defer func() {
+		s.limiter.release(op, time.Since(started))
+	}()
 
-					baseKey := path.Base(m.Key)
+	if m.Bucket != s.bucket {
+		return fmt.Errorf("expected bucket %q, got %q", s.bucket, m.Bucket)
+	}
 
-					err = func() error {
-						f, err := os.CreateTemp(s.tempDir, "*_"+baseKey)
-						if err != nil {
-							return fmt.Errorf("tempfile: %w", err)
-						}
-						defer f.Close()
-						defer os.Remove(f.Name())
+	ctx = withRequestLogFields(ctx, op, m.Key)
+	ctx = withReplyQueue(ctx, m.ReplyQueue)
+	s.logf(ctx, "Got message with key %q", m.Key)
 
-						metaData, err := s.getObject(ctx, f, m.Key)
-						if err != nil {
-							return err
-						}
+	if !m.EventTime.IsZero() {
+		s.metrics.observeAge(time.Since(m.EventTime))
+	}
 
-						result, err := handle(ctx, Input{Filename: f.Name(), Metadata: metaData})
-						if err != nil {
-							return fmt.Errorf("handle: %w", err)
-						}
+	s.handlersMu.RLock()
+	handle := s.handlers[op]
+	s.handlersMu.RUnlock()
+	if handle == nil || !s.keyFilter.matches(m.Key) {
+		// Leave it for another server.
+		return s.retryMessage(ctx, m, 0)
+	}
+	if s.sandbox.sandboxed(op) {
+		handle = func(ctx context.Context, input Input) (Output, error) {
+			return s.sandbox.handle(ctx, op, input)
+		}
+	}
 
-						// The client uses an UUID in the base name of the file to identify the
-						// message in the output quueue, so we need to preserve that.
-						// With that, we also know that it's unique.
-						key := toClient + "/" + op + "/" + baseKey
+	ctx, usage := withUsage(ctx)
+	defer func() {
+		s.stats.addUsage(op, usage.usage())
+	}()
 
-						if err := s.upload(result.Filename, key, result.Metadata); err != nil {
-							return err
-						}
+	var lock *lease
+	if s.singleton.isSingleton(op) {
+		l, ok, err := s.singleton.lock(ctx, s.common, op, m.Key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			s.logf(ctx, "Op %q is locked by another server, retrying %q in %s", op, m.Key, s.singleton.opts.RetryAfter)
+			return s.retryMessage(ctx, m, s.singleton.opts.RetryAfter)
+		}
+		defer l.unlock()
+		lock = l
+	}
 
-						return err
+	opFull := !s.opSlots.tryAcquire(op)
+	if !opFull {
+		defer s.opSlots.release(op)
+	} else if !s.backpressure.rejectsOpConcurrency() {
+		s.logf(ctx, "Op %q is at its max concurrency, retrying %q in %s", op, m.Key, opRetryAfter)
+		return s.retryMessage(ctx, m, opRetryAfter)
+	}
+
+	// We have a handler for this operation, so we can process the file.
+	// Delete the message from the queue before the visibility timeout expires.
+	if err := s.ackMessage(ctx, m); err != nil {
+		return err
+	}
 
-					}()
+	id := m.RequestID
+	ctx, done, ok := s.control.start(ctx, op, id)
+	if !ok {
+		s.logf(ctx, "Request %q is cancelled, dropping it", id)
+		return nil
+	}
+	defer done()
 
-					if err != nil {
-						return err
-					}
+	s.auditEvent(ctx, op, m.Key, AuditRecord{Event: AuditReceived, Principal: m.Principal, SourceIP: m.SourceIP})
+	if s.accessLog != nil {
+		var access *accessEntry
+		ctx, access = withAccessEntry(ctx)
+		access.setRequest(id, m.Key, 0)
+		defer func(started time.Time) {
+			access.inputSize = usage.usage().BytesDownloaded
+			r := access.record(AccessServer, op, RequestIdentity(ctx), started, err)
+			r.InstanceID = s.stats.instanceID
+			s.accessLog(r)
+		}(time.Now())
+	}
+	s.event(op, m.Key, Event{Type: EventRequestReceived})
+
+	if err := s.backpressure.check(ctx, op, opFull); err != nil {
+		s.logf(ctx, "Request %q rejected, the server is busy: %s", id, err)
+		return s.respondError(ctx, op, m.Key, ErrorCodeBusy, err)
+	}
+
+	if s.archive {
+		// The request itself is not affected by this, so just log any error.
+		if err := s.copyObject(ctx, m.Key, archiveKey(m.Key)); err != nil {
+			s.logf(ctx, "Failed to archive %q: %s", m.Key, err)
+		}
+	}
+
+	defer func() {
+		s.auditEvent(ctx, op, m.Key, AuditRecord{Event: AuditCleaned})
+	}()
+
+	var (
+		f         *os.File
+		abandoned bool
+		dir       = s.tempDir
+		opts      = s.ops[op]
+		stream    *inputStream
+	)
+	if handleStream := s.streamHandlers[op]; handleStream != nil {
+		if stream, err = s.openStream(ctx, m.Key); err != nil {
+			return err
+		}
+		if stream != nil {
+			defer stream.close()
+			handle = func(ctx context.Context, _ Input) (Output, error) {
+				return handleStream(ctx, stream.input())
+			}
+		}
+	}
+	if s.workspaces != nil {
+		ws, err := s.workspaces.get()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// An abandoned handler may still write to its workspace.
+			if !abandoned {
+				s.workspaces.put(ws)
+			}
+		}()
+		dir = ws
+	}
+
+	var (
+		w  io.Writer
+		sf *spillFile
+	)
+	switch {
+	case stream != nil:
+		// The handler reads the input while it is downloaded.
+	case opts.MemoryWorkspace:
+		if sf, err = newSpillFile(s.memoryDir, dir, m.Key, s.memory.MaxSize); err != nil {
+			return err
+		}
+		defer sf.remove()
+		w = sf
+	default:
+		if s.workspaces != nil {
+			f, err = createWorkspaceFile(dir, m.Key)
+		} else {
+			f, err = createTemp(dir, m.Key)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		defer os.Remove(f.Name())
+		w = f
+	}
+
+	var (
+		input         Input
+		inputSize     int64
+		inputChecksum string
+	)
+	if stream != nil {
+		input = Input{Metadata: stream.metadata, ContentType: stream.contentType}
+		inputSize = stream.size
+	} else {
+		metaData, contentType, err := s.getObject(ctx, w, m.Key)
+		if err != nil {
+			return err
+		}
+		if sf != nil {
+			// The input may have been moved to disk.
+			f = sf.File
+		}
+		if metaData[MetaDeltaBaseline] != "" {
+			rf, err := s.reconstructDelta(ctx, dir, m.Key, f, metaData)
+			if err != nil {
+				s.logf(ctx, "Request %q could not be rebuilt from its delta: %s", id, err)
+				return s.respondError(ctx, op, m.Key, ErrorCodeInvalidInput, err)
+			}
+			defer rf.Close()
+			defer os.Remove(rf.Name())
+			f = rf
+		}
+		if fi, err := f.Stat(); err == nil {
+			inputSize = fi.Size()
+		}
+		input = Input{Filename: f.Name(), Metadata: metaData, ContentType: contentType}
+		if metaData[MetaInputChecksum] != "" {
+			// The client wants to verify that the response answers its request.
+			if inputChecksum, err = fileChecksum(f.Name()); err != nil {
+				return err
+			}
+		}
+	}
+	usage.add(Usage{BytesDownloaded: inputSize})
+	metaData := input.Metadata
+	ctx = withRequestMetadata(ctx, metaData)
+	if identity := identityFromMetadata(metaData); !identity.IsZero() {
+		ctx = withIdentityLogFields(WithIdentity(ctx, identity), identity)
+		s.logf(ctx, "Request %q is from service %q, user %q, tenant %q", id, identity.Service, identity.User, identity.Tenant)
+	}
+
+	if err := checkRequestProtocol(metaData); err != nil {
+		s.logf(ctx, "Request %q is from a newer client: %s", id, err)
+		return s.respondError(ctx, op, m.Key, ErrorCodeProtocolVersion, err)
+	}
+
+	if s.signatures != nil {
+		if err := s.signatures.verify(ctx, m.Key, input); err != nil {
+			s.logf(ctx, "Request %q failed signature verification: %s", id, err)
+			if errors.Is(err, ErrInvalidSignature) {
+				return s.respondError(ctx, op, m.Key, ErrorCodeInvalidSignature, err)
+			}
+			return err
+		}
+	}
+
+	if err := decryptMetadata(ctx, s.kms, op, metaData); err != nil {
+		s.logf(ctx, "Request %q has metadata that could not be decrypted: %s", id, err)
+		return s.respondError(ctx, op, m.Key, ErrorCodeInvalidMetadata, err)
+	}
+
+	if err := s.quotas.admit(RequestIdentity(ctx), inputSize, time.Now()); err != nil {
+		s.logf(ctx, "Request %q is over quota: %s", id, err)
+		s.stats.quotaExceeded()
+		s.metrics.observeQuotaExceeded(op)
+		return s.respondError(ctx, op, m.Key, ErrorCodeQuotaExceeded, err)
+	}
+
+	if schema := s.schemas[op]; schema != nil {
+		if err := schema.Validate(metaData); err != nil {
+			s.logf(ctx, "Request %q has invalid metadata: %s", id, err)
+			return s.respondError(ctx, op, m.Key, ErrorCodeInvalidMetadata, err)
+		}
+	}
+
+	if opts.MaxInputSize > 0 && inputSize > opts.MaxInputSize {
+		err := fmt.Errorf("input is %d bytes, max is %d", inputSize, opts.MaxInputSize)
+		s.logf(ctx, "Request %q is too large: %s", id, err)
+		return s.respondError(ctx, op, m.Key, ErrorCodeInvalidInput, err)
+	}
+
+	// Streamed inputs are not on disk to scan or validate.
+	if stream == nil {
+		if ok, err := s.scan(ctx, op, m.Key, input); !ok {
+			return err
+		}
+	}
+
+	if validate := s.validators[op]; validate != nil && stream == nil {
+		if err := validate(ctx, input); err != nil {
+			s.logf(ctx, "Request %q is invalid: %s", id, err)
+			if s.quarantine {
+				if err := s.copyObject(ctx, m.Key, quarantineKey(m.Key)); err != nil {
+					s.logf(ctx, "Failed to quarantine %q: %s", m.Key, err)
 				}
+			}
+			return s.respondError(ctx, op, m.Key, ErrorCodeInvalidInput, err)
+		}
+	}
 
-				time.Sleep(s.pollIntervall)
+	s.stats.start()
+	handlerStarted := time.Now()
+	if !m.EventTime.IsZero() {
+		age := handlerStarted.Sub(m.EventTime)
+		s.stats.messageAge.observe(age)
+		s.metrics.observeMessageAge(op, age)
+	}
+	s.event(op, m.Key, Event{Type: EventHandlerStarted, Size: usage.usage().BytesDownloaded})
+	emitter := &chunkEmitter{s: s, op: op, id: id}
+	checkpoints := &checkpointer{s: s, op: op, id: id}
+	newHandlerCtx := func() (context.Context, context.CancelFunc) {
+		lockCtx, cancelLock := lock.context(ctx)
+		handlerCtx, cancel := withOptionalTimeout(withCheckpointer(withChunkEmitter(lockCtx, emitter), checkpoints), opts.Timeout)
+		return handlerCtx, func() {
+			cancel()
+			cancelLock()
+		}
+	}
+	first := m.Attempt
+	if first == 0 {
+		first = 1
+	}
+	result, err := s.runHandlerWithRetries(ctx, newHandlerCtx, op, id, opts, first, stream != nil, handle, input)
+	var abandonedErr *abandonedError
+	abandoned = errors.As(err, &abandonedErr)
+	if lock.isLost() {
+		// Another server may have run the op at the same time.
+		err = lockLostError(err)
+	}
+	var partial error
+	if errors.Is(err, ErrPartial) && result.Filename != "" {
+		// The partial result is sent as the response, with ErrorCodePartial.
+		partial, err = err, nil
+	}
+	if stream != nil && stream.hash != nil && err == nil {
+		if inputChecksum, err = stream.checksum(); err != nil {
+			err = fmt.Errorf("read input: %w", err)
+		}
+	}
+	handlerFinished := time.Now()
+	s.metrics.observe(op, time.Since(handlerStarted), err)
+	s.stats.handlerDuration.observe(time.Since(handlerStarted))
+	handled := AuditRecord{Event: AuditHandled, Size: usage.usage().BytesDownloaded, Duration: time.Since(handlerStarted)}
+	if err != nil {
+		handled.Error = err.Error()
+	}
+	s.auditEvent(ctx, op, m.Key, handled)
+	s.event(op, m.Key, Event{Type: EventHandlerFinished, Duration: handled.Duration, Err: err})
+	s.stats.done(err)
+	if s.control.isCancelled(id) {
+		s.logf(ctx, "Request %q was cancelled", id)
+		return nil
+	}
+	var requeueErr *requeueError
+	if errors.As(err, &requeueErr) {
+		s.logf(ctx, "Request %q failed (attempt %d), requeueing it with a delay of %s: %s", id, requeueErr.attempt-1, requeueErr.delay, err)
+		return s.requeueMessage(ctx, m, requeueErr.attempt, requeueErr.delay)
+	}
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		s.logf(ctx, "Request %q failed: %s", id, limitErr)
+		return s.respondError(ctx, op, m.Key, limitErr.code, limitErr)
+	}
+	if errors.Is(err, ErrNoRoute) {
+		return s.respondError(ctx, op, m.Key, ErrorCodeNoRoute, err)
+	}
+	if retryable, permanent := classifiedHandlerError(err); retryable || permanent {
+		s.logf(ctx, "Request %q failed: %s", id, err)
+		return s.respondError(ctx, op, m.Key, ErrorCodeHandler, err)
+	}
+	if err != nil {
+		s.notify(ctx, Completion{Op: op, Key: m.Key, Status: CompletionFailed, ErrorCode: ErrorCodeHandler, Error: err.Error()})
+		return fmt.Errorf("handle: %w", err)
+	}
+
+	result, cleanup, err := s.filterOutput(ctx, op, input, result)
+	defer cleanup()
+	if err != nil {
+		s.logf(ctx, "Output for request %q was rejected: %s", id, err)
+		return s.respondError(ctx, op, m.Key, ErrorCodeHandler, err)
+	}
+
+	key := responseKey(op, m.Key)
+
+	metadata := s.responseMetadata(op, id, inputChecksum)
+	Timeline{Enqueued: m.EventTime, Received: started, HandlerStarted: handlerStarted, HandlerFinished: handlerFinished}.setServerMetadata(metadata)
+	if partial != nil {
+		metadata[MetaErrorCode] = ErrorCodePartial
+		metadata[MetaError] = truncate(partial.Error(), maxErrorMessageLen)
+	}
+	for k, v := range result.Metadata {
+		if _, found := metadata[k]; !found {
+			metadata[k] = v
+		}
+	}
+	if n := emitter.count(); n > 0 {
+		metadata[MetaChunkCount] = strconv.Itoa(n)
+	}
+
+	filename, contentType := result.Filename, result.ContentType
+	var outputChecksum string
+	if s.signing != nil {
+		// Sign the output as the client sees it, after decompression.
+		if outputChecksum, err = fileChecksum(filename); err != nil {
+			return err
+		}
+	}
+	if opts.Compress || opts.Dictionary != "" {
+		if contentType == "" {
+			if contentType, err = detectContentType(filename); err != nil {
+				return err
 			}
 		}
-	})
+		if filename, err = s.compressFile(ctx, s.tempDir, filename, opts.Dictionary, metadata); err != nil {
+			return err
+		}
+		defer os.Remove(filename)
+	}
 
-	return g.Wait()
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	if s.pricing != nil {
+		// The upload has not happened yet, so estimate it.
+		estimate := usage.usage()
+		estimate.add(uploadUsage(fi.Size()))
+		metadata[MetaCost] = strconv.FormatFloat(estimate.Cost(*s.pricing), 'g', 6, 64)
+	}
 
+	if s.signing != nil {
+		s.signing.sign(key, outputChecksum, metadata)
+	}
+
+	if err := s.upload(ctx, filename, key, contentType, opts.StorageClass, metadata); err != nil {
+		return err
+	}
+	if err := s.sendReply(ctx, op, m.Key, key); err != nil {
+		return err
+	}
+	usage.add(Usage{BytesUploaded: fi.Size()})
+	accessEntryFrom(ctx).setResponse(key, fi.Size(), metadata[MetaErrorCode], metadata[MetaError])
+	if partial == nil {
+		checkpoints.remove(ctx)
+	}
+	s.auditEvent(ctx, op, m.Key, AuditRecord{Event: AuditResponded, Size: fi.Size()})
+	s.event(op, m.Key, Event{Type: EventResponseUploaded, Size: fi.Size()})
+
+	s.notify(ctx, Completion{Op: op, Key: m.Key, Status: CompletionSucceeded, ResultKey: key, Metadata: metadata})
+
+	return nil
 }
 
 // ServerOptions are options for the server.
@@ -185,24 +793,208 @@ type ServerOptions struct {
 	// The operation is also the first path segment below in/out in the bucket.
 	Handlers Handlers
 
+	// ReloadHandlers, if set, is called on the ControlReloadHandlers command
+	// to replace Handlers.
+	ReloadHandlers func() (Handlers, error)
+
 	// The in queue to poll for new messages.
+	// Not used with ListPolling.
 	Queue string
 
-	// PollInterval is the interval between polling for new messages.
+	// ListPolling, if set, finds requests by listing the bucket instead of
+	// receiving from Queue.
+	ListPolling *ListPollingOptions
+
+	// KeyFilter, if set, limits the requests handled by this server by key pattern,
+	// e.g. when several deployments share one bucket and queue.
+	KeyFilter *KeyFilterOptions
+
+	// Quotas, if set, limits the requests per caller Identity.
+	// Combine it with Signatures if the callers can not be trusted to identify themselves.
+	Quotas *QuotaOptions
+
+	// DecryptMetadata, if set, decrypts the metadata values encrypted by clients with
+	// ClientOptions.EncryptMetadata before the request is handled.
+	// Requests with encrypted metadata are otherwise rejected with ErrorCodeInvalidMetadata.
+	DecryptMetadata bool
+
+	// Signatures, if set, verifies the signatures of requests from clients with ClientOptions.Signing.
+	Signatures *SignatureOptions
+
+	// FairScheduling, if set, starts the requests of different ops, or tenants,
+	// with weighted fair queueing instead of in the order they are received.
+	FairScheduling *FairSchedulingOptions
+
+	// Backpressure, if set, rejects requests with ErrorCodeBusy when the server is saturated.
+	Backpressure *BackpressureOptions
+
+	// AccessLog, if set, is called with an AccessRecord once per request handled by this server.
+	// It is called synchronously, so it should not block.
+	AccessLog func(r AccessRecord)
+
+	// HandlerRetry configures the retries of handlers that fail with a Retryable error.
+	// It can be overridden per op with OpOptions.HandlerRetry.
+	// Defaults to 3 attempts with a backoff from 1 second.
+	HandlerRetry *HandlerRetryOptions
+
+	// StuckHandlers, if set, reports, and optionally cancels, handlers that run for
+	// much longer than their op's p99 duration.
+	StuckHandlers *StuckHandlerOptions
+
+	// ResponseSigning, if set, signs the responses, including error responses,
+	// so clients with ClientOptions.ResponseSignatures can verify that they were
+	// produced by this server. The signature covers the response key, which holds
+	// the op and request ID, the SHA-256 of the output and its metadata.
+	// Chunks emitted with EmitChunk are not signed.
+	ResponseSigning *SigningOptions
+
+	// DirectSubmit, if set, only accepts requests sent by clients with ClientOptions.SubmitQueue
+	// and never parses S3 event notifications, which are deleted from the queue.
+	// Use it with buckets where event notifications can not be configured,
+	// see ProvisionerOptions.DirectSubmit.
+	DirectSubmit bool
+
+	// ControlQueue, if set, is an SQS queue to poll for ControlMessage commands,
+	// see SendControlMessage.
+	// An SQS message is only received by one server, so to reach all replicas,
+	// give each its own queue, e.g. subscribed to an SNS topic with raw message delivery,
+	// or set ControlMessage.InstanceID.
+	ControlQueue string
+
+	// PollInterval was the interval between polling for new messages when the queue is empty.
+	//
+	// Deprecated: The wait for new messages is tuned from the arrival rate, between 1 second
+	// under load and 20 seconds when idle. This is ignored.
 	PollInterval time.Duration
 
+	// MaxConcurrency is the maximum number of requests handled concurrently.
+	// Defaults to 1, or 4 times the number of CPUs with AdaptiveConcurrency.
+	MaxConcurrency int
+
+	// Ops maps an operation to OpOptions overriding the defaults for it,
+	// e.g. its handler timeout and concurrency.
+	Ops map[string]OpOptions
+
+	// WorkspacePool, if set, downloads each input into its own workspace directory,
+	// taken from a pool of directories that are scrubbed and reused between requests.
+	WorkspacePool *WorkspacePoolOptions
+
+	// StreamHandlers maps an operation to a handler of inputs of at least StreamOptions.Threshold
+	// in size, which reads the input while it is downloaded.
+	// Smaller inputs are passed to the handler in Handlers, which is required.
+	// Streamed inputs are not scanned nor validated by the Validators,
+	// the Input passed to OutputFilters has no Filename, and they are not sandboxed.
+	StreamHandlers map[string]StreamHandler
+
+	// Stream configures the streaming of inputs to StreamHandlers.
+	// Defaults to a 64 MiB threshold and four concurrent 16 MiB parts.
+	Stream *StreamOptions
+
+	// MemoryWorkspace configures the memory-backed workspaces of the ops with
+	// OpOptions.MemoryWorkspace. Defaults to /dev/shm with an 8 MiB threshold.
+	MemoryWorkspace *MemoryWorkspaceOptions
+
+	// Sandbox, if set, runs the handlers in a worker subprocess per request,
+	// so a crash or leak in a handler does not affect the server.
+	// The op must still have a handler in Handlers.
+	Sandbox *SandboxOptions
+
+	// AdaptiveConcurrency, if set, varies the number of requests handled concurrently
+	// between 1 and MaxConcurrency based on handler latency and host CPU and memory usage.
+	AdaptiveConcurrency *AdaptiveConcurrencyOptions
+
 	// Infof logs info messages.
+	// Messages are prefixed with the instance ID.
 	Infof func(format string, args ...interface{})
 
+	// Logger, if set, is used instead of Infof to log JSON lines,
+	// including the instance ID and, when handling a request, the op and request ID.
+	Logger *JSONLogger
+
+	// Singleton, if set, makes sure that the configured ops never run concurrently
+	// across server replicas.
+	Singleton *SingletonOptions
+
+	// Validators maps an operation to a Validator run before the handler.
+	// See CombineValidators, MaxSizeValidator, ExtensionValidator and ContentTypeValidator.
+	Validators map[string]Validator
+
+	// MetadataSchemas maps an operation to a MetadataSchema the request metadata is validated
+	// against before the input is scanned, validated and handled.
+	MetadataSchemas map[string]*MetadataSchema
+
+	// Scan, if set, scans inputs before they are validated and handled,
+	// for deployments accepting files from untrusted clients.
+	Scan *ScanOptions
+
+	// Quarantine, if set, copies inputs rejected by a Validator below quarantine/
+	// for inspection.
+	// See ProvisionerOptions.QuarantineExpirationDays.
+	Quarantine bool
+
+	// OutputFilters maps an operation to an OutputFilter run on the handler's Output before upload.
+	// See CombineOutputFilters and ValidateOutput.
+	OutputFilters map[string]OutputFilter
+
+	// ObjectLock, if set, configures writes for buckets with S3 Object Lock enabled,
+	// e.g. the retention of responses.
+	ObjectLock *ObjectLockOptions
+
+	// SNS, if set, publishes a Completion to an SNS topic for each finished request.
+	SNS *SNSOptions
+
+	// EventBridge, if set, sends an event for each finished request to an EventBridge bus,
+	// e.g. to start a Step Functions state machine.
+	EventBridge *EventBridgeOptions
+
+	// Webhooks, if set, POSTs a signed WebhookPayload to the MetaCallbackURL set
+	// on a request when it finishes.
+	Webhooks *WebhookOptions
+
+	// StepFunctions, if set, completes the Step Functions task in the MetaTaskToken set
+	// on a request when it finishes, so an op can be a callback task in a state machine.
+	StepFunctions *StepFunctionsOptions
+
+	// Events, if set, receives an Event per request lifecycle event.
+	Events *EventBus
+
+	// Audit, if set, writes an AuditRecord per request lifecycle event to a Firehose stream,
+	// JSONL objects in the bucket or a custom writer.
+	Audit *AuditOptions
+
+	// Archive, if set, copies each request input below archive/ before handling it,
+	// so it can be replayed with Admin.Replay.
+	// See ProvisionerOptions.ArchiveExpirationDays.
+	Archive bool
+
+	// Pricing, if set, is used to estimate the AWS cost of handling each request,
+	// which is added to the response metadata (see MetaCost).
+	// See DefaultPricing. The usage per op is always available in ServerStats.Usage.
+	Pricing *Pricing
+
+	// CloudWatch, if set, publishes metrics to CloudWatch.
+	CloudWatch *CloudWatchOptions
+
+	// SlowTransfer, if set, warns about slow request downloads and response uploads.
+	// The throughput of all transfers is available in ServerStats.
+	SlowTransfer *SlowTransferOptions
+
+	// ExpvarName, if set, publishes the server Stats with this name in the "s3rpc" expvar map,
+	// e.g. available on /debug/vars with the expvar package's HTTP handler.
+	// The name must be unique among the open servers in the process;
+	// it is released when the server is closed.
+	ExpvarName string
+
+	// InstanceID identifies this server when running multiple replicas against the same queue.
+	// It is included in the logs, the stats and the response metadata (see MetaInstanceID).
+	// Defaults to <hostname>-<pid>-<random>.
+	InstanceID string
+
 	// The AWS config.
 	AWSConfig
 }
 
 func (opts *ServerOptions) init() error {
-	if opts.Region == "" {
-		opts.Region = defaultRegion
-	}
-
 	if opts.AccessKeyID == "" {
 		return errors.New("access key id is required")
 	}
@@ -211,9 +1003,191 @@ func (opts *ServerOptions) init() error {
 		return errors.New("secret access key is required")
 	}
 
-	if opts.Queue == "" {
+	if opts.ListPolling != nil {
+		if err := opts.ListPolling.init(); err != nil {
+			return err
+		}
+	} else if opts.Queue == "" {
 		return fmt.Errorf("queue is required")
 	}
 
-	return nil
+	if opts.KeyFilter != nil {
+		if err := opts.KeyFilter.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Quotas != nil {
+		if err := opts.Quotas.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.FairScheduling != nil {
+		if err := opts.FairScheduling.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Backpressure != nil {
+		if err := opts.Backpressure.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.HandlerRetry == nil {
+		opts.HandlerRetry = &HandlerRetryOptions{}
+	}
+	if err := opts.HandlerRetry.init(); err != nil {
+		return err
+	}
+	if opts.HandlerRetry.Requeue && opts.ListPolling != nil {
+		return errors.New("handler retry: requeue is not supported with list polling")
+	}
+
+	if opts.StuckHandlers != nil {
+		if err := opts.StuckHandlers.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.ResponseSigning != nil {
+		if err := opts.ResponseSigning.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Signatures != nil {
+		if err := opts.Signatures.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Singleton != nil {
+		if err := opts.Singleton.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.ObjectLock != nil {
+		if err := opts.ObjectLock.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.SNS != nil {
+		if err := opts.SNS.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.EventBridge != nil {
+		if err := opts.EventBridge.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Webhooks != nil {
+		if err := opts.Webhooks.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Audit != nil {
+		if err := opts.Audit.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Scan != nil {
+		if err := opts.Scan.init(); err != nil {
+			return err
+		}
+	}
+
+	if err := initMetadataSchemas(opts.MetadataSchemas); err != nil {
+		return err
+	}
+
+	for op, o := range opts.Ops {
+		if err := o.validate(op); err != nil {
+			return err
+		}
+		if o.HandlerRetry != nil {
+			if err := o.HandlerRetry.init(); err != nil {
+				return fmt.Errorf("op %q: %w", op, err)
+			}
+			if o.HandlerRetry.Requeue && opts.ListPolling != nil {
+				return fmt.Errorf("op %q: handler retry: requeue is not supported with list polling", op)
+			}
+		}
+	}
+
+	if opts.Sandbox != nil {
+		if err := opts.Sandbox.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.CloudWatch != nil {
+		if err := opts.CloudWatch.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.SlowTransfer != nil {
+		if err := opts.SlowTransfer.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.AdaptiveConcurrency != nil {
+		if err := opts.AdaptiveConcurrency.init(); err != nil {
+			return err
+		}
+		if opts.MaxConcurrency == 0 {
+			opts.MaxConcurrency = 4 * runtime.NumCPU()
+		}
+	}
+
+	if opts.MaxConcurrency == 0 {
+		opts.MaxConcurrency = 1
+	}
+
+	if opts.WorkspacePool != nil {
+		if err := opts.WorkspacePool.init(opts.MaxConcurrency); err != nil {
+			return err
+		}
+	}
+
+	for op := range opts.StreamHandlers {
+		if opts.Handlers[op] == nil {
+			return fmt.Errorf("stream handler for op %q has no handler for small inputs", op)
+		}
+	}
+	if len(opts.StreamHandlers) > 0 && opts.Stream == nil {
+		opts.Stream = &StreamOptions{}
+	}
+	if opts.Stream != nil {
+		if err := opts.Stream.init(); err != nil {
+			return err
+		}
+	}
+
+	if opts.MemoryWorkspace == nil {
+		for _, o := range opts.Ops {
+			if o.MemoryWorkspace {
+				opts.MemoryWorkspace = &MemoryWorkspaceOptions{}
+				break
+			}
+		}
+	}
+	if opts.MemoryWorkspace != nil {
+		if err := opts.MemoryWorkspace.init(); err != nil {
+			return err
+		}
+	}
+
+	// Resolve the region last, as it may need a network call.
+	return opts.resolveRegion(opts.Queue)
 }
@@ -0,0 +1,213 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestServerExpvar(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ServerOptions{
+		Queue:      "https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue",
+		ExpvarName: "s3rpc_test",
+		InstanceID: "myinstance",
+		AWSConfig:  AWSConfig{AccessKeyID: "id", SecretAccessKey: "secret"},
+	}
+
+	server, err := NewServer(opts)
+	c.Assert(err, qt.IsNil)
+
+	var stats ServerStats
+	c.Assert(json.Unmarshal([]byte(expvar.Get("s3rpc").(*expvar.Map).Get("s3rpc_test").String()), &stats), qt.IsNil)
+	c.Assert(stats.InstanceID, qt.Equals, "myinstance")
+	c.Assert(stats.Concurrency, qt.Equals, 1)
+
+	_, err = NewServer(opts)
+	c.Assert(err, qt.ErrorMatches, `expvar "s3rpc_test" is already published`)
+
+	// The name is released on Close.
+	c.Assert(server.Close(), qt.IsNil)
+	c.Assert(expvar.Get("s3rpc").(*expvar.Map).Get("s3rpc_test"), qt.IsNil)
+	server, err = NewServer(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(server.Close(), qt.IsNil)
+}
+
+// TestServerPipeline runs requests through ListenAndServe with a fake S3 and SQS:
+// a valid input is archived, handled and answered, an invalid one is quarantined
+// and answered with an error.
+func TestServerPipeline(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ServerOptions{
+		Handlers: Handlers{
+			"shout": func(ctx context.Context, input Input) (Output, error) {
+				b, err := os.ReadFile(input.Filename)
+				if err != nil {
+					return Output{}, err
+				}
+				filename := input.Filename + ".out"
+				if err := os.WriteFile(filename, []byte(strings.ToUpper(string(b))), 0o644); err != nil {
+					return Output{}, err
+				}
+				return Output{Filename: filename, Metadata: map[string]string{"shouted": "yes"}}, nil
+			},
+		},
+		Validators: map[string]Validator{"shout": MaxSizeValidator(10)},
+		Quarantine: true,
+		Archive:    true,
+		Queue:      "https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue",
+		Infof:      func(format string, args ...interface{}) {},
+		AWSConfig:  AWSConfig{Bucket: "mybucket", AccessKeyID: "id", SecretAccessKey: "secret"},
+	}
+	server, err := NewServer(opts)
+	c.Assert(err, qt.IsNil)
+
+	fs, fq := newFakeS3(), &fakeSQS{}
+	server.s3Client = fs.client(c)
+	server.uploader = manager.NewUploader(server.s3Client)
+	server.sqsClient = fq.client(c)
+
+	valid, invalid := requestKey("shout", newRequestID(), "valid.txt", time.Time{}), requestKey("shout", newRequestID(), "invalid.txt", time.Time{})
+	fs.putBody(valid, "hello")
+	fs.putBody(invalid, "hello, too long")
+	fq.send(fakeS3Event("mybucket", valid), fakeS3Event("mybucket", invalid))
+
+	done := make(chan error)
+	go func() {
+		done <- server.ListenAndServe(context.Background())
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for fs.get(responseKey("shout", valid)) == nil || fs.get(responseKey("shout", invalid)) == nil {
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for the responses")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(server.Close(), qt.IsNil)
+	c.Assert(<-done, qt.IsNil)
+
+	// The valid input is archived and answered with the handler output.
+	c.Assert(fs.body(archiveKey(valid)), qt.Equals, "hello")
+	c.Assert(fs.body(responseKey("shout", valid)), qt.Equals, "HELLO")
+	metadata := fs.get(responseKey("shout", valid))
+	c.Assert(metadata["shouted"], qt.Equals, "yes")
+	c.Assert(metadata[MetaErrorCode], qt.Equals, "")
+
+	// The invalid input is quarantined and answered with an error.
+	c.Assert(fs.body(quarantineKey(invalid)), qt.Equals, "hello, too long")
+	metadata = fs.get(responseKey("shout", invalid))
+	c.Assert(metadata[MetaErrorCode], qt.Equals, ErrorCodeInvalidInput)
+
+	// Both messages are deleted from the queue.
+	c.Assert(fq.deletedHandles(), qt.DeepEquals, []string{"receipt-0", "receipt-1"})
+}
+
+// fakeS3Event returns the S3 event notification for a new object with the given key.
+func fakeS3Event(bucket, key string) string {
+	return fmt.Sprintf(`{"Records":[{"eventTime":%q,"s3":{"bucket":{"name":%q},"object":{"key":%q}}}]}`,
+		time.Now().UTC().Format(time.RFC3339), bucket, key)
+}
+
+// fakeSQS implements the SQS query API for the messages of one queue.
+type fakeSQS struct {
+	mu       sync.Mutex
+	messages []string
+	received int
+	deleted  []string
+}
+
+// send adds messages with the given bodies to the queue.
+func (f *fakeSQS) send(bodies ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, bodies...)
+}
+
+// deletedHandles returns the sorted receipt handles of the deleted messages.
+func (f *fakeSQS) deletedHandles() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleted := append([]string(nil), f.deleted...)
+	sort.Strings(deleted)
+	return deleted
+}
+
+// client returns a client for the fake, closed when c's test is done.
+func (f *fakeSQS) client(c *qt.C) *sqs.Client {
+	ts := httptest.NewServer(f)
+	c.Cleanup(ts.Close)
+	// The signing region is set up front, or the resolver sets it on first use, racing with concurrent requests.
+	return sqs.New(sqs.Options{
+		Region:           "eu-north-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("a", "s", ""),
+		EndpointResolver: sqs.EndpointResolverFromURL(ts.URL, func(e *aws.Endpoint) { e.SigningRegion = "eu-north-1" }),
+	})
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	action := r.Form.Get("Action")
+
+	type sqsMessage struct {
+		XMLName       xml.Name `xml:"Message"`
+		MessageId     string
+		ReceiptHandle string
+		MD5OfBody     string
+		Body          string
+	}
+	var result []sqsMessage
+
+	f.mu.Lock()
+	switch action {
+	case "ReceiveMessage":
+		for ; f.received < len(f.messages); f.received++ {
+			sum := md5.Sum([]byte(f.messages[f.received]))
+			result = append(result, sqsMessage{
+				MessageId:     fmt.Sprintf("message-%d", f.received),
+				ReceiptHandle: fmt.Sprintf("receipt-%d", f.received),
+				MD5OfBody:     hex.EncodeToString(sum[:]),
+				Body:          f.messages[f.received],
+			})
+		}
+	case "DeleteMessage":
+		f.deleted = append(f.deleted, r.Form.Get("ReceiptHandle"))
+	case "ChangeMessageVisibility":
+	default:
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>InvalidAction</Code><Message>%s is not supported</Message></Error></ErrorResponse>`, action)
+		return
+	}
+	f.mu.Unlock()
+
+	if action == "ReceiveMessage" && len(result) == 0 {
+		// Do not spin while the server polls an empty queue.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b, _ := xml.Marshal(result)
+	fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult>%s</%[1]sResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></%[1]sResponse>`, action, b)
+}
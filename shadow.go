@@ -0,0 +1,118 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ShadowOptions configures a shadow handler, see ShadowHandler.
+type ShadowOptions struct {
+	// Timeout is the max time the shadow handler may run after the primary has finished.
+	// Defaults to 1 minute.
+	Timeout time.Duration
+
+	// Diff configures the comparison of the outputs.
+	Diff DiffOptions
+
+	// OnResult is called with the result of each shadowed request, e.g. to log or record metrics.
+	OnResult func(ctx context.Context, r ShadowResult)
+}
+
+// ShadowResult is the outcome of a shadowed request.
+type ShadowResult struct {
+	// PrimaryDuration and ShadowDuration are the durations of the handler calls.
+	PrimaryDuration time.Duration
+	ShadowDuration  time.Duration
+
+	// PrimaryErr is the error returned by the primary handler.
+	PrimaryErr error
+
+	// Err is set if the shadow handler, or the comparison, failed.
+	Err error
+
+	// Diff compares the primary and the shadow output. It is only set if both succeeded.
+	Diff OutputDiff
+}
+
+// ShadowHandler returns a handler that passes each request to both primary and shadow,
+// concurrently, returning primary's result. The shadow output is compared to the primary's
+// and then discarded, so a new handler implementation can be validated against production traffic.
+// The shadow handler gets its own copy of the input file.
+func ShadowHandler(primary, shadow func(ctx context.Context, input Input) (Output, error), opts ShadowOptions) func(ctx context.Context, input Input) (Output, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Minute
+	}
+	return func(ctx context.Context, input Input) (Output, error) {
+		type shadowOutput struct {
+			output   Output
+			duration time.Duration
+			err      error
+		}
+
+		shadowCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		shadowDir, err := os.MkdirTemp(filepath.Dir(input.Filename), "shadow")
+		if err != nil {
+			return primary(ctx, input)
+		}
+		defer os.RemoveAll(shadowDir)
+
+		done := make(chan shadowOutput, 1)
+		go func() {
+			var so shadowOutput
+			shadowInput := input
+			shadowInput.Filename = filepath.Join(shadowDir, filepath.Base(input.Filename))
+			if so.err = copyFile(input.Filename, shadowInput.Filename); so.err == nil {
+				start := time.Now()
+				so.output, so.err = shadow(shadowCtx, shadowInput)
+				so.duration = time.Since(start)
+			}
+			done <- so
+		}()
+
+		start := time.Now()
+		output, err := primary(ctx, input)
+		result := ShadowResult{PrimaryDuration: time.Since(start), PrimaryErr: err}
+
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		var so shadowOutput
+		select {
+		case so = <-done:
+		case <-timer.C:
+			cancel()
+			so = <-done
+			so.err = fmt.Errorf("shadow: timed out after %s", opts.Timeout)
+		}
+		result.ShadowDuration, result.Err = so.duration, so.err
+
+		if err == nil && result.Err == nil {
+			result.Diff, result.Err = DiffOutputs(output, so.output, opts.Diff)
+		}
+		if opts.OnResult != nil {
+			opts.OnResult(ctx, result)
+		}
+		return output, err
+	}
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffered(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
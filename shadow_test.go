@@ -0,0 +1,73 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestShadowHandler(t *testing.T) {
+	c := qt.New(t)
+
+	// upper writes its output next to the input, as many handlers do.
+	upper := func(suffix string) func(ctx context.Context, input Input) (Output, error) {
+		return func(ctx context.Context, input Input) (Output, error) {
+			b, err := os.ReadFile(input.Filename)
+			if err != nil {
+				return Output{}, err
+			}
+			filename := input.Filename + ".out"
+			return Output{Filename: filename}, os.WriteFile(filename, []byte(strings.ToUpper(string(b))+suffix), 0o644)
+		}
+	}
+
+	var results []ShadowResult
+	onResult := func(ctx context.Context, r ShadowResult) {
+		results = append(results, r)
+	}
+
+	dir := t.TempDir()
+	input := Input{Filename: filepath.Join(dir, "in.txt")}
+	c.Assert(os.WriteFile(input.Filename, []byte("hello"), 0o644), qt.IsNil)
+	ctx := context.Background()
+
+	h := ShadowHandler(upper(""), upper("!"), ShadowOptions{OnResult: onResult})
+	output, err := h(ctx, input)
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "HELLO")
+	c.Assert(results, qt.HasLen, 1)
+	c.Assert(results[0].Err, qt.IsNil)
+	c.Assert(results[0].Diff.Offset, qt.Equals, int64(5))
+
+	// The shadow's files are removed.
+	entries, err := os.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 2)
+
+	// Slow and failing shadows don't affect the primary result.
+	slow := func(ctx context.Context, input Input) (Output, error) {
+		<-ctx.Done()
+		return Output{}, ctx.Err()
+	}
+	h = ShadowHandler(upper(""), slow, ShadowOptions{Timeout: 10 * time.Millisecond, OnResult: onResult})
+	_, err = h(ctx, input)
+	c.Assert(err, qt.IsNil)
+	c.Assert(results[1].Err, qt.ErrorMatches, "shadow: timed out after 10ms")
+
+	failing := func(ctx context.Context, input Input) (Output, error) {
+		return Output{}, errors.New("failed")
+	}
+	h = ShadowHandler(failing, upper(""), ShadowOptions{OnResult: onResult})
+	_, err = h(ctx, input)
+	c.Assert(err, qt.ErrorMatches, "failed")
+	c.Assert(results[2].PrimaryErr, qt.ErrorMatches, "failed")
+	c.Assert(results[2].Err, qt.IsNil)
+}
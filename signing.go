@@ -0,0 +1,299 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+const publicKeys = "public_keys"
+
+// Metadata keys set on signed requests, see ClientOptions.Signing.
+const (
+	// MetaSignatureKeyID holds the ID of the key the request is signed with.
+	MetaSignatureKeyID = "s3rpc-signature-key-id"
+
+	// MetaSignature holds the base64 encoded Ed25519 signature of the request.
+	MetaSignature = "s3rpc-signature"
+)
+
+// emptyChecksum is the SHA-256 of the empty body of error responses.
+const emptyChecksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// ErrorCodeInvalidSignature means that the request was unsigned or its signature did not verify,
+// see ServerOptions.Signatures.
+const ErrorCodeInvalidSignature = "invalid_signature"
+
+// ErrInvalidSignature is returned from Client.Execute when the server rejected the request's signature,
+// or when the response's signature did not verify, see ClientOptions.ResponseSignatures.
+// Check for it with errors.Is.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// publicKeyRefreshInterval is how often public keys stored in the bucket are reloaded,
+// so a removed key is no longer accepted.
+const publicKeyRefreshInterval = 5 * time.Minute
+
+// publicKeyKey returns the well-known key of the public key with the given ID.
+func publicKeyKey(keyID string) string {
+	return publicKeys + "/" + keyID
+}
+
+// SigningOptions configures the client to sign its requests with an Ed25519 key,
+// so servers with ServerOptions.Signatures can verify who sent them.
+// The signature covers the request key, which holds the op and request ID,
+// the SHA-256 of the input and its metadata.
+// Each client, or team, should have its own key pair, see ed25519.GenerateKey.
+type SigningOptions struct {
+	// KeyID identifies the key to the server, e.g. "billing-2026".
+	// It must be 1 to 64 ASCII letters, digits and hyphens.
+	KeyID string
+
+	// PrivateKey signs the requests.
+	PrivateKey ed25519.PrivateKey
+}
+
+func (o *SigningOptions) init() error {
+	if err := validateKeyID(o.KeyID); err != nil {
+		return err
+	}
+	if len(o.PrivateKey) != ed25519.PrivateKeySize {
+		return errors.New("signing: invalid private key")
+	}
+	return nil
+}
+
+// SignatureOptions configures the server to verify the request signatures of clients with
+// ClientOptions.Signing. Requests without a valid signature get a ResponseError with code
+// ErrorCodeInvalidSignature. Signed inputs are verified on disk before they are handled,
+// so they are never passed to the StreamHandlers.
+//
+// It also configures the client to verify the response signatures of servers with
+// ServerOptions.ResponseSigning, see ClientOptions.ResponseSignatures.
+type SignatureOptions struct {
+	// PublicKeys maps a key ID to its public key.
+	PublicKeys map[string]ed25519.PublicKey
+
+	// KeysInBucket, if set, also looks up key IDs not in PublicKeys below public_keys/
+	// in the bucket, see Admin.PutPublicKey, reloading them every five minutes.
+	// Not supported for response signatures, as the bucket holds the client keys.
+	KeysInBucket bool
+
+	// AllowUnsigned, if set, passes unsigned requests to the handlers,
+	// or accepts unsigned responses on the client,
+	// e.g. while the clients or servers are rolled out with signing.
+	// Requests and responses with an invalid signature are still rejected.
+	AllowUnsigned bool
+}
+
+func (o *SignatureOptions) init() error {
+	if len(o.PublicKeys) == 0 && !o.KeysInBucket {
+		return errors.New("signatures: public keys or keys in bucket is required")
+	}
+	for id, key := range o.PublicKeys {
+		if err := validateKeyID(id); err != nil {
+			return err
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("signatures: invalid public key %q", id)
+		}
+	}
+	return nil
+}
+
+// validateKeyID returns an error if id can not be used as a key ID.
+func validateKeyID(id string) error {
+	if err := validateRequestID(id); err != nil {
+		return fmt.Errorf("invalid key ID %q", id)
+	}
+	return nil
+}
+
+// signedMetadataExcluded are the metadata keys not covered by the signature:
+// the signature itself and the keys of the transfer encodings, which the server removes.
+var signedMetadataExcluded = map[string]bool{
+	MetaSignatureKeyID:  true,
+	MetaSignature:       true,
+	MetaContentEncoding: true,
+	MetaDictionary:      true,
+	MetaDictionaryID:    true,
+	MetaDeltaBaseline:   true,
+	MetaDeltaETag:       true,
+}
+
+// signedMessage returns the message signed for the request or response with the given key,
+// body checksum and metadata. The response keys include the op and request ID,
+// so a signed response can not be passed off as the response to another request.
+// S3 lower cases the metadata keys, so they are signed in lower case.
+func signedMessage(key, checksum string, metadata map[string]string) []byte {
+	lower := make(map[string]string, len(metadata))
+	keys := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		k = strings.ToLower(k)
+		if signedMetadataExcluded[k] {
+			continue
+		}
+		lower[k] = v
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "s3rpc-signature-v1\n%s\n%s\n", key, checksum)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q\n", k, lower[k])
+	}
+	return b.Bytes()
+}
+
+// sign sets the signature of the request or response with the given key and body checksum in metadata.
+func (o *SigningOptions) sign(key, checksum string, metadata map[string]string) {
+	sig := ed25519.Sign(o.PrivateKey, signedMessage(key, checksum, metadata))
+	metadata[MetaSignatureKeyID] = o.KeyID
+	metadata[MetaSignature] = base64.StdEncoding.EncodeToString(sig)
+}
+
+// signatureVerifier verifies request or response signatures with the keys in SignatureOptions.
+type signatureVerifier struct {
+	opts SignatureOptions
+
+	// fetch fetches the public key with the given ID from the bucket.
+	fetch func(ctx context.Context, keyID string) ([]byte, error)
+
+	mu     sync.Mutex
+	cached map[string]cachedPublicKey
+}
+
+type cachedPublicKey struct {
+	key      ed25519.PublicKey
+	loadedAt time.Time
+}
+
+func newSignatureVerifier(opts *SignatureOptions, fetch func(ctx context.Context, keyID string) ([]byte, error)) *signatureVerifier {
+	if opts == nil {
+		return nil
+	}
+	return &signatureVerifier{opts: *opts, fetch: fetch, cached: make(map[string]cachedPublicKey)}
+}
+
+// verify verifies the signature of the request or response with the given key,
+// body and metadata in input.
+// It returns an error wrapping ErrInvalidSignature if it is missing or invalid.
+func (v *signatureVerifier) verify(ctx context.Context, key string, input Input) error {
+	keyID, sig := input.Metadata[MetaSignatureKeyID], input.Metadata[MetaSignature]
+	if keyID == "" && sig == "" {
+		if v.opts.AllowUnsigned {
+			return nil
+		}
+		return fmt.Errorf("%w: not signed", ErrInvalidSignature)
+	}
+	publicKey, err := v.publicKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || len(b) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+	}
+	checksum, err := fileChecksum(input.Filename)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, signedMessage(key, checksum, input.Metadata), b) {
+		return fmt.Errorf("%w: signature of key %q does not match", ErrInvalidSignature, keyID)
+	}
+	return nil
+}
+
+// publicKey returns the public key with the given ID.
+func (v *signatureVerifier) publicKey(ctx context.Context, keyID string) (ed25519.PublicKey, error) {
+	if key, found := v.opts.PublicKeys[keyID]; found {
+		return key, nil
+	}
+	if !v.opts.KeysInBucket || validateKeyID(keyID) != nil {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, keyID)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, found := v.cached[keyID]; found && time.Since(c.loadedAt) < publicKeyRefreshInterval {
+		if c.key == nil {
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, keyID)
+		}
+		return c.key, nil
+	}
+	b, err := v.fetch(ctx, keyID)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			// Remember missing keys too, so unknown key IDs do not cause a GET per request.
+			v.cached[keyID] = cachedPublicKey{loadedAt: time.Now()}
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, keyID)
+		}
+		return nil, fmt.Errorf("public key %q: %w", keyID, err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key %q: invalid key in bucket", keyID)
+	}
+	key := ed25519.PublicKey(b)
+	v.cached[keyID] = cachedPublicKey{key: key, loadedAt: time.Now()}
+	return key, nil
+}
+
+// fetchPublicKey downloads the public key with the given ID.
+func (c *common) fetchPublicKey(ctx context.Context, keyID string) ([]byte, error) {
+	o, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(publicKeyKey(keyID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	return io.ReadAll(io.LimitReader(o.Body, ed25519.PublicKeySize+1))
+}
+
+// PutPublicKey stores the public key with the given ID below public_keys/ in the bucket,
+// for servers with SignatureOptions.KeysInBucket.
+func (a *Admin) PutPublicKey(ctx context.Context, keyID string, key ed25519.PublicKey) error {
+	if err := validateKeyID(keyID); err != nil {
+		return err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key %q", keyID)
+	}
+	if _, err := a.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(publicKeyKey(keyID)),
+		Body:   bytes.NewReader(key),
+	}); err != nil {
+		return fmt.Errorf("failed to put public key %q: %w", keyID, err)
+	}
+	return nil
+}
+
+// DeletePublicKey removes the public key with the given ID from the bucket.
+// Servers stop accepting it within five minutes.
+func (a *Admin) DeletePublicKey(ctx context.Context, keyID string) error {
+	if err := validateKeyID(keyID); err != nil {
+		return err
+	}
+	if _, err := a.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(publicKeyKey(keyID)),
+	}); err != nil {
+		return fmt.Errorf("failed to delete public key %q: %w", keyID, err)
+	}
+	return nil
+}
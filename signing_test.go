@@ -0,0 +1,127 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestSigning(t *testing.T) {
+	c := qt.New(t)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.IsNil)
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.IsNil)
+
+	c.Assert((&SigningOptions{KeyID: "billing_1", PrivateKey: privateKey}).init(), qt.ErrorMatches, `invalid key ID "billing_1"`)
+	c.Assert((&SigningOptions{KeyID: "billing"}).init(), qt.ErrorMatches, "signing: invalid private key")
+	signing := &SigningOptions{KeyID: "billing", PrivateKey: privateKey}
+	c.Assert(signing.init(), qt.IsNil)
+	c.Assert((&SignatureOptions{}).init(), qt.ErrorMatches, "signatures: public keys or keys in bucket is required")
+	c.Assert((&SignatureOptions{PublicKeys: map[string]ed25519.PublicKey{"billing": publicKey[:8]}}).init(), qt.ErrorMatches, `signatures: invalid public key "billing"`)
+
+	filename := filepath.Join(t.TempDir(), "input.csv")
+	c.Assert(os.WriteFile(filename, []byte("a,b,c"), 0o600), qt.IsNil)
+	checksum, err := fileChecksum(filename)
+	c.Assert(err, qt.IsNil)
+	key := "to_server/ocr/01gcabc_input.csv"
+
+	// The client signs before compressing, which the server undoes.
+	metadata := map[string]string{"Lang": "en", MetaIdentityTenant: "acme"}
+	signing.sign(key, checksum, metadata)
+	metadata[MetaContentEncoding] = contentEncodingGzip
+	c.Assert(metadata[MetaSignatureKeyID], qt.Equals, "billing")
+
+	// S3 lower cases the metadata keys.
+	received := func() map[string]string {
+		return map[string]string{"lang": "en", MetaIdentityTenant: "acme", MetaSignatureKeyID: metadata[MetaSignatureKeyID], MetaSignature: metadata[MetaSignature]}
+	}
+
+	ctx := context.Background()
+	v := newSignatureVerifier(&SignatureOptions{PublicKeys: map[string]ed25519.PublicKey{"billing": publicKey}}, nil)
+	c.Assert(v.verify(ctx, key, Input{Filename: filename, Metadata: received()}), qt.IsNil)
+
+	checkInvalid := func(err error, pattern string) {
+		c.Helper()
+		c.Assert(errors.Is(err, ErrInvalidSignature), qt.IsTrue)
+		c.Assert(err, qt.ErrorMatches, pattern)
+	}
+	checkInvalid(v.verify(ctx, "to_server/delete/01gcabc_input.csv", Input{Filename: filename, Metadata: received()}), `invalid signature: signature of key "billing" does not match`)
+	tampered := received()
+	tampered[MetaIdentityTenant] = "other"
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: tampered}), ".* does not match")
+	tampered = received()
+	tampered[MetaSignature] = "invalid"
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: tampered}), "invalid signature: malformed signature")
+	tampered = received()
+	tampered[MetaSignatureKeyID] = "search"
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: tampered}), `invalid signature: unknown key "search"`)
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: map[string]string{"lang": "en"}}), "invalid signature: not signed")
+
+	v.opts.AllowUnsigned = true
+	c.Assert(v.verify(ctx, key, Input{Filename: filename, Metadata: map[string]string{"lang": "en"}}), qt.IsNil)
+	v.opts.PublicKeys["billing"] = otherPublicKey
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: received()}), ".* does not match")
+
+	var fetched []string
+	v = newSignatureVerifier(&SignatureOptions{KeysInBucket: true}, func(ctx context.Context, keyID string) ([]byte, error) {
+		fetched = append(fetched, keyID)
+		if keyID == "billing" {
+			return publicKey, nil
+		}
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	})
+	c.Assert(v.verify(ctx, key, Input{Filename: filename, Metadata: received()}), qt.IsNil)
+	c.Assert(v.verify(ctx, key, Input{Filename: filename, Metadata: received()}), qt.IsNil)
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: tampered}), `invalid signature: unknown key "search"`)
+	checkInvalid(v.verify(ctx, key, Input{Filename: filename, Metadata: tampered}), `invalid signature: unknown key "search"`)
+	c.Assert(fetched, qt.DeepEquals, []string{"billing", "search"})
+
+	var respErr error = &ResponseError{Code: ErrorCodeInvalidSignature}
+	c.Assert(errors.Is(respErr, ErrInvalidSignature), qt.IsTrue)
+}
+
+func TestResponseSigning(t *testing.T) {
+	c := qt.New(t)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.IsNil)
+	signing := &SigningOptions{KeyID: "server", PrivateKey: privateKey}
+	c.Assert(signing.init(), qt.IsNil)
+
+	opts := ClientOptions{Queue: "https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue", ResponseSignatures: &SignatureOptions{KeysInBucket: true}}
+	opts.AccessKeyID, opts.SecretAccessKey = "id", "secret"
+	_, err = NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, "response signatures: keys in bucket is not supported")
+
+	ctx := context.Background()
+	v := newSignatureVerifier(&SignatureOptions{PublicKeys: map[string]ed25519.PublicKey{"server": publicKey}}, nil)
+	key := responseKey("ocr", "to_server/ocr/01gcabc_input.csv")
+
+	// Error responses have an empty body.
+	filename := filepath.Join(t.TempDir(), "output")
+	c.Assert(os.WriteFile(filename, nil, 0o600), qt.IsNil)
+	checksum, err := fileChecksum(filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(checksum, qt.Equals, emptyChecksum)
+
+	metadata := map[string]string{MetaRequestID: "01gcabc", MetaOp: "ocr", MetaErrorCode: ErrorCodeHandler}
+	signing.sign(key, emptyChecksum, metadata)
+	c.Assert(v.verify(ctx, key, Input{Filename: filename, Metadata: metadata}), qt.IsNil)
+
+	// A signed response moved to answer another request.
+	err = v.verify(ctx, responseKey("ocr", "to_server/ocr/01gcdef_input.csv"), Input{Filename: filename, Metadata: metadata})
+	c.Assert(errors.Is(err, ErrInvalidSignature), qt.IsTrue)
+
+	c.Assert(os.WriteFile(filename, []byte("forged"), 0o600), qt.IsNil)
+	err = v.verify(ctx, key, Input{Filename: filename, Metadata: metadata})
+	c.Assert(err, qt.ErrorMatches, `invalid signature: signature of key "server" does not match`)
+}
@@ -0,0 +1,268 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrorCodeLockLost means that the server lost the singleton lock while the handler was running,
+// e.g. to another server after the lease could not be renewed in time, and cancelled the handler.
+const ErrorCodeLockLost = "lock_lost"
+
+// SingletonOptions configures ops that must never run concurrently across server replicas,
+// e.g. compaction. Before invoking the handler for such an op, the server acquires
+// a lock in a DynamoDB table. If the lock is held by another server,
+// the request is made visible in the queue again after RetryAfter.
+// If the lock is lost while the handler runs, its context is cancelled and the client
+// gets a ResponseError with code ErrorCodeLockLost.
+type SingletonOptions struct {
+	// Table is the name of the DynamoDB table holding the locks.
+	// It must have a string partition key named LockID.
+	// Enabling TTL on the numeric Expires attribute will clean up stale locks.
+	Table string
+
+	// Ops are the ops to lock.
+	Ops []string
+
+	// Key, if set, returns the resource key to lock for an op given the request metadata.
+	// Requests with different keys for the same op can then run concurrently.
+	// By default the op itself is locked.
+	Key func(op string, metadata map[string]string) string
+
+	// LeaseDuration is how long a lock is held without being renewed.
+	// It is renewed while the handler is still running,
+	// so this is how long a lock held by a crashed server blocks others.
+	// The lock is lost if it is not renewed within this time.
+	// Defaults to 2 minutes.
+	LeaseDuration time.Duration
+
+	// RetryAfter is how long to wait before retrying a request when the lock is held.
+	// Defaults to 30 seconds.
+	RetryAfter time.Duration
+}
+
+func (opts *SingletonOptions) init() error {
+	if opts.Table == "" {
+		return errors.New("singleton: table is required")
+	}
+
+	if opts.LeaseDuration < 0 || opts.RetryAfter < 0 {
+		return errors.New("singleton: LeaseDuration and RetryAfter can not be negative")
+	}
+
+	if opts.LeaseDuration == 0 {
+		opts.LeaseDuration = 2 * time.Minute
+	}
+
+	if opts.RetryAfter == 0 {
+		opts.RetryAfter = 30 * time.Second
+	}
+
+	return nil
+}
+
+type singleton struct {
+	opts   SingletonOptions
+	ops    map[string]bool
+	owner  string
+	client dynamoDBClient
+}
+
+// dynamoDBClient is the subset of the DynamoDB API used for the singleton locks.
+type dynamoDBClient interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+func newSingleton(opts *SingletonOptions, awsCfg aws.Config, owner string) *singleton {
+	if opts == nil {
+		return nil
+	}
+
+	ops := make(map[string]bool)
+	for _, op := range opts.Ops {
+		ops[op] = true
+	}
+
+	return &singleton{
+		opts:   *opts,
+		ops:    ops,
+		owner:  owner,
+		client: dynamodb.NewFromConfig(awsCfg),
+	}
+}
+
+func (s *singleton) isSingleton(op string) bool {
+	return s != nil && s.ops[op]
+}
+
+// lease is a lock held by this server, see singleton.lock.
+type lease struct {
+	// lost is closed when the lock is lost.
+	lost   chan struct{}
+	unlock func()
+}
+
+// context returns a copy of ctx that is cancelled when the lock is lost.
+// A nil lease is never lost.
+func (l *lease) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if l == nil {
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-l.lost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// isLost reports whether the lock was lost.
+func (l *lease) isLost() bool {
+	if l == nil {
+		return false
+	}
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// lock tries to acquire the lock for the request with the given object key.
+// If ok is true, the caller must call unlock on the lease when done.
+// The lease is renewed until then.
+func (s *singleton) lock(ctx context.Context, c *common, op, objectKey string) (l *lease, ok bool, err error) {
+	lockID := op
+	if s.opts.Key != nil {
+		metadata, err := c.headObject(ctx, objectKey)
+		if err != nil {
+			return nil, false, err
+		}
+		lockID = op + "/" + s.opts.Key(op, metadata)
+	}
+
+	expires := time.Now().Add(s.opts.LeaseDuration)
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.opts.Table),
+		Item: map[string]types.AttributeValue{
+			"LockID":  &types.AttributeValueMemberS{Value: lockID},
+			"Owner":   &types.AttributeValueMemberS{Value: s.owner},
+			"Expires": s.expires(),
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#id) OR #expires < :now"),
+		ExpressionAttributeNames: map[string]string{"#id": "LockID", "#expires": "Expires"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	if err != nil {
+		var cerr *types.ConditionalCheckFailedException
+		if errors.As(err, &cerr) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("singleton: failed to acquire lock %q: %w", lockID, err)
+	}
+
+	// Renew the lease until unlocked.
+	l = &lease{lost: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		interval := s.opts.LeaseDuration / 3
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// A renewal must not block the check for an expired lease.
+				renewCtx, cancel := context.WithTimeout(ctx, interval)
+				err := s.renew(renewCtx, lockID)
+				cancel()
+				if err == nil {
+					expires = time.Now().Add(s.opts.LeaseDuration)
+					continue
+				}
+				var cerr *types.ConditionalCheckFailedException
+				if errors.As(err, &cerr) || time.Now().After(expires) {
+					c.infof("Lost lock %q: %s", lockID, err)
+					close(l.lost)
+					return
+				}
+				c.infof("Failed to renew lock %q: %s", lockID, err)
+			}
+		}
+	}()
+
+	l.unlock = func() {
+		close(done)
+		if err := s.release(lockID); err != nil {
+			c.infof("Failed to release lock %q: %s", lockID, err)
+		}
+	}
+
+	return l, true, nil
+}
+
+// lockLostError returns the error of a handler that returned err after the lock was lost.
+func lockLostError(err error) *limitError {
+	lostErr := errors.New("singleton: lost the lock while the handler was running")
+	if err != nil {
+		lostErr = fmt.Errorf("%s: %w", lostErr, err)
+	}
+	return &limitError{code: ErrorCodeLockLost, err: lostErr}
+}
+
+func (s *singleton) renew(ctx context.Context, lockID string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                s.tableName(),
+		Key:                      s.key(lockID),
+		UpdateExpression:         aws.String("SET #expires = :expires"),
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#expires": "Expires", "#owner": "Owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expires": s.expires(),
+			":owner":   &types.AttributeValueMemberS{Value: s.owner},
+		},
+	})
+	return err
+}
+
+func (s *singleton) release(lockID string) error {
+	// Use a fresh context, as the request context may be cancelled by now.
+	_, err := s.client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName:                s.tableName(),
+		Key:                      s.key(lockID),
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "Owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: s.owner},
+		},
+	})
+	return err
+}
+
+func (s *singleton) tableName() *string {
+	return aws.String(s.opts.Table)
+}
+
+func (s *singleton) key(lockID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"LockID": &types.AttributeValueMemberS{Value: lockID}}
+}
+
+func (s *singleton) expires() types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(s.opts.LeaseDuration).Unix(), 10)}
+}
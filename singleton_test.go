@@ -0,0 +1,202 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestSingleton(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&SingletonOptions{}).init(), qt.ErrorMatches, ".*table is required")
+	c.Assert((&SingletonOptions{Table: "locks", LeaseDuration: -time.Second}).init(), qt.ErrorMatches, ".*can not be negative")
+	c.Assert((&SingletonOptions{Table: "locks", RetryAfter: -time.Second}).init(), qt.ErrorMatches, ".*can not be negative")
+
+	opts := &SingletonOptions{Table: "locks", Ops: []string{"compact"}}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.LeaseDuration, qt.Equals, 2*time.Minute)
+	c.Assert(opts.RetryAfter, qt.Equals, 30*time.Second)
+
+	s := newSingleton(opts, aws.Config{Region: defaultRegion}, "myinstance")
+	c.Assert(s.isSingleton("compact"), qt.IsTrue)
+	c.Assert(s.isSingleton("resize"), qt.IsFalse)
+
+	var nilSingleton *singleton
+	c.Assert(newSingleton(nil, aws.Config{}, "myinstance"), qt.IsNil)
+	c.Assert(nilSingleton.isSingleton("compact"), qt.IsFalse)
+}
+
+func TestSingletonLock(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	opts := &SingletonOptions{Table: "locks", Ops: []string{"compact"}, LeaseDuration: 30 * time.Millisecond}
+	c.Assert(opts.init(), qt.IsNil)
+	db := &fakeDynamoDB{items: make(map[string]fakeLockItem)}
+	singletonFor := func(owner string) *singleton {
+		return &singleton{opts: *opts, ops: map[string]bool{"compact": true}, owner: owner, client: db}
+	}
+	s1, s2 := singletonFor("server1"), singletonFor("server2")
+	var (
+		mu     sync.Mutex
+		logged []string
+	)
+	ep := &common{infof: func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, format)
+	}}
+
+	l, ok, err := s1.lock(ctx, ep, "compact", "to_server/compact/01a_a.db")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	_, ok, err = s2.lock(ctx, ep, "compact", "to_server/compact/01b_b.db")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+
+	// The lease is renewed while held.
+	time.Sleep(2 * opts.LeaseDuration)
+	c.Assert(l.isLost(), qt.IsFalse)
+	c.Assert(db.owner("compact"), qt.Equals, "server1")
+	c.Assert(s2.renew(ctx, "compact"), qt.ErrorAs, new(*types.ConditionalCheckFailedException))
+
+	// Another server takes the lock over, e.g. after the renewals failed for too long.
+	handlerCtx, cancel := l.context(ctx)
+	defer cancel()
+	db.setOwner("compact", "server2")
+	select {
+	case <-handlerCtx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("handler context not cancelled after the lock was lost")
+	}
+	c.Assert(l.isLost(), qt.IsTrue)
+	l.unlock()
+	c.Assert(db.owner("compact"), qt.Equals, "server2")
+
+	mu.Lock()
+	c.Assert(logged, qt.Contains, "Lost lock %q: %s")
+	mu.Unlock()
+
+	// The renewals hang until the lease has expired.
+	db.mu.Lock()
+	delete(db.items, "compact")
+	db.mu.Unlock()
+	l, ok, err = s1.lock(ctx, ep, "compact", "to_server/compact/01c_c.db")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	handlerCtx, cancel = l.context(ctx)
+	defer cancel()
+	db.mu.Lock()
+	db.hang = true
+	db.mu.Unlock()
+	select {
+	case <-handlerCtx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("handler context not cancelled after the lease expired")
+	}
+	mu.Lock()
+	c.Assert(logged, qt.Contains, "Failed to renew lock %q: %s")
+	mu.Unlock()
+	db.mu.Lock()
+	db.hang = false
+	db.mu.Unlock()
+	l.unlock()
+
+	err = lockLostError(errors.New("context canceled"))
+	c.Assert(err, qt.ErrorMatches, "singleton: lost the lock while the handler was running: context canceled")
+	c.Assert(err.(*limitError).code, qt.Equals, ErrorCodeLockLost)
+
+	// A nil lease is never lost.
+	var nilLease *lease
+	ctx, cancel = nilLease.context(ctx)
+	cancel()
+	c.Assert(nilLease.isLost(), qt.IsFalse)
+}
+
+type fakeLockItem struct {
+	owner   string
+	expires int64
+}
+
+// fakeDynamoDB implements the conditional writes of the singleton locks.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]fakeLockItem
+
+	// hang, if set, blocks the renewals until their context is done.
+	hang bool
+}
+
+func (f *fakeDynamoDB) owner(lockID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items[lockID].owner
+}
+
+func (f *fakeDynamoDB) setOwner(lockID, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item := f.items[lockID]
+	item.owner = owner
+	f.items[lockID] = item
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lockID := stringAttr(params.Item["LockID"])
+	if item, found := f.items[lockID]; found && item.expires >= numberAttr(params.ExpressionAttributeValues[":now"]) {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.items[lockID] = fakeLockItem{owner: stringAttr(params.Item["Owner"]), expires: numberAttr(params.Item["Expires"])}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	if f.hang {
+		f.mu.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	defer f.mu.Unlock()
+	lockID := stringAttr(params.Key["LockID"])
+	item, found := f.items[lockID]
+	if !found || item.owner != stringAttr(params.ExpressionAttributeValues[":owner"]) {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	item.expires = numberAttr(params.ExpressionAttributeValues[":expires"])
+	f.items[lockID] = item
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lockID := stringAttr(params.Key["LockID"])
+	item, found := f.items[lockID]
+	if !found || item.owner != stringAttr(params.ExpressionAttributeValues[":owner"]) {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	delete(f.items, lockID)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func stringAttr(v types.AttributeValue) string {
+	return v.(*types.AttributeValueMemberS).Value
+}
+
+func numberAttr(v types.AttributeValue) int64 {
+	n, _ := strconv.ParseInt(v.(*types.AttributeValueMemberN).Value, 10, 64)
+	return n
+}
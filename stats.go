@@ -0,0 +1,250 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerStats holds statistics for a server instance.
+type ServerStats struct {
+	// InstanceID is the ID of the server instance.
+	InstanceID string
+
+	// Started is when the server was created.
+	Started time.Time
+
+	// InFlight is the number of requests currently being handled.
+	InFlight int
+
+	// Processed is the number of requests handled successfully.
+	Processed uint64
+
+	// Failed is the number of requests where the handler returned an error.
+	Failed uint64
+
+	// QuotaExceeded is the number of requests rejected by ServerOptions.Quotas.
+	QuotaExceeded uint64
+
+	// Concurrency is the current maximum number of requests handled concurrently.
+	// See ServerOptions.AdaptiveConcurrency.
+	Concurrency int
+
+	// Paused is whether the server is paused, see ControlPause.
+	Paused bool
+
+	// Usage is the AWS usage per op. See Usage.Cost.
+	Usage map[string]Usage
+
+	// MessageAge is the time from a request was uploaded until its handler started,
+	// which grows with the queue backlog.
+	MessageAge Histogram
+
+	// HandlerDuration is the duration of the handler invocations.
+	HandlerDuration Histogram
+
+	// Uploads and Downloads are the throughput totals of the response uploads
+	// and the request downloads. See ServerOptions.SlowTransfer.
+	Uploads   TransferStats
+	Downloads TransferStats
+}
+
+type serverStats struct {
+	instanceID string
+	started    time.Time
+
+	messageAge      *histogram
+	handlerDuration *histogram
+
+	mu        sync.Mutex
+	inFlight  int
+	processed uint64
+	failed    uint64
+	overQuota uint64
+	usage     map[string]Usage
+}
+
+func newServerStats(instanceID string) *serverStats {
+	return &serverStats{
+		instanceID:      instanceID,
+		started:         time.Now(),
+		messageAge:      newHistogram(),
+		handlerDuration: newHistogram(),
+		usage:           make(map[string]Usage),
+	}
+}
+
+func (s *serverStats) start() {
+	s.mu.Lock()
+	s.inFlight++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) done(err error) {
+	s.mu.Lock()
+	s.inFlight--
+	if err != nil {
+		s.failed++
+	} else {
+		s.processed++
+	}
+	s.mu.Unlock()
+}
+
+// quotaExceeded counts a request rejected by the quotas.
+func (s *serverStats) quotaExceeded() {
+	s.mu.Lock()
+	s.overQuota++
+	s.mu.Unlock()
+}
+
+func (s *serverStats) addUsage(op string, u Usage) {
+	s.mu.Lock()
+	total := s.usage[op]
+	total.add(u)
+	s.usage[op] = total
+	s.mu.Unlock()
+}
+
+func (s *serverStats) snapshot() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := make(map[string]Usage, len(s.usage))
+	for op, u := range s.usage {
+		usage[op] = u
+	}
+	return ServerStats{
+		InstanceID:      s.instanceID,
+		Started:         s.started,
+		InFlight:        s.inFlight,
+		Processed:       s.processed,
+		Failed:          s.failed,
+		QuotaExceeded:   s.overQuota,
+		Usage:           usage,
+		MessageAge:      s.messageAge.snapshot(),
+		HandlerDuration: s.handlerDuration.snapshot(),
+	}
+}
+
+// ClientStats holds statistics for a client.
+type ClientStats struct {
+	// InFlight is the number of Execute calls currently uploading or waiting for a response.
+	InFlight int
+
+	// Waiting is the number of Execute calls waiting for an in-flight slot,
+	// see ClientOptions.MaxInFlight.
+	Waiting int
+
+	// ResponseLatency is the time from the start of the upload of a request
+	// until its response was received, not including the download of the response.
+	ResponseLatency Histogram
+
+	// Uploads and Downloads are the throughput totals of the request uploads
+	// and the response downloads. See ClientOptions.SlowTransfer.
+	Uploads   TransferStats
+	Downloads TransferStats
+}
+
+type clientStats struct {
+	// sem limits the number of requests in flight, nil if unlimited.
+	sem chan struct{}
+
+	responseLatency *histogram
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  int
+}
+
+func newClientStats(maxInFlight int) *clientStats {
+	s := &clientStats{responseLatency: newHistogram()}
+	if maxInFlight > 0 {
+		s.sem = make(chan struct{}, maxInFlight)
+	}
+	return s
+}
+
+// acquire waits for an in-flight slot.
+func (s *clientStats) acquire(ctx context.Context) error {
+	if s.sem != nil {
+		s.mu.Lock()
+		s.waiting++
+		s.mu.Unlock()
+		var err error
+		select {
+		case s.sem <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		s.mu.Lock()
+		s.waiting--
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.inFlight++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *clientStats) release() {
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+func (s *clientStats) snapshot() ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ClientStats{InFlight: s.inFlight, Waiting: s.waiting, ResponseLatency: s.responseLatency.snapshot()}
+}
+
+// newInstanceID returns an ID that is unique enough to tell server replicas apart.
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	b := make([]byte, 3)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+// expvarStats holds the stats of the servers with ServerOptions.ExpvarName set, by name.
+// It is published as the "s3rpc" expvar on first use, as expvars can not be unpublished.
+var expvarStats struct {
+	once sync.Once
+	mu   sync.Mutex
+	m    *expvar.Map
+}
+
+func publishExpvar(name string, s *Server) error {
+	expvarStats.once.Do(func() {
+		expvarStats.m = expvar.NewMap("s3rpc")
+	})
+	expvarStats.mu.Lock()
+	defer expvarStats.mu.Unlock()
+	if expvarStats.m.Get(name) != nil {
+		return fmt.Errorf("expvar %q is already published", name)
+	}
+	expvarStats.m.Set(name, expvar.Func(func() interface{} {
+		return s.Stats()
+	}))
+	return nil
+}
+
+func unpublishExpvar(name string) {
+	expvarStats.mu.Lock()
+	defer expvarStats.mu.Unlock()
+	expvarStats.m.Delete(name)
+}
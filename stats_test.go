@@ -0,0 +1,85 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestServerStats(t *testing.T) {
+	c := qt.New(t)
+
+	s := newServerStats("myinstance")
+	s.start()
+	s.start()
+	c.Assert(s.snapshot().InFlight, qt.Equals, 2)
+	s.done(nil)
+	s.done(errors.New("failed"))
+
+	stats := s.snapshot()
+	c.Assert(stats.InstanceID, qt.Equals, "myinstance")
+	c.Assert(stats.InFlight, qt.Equals, 0)
+	c.Assert(stats.Processed, qt.Equals, uint64(1))
+	c.Assert(stats.Failed, qt.Equals, uint64(1))
+
+	c.Assert(newInstanceID(), qt.Not(qt.Equals), newInstanceID())
+}
+
+func TestHistogram(t *testing.T) {
+	c := qt.New(t)
+
+	h := newHistogram()
+	c.Assert(h.snapshot().Quantile(0.5), qt.Equals, time.Duration(0))
+	for _, d := range []time.Duration{5 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond, 3 * time.Second, time.Hour} {
+		h.observe(d)
+	}
+
+	snapshot := h.snapshot()
+	c.Assert(snapshot.Count, qt.Equals, uint64(5))
+	c.Assert(snapshot.Counts, qt.HasLen, len(snapshot.Bounds)+1)
+	c.Assert(snapshot.Counts[0], qt.Equals, uint64(1))
+	c.Assert(snapshot.Counts[1], qt.Equals, uint64(2))
+	c.Assert(snapshot.Counts[len(snapshot.Bounds)], qt.Equals, uint64(1))
+	c.Assert(snapshot.Mean(), qt.Equals, (time.Hour+3*time.Second+45*time.Millisecond)/5)
+	c.Assert(snapshot.Quantile(0), qt.Equals, 10*time.Millisecond)
+	c.Assert(snapshot.Quantile(0.5), qt.Equals, 25*time.Millisecond)
+	c.Assert(snapshot.Quantile(0.7), qt.Equals, 5*time.Second)
+	c.Assert(snapshot.Quantile(1), qt.Equals, 10*time.Minute)
+}
+
+func TestClientStats(t *testing.T) {
+	c := qt.New(t)
+
+	s := newClientStats(1)
+	ctx := context.Background()
+	counts := func() ClientStats {
+		stats := s.snapshot()
+		return ClientStats{InFlight: stats.InFlight, Waiting: stats.Waiting}
+	}
+	c.Assert(s.acquire(ctx), qt.IsNil)
+	c.Assert(counts(), qt.DeepEquals, ClientStats{InFlight: 1})
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- s.acquire(ctx)
+	}()
+	for s.snapshot().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(counts(), qt.DeepEquals, ClientStats{InFlight: 1, Waiting: 1})
+	s.release()
+	c.Assert(<-acquired, qt.IsNil)
+	c.Assert(counts(), qt.DeepEquals, ClientStats{InFlight: 1})
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	c.Assert(s.acquire(ctx), qt.Equals, context.Canceled)
+	c.Assert(counts(), qt.DeepEquals, ClientStats{InFlight: 1})
+
+	unlimited := newClientStats(0)
+	c.Assert(unlimited.acquire(ctx), qt.IsNil)
+	unlimited.release()
+}
@@ -0,0 +1,255 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// StreamInput is the input to a StreamHandler.
+type StreamInput struct {
+	// Body reads the input while it is downloaded.
+	// Compressed inputs are decompressed, see MetaContentEncoding.
+	Body io.Reader
+
+	// Size is the size in bytes of the object in the bucket.
+	Size int64
+
+	Metadata    map[string]string
+	ContentType string
+}
+
+// StreamHandler handles a large input while it is downloaded, see ServerOptions.StreamHandlers.
+type StreamHandler func(ctx context.Context, input StreamInput) (Output, error)
+
+// StreamOptions configures the streaming of large inputs to the ServerOptions.StreamHandlers.
+// The input is downloaded in parts with concurrent ranged GETs, which are fed to the handler
+// in order as they arrive, so network and compute overlap for multi-GB files.
+// At most Concurrency parts are held in memory.
+type StreamOptions struct {
+	// Threshold is the input size in bytes from which inputs are streamed.
+	// Smaller inputs are downloaded and passed to the Handlers as usual.
+	// Defaults to 64 MiB.
+	Threshold int64
+
+	// PartSize is the size in bytes of each part.
+	// Defaults to 16 MiB.
+	PartSize int64
+
+	// Concurrency is the number of parts downloaded concurrently.
+	// Defaults to 4.
+	Concurrency int
+}
+
+func (o *StreamOptions) init() error {
+	if o.Threshold < 0 || o.PartSize < 0 || o.Concurrency < 0 {
+		return errors.New("stream: threshold, part size and concurrency can not be negative")
+	}
+	if o.Threshold == 0 {
+		o.Threshold = 64 << 20
+	}
+	if o.PartSize == 0 {
+		o.PartSize = 16 << 20
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = 4
+	}
+	return nil
+}
+
+// openStream starts downloading the object with the given key in parts if it is at least
+// the stream threshold in size. It returns nil if the object is smaller.
+func (s *Server) openStream(ctx context.Context, key string) (*inputStream, error) {
+	if s.signatures != nil {
+		// Signed inputs are verified on disk before they are handled.
+		return nil, nil
+	}
+	head, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	metadata := decodeMetadata(head.Metadata)
+	if head.ContentLength < s.stream.Threshold || metadata[MetaDeltaBaseline] != "" {
+		// Deltas are rebuilt on disk before they are handled.
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &inputStream{
+		size:        head.ContentLength,
+		metadata:    metadata,
+		contentType: aws.ToString(head.ContentType),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	partSize := s.stream.PartSize
+	r.parts = make([]chan streamPart, (r.size+partSize-1)/partSize)
+	for i := range r.parts {
+		r.parts[i] = make(chan streamPart, 1)
+	}
+	r.slots = make(chan struct{}, s.stream.Concurrency)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for i := range r.parts {
+			select {
+			case r.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			start := int64(i) * partSize
+			end := start + partSize
+			if end > r.size {
+				end = r.size
+			}
+			r.wg.Add(1)
+			go func(i int) {
+				defer r.wg.Done()
+				b, err := s.getRange(ctx, key, start, end)
+				r.parts[i] <- streamPart{b: b, err: err}
+			}(i)
+		}
+	}()
+
+	body, err := decompressBody(ctx, r, r.metadata, s.dictionaries)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.metadata[MetaInputChecksum] != "" {
+		// The client wants to verify that the response answers its request.
+		r.hash = sha256.New()
+		body = io.TeeReader(body, r.hash)
+	}
+	r.body = body
+	return r, nil
+}
+
+// getRange downloads the bytes from start to end of the object with the given key.
+func (s *Server) getRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	started := time.Now()
+	o, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	b := make([]byte, end-start)
+	if _, err := io.ReadFull(o.Body, b); err != nil {
+		return nil, fmt.Errorf("download part at %d: %w", start, err)
+	}
+	s.transfers.observe(ctx, s.common, TransferDownload, key, int64(len(b)), time.Since(started))
+	return b, nil
+}
+
+type streamPart struct {
+	b   []byte
+	err error
+}
+
+// inputStream reads the parts of an input in order as they are downloaded.
+type inputStream struct {
+	size        int64
+	metadata    map[string]string
+	contentType string
+
+	// body is the decompressed input read by the handler.
+	body io.Reader
+	hash hash.Hash
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// parts receive the downloaded parts, and slots limit the parts in memory.
+	parts []chan streamPart
+	slots chan struct{}
+	next  int
+	cur   []byte
+	err   error
+}
+
+func (r *inputStream) input() StreamInput {
+	return StreamInput{Body: r.body, Size: r.size, Metadata: r.metadata, ContentType: r.contentType}
+}
+
+// Read reads the raw object bytes.
+func (r *inputStream) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.next == len(r.parts) {
+			return 0, io.EOF
+		}
+		select {
+		case part := <-r.parts[r.next]:
+			// The part is now held here, so let the next download start.
+			<-r.slots
+			r.cur, r.err = part.b, part.err
+			r.next++
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// checksum reads the rest of the input and returns its checksum, as fileChecksum.
+func (r *inputStream) checksum() (string, error) {
+	if _, err := copyBuffered(io.Discard, r.body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(r.hash.Sum(nil)), nil
+}
+
+// close stops the downloads.
+func (r *inputStream) close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// uploadOptionsKey holds the ClientOpOptions multipart settings of an upload.
+type uploadOptionsKey struct{}
+
+// withUploadOptions sets the part size and concurrency of multipart uploads in ctx, if set.
+func withUploadOptions(ctx context.Context, partSize int64, concurrency int) context.Context {
+	if partSize == 0 && concurrency == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, uploadOptionsKey{}, func(u *manager.Uploader) {
+		if partSize != 0 {
+			u.PartSize = partSize
+		}
+		if concurrency != 0 {
+			u.Concurrency = concurrency
+		}
+	})
+}
+
+// uploadOptions returns the uploader options set with withUploadOptions.
+func uploadOptions(ctx context.Context) []func(*manager.Uploader) {
+	if f, ok := ctx.Value(uploadOptionsKey{}).(func(*manager.Uploader)); ok {
+		return []func(*manager.Uploader){f}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package s3rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStreamOptions(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &StreamOptions{}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(*opts, qt.Equals, StreamOptions{Threshold: 64 << 20, PartSize: 16 << 20, Concurrency: 4})
+	c.Assert((&StreamOptions{Concurrency: -1}).init(), qt.IsNotNil)
+}
+
+// newTestInputStream returns an inputStream of the given parts, which are delivered in reverse order.
+func newTestInputStream(metadata map[string]string, parts ...streamPart) *inputStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &inputStream{metadata: metadata, ctx: ctx, cancel: cancel, slots: make(chan struct{}, len(parts))}
+	r.parts = make([]chan streamPart, len(parts))
+	for i := range parts {
+		r.parts[i] = make(chan streamPart, 1)
+		r.slots <- struct{}{}
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		r.parts[i] <- parts[i]
+	}
+	return r
+}
+
+func TestInputStream(t *testing.T) {
+	c := qt.New(t)
+
+	r := newTestInputStream(nil, streamPart{b: []byte("abc")}, streamPart{b: []byte("def")}, streamPart{b: []byte("g")})
+	b, err := io.ReadAll(r)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "abcdefg")
+	c.Assert(r.slots, qt.HasLen, 0)
+
+	// A failed part fails the read.
+	r = newTestInputStream(nil, streamPart{b: []byte("abc")}, streamPart{err: errors.New("boom")})
+	b, err = io.ReadAll(r)
+	c.Assert(err, qt.ErrorMatches, "boom")
+	c.Assert(string(b), qt.Equals, "abc")
+
+	// A cancelled stream stops waiting for parts.
+	r = newTestInputStream(nil)
+	r.parts = []chan streamPart{make(chan streamPart, 1)}
+	r.close()
+	_, err = io.ReadAll(r)
+	c.Assert(err, qt.Equals, context.Canceled)
+}
+
+func TestInputStreamChecksum(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("hello world"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(zw.Close(), qt.IsNil)
+	compressed := buf.Bytes()
+
+	r := newTestInputStream(
+		map[string]string{MetaContentEncoding: contentEncodingGzip, MetaInputChecksum: "x"},
+		streamPart{b: compressed[:10]}, streamPart{b: compressed[10:]},
+	)
+	body, err := decompressBody(context.Background(), r, r.metadata, nil)
+	c.Assert(err, qt.IsNil)
+	r.hash = sha256.New()
+	r.body = io.TeeReader(body, r.hash)
+
+	// The handler reads only some of the input.
+	b := make([]byte, 5)
+	_, err = io.ReadFull(r.input().Body, b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "hello")
+
+	checksum, err := r.checksum()
+	c.Assert(err, qt.IsNil)
+	sum := sha256.Sum256([]byte("hello world"))
+	c.Assert(checksum, qt.Equals, hex.EncodeToString(sum[:]))
+}
+
+func TestUploadOptions(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	c.Assert(withUploadOptions(ctx, 0, 0), qt.Equals, ctx)
+	c.Assert(uploadOptions(ctx), qt.HasLen, 0)
+
+	opts := uploadOptions(withUploadOptions(ctx, 64<<20, 0))
+	c.Assert(opts, qt.HasLen, 1)
+	u := &manager.Uploader{PartSize: manager.DefaultUploadPartSize, Concurrency: manager.DefaultUploadConcurrency}
+	opts[0](u)
+	c.Assert(u.PartSize, qt.Equals, int64(64<<20))
+	c.Assert(u.Concurrency, qt.Equals, manager.DefaultUploadConcurrency)
+}
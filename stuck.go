@@ -0,0 +1,119 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrorCodeStuck means that the handler was cancelled after it ran for much longer than usual,
+// see StuckHandlerOptions.Cancel.
+const ErrorCodeStuck = "stuck"
+
+// StuckHandlerOptions configures the detection of stuck handlers: handlers that run for longer
+// than Factor times the p99 duration of their op on this server,
+// so hung handlers surface before their clients time out.
+//
+// A stuck handler is logged, published as EventHandlerStuck and counted in the
+// StuckHandlers CloudWatch metric.
+type StuckHandlerOptions struct {
+	// Factor is the multiple of the op's p99 handler duration after which a handler is stuck.
+	// Defaults to 3.
+	Factor float64
+
+	// MinSamples is the number of successful invocations of an op needed before
+	// its handlers are checked. Defaults to 100.
+	MinSamples int
+
+	// MinDuration is the least duration after which a handler is stuck,
+	// for ops that are usually quick. Defaults to 10 seconds.
+	MinDuration time.Duration
+
+	// Cancel, if set, also cancels the context of stuck handlers.
+	// The client gets a ResponseError with code ErrorCodeStuck.
+	Cancel bool
+}
+
+func (o *StuckHandlerOptions) init() error {
+	if o.Factor < 0 || o.MinSamples < 0 || o.MinDuration < 0 {
+		return errors.New("stuck handlers: options can not be negative")
+	}
+	if o.Factor == 0 {
+		o.Factor = 3
+	}
+	if o.MinSamples == 0 {
+		o.MinSamples = 100
+	}
+	if o.MinDuration == 0 {
+		o.MinDuration = 10 * time.Second
+	}
+	return nil
+}
+
+// stuckDetector keeps the handler durations per op to tell when a handler is stuck.
+type stuckDetector struct {
+	opts StuckHandlerOptions
+
+	mu        sync.Mutex
+	durations map[string]*histogram
+}
+
+func newStuckDetector(opts *StuckHandlerOptions) *stuckDetector {
+	if opts == nil {
+		return nil
+	}
+	return &stuckDetector{opts: *opts, durations: make(map[string]*histogram)}
+}
+
+// observe records the duration of a successful invocation of the handler for op.
+func (d *stuckDetector) observe(op string, duration time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	h := d.durations[op]
+	if h == nil {
+		h = newHistogram()
+		d.durations[op] = h
+	}
+	d.mu.Unlock()
+	h.observe(duration)
+}
+
+// threshold returns the duration after which a handler for op is stuck,
+// 0 if there are too few samples to tell.
+func (d *stuckDetector) threshold(op string) time.Duration {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	h := d.durations[op]
+	d.mu.Unlock()
+	if h == nil {
+		return 0
+	}
+	snapshot := h.snapshot()
+	if snapshot.Count < uint64(d.opts.MinSamples) {
+		return 0
+	}
+	threshold := time.Duration(float64(snapshot.Quantile(0.99)) * d.opts.Factor)
+	if threshold < d.opts.MinDuration {
+		threshold = d.opts.MinDuration
+	}
+	return threshold
+}
+
+// handlerStuck reports that the handler for the request with the given id
+// has run for longer than threshold.
+func (s *Server) handlerStuck(ctx context.Context, op, id string, threshold time.Duration) {
+	s.logf(ctx, "Handler for request %q is stuck, it has run for longer than %s", id, threshold)
+	s.events.publish(Event{Type: EventHandlerStuck, Op: op, RequestID: id, Duration: threshold})
+	s.metrics.observeStuck(op)
+}
+
+// stuckError returns the error of a handler cancelled after it ran for longer than threshold.
+func stuckError(threshold time.Duration) *limitError {
+	return &limitError{code: ErrorCodeStuck, err: fmt.Errorf("handler was stuck, it ran for longer than %s", threshold)}
+}
@@ -0,0 +1,65 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStuckDetector(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&StuckHandlerOptions{Factor: -1}).init(), qt.ErrorMatches, "stuck handlers: options can not be negative")
+
+	var nilDetector *stuckDetector
+	nilDetector.observe("ocr", time.Second)
+	c.Assert(nilDetector.threshold("ocr"), qt.Equals, time.Duration(0))
+
+	opts := &StuckHandlerOptions{MinSamples: 10}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Factor, qt.Equals, 3.0)
+	c.Assert(opts.MinDuration, qt.Equals, 10*time.Second)
+
+	d := newStuckDetector(opts)
+	for i := 0; i < 9; i++ {
+		d.observe("ocr", 4*time.Second)
+	}
+	c.Assert(d.threshold("ocr"), qt.Equals, time.Duration(0))
+	d.observe("ocr", 4*time.Second)
+	// The p99 is the 5 second bucket.
+	c.Assert(d.threshold("ocr"), qt.Equals, 15*time.Second)
+	c.Assert(d.threshold("resize"), qt.Equals, time.Duration(0))
+
+	for i := 0; i < 10; i++ {
+		d.observe("thumbnail", 20*time.Millisecond)
+	}
+	c.Assert(d.threshold("thumbnail"), qt.Equals, 10*time.Second)
+}
+
+func TestRunHandlerStuck(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &StuckHandlerOptions{MinSamples: 1, MinDuration: time.Millisecond, Cancel: true}
+	c.Assert(opts.init(), qt.IsNil)
+	s := &Server{common: &common{infof: func(format string, args ...interface{}) {}}, stuck: newStuckDetector(opts)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := s.runHandler(ctx, cancel, "ocr", "01h", OpOptions{}, func(ctx context.Context, input Input) (Output, error) {
+		return Output{}, nil
+	}, Input{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.stuck.threshold("ocr") >= time.Millisecond, qt.IsTrue)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = s.runHandler(ctx, cancel, "ocr", "01h", OpOptions{}, func(ctx context.Context, input Input) (Output, error) {
+		<-ctx.Done()
+		return Output{}, ctx.Err()
+	}, Input{})
+	var limitErr *limitError
+	c.Assert(errors.As(err, &limitErr), qt.IsTrue)
+	c.Assert(limitErr.code, qt.Equals, ErrorCodeStuck)
+	c.Assert(err, qt.ErrorMatches, "handler was stuck, it ran for longer than .*")
+}
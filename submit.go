@@ -0,0 +1,124 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SQS message attributes of the messages sent by clients with ClientOptions.SubmitQueue.
+// A server identifies a request by these instead of parsing an S3 event notification.
+// A server sends its response messages to clients with ClientOptions.DirectSubmit
+// with the same attributes.
+const (
+	AttrOp        = "s3rpc-op"
+	AttrRequestID = "s3rpc-request-id"
+	AttrBucket    = "s3rpc-bucket"
+	AttrKey       = "s3rpc-key"
+
+	// AttrReplyQueue is the queue the server sends the response message to,
+	// see ClientOptions.DirectSubmit.
+	AttrReplyQueue = "s3rpc-reply-queue"
+
+	// AttrAttempt is the attempt of a request the server sent back to its queue
+	// after a Retryable error, see HandlerRetryOptions.Requeue.
+	AttrAttempt = "s3rpc-attempt"
+)
+
+// submit sends a message for the request uploaded to key to the endpoint's submit queue.
+// If replyQueue is set, the server sends a message to it when the response is uploaded.
+func (c *common) submit(ctx context.Context, op, id, key, replyQueue string) error {
+	c.logf(ctx, "Submitting %q to %q", key, c.submitQueue)
+	return c.sendRequestMessage(ctx, c.submitQueue, op, id, key, replyQueue)
+}
+
+// sendRequestMessage sends a message with the request attributes to queue.
+func (c *common) sendRequestMessage(ctx context.Context, queue, op, id, key, replyQueue string) error {
+	_, err := c.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queue),
+		MessageBody:       aws.String(key),
+		MessageAttributes: requestAttributes(c.bucket, op, id, key, replyQueue),
+	})
+	return err
+}
+
+// requestAttributes returns the message attributes of a request.
+func requestAttributes(bucket, op, id, key, replyQueue string) map[string]sqstypes.MessageAttributeValue {
+	attributes := map[string]sqstypes.MessageAttributeValue{
+		AttrOp:        stringAttribute(op),
+		AttrRequestID: stringAttribute(id),
+		AttrBucket:    stringAttribute(bucket),
+		AttrKey:       stringAttribute(key),
+	}
+	if replyQueue != "" {
+		attributes[AttrReplyQueue] = stringAttribute(replyQueue)
+	}
+	return attributes
+}
+
+type replyQueueKey struct{}
+
+// withReplyQueue stores the request's reply queue in ctx for sendReply.
+func withReplyQueue(ctx context.Context, queue string) context.Context {
+	if queue == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, replyQueueKey{}, queue)
+}
+
+// sendReply sends a message for the response uploaded to resultKey
+// to the reply queue of the request, if any.
+func (s *Server) sendReply(ctx context.Context, op, key, resultKey string) error {
+	queue, _ := ctx.Value(replyQueueKey{}).(string)
+	if queue == "" {
+		return nil
+	}
+	if err := s.sendRequestMessage(ctx, queue, op, requestID(key), resultKey, ""); err != nil {
+		return fmt.Errorf("failed to send reply to %q: %w", queue, err)
+	}
+	return nil
+}
+
+func stringAttribute(v string) sqstypes.MessageAttributeValue {
+	return sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+}
+
+// parseSQSMessage parses a message sent by submit or, if it has no s3rpc attributes,
+// an S3 event notification.
+// It returns false if the message holds no request, e.g. the s3:TestEvent.
+func parseSQSMessage(m sqstypes.Message) (message, bool, error) {
+	if msg, ok := parseSubmitMessage(m); ok {
+		return msg, true, nil
+	}
+	return parseMessage(aws.ToString(m.Body), aws.ToString(m.ReceiptHandle))
+}
+
+// parseSubmitMessage parses a message sent by submit.
+func parseSubmitMessage(m sqstypes.Message) (message, bool) {
+	attr := func(name string) string {
+		return aws.ToString(m.MessageAttributes[name].StringValue)
+	}
+	msg := message{
+		Bucket:        attr(AttrBucket),
+		Key:           attr(AttrKey),
+		Op:            attr(AttrOp),
+		RequestID:     attr(AttrRequestID),
+		ReplyQueue:    attr(AttrReplyQueue),
+		ReceiptHandle: aws.ToString(m.ReceiptHandle),
+	}
+	if msg.Op == "" || msg.RequestID == "" || msg.Key == "" {
+		return message{}, false
+	}
+	if attempt, err := strconv.Atoi(attr(AttrAttempt)); err == nil && attempt > 0 {
+		msg.Attempt = attempt
+	}
+	if ms, err := strconv.ParseInt(m.Attributes[string(sqstypes.MessageSystemAttributeNameSentTimestamp)], 10, 64); err == nil {
+		msg.EventTime = time.UnixMilli(ms)
+	}
+	return msg, true
+}
@@ -0,0 +1,55 @@
+package s3rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseSQSMessage(t *testing.T) {
+	c := qt.New(t)
+
+	m, ok, err := parseSQSMessage(sqstypes.Message{
+		Body:          aws.String("uploads/01gcabc.jpg"),
+		ReceiptHandle: aws.String("rh"),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			AttrOp:         stringAttribute("resize"),
+			AttrRequestID:  stringAttribute("01gcabc"),
+			AttrBucket:     stringAttribute("mybucket"),
+			AttrKey:        stringAttribute("uploads/01gcabc.jpg"),
+			AttrReplyQueue: stringAttribute("https://cqueue"),
+		},
+		Attributes: map[string]string{"SentTimestamp": "1662973200000"},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(m.Op, qt.Equals, "resize")
+	c.Assert(m.RequestID, qt.Equals, "01gcabc")
+	c.Assert(m.Bucket, qt.Equals, "mybucket")
+	c.Assert(m.Key, qt.Equals, "uploads/01gcabc.jpg")
+	c.Assert(m.ReceiptHandle, qt.Equals, "rh")
+	c.Assert(m.ReplyQueue, qt.Equals, "https://cqueue")
+	c.Assert(m.EventTime.Equal(time.Date(2022, 9, 12, 9, 0, 0, 0, time.UTC)), qt.IsTrue)
+	c.Assert(m.Attempt, qt.Equals, 0)
+
+	attributes := requestAttributes("mybucket", "resize", "01gcabc", "uploads/01gcabc.jpg", "")
+	attributes[AttrAttempt] = stringAttribute("2")
+	m, ok, err = parseSQSMessage(sqstypes.Message{Body: aws.String("uploads/01gcabc.jpg"), MessageAttributes: attributes})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(m.Attempt, qt.Equals, 2)
+	c.Assert(m.ReplyQueue, qt.Equals, "")
+
+	// Without the attributes, the body is parsed as an S3 event notification.
+	body := `{"Records":[{"s3":{"bucket":{"name":"mybucket"},"object":{"key":"to_server/resize/01gcabc_image.jpg"}}}]}`
+	m, ok, err = parseSQSMessage(sqstypes.Message{Body: aws.String(body), ReceiptHandle: aws.String("rh")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(m.Op, qt.Equals, "resize")
+
+	_, _, err = parseSQSMessage(sqstypes.Message{Body: aws.String("invalid"), ReceiptHandle: aws.String("rh")})
+	c.Assert(err, qt.Not(qt.IsNil))
+}
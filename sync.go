@@ -0,0 +1,258 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// syncManifestName is the name of the object below SyncOptions.DestPrefix
+// recording the processed source objects.
+const syncManifestName = ".s3rpc-sync.json"
+
+// SyncOptions configures Client.Sync.
+type SyncOptions struct {
+	// Op is the op to execute for each new or changed source object.
+	Op string
+
+	// SourcePrefix is the prefix of the objects to process, e.g. "images/raw/".
+	SourcePrefix string
+
+	// DestPrefix is the prefix the results are written to, with the same relative key
+	// as the source and the extension of the result, if it has one.
+	// It must not overlap with SourcePrefix.
+	DestPrefix string
+
+	// Metadata, if set, is sent with each request.
+	Metadata map[string]string
+
+	// Concurrency is the max number of objects processed concurrently.
+	// Defaults to 4.
+	Concurrency int
+
+	// Delete, if set, deletes the results of source objects that no longer exist.
+	Delete bool
+}
+
+func (o *SyncOptions) init() error {
+	if o.Op == "" || o.SourcePrefix == "" || o.DestPrefix == "" {
+		return errors.New("sync: Op, SourcePrefix and DestPrefix are required")
+	}
+	if strings.HasPrefix(o.DestPrefix, o.SourcePrefix) || strings.HasPrefix(o.SourcePrefix, o.DestPrefix) {
+		return fmt.Errorf("sync: SourcePrefix %q and DestPrefix %q overlap", o.SourcePrefix, o.DestPrefix)
+	}
+	for _, prefix := range []string{toServer, toClient, archive, quarantine, audit, chunks, checkpoints, baselines, dictionaries, publicKeys} {
+		if strings.HasPrefix(o.DestPrefix, prefix+"/") {
+			return fmt.Errorf("sync: DestPrefix %q is reserved", o.DestPrefix)
+		}
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	return nil
+}
+
+// SyncResult summarizes a Client.Sync run.
+type SyncResult struct {
+	Processed int
+	Unchanged int
+	Deleted   int
+
+	// Failed maps the keys of the source objects that failed to their error.
+	// They are retried on the next run.
+	Failed map[string]error
+}
+
+// syncManifest maps source keys relative to SourcePrefix to their state.
+type syncManifest map[string]syncEntry
+
+type syncEntry struct {
+	ETag string `json:"etag"`
+
+	// Output is the result key relative to DestPrefix.
+	Output string `json:"output"`
+}
+
+// syncSource is a source object.
+type syncSource struct {
+	rel  string
+	etag string
+}
+
+// planSync returns the sources that are new or changed since the manifest was written
+// and the manifest entries whose sources no longer exist.
+func planSync(sources []syncSource, manifest syncManifest) (changed []syncSource, removed []string) {
+	seen := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		seen[src.rel] = true
+		if e, found := manifest[src.rel]; !found || e.ETag != src.etag {
+			changed = append(changed, src)
+		}
+	}
+	for rel := range manifest {
+		if !seen[rel] {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(removed)
+	return
+}
+
+// syncOutputKey returns the result key relative to DestPrefix for the source rel and the result filename.
+func syncOutputKey(rel, filename string) string {
+	if ext := path.Ext(filename); ext != "" {
+		return strings.TrimSuffix(rel, path.Ext(rel)) + ext
+	}
+	return rel
+}
+
+// Sync keeps DestPrefix in sync with the objects below SourcePrefix in the primary bucket:
+// it submits new and changed source objects, tracked by ETag, to the op
+// and uploads the results below DestPrefix.
+// The state is kept in a .s3rpc-sync.json object below DestPrefix.
+// The client user needs s3:ListBucket and s3:GetObject on SourcePrefix
+// and s3:GetObject, s3:PutObject and s3:DeleteObject on DestPrefix.
+func (c *Client) Sync(ctx context.Context, opts SyncOptions) (SyncResult, error) {
+	if err := opts.init(); err != nil {
+		return SyncResult{}, err
+	}
+	result := SyncResult{Failed: make(map[string]error)}
+
+	manifestKey := opts.DestPrefix + syncManifestName
+	manifest, err := c.loadSyncManifest(ctx, manifestKey)
+	if err != nil {
+		return result, err
+	}
+	sources, err := c.listSyncSources(ctx, opts.SourcePrefix)
+	if err != nil {
+		return result, err
+	}
+	changed, removed := planSync(sources, manifest)
+	result.Unchanged = len(sources) - len(changed)
+
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.Concurrency)
+	for _, src := range changed {
+		src := src
+		g.Go(func() error {
+			output, err := c.syncOne(gctx, opts, src)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Failed[opts.SourcePrefix+src.rel] = err
+				return nil
+			}
+			if prev, found := manifest[src.rel]; found && prev.Output != output {
+				_ = c.deleteObject(gctx, opts.DestPrefix+prev.Output)
+			}
+			manifest[src.rel] = syncEntry{ETag: src.etag, Output: output}
+			result.Processed++
+			return nil
+		})
+	}
+	g.Wait()
+
+	if opts.Delete {
+		for _, rel := range removed {
+			if err := c.deleteObject(ctx, opts.DestPrefix+manifest[rel].Output); err != nil {
+				result.Failed[opts.SourcePrefix+rel] = err
+				continue
+			}
+			delete(manifest, rel)
+			result.Deleted++
+		}
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return result, err
+	}
+	if err := c.uploadBytes(ctx, manifestKey, b, nil); err != nil {
+		return result, fmt.Errorf("sync: failed to write manifest: %w", err)
+	}
+	return result, nil
+}
+
+// syncOne downloads src, executes the op and uploads the result, returning its relative key.
+func (c *Client) syncOne(ctx context.Context, opts SyncOptions, src syncSource) (string, error) {
+	key := opts.SourcePrefix + src.rel
+	f, err := createTemp(c.tempDir, key)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, contentType, err := c.getObject(ctx, f, key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download source: %w", err)
+	}
+
+	output, err := c.Execute(ctx, opts.Op, Input{Filename: f.Name(), Metadata: opts.Metadata, ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(output.Filename)
+
+	rel := syncOutputKey(src.rel, output.Filename)
+	if err := c.upload(ctx, output.Filename, opts.DestPrefix+rel, output.ContentType, "", output.Metadata); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+func (c *Client) loadSyncManifest(ctx context.Context, key string) (syncManifest, error) {
+	o, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return make(syncManifest), nil
+		}
+		return nil, fmt.Errorf("sync: failed to read manifest: %w", err)
+	}
+	defer o.Body.Close()
+	manifest := make(syncManifest)
+	if err := json.NewDecoder(o.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("sync: failed to decode manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func (c *Client) listSyncSources(ctx context.Context, prefix string) ([]syncSource, error) {
+	var sources []syncSource
+	p := s3.NewListObjectsV2Paginator(c.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("sync: failed to list objects: %w", err)
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if strings.HasSuffix(key, "/") {
+				// Folder placeholder.
+				continue
+			}
+			sources = append(sources, syncSource{rel: strings.TrimPrefix(key, prefix), etag: aws.ToString(o.ETag)})
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,42 @@
+package s3rpc
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPlanSync(t *testing.T) {
+	c := qt.New(t)
+
+	manifest := syncManifest{
+		"a.png":     {ETag: `"1"`, Output: "a.jpg"},
+		"b.png":     {ETag: `"2"`, Output: "b.jpg"},
+		"gone.png":  {ETag: `"3"`, Output: "gone.jpg"},
+		"gone2.png": {ETag: `"4"`, Output: "gone2.jpg"},
+	}
+	changed, removed := planSync([]syncSource{
+		{rel: "a.png", etag: `"1"`},
+		{rel: "b.png", etag: `"22"`},
+		{rel: "sub/c.png", etag: `"5"`},
+	}, manifest)
+	c.Assert(changed, qt.HasLen, 2)
+	c.Assert(changed[0], qt.Equals, syncSource{rel: "b.png", etag: `"22"`})
+	c.Assert(changed[1], qt.Equals, syncSource{rel: "sub/c.png", etag: `"5"`})
+	c.Assert(removed, qt.DeepEquals, []string{"gone.png", "gone2.png"})
+
+	c.Assert(syncOutputKey("sub/c.png", "/tmp/123_01gcabc_c.jpg"), qt.Equals, "sub/c.jpg")
+	c.Assert(syncOutputKey("sub/c.png", "/tmp/123_01gcabc_c"), qt.Equals, "sub/c.png")
+}
+
+func TestSyncOptions(t *testing.T) {
+	c := qt.New(t)
+
+	opts := SyncOptions{Op: "resize", SourcePrefix: "images/raw/", DestPrefix: "images/small/"}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.Concurrency, qt.Equals, 4)
+
+	c.Assert((&SyncOptions{Op: "resize", SourcePrefix: "images/", DestPrefix: "images/small/"}).init(), qt.ErrorMatches, ".*overlap")
+	c.Assert((&SyncOptions{Op: "resize", SourcePrefix: "images/", DestPrefix: "to_client/small/"}).init(), qt.ErrorMatches, ".*reserved")
+	c.Assert((&SyncOptions{Op: "resize", DestPrefix: "small/"}).init(), qt.ErrorMatches, ".*required")
+}
@@ -0,0 +1,65 @@
+package s3rpc
+
+import (
+	"time"
+)
+
+// Metadata keys with the server's part of the Timeline, set on responses.
+// The times are UTC in RFC 3339 format with nanoseconds.
+const (
+	MetaTimeEnqueued        = "s3rpc-time-enqueued"
+	MetaTimeReceived        = "s3rpc-time-received"
+	MetaTimeHandlerStarted  = "s3rpc-time-handler-started"
+	MetaTimeHandlerFinished = "s3rpc-time-handler-finished"
+)
+
+// Timeline is when each step of a request happened, see Output.Timeline,
+// so the time of a slow request can be broken down without correlating logs.
+// The server's times are from its clock, which may be skewed against the client's.
+// Times not known, e.g. from servers that do not set them, are zero.
+type Timeline struct {
+	// UploadStarted and UploadFinished is when the client uploaded the input.
+	UploadStarted  time.Time
+	UploadFinished time.Time
+
+	// Enqueued is when the request was put on the server's queue,
+	// and Received is when a server took it off.
+	Enqueued time.Time
+	Received time.Time
+
+	// HandlerStarted and HandlerFinished is when the handler ran on the server.
+	HandlerStarted  time.Time
+	HandlerFinished time.Time
+
+	// DownloadStarted and DownloadFinished is when the client downloaded the response.
+	DownloadStarted  time.Time
+	DownloadFinished time.Time
+}
+
+// setServerMetadata sets the server's times that are known in the response metadata.
+func (t Timeline) setServerMetadata(metadata map[string]string) {
+	for k, v := range map[string]time.Time{
+		MetaTimeEnqueued:        t.Enqueued,
+		MetaTimeReceived:        t.Received,
+		MetaTimeHandlerStarted:  t.HandlerStarted,
+		MetaTimeHandlerFinished: t.HandlerFinished,
+	} {
+		if !v.IsZero() {
+			metadata[k] = v.UTC().Format(time.RFC3339Nano)
+		}
+	}
+}
+
+// timelineFromMetadata returns the server's times in the response metadata.
+func timelineFromMetadata(metadata map[string]string) Timeline {
+	parse := func(k string) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, metadata[k])
+		return t
+	}
+	return Timeline{
+		Enqueued:        parse(MetaTimeEnqueued),
+		Received:        parse(MetaTimeReceived),
+		HandlerStarted:  parse(MetaTimeHandlerStarted),
+		HandlerFinished: parse(MetaTimeHandlerFinished),
+	}
+}
@@ -0,0 +1,31 @@
+package s3rpc
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTimeline(t *testing.T) {
+	c := qt.New(t)
+
+	received := time.Date(2026, 10, 15, 12, 0, 0, 123456789, time.FixedZone("CEST", 2*3600))
+	server := Timeline{
+		Received:        received,
+		HandlerStarted:  received.Add(time.Second),
+		HandlerFinished: received.Add(3 * time.Second),
+	}
+	metadata := map[string]string{MetaOp: "ocr"}
+	server.setServerMetadata(metadata)
+	c.Assert(metadata[MetaTimeReceived], qt.Equals, "2026-10-15T10:00:00.123456789Z")
+	_, found := metadata[MetaTimeEnqueued]
+	c.Assert(found, qt.IsFalse)
+
+	got := timelineFromMetadata(metadata)
+	c.Assert(got.Enqueued.IsZero(), qt.IsTrue)
+	c.Assert(got.Received.Equal(server.Received), qt.IsTrue)
+	c.Assert(got.HandlerFinished.Sub(got.HandlerStarted), qt.Equals, 2*time.Second)
+
+	c.Assert(timelineFromMetadata(map[string]string{MetaTimeReceived: "yesterday"}), qt.Equals, Timeline{})
+}
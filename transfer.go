@@ -0,0 +1,154 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Transfer directions, see SlowTransfer.Direction.
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// SlowTransferOptions configures warnings for uploads and downloads slower than MinBytesPerSecond,
+// e.g. to tell network issues apart from slow handlers with large payloads.
+// Slow transfers are logged and passed to OnSlowTransfer.
+type SlowTransferOptions struct {
+	// MinBytesPerSecond is the throughput below which a transfer is considered slow.
+	MinBytesPerSecond float64
+
+	// MinSize is the size in bytes below which transfers are not checked,
+	// as the throughput of small transfers is dominated by latency.
+	// Defaults to 1 MiB.
+	MinSize int64
+
+	// OnSlowTransfer, if set, is called for each slow transfer, e.g. to send an alert.
+	OnSlowTransfer func(ctx context.Context, t SlowTransfer)
+}
+
+func (o *SlowTransferOptions) init() error {
+	if o.MinBytesPerSecond <= 0 {
+		return errors.New("slow transfer: min bytes per second must be positive")
+	}
+	if o.MinSize < 0 {
+		return errors.New("slow transfer: min size can not be negative")
+	}
+	if o.MinSize == 0 {
+		o.MinSize = 1 << 20
+	}
+	return nil
+}
+
+// SlowTransfer describes an upload or download slower than SlowTransferOptions.MinBytesPerSecond.
+type SlowTransfer struct {
+	// Direction is TransferUpload or TransferDownload.
+	Direction string
+
+	// Key is the object key.
+	Key string
+
+	Bytes    int64
+	Duration time.Duration
+}
+
+// BytesPerSecond returns the throughput of the transfer.
+func (t SlowTransfer) BytesPerSecond() float64 {
+	return bytesPerSecond(t.Bytes, t.Duration)
+}
+
+// TransferStats holds the totals of completed uploads or downloads.
+type TransferStats struct {
+	// Count is the number of transfers.
+	Count uint64
+
+	// Bytes is the number of bytes transferred.
+	Bytes int64
+
+	// Duration is the time spent transferring.
+	Duration time.Duration
+
+	// Slow is the number of transfers below SlowTransferOptions.MinBytesPerSecond.
+	Slow uint64
+}
+
+// BytesPerSecond returns the average throughput of the transfers.
+func (s TransferStats) BytesPerSecond() float64 {
+	return bytesPerSecond(s.Bytes, s.Duration)
+}
+
+func bytesPerSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// transferMonitor records the throughput of the uploads and downloads of a client or server.
+type transferMonitor struct {
+	opts    *SlowTransferOptions
+	metrics *cloudWatchMetrics
+
+	mu        sync.Mutex
+	uploads   TransferStats
+	downloads TransferStats
+}
+
+func newTransferMonitor(opts *SlowTransferOptions, metrics *cloudWatchMetrics) *transferMonitor {
+	return &transferMonitor{opts: opts, metrics: metrics}
+}
+
+// observe records a completed transfer, warning if it was slow.
+func (m *transferMonitor) observe(ctx context.Context, c *common, direction, key string, n int64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	slow := m.opts != nil && n >= m.opts.MinSize && bytesPerSecond(n, d) < m.opts.MinBytesPerSecond
+
+	m.mu.Lock()
+	stats := &m.uploads
+	if direction == TransferDownload {
+		stats = &m.downloads
+	}
+	stats.Count++
+	stats.Bytes += n
+	stats.Duration += d
+	if slow {
+		stats.Slow++
+	}
+	m.mu.Unlock()
+
+	m.metrics.observeTransfer(direction, bytesPerSecond(n, d))
+
+	if !slow {
+		return
+	}
+	t := SlowTransfer{Direction: direction, Key: key, Bytes: n, Duration: d}
+	c.logf(ctx, "Slow %s of %q: %d bytes in %s (%s/s)", direction, key, n, d.Round(time.Millisecond), formatBytes(t.BytesPerSecond()))
+	if m.opts.OnSlowTransfer != nil {
+		m.opts.OnSlowTransfer(ctx, t)
+	}
+}
+
+func (m *transferMonitor) snapshot() (uploads, downloads TransferStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.uploads, m.downloads
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for n/div >= unit && exp < 3 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/div, "KMGT"[exp])
+}
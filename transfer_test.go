@@ -0,0 +1,53 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTransferMonitor(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert((&SlowTransferOptions{}).init(), qt.ErrorMatches, ".*must be positive")
+
+	var slow []SlowTransfer
+	opts := &SlowTransferOptions{
+		MinBytesPerSecond: 1 << 20,
+		OnSlowTransfer: func(ctx context.Context, t SlowTransfer) {
+			slow = append(slow, t)
+		},
+	}
+	c.Assert(opts.init(), qt.IsNil)
+	c.Assert(opts.MinSize, qt.Equals, int64(1<<20))
+
+	var logged []string
+	cm := &common{infof: func(format string, args ...interface{}) { logged = append(logged, format) }}
+	ctx := context.Background()
+
+	m := newTransferMonitor(opts, nil)
+	m.observe(ctx, cm, TransferUpload, "to_server/resize/a.jpg", 4<<20, time.Second)
+	m.observe(ctx, cm, TransferDownload, "to_client/resize/a.jpg", 4<<20, 8*time.Second)
+	// Too small to be checked.
+	m.observe(ctx, cm, TransferDownload, "to_client/resize/b.jpg", 1024, time.Second)
+
+	c.Assert(slow, qt.HasLen, 1)
+	c.Assert(slow[0].Key, qt.Equals, "to_client/resize/a.jpg")
+	c.Assert(slow[0].BytesPerSecond(), qt.Equals, float64(512<<10))
+	c.Assert(logged, qt.HasLen, 1)
+
+	uploads, downloads := m.snapshot()
+	c.Assert(uploads, qt.Equals, TransferStats{Count: 1, Bytes: 4 << 20, Duration: time.Second})
+	c.Assert(uploads.BytesPerSecond(), qt.Equals, float64(4<<20))
+	c.Assert(downloads.Count, qt.Equals, uint64(2))
+	c.Assert(downloads.Slow, qt.Equals, uint64(1))
+
+	var nilMonitor *transferMonitor
+	nilMonitor.observe(ctx, cm, TransferUpload, "key", 1, time.Second)
+
+	c.Assert(formatBytes(512), qt.Equals, "512 B")
+	c.Assert(formatBytes(1536), qt.Equals, "1.5 KiB")
+	c.Assert(formatBytes(3<<20), qt.Equals, "3.0 MiB")
+}
@@ -0,0 +1,132 @@
+package s3rpc
+
+import (
+	"context"
+	"sync"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Usage is the billable AWS usage of handling requests.
+// The batched SQS ReceiveMessage calls are shared between requests and not included.
+type Usage struct {
+	// S3Reads is the number of GET and HEAD requests.
+	S3Reads int64
+
+	// S3Writes is the number of PUT, COPY, POST and LIST requests.
+	S3Writes int64
+
+	// SQSRequests is the number of SQS requests.
+	SQSRequests int64
+
+	// BytesDownloaded and BytesUploaded are the object bytes transferred.
+	BytesDownloaded int64
+	BytesUploaded   int64
+}
+
+func (u *Usage) add(o Usage) {
+	u.S3Reads += o.S3Reads
+	u.S3Writes += o.S3Writes
+	u.SQSRequests += o.SQSRequests
+	u.BytesDownloaded += o.BytesDownloaded
+	u.BytesUploaded += o.BytesUploaded
+}
+
+// Cost returns the estimated cost of u in USD.
+func (u Usage) Cost(p Pricing) float64 {
+	const gb = 1 << 30
+	return float64(u.S3Reads)*p.S3ReadPer1000/1000 +
+		float64(u.S3Writes)*p.S3WritePer1000/1000 +
+		float64(u.SQSRequests)*p.SQSPerMillion/1e6 +
+		float64(u.BytesDownloaded+u.BytesUploaded)*p.TransferPerGB/gb
+}
+
+// Pricing holds the AWS prices in USD used to estimate the cost of a request.
+type Pricing struct {
+	S3ReadPer1000  float64
+	S3WritePer1000 float64
+	SQSPerMillion  float64
+
+	// TransferPerGB is the data transfer cost, which is zero within a region.
+	TransferPerGB float64
+}
+
+// DefaultPricing is the S3 Standard and SQS standard queue pricing in us-east-1.
+var DefaultPricing = Pricing{
+	S3ReadPer1000:  0.0004,
+	S3WritePer1000: 0.005,
+	SQSPerMillion:  0.40,
+}
+
+type usageKey struct{}
+
+// jobUsage collects the Usage of a single request.
+type jobUsage struct {
+	mu sync.Mutex
+	u  Usage
+}
+
+func (j *jobUsage) add(u Usage) {
+	j.mu.Lock()
+	j.u.add(u)
+	j.mu.Unlock()
+}
+
+func (j *jobUsage) usage() Usage {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.u
+}
+
+// withUsage returns a context that collects the AWS calls made with it.
+func withUsage(ctx context.Context) (context.Context, *jobUsage) {
+	j := &jobUsage{}
+	return context.WithValue(ctx, usageKey{}, j), j
+}
+
+func usageFromContext(ctx context.Context) *jobUsage {
+	j, _ := ctx.Value(usageKey{}).(*jobUsage)
+	return j
+}
+
+// addUsageMiddleware counts the S3 and SQS calls made with a context from withUsage.
+func addUsageMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("s3rpcUsage",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if j := usageFromContext(ctx); j != nil {
+				j.add(callUsage(awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)))
+			}
+			return next.HandleInitialize(ctx, in)
+		},
+	), middleware.After)
+}
+
+func callUsage(service, operation string) Usage {
+	switch service {
+	case "SQS":
+		return Usage{SQSRequests: 1}
+	case "S3":
+		switch operation {
+		case "GetObject", "HeadObject":
+			return Usage{S3Reads: 1}
+		case "DeleteObject", "DeleteObjects":
+			// Free.
+			return Usage{}
+		default:
+			return Usage{S3Writes: 1}
+		}
+	}
+	return Usage{}
+}
+
+// uploadUsage is the expected Usage of uploading size bytes with the S3 upload manager.
+func uploadUsage(size int64) Usage {
+	writes := int64(1)
+	if size > manager.DefaultUploadPartSize {
+		// Create, parts and complete.
+		writes = (size+manager.DefaultUploadPartSize-1)/manager.DefaultUploadPartSize + 2
+	}
+	return Usage{S3Writes: writes, BytesUploaded: size}
+}
@@ -0,0 +1,36 @@
+package s3rpc
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestUsage(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(callUsage("S3", "GetObject"), qt.Equals, Usage{S3Reads: 1})
+	c.Assert(callUsage("S3", "PutObject"), qt.Equals, Usage{S3Writes: 1})
+	c.Assert(callUsage("S3", "DeleteObject"), qt.Equals, Usage{})
+	c.Assert(callUsage("SQS", "DeleteMessage"), qt.Equals, Usage{SQSRequests: 1})
+
+	c.Assert(uploadUsage(1024), qt.Equals, Usage{S3Writes: 1, BytesUploaded: 1024})
+	c.Assert(uploadUsage(12<<20).S3Writes, qt.Equals, int64(5))
+
+	ctx, j := withUsage(context.Background())
+	c.Assert(usageFromContext(ctx), qt.Equals, j)
+	c.Assert(usageFromContext(context.Background()), qt.IsNil)
+	j.add(Usage{S3Reads: 1000, S3Writes: 1000})
+	j.add(Usage{SQSRequests: 1e6, BytesDownloaded: 1 << 30})
+
+	u := j.usage()
+	c.Assert(math.Abs(u.Cost(DefaultPricing)-0.4054) < 1e-9, qt.IsTrue)
+	c.Assert(u.Cost(Pricing{TransferPerGB: 0.09}), qt.Equals, 0.09)
+
+	stats := newServerStats("myinstance")
+	stats.addUsage("op", u)
+	stats.addUsage("op", u)
+	c.Assert(stats.snapshot().Usage["op"].S3Reads, qt.Equals, int64(2000))
+}
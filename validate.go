@@ -0,0 +1,181 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Validator validates a request input after it is downloaded, before it is passed to the handler.
+// A non-nil error is sent to the client as a ResponseError with code ErrorCodeInvalidInput.
+// See ServerOptions.Validators.
+type Validator func(ctx context.Context, input Input) error
+
+// CombineValidators returns a Validator that runs validators in order, stopping at the first error.
+func CombineValidators(validators ...Validator) Validator {
+	return func(ctx context.Context, input Input) error {
+		for _, v := range validators {
+			if err := v(ctx, input); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// MaxSizeValidator rejects inputs larger than maxBytes.
+func MaxSizeValidator(maxBytes int64) Validator {
+	return func(ctx context.Context, input Input) error {
+		fi, err := os.Stat(input.Filename)
+		if err != nil {
+			return err
+		}
+		if fi.Size() > maxBytes {
+			return fmt.Errorf("input is %d bytes, max is %d", fi.Size(), maxBytes)
+		}
+		return nil
+	}
+}
+
+// ExtensionValidator rejects inputs with a filename extension not in extensions, e.g. ".jpg".
+// The match is case insensitive.
+func ExtensionValidator(extensions ...string) Validator {
+	return func(ctx context.Context, input Input) error {
+		ext := filepath.Ext(input.Filename)
+		for _, e := range extensions {
+			if strings.EqualFold(e, ext) {
+				return nil
+			}
+		}
+		return fmt.Errorf("extension %q is not allowed", ext)
+	}
+}
+
+// ContentTypeValidator rejects inputs with a content type, sniffed from the first bytes
+// of the file with http.DetectContentType, not matching one of contentTypes.
+// A content type matches if it starts with one of contentTypes, e.g. "image/" or "text/plain".
+func ContentTypeValidator(contentTypes ...string) Validator {
+	return func(ctx context.Context, input Input) error {
+		contentType, err := sniffContentType(input.Filename)
+		if err != nil {
+			return err
+		}
+		for _, t := range contentTypes {
+			if strings.HasPrefix(contentType, t) {
+				return nil
+			}
+		}
+		return fmt.Errorf("content type %q is not allowed", contentType)
+	}
+}
+
+// Error codes set in ResponseError.Code.
+const (
+	// ErrorCodeInvalidInput means that the input was rejected by a Validator.
+	ErrorCodeInvalidInput = "invalid_input"
+
+	// ErrorCodeHandler means that the handler failed with a Permanent error, a Retryable error
+	// after its retries, or that its output was rejected by an OutputFilter.
+	ErrorCodeHandler = "handler_error"
+
+	// ErrorCodeInfected means that a ScanFunc detected a threat in the input.
+	ErrorCodeInfected = "infected"
+
+	// ErrorCodeInvalidMetadata means that the request metadata did not match the op's MetadataSchema.
+	ErrorCodeInvalidMetadata = "invalid_metadata"
+
+	// ErrorCodeNoRoute means that no HandlerRoute matched the input, see Route.
+	ErrorCodeNoRoute = "no_route"
+
+	// ErrorCodeTimeout means that the handler did not finish within OpOptions.Timeout.
+	ErrorCodeTimeout = "timeout"
+
+	// ErrorCodeResourceLimit means that the handler exceeded OpOptions.MaxMemory.
+	ErrorCodeResourceLimit = "resource_limit"
+)
+
+// ResponseError is returned from Client.Execute when the server responded with an error.
+type ResponseError struct {
+	// Code is one of the ErrorCode* constants.
+	Code string
+
+	// Message describes the error.
+	Message string
+
+	// RetryAfter is how long the server asked the client to wait before retrying,
+	// set for ErrorCodeBusy.
+	RetryAfter time.Duration
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// responseErrors maps error codes to the errors a ResponseError with the code matches.
+var responseErrors = map[string]error{
+	ErrorCodeProtocolVersion:  ErrProtocolVersion,
+	ErrorCodeQuotaExceeded:    ErrQuotaExceeded,
+	ErrorCodeInvalidSignature: ErrInvalidSignature,
+	ErrorCodeBusy:             ErrBusy,
+	ErrorCodePartial:          ErrPartial,
+}
+
+// Is reports whether target is the error matching e's code, e.g. ErrQuotaExceeded.
+func (e *ResponseError) Is(target error) bool {
+	err, found := responseErrors[e.Code]
+	return found && err == target
+}
+
+// responseErrorFrom returns the error in the response metadata, if any.
+func responseErrorFrom(metadata map[string]string) error {
+	code := metadata[MetaErrorCode]
+	if code == "" {
+		return nil
+	}
+	return &ResponseError{Code: code, Message: metadata[MetaError], RetryAfter: parseRetryAfter(metadata[MetaRetryAfter])}
+}
+
+// respondError sends an error response with an empty body for the request with the given key.
+func (s *Server) respondError(ctx context.Context, op, key, code string, err error) error {
+	metadata := s.responseMetadata(op, requestID(key), "")
+	metadata[MetaErrorCode] = code
+	metadata[MetaError] = truncate(err.Error(), maxErrorMessageLen)
+	var busyErr *busyError
+	if errors.As(err, &busyErr) {
+		metadata[MetaRetryAfter] = formatRetryAfter(busyErr.retryAfter)
+	}
+	resultKey := responseKey(op, key)
+	if s.signing != nil {
+		s.signing.sign(resultKey, emptyChecksum, metadata)
+	}
+	if err := s.uploadBytes(ctx, resultKey, nil, metadata); err != nil {
+		return err
+	}
+	if err := s.sendReply(ctx, op, key, resultKey); err != nil {
+		return err
+	}
+	accessEntryFrom(ctx).setResponse(resultKey, 0, code, metadata[MetaError])
+	s.auditEvent(ctx, op, key, AuditRecord{Event: AuditResponded, ErrorCode: code, Error: metadata[MetaError]})
+	s.event(op, key, Event{Type: EventResponseUploaded, Err: &ResponseError{Code: code, Message: metadata[MetaError]}})
+	s.notify(ctx, Completion{Op: op, Key: key, Status: CompletionFailed, ResultKey: resultKey, ErrorCode: code, Error: metadata[MetaError], Metadata: metadata})
+	return nil
+}
+
+// maxErrorMessageLen keeps the error message well within the 2 KB S3 allows for user metadata.
+const maxErrorMessageLen = 1024
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// quarantineKey returns the quarantine key for the request key to_server/<op>/<id>_<filename>.
+func quarantineKey(key string) string {
+	return quarantine + strings.TrimPrefix(key, toServer)
+}
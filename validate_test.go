@@ -0,0 +1,62 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestValidators(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	dir := c.TempDir()
+	writeFile := func(name, content string) Input {
+		filename := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+		return Input{Filename: filename}
+	}
+
+	text := writeFile("text.TXT", "hello world")
+	png := writeFile("image.png", "\x89PNG\x0D\x0A\x1A\x0A")
+
+	c.Assert(MaxSizeValidator(11)(ctx, text), qt.IsNil)
+	c.Assert(MaxSizeValidator(10)(ctx, text), qt.ErrorMatches, "input is 11 bytes, max is 10")
+
+	c.Assert(ExtensionValidator(".txt")(ctx, text), qt.IsNil)
+	c.Assert(ExtensionValidator(".jpg", ".png")(ctx, text), qt.ErrorMatches, `extension ".TXT" is not allowed`)
+
+	c.Assert(ContentTypeValidator("image/")(ctx, png), qt.IsNil)
+	c.Assert(ContentTypeValidator("image/")(ctx, text), qt.ErrorMatches, `content type "text/plain.*" is not allowed`)
+
+	var calls int
+	counting := func(ctx context.Context, input Input) error {
+		calls++
+		return nil
+	}
+	c.Assert(CombineValidators(counting, MaxSizeValidator(10), counting)(ctx, text), qt.ErrorMatches, "input is.*")
+	c.Assert(calls, qt.Equals, 1)
+	c.Assert(CombineValidators(counting, counting)(ctx, text), qt.IsNil)
+	c.Assert(calls, qt.Equals, 3)
+}
+
+func TestResponseError(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(responseErrorFrom(map[string]string{MetaInstanceID: "foo"}), qt.IsNil)
+
+	err := responseErrorFrom(map[string]string{MetaErrorCode: ErrorCodeInvalidInput, MetaError: "too big"})
+	c.Assert(err, qt.ErrorMatches, "invalid_input: too big")
+	var respErr *ResponseError
+	c.Assert(errors.As(err, &respErr), qt.IsTrue)
+	c.Assert(respErr.Code, qt.Equals, ErrorCodeInvalidInput)
+
+	c.Assert(truncate("abc", 2), qt.Equals, "ab")
+	c.Assert(truncate(strings.Repeat("a", 10), 20), qt.HasLen, 10)
+	c.Assert(quarantineKey("to_server/resize/01gcabc_image.jpg"), qt.Equals, "quarantine/resize/01gcabc_image.jpg")
+}
@@ -0,0 +1,53 @@
+package s3rpc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// fileChecksum returns the hex encoded SHA-256 of the file.
+func fileChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := copyBuffered(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// responseMetadata returns the metadata identifying the request a response answers.
+func (s *Server) responseMetadata(op, id, inputChecksum string) map[string]string {
+	metadata := map[string]string{
+		MetaInstanceID:      s.stats.instanceID,
+		MetaRequestID:       id,
+		MetaOp:              op,
+		MetaProtocolVersion: strconv.Itoa(ProtocolVersion),
+	}
+	if inputChecksum != "" {
+		metadata[MetaInputChecksum] = inputChecksum
+	}
+	return metadata
+}
+
+// verifyResponse checks that the response metadata matches the outstanding request.
+// An empty inputChecksum is not checked, and neither is one missing in the response,
+// as error responses may be sent before the input is downloaded.
+func verifyResponse(metadata map[string]string, op, id, inputChecksum string) error {
+	if got := metadata[MetaRequestID]; got != id {
+		return fmt.Errorf("response is for request %q, expected %q", got, id)
+	}
+	if got := metadata[MetaOp]; got != op {
+		return fmt.Errorf("response is for op %q, expected %q", got, op)
+	}
+	if got := metadata[MetaInputChecksum]; inputChecksum != "" && got != "" && got != inputChecksum {
+		return fmt.Errorf("response is for input with checksum %s, expected %s", got, inputChecksum)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package s3rpc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestVerifyResponse(t *testing.T) {
+	c := qt.New(t)
+
+	filename := filepath.Join(c.TempDir(), "input.txt")
+	c.Assert(os.WriteFile(filename, []byte("hello"), 0o644), qt.IsNil)
+	checksum, err := fileChecksum(filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(checksum, qt.Equals, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+
+	s := &Server{stats: newServerStats("server1")}
+	metadata := s.responseMetadata("resize", "01gcabc", checksum)
+	c.Assert(metadata[MetaInstanceID], qt.Equals, "server1")
+
+	c.Assert(verifyResponse(metadata, "resize", "01gcabc", checksum), qt.IsNil)
+	c.Assert(verifyResponse(metadata, "resize", "01gcabc", ""), qt.IsNil)
+	c.Assert(verifyResponse(s.responseMetadata("resize", "01gcabc", ""), "resize", "01gcabc", checksum), qt.IsNil)
+	c.Assert(verifyResponse(metadata, "resize", "01gcabd", checksum), qt.ErrorMatches, `response is for request "01gcabc", expected "01gcabd"`)
+	c.Assert(verifyResponse(metadata, "compact", "01gcabc", checksum), qt.ErrorMatches, `response is for op "resize", expected "compact"`)
+	c.Assert(verifyResponse(metadata, "resize", "01gcabc", "abc"), qt.ErrorMatches, `response is for input with checksum 2cf.*, expected abc`)
+}
@@ -0,0 +1,289 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// WatcherOptions configures a Watcher.
+type WatcherOptions struct {
+	// Dir is the directory to watch, including subdirectories.
+	Dir string
+
+	// OutputDir is where the results are written, with the same relative path as the input
+	// and the extension of the result, if it has one.
+	OutputDir string
+
+	// Op is the op to execute for each new or changed file.
+	Op string
+
+	// Metadata, if set, is sent with each request.
+	Metadata map[string]string
+
+	// StateFile is a JSON file recording the files processed, so they are not
+	// submitted again after a restart. Defaults to .s3rpc-watcher.json in OutputDir.
+	StateFile string
+
+	// PollInterval is the interval between scans of Dir.
+	// Defaults to 5 seconds.
+	PollInterval time.Duration
+
+	// SettleTime is how long a file must be unmodified before it is submitted,
+	// so files still being written are skipped.
+	// Defaults to 2 seconds.
+	SettleTime time.Duration
+
+	// Concurrency is the max number of files processed concurrently.
+	// Defaults to 4.
+	Concurrency int
+}
+
+func (o *WatcherOptions) init() error {
+	if o.Dir == "" || o.OutputDir == "" || o.Op == "" {
+		return errors.New("watcher: Dir, OutputDir and Op are required")
+	}
+	if o.StateFile == "" {
+		o.StateFile = filepath.Join(o.OutputDir, ".s3rpc-watcher.json")
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = 5 * time.Second
+	}
+	if o.SettleTime == 0 {
+		o.SettleTime = 2 * time.Second
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	return nil
+}
+
+// Watcher submits new and changed files in a directory to an op and writes the results
+// to an output directory, for drop-folder workflows.
+type Watcher struct {
+	opts    WatcherOptions
+	execute func(ctx context.Context, op string, input Input) (Output, error)
+	infof   func(format string, args ...interface{})
+	now     func() time.Time
+
+	mu    sync.Mutex
+	state map[string]watchedFile
+}
+
+// watchedFile is the state of a processed file.
+type watchedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// Output is the result's path relative to OutputDir.
+	Output string `json:"output,omitempty"`
+
+	// Error is set if the server rejected the file.
+	// It is not submitted again until it changes.
+	Error string `json:"error,omitempty"`
+}
+
+// NewWatcher creates a new Watcher executing requests with client.
+func NewWatcher(client *Client, opts WatcherOptions) (*Watcher, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.OutputDir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &Watcher{opts: opts, execute: client.Execute, infof: client.infof, now: time.Now}
+	if err := w.loadState(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Watch scans the directory every PollInterval until ctx is done.
+// AWS errors are logged and the files retried on the next scan.
+func (w *Watcher) Watch(ctx context.Context) error {
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.RunOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce scans the directory once and processes the new and changed files.
+func (w *Watcher) RunOnce(ctx context.Context) error {
+	pending, err := w.scan()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(w.opts.Concurrency)
+	for _, rel := range pending {
+		rel := rel
+		g.Go(func() error {
+			w.process(ctx, rel)
+			return nil
+		})
+	}
+	g.Wait()
+	return w.saveState()
+}
+
+// scan returns the relative paths of the files that are new or changed since processed
+// and have settled.
+func (w *Watcher) scan() ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var pending []string
+	err := filepath.WalkDir(w.opts.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if path != w.opts.Dir && (strings.HasPrefix(name, ".") || strings.HasSuffix(name, partialSuffix)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if sameDir(path, w.opts.OutputDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if w.now().Sub(fi.ModTime()) < w.opts.SettleTime {
+			return nil
+		}
+		rel, err := filepath.Rel(w.opts.Dir, path)
+		if err != nil {
+			return err
+		}
+		if s, found := w.state[rel]; found && s.Size == fi.Size() && s.ModTime.Equal(fi.ModTime()) {
+			return nil
+		}
+		pending = append(pending, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("watcher: failed to scan %q: %w", w.opts.Dir, err)
+	}
+	return pending, nil
+}
+
+func (w *Watcher) process(ctx context.Context, rel string) {
+	filename := filepath.Join(w.opts.Dir, rel)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		// Removed since the scan.
+		return
+	}
+
+	output, err := w.execute(ctx, w.opts.Op, Input{Filename: filename, Metadata: w.opts.Metadata})
+	state := watchedFile{Size: fi.Size(), ModTime: fi.ModTime()}
+	if err != nil {
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) {
+			w.infof("Failed to process %q, retrying on next scan: %s", rel, err)
+			return
+		}
+		w.infof("Server rejected %q: %s", rel, err)
+		state.Error = err.Error()
+	} else {
+		out := rel
+		if ext := filepath.Ext(output.Filename); ext != "" {
+			out = strings.TrimSuffix(rel, filepath.Ext(rel)) + ext
+		}
+		if err := moveFile(output.Filename, filepath.Join(w.opts.OutputDir, out)); err != nil {
+			w.infof("Failed to write result for %q, retrying on next scan: %s", rel, err)
+			return
+		}
+		state.Output = out
+	}
+
+	w.mu.Lock()
+	w.state[rel] = state
+	w.mu.Unlock()
+}
+
+func (w *Watcher) loadState() error {
+	w.state = make(map[string]watchedFile)
+	b, err := os.ReadFile(w.opts.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("watcher: failed to read state: %w", err)
+	}
+	if err := json.Unmarshal(b, &w.state); err != nil {
+		return fmt.Errorf("watcher: failed to decode state: %w", err)
+	}
+	return nil
+}
+
+// saveState writes the state to a temp file renamed into place.
+func (w *Watcher) saveState() error {
+	w.mu.Lock()
+	b, err := json.MarshalIndent(w.state, "", "  ")
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := w.opts.StateFile + partialSuffix
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("watcher: failed to write state: %w", err)
+	}
+	if err := os.Rename(tmp, w.opts.StateFile); err != nil {
+		return fmt.Errorf("watcher: failed to write state: %w", err)
+	}
+	return nil
+}
+
+// moveFile renames src to dst, creating dst's directory,
+// falling back to a copy if they are on different file systems.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func sameDir(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
@@ -0,0 +1,101 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWatcher(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	c.Assert(os.MkdirAll(filepath.Join(in, "sub"), 0o755), qt.IsNil)
+	write := func(name, content string, age time.Duration) {
+		filename := filepath.Join(in, name)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+		mtime := time.Now().Add(-age)
+		c.Assert(os.Chtimes(filename, mtime, mtime), qt.IsNil)
+	}
+
+	var (
+		mu        sync.Mutex
+		submitted []string
+		failAWS   bool
+	)
+	execute := func(ctx context.Context, op string, input Input) (Output, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		b, err := os.ReadFile(input.Filename)
+		if err != nil {
+			return Output{}, err
+		}
+		submitted = append(submitted, filepath.Base(input.Filename))
+		if failAWS {
+			return Output{}, &endpointError{err: errors.New("unavailable")}
+		}
+		if string(b) == "invalid" {
+			return Output{}, &ResponseError{Code: ErrorCodeInvalidInput, Message: "invalid"}
+		}
+		result := filepath.Join(dir, "result_"+filepath.Base(input.Filename)+".md")
+		c.Check(os.WriteFile(result, []byte(strings.ToUpper(string(b))), 0o644), qt.IsNil)
+		return Output{Filename: result}, nil
+	}
+
+	newWatcher := func() *Watcher {
+		opts := WatcherOptions{Dir: in, OutputDir: out, Op: "upper"}
+		c.Assert(opts.init(), qt.IsNil)
+		w := &Watcher{opts: opts, execute: execute, infof: func(format string, args ...interface{}) {}, now: time.Now}
+		c.Assert(w.loadState(), qt.IsNil)
+		return w
+	}
+
+	write("a.txt", "a", time.Minute)
+	write("sub/b.txt", "b", time.Minute)
+	write("bad.txt", "invalid", time.Minute)
+	write("new.txt", "still writing", 0)
+	write(".hidden", "h", time.Minute)
+
+	w := newWatcher()
+	ctx := context.Background()
+	c.Assert(w.RunOnce(ctx), qt.IsNil)
+	c.Assert(submitted, qt.HasLen, 3)
+	b, err := os.ReadFile(filepath.Join(out, "sub", "b.md"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "B")
+	c.Assert(w.state["bad.txt"].Error, qt.Contains, "invalid")
+
+	// A new watcher picks up the state; only the settled and changed files are submitted.
+	submitted = nil
+	write("new.txt", "settled", time.Minute)
+	write("a.txt", "a2", 30*time.Second)
+	w = newWatcher()
+	c.Assert(w.RunOnce(ctx), qt.IsNil)
+	sort.Strings(submitted)
+	c.Assert(submitted, qt.DeepEquals, []string{"a.txt", "new.txt"})
+	b, err = os.ReadFile(filepath.Join(out, "a.md"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "A2")
+
+	// AWS errors are retried on the next scan.
+	submitted = nil
+	failAWS = true
+	write("c.txt", "c", time.Minute)
+	c.Assert(w.RunOnce(ctx), qt.IsNil)
+	failAWS = false
+	c.Assert(w.RunOnce(ctx), qt.IsNil)
+	c.Assert(submitted, qt.DeepEquals, []string{"c.txt", "c.txt"})
+	c.Assert(w.RunOnce(ctx), qt.IsNil)
+	c.Assert(submitted, qt.HasLen, 2)
+
+	c.Assert((&WatcherOptions{Dir: in}).init(), qt.ErrorMatches, "watcher: Dir, OutputDir and Op are required")
+}
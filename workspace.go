@@ -0,0 +1,128 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// WorkspacePoolOptions configures a pool of workspace directories, one per request in flight,
+// that are created up front and scrubbed and reused between requests,
+// cutting file system overhead at very high request rates.
+//
+// The input is downloaded into the workspace, and handlers may write their outputs and
+// scratch files next to it, i.e. to filepath.Dir(input.Filename), without name clashes
+// with other requests. Everything in the workspace is removed after the response is sent.
+type WorkspacePoolOptions struct {
+	// Size is the number of workspaces created up front and kept for reuse.
+	// More workspaces are created as needed, but not kept.
+	// Defaults to ServerOptions.MaxConcurrency.
+	Size int
+}
+
+func (o *WorkspacePoolOptions) init(maxConcurrency int) error {
+	if o.Size < 0 {
+		return errors.New("workspace pool: size can not be negative")
+	}
+	if o.Size == 0 {
+		o.Size = maxConcurrency
+	}
+	return nil
+}
+
+// workspacePool recycles workspace directories below dir.
+type workspacePool struct {
+	dir  string
+	free chan string
+
+	mu sync.Mutex
+	n  int
+}
+
+func newWorkspacePool(dir string, size int) (*workspacePool, error) {
+	p := &workspacePool{dir: dir, free: make(chan string, size)}
+	for i := 0; i < size; i++ {
+		ws, err := p.create()
+		if err != nil {
+			return nil, err
+		}
+		p.free <- ws
+	}
+	return p, nil
+}
+
+func (p *workspacePool) create() (string, error) {
+	p.mu.Lock()
+	p.n++
+	ws := filepath.Join(p.dir, "ws"+strconv.Itoa(p.n))
+	p.mu.Unlock()
+	if err := os.Mkdir(ws, 0o700); err != nil {
+		return "", fmt.Errorf("workspace: %w", err)
+	}
+	return ws, nil
+}
+
+// get returns an empty workspace.
+func (p *workspacePool) get() (string, error) {
+	select {
+	case ws := <-p.free:
+		return ws, nil
+	default:
+		return p.create()
+	}
+}
+
+// put scrubs ws and returns it to the pool, or removes it if the pool is full
+// or ws could not be scrubbed.
+func (p *workspacePool) put(ws string) {
+	if err := scrubDir(ws); err == nil {
+		select {
+		case p.free <- ws:
+			return
+		default:
+		}
+	}
+	os.RemoveAll(ws)
+}
+
+// scrubDir removes everything in dir, making sure that dir is still a private directory,
+// as a handler may have replaced or changed it.
+// Symbolic links are removed, not followed.
+func scrubDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("workspace %q is not a directory", dir)
+	}
+	if fi.Mode().Perm() != 0o700 {
+		if err := os.Chmod(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createWorkspaceFile creates the file for the request with the given key in the empty workspace ws.
+// The request ID in the key makes the name unique, so no random name is needed.
+func createWorkspaceFile(ws, key string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(ws, safeFilename(path.Base(key))), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("workspace: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,69 @@
+package s3rpc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWorkspacePool(t *testing.T) {
+	c := qt.New(t)
+
+	opts := &WorkspacePoolOptions{}
+	c.Assert(opts.init(4), qt.IsNil)
+	c.Assert(opts.Size, qt.Equals, 4)
+	c.Assert((&WorkspacePoolOptions{Size: -1}).init(4), qt.IsNotNil)
+
+	dir := t.TempDir()
+	p, err := newWorkspacePool(dir, 1)
+	c.Assert(err, qt.IsNil)
+
+	ws, err := p.get()
+	c.Assert(err, qt.IsNil)
+	f, err := createWorkspaceFile(ws, "to_server/resize/01h_a:b.jpg")
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	c.Assert(filepath.Base(f.Name()), qt.Equals, "01h_a_b.jpg")
+	_, err = createWorkspaceFile(ws, "to_server/resize/01h_a:b.jpg")
+	c.Assert(err, qt.IsNotNil)
+
+	// A handler leaving files, directories and a link to outside of the workspace behind.
+	outside := filepath.Join(dir, "outside.txt")
+	c.Assert(os.WriteFile(outside, []byte("keep"), 0o644), qt.IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(ws, "scratch", "deep"), 0o755), qt.IsNil)
+	c.Assert(os.Symlink(dir, filepath.Join(ws, "link")), qt.IsNil)
+	c.Assert(os.Chmod(ws, 0o755), qt.IsNil)
+
+	// The pool is empty, so a new workspace is created.
+	ws2, err := p.get()
+	c.Assert(err, qt.IsNil)
+	c.Assert(ws2, qt.Not(qt.Equals), ws)
+
+	p.put(ws)
+	entries, err := os.ReadDir(ws)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+	fi, err := os.Stat(ws)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fi.Mode().Perm(), qt.Equals, os.FileMode(0o700))
+	_, err = os.Stat(outside)
+	c.Assert(err, qt.IsNil)
+
+	// The pool is full, so this one is removed.
+	p.put(ws2)
+	_, err = os.Stat(ws2)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	reused, err := p.get()
+	c.Assert(err, qt.IsNil)
+	c.Assert(reused, qt.Equals, ws)
+
+	// A workspace replaced by a file is not reused.
+	c.Assert(os.RemoveAll(reused), qt.IsNil)
+	c.Assert(os.WriteFile(reused, nil, 0o644), qt.IsNil)
+	p.put(reused)
+	_, err = os.Stat(reused)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}